@@ -0,0 +1,299 @@
+// Package apiclient is a client of the REST API of the SCEP server, the user
+// API at /api and the admin API at /admin/api.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+// Client calls the REST API of a SCEP server.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	ca         string
+	username   string
+	password   string
+	token      string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client the requests are sent with, for
+// example to configure TLS client certificates. It defaults to
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBasicAuth authenticates the requests with the username and password,
+// for servers whose admin API is behind a proxy requiring them.
+func WithBasicAuth(username, password string) Option {
+	return func(c *Client) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithBearerToken authenticates the requests with the bearer token.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithCA makes the client add clients to, list the clients and
+// certificates of, and fetch the CRL of the CA named name instead of the
+// default CA.
+func WithCA(name string) Option {
+	return func(c *Client) {
+		c.ca = name
+	}
+}
+
+// New returns a client of the server at serverURL, such as
+// https://scep.example.com.
+func New(serverURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL %q", serverURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// caPath inserts the name of the CA of the client after prefix.
+func (c *Client) caPath(prefix, path string) string {
+	if c.ca == "" {
+		return prefix + path
+	}
+	return prefix + "/" + url.PathEscape(c.ca) + path
+}
+
+// do sends a request with the JSON of body, if it is not nil, and decodes
+// the JSON response into out, if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	data, err := c.doRaw(ctx, method, path, nil, body)
+	if err != nil || out == nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func (c *Client) doRaw(ctx context.Context, method, path string, query url.Values, body interface{}) ([]byte, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, responseError(resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// responseError reads the message of an error response, which is JSON
+// with a message or plain text.
+func responseError(status int, body []byte) error {
+	var res struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.Message == "" {
+		res.Message = strings.TrimSpace(string(body))
+	}
+	return &Error{StatusCode: status, Message: res.Message}
+}
+
+// Ping checks that the admin API is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.doRaw(ctx, "GET", "/admin/api/ping", nil, nil)
+	return err
+}
+
+// ListClients returns the clients of the CA.
+func (c *Client) ListClients(ctx context.Context) ([]scepdepot.Client, error) {
+	var clients []scepdepot.Client
+	err := c.do(ctx, "GET", c.caPath("/api", "/client"), nil, &clients)
+	return clients, err
+}
+
+// GetClient returns the client uid of the CA, or nil if there is none.
+func (c *Client) GetClient(ctx context.Context, uid string) (*scepdepot.Client, error) {
+	var client *scepdepot.Client
+	err := c.do(ctx, "GET", c.caPath("/api", "/client/"+url.PathEscape(uid)), nil, &client)
+	return client, err
+}
+
+// AddClient adds an INACTIVE client to the CA.
+func (c *Client) AddClient(ctx context.Context, uid string, attributes map[string]interface{}) error {
+	return c.do(ctx, "POST", c.caPath("/admin/api", "/client/add"), scepdepot.Client{
+		Uid:        uid,
+		Attributes: attributes,
+	}, nil)
+}
+
+// UpdateClient replaces the attributes of the client uid.
+func (c *Client) UpdateClient(ctx context.Context, uid string, attributes map[string]interface{}) error {
+	return c.do(ctx, "PUT", "/admin/api/client/update", scepdepot.UpdateInfo{
+		Uid:        uid,
+		Attributes: attributes,
+	}, nil)
+}
+
+// RevokeClient makes the client uid INACTIVE, revoking its certificates
+// and deleting its secret.
+func (c *Client) RevokeClient(ctx context.Context, uid string) error {
+	return c.do(ctx, "POST", "/admin/api/client/revoke", scepdepot.UpdateInfo{Uid: uid}, nil)
+}
+
+// DeleteClient revokes the certificates of the client uid and archives it.
+func (c *Client) DeleteClient(ctx context.Context, uid string) error {
+	return c.do(ctx, "DELETE", "/admin/api/client/"+url.PathEscape(uid), nil, nil)
+}
+
+// Secret is a created secret.
+type Secret struct {
+	Target     string      `json:"target"`
+	Secret     string      `json:"secret"`
+	Type       string      `json:"type"`
+	Invitation *Invitation `json:"invitation,omitempty"`
+}
+
+// Invitation is an enrollment invitation issued with a secret.
+type Invitation struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// QRCode is the base64 of a PNG image of the QR code of URL.
+	QRCode string `json:"qr_png"`
+}
+
+// CreateSecret creates a secret of a client, which activates an INACTIVE
+// client or makes an ISSUED client UPDATABLE. The secret is only returned
+// here.
+func (c *Client) CreateSecret(ctx context.Context, info scepdepot.CreateSecretInfo) (*Secret, error) {
+	var secret Secret
+	if err := c.do(ctx, "POST", "/admin/api/secret/create", info, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// GetSecret returns the secret of the client uid, without the secret
+// itself.
+func (c *Client) GetSecret(ctx context.Context, uid string) (*scepdepot.SecretInfo, error) {
+	var info scepdepot.SecretInfo
+	if err := c.do(ctx, "GET", "/admin/api/secret/get/"+url.PathEscape(uid), nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListCerts returns the certificates the CA issued to cn.
+func (c *Client) ListCerts(ctx context.Context, cn string) ([]scepdepot.Certificate, error) {
+	var certs []scepdepot.Certificate
+	err := c.do(ctx, "GET", c.caPath("/api", "/cert/list/"+url.PathEscape(cn)), nil, &certs)
+	return certs, err
+}
+
+// GetCert returns the certificate with the serial number.
+func (c *Client) GetCert(ctx context.Context, serial *big.Int) (*scepdepot.Certificate, error) {
+	var cert scepdepot.Certificate
+	if err := c.do(ctx, "GET", "/admin/api/cert/"+serial.String(), nil, &cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// RevokeCert revokes the valid or held certificate with the serial number.
+// invalidityDate is when the key is known or suspected to be compromised,
+// and may be nil.
+func (c *Client) RevokeCert(ctx context.Context, serial *big.Int, reason scepdepot.RevocationReason, invalidityDate *time.Time) error {
+	body := struct {
+		ReasonCode     scepdepot.RevocationReason `json:"reason_code"`
+		InvalidityDate *time.Time                 `json:"invalidity_date,omitempty"`
+	}{reason, invalidityDate}
+	return c.do(ctx, "POST", "/admin/api/cert/"+serial.String()+"/revoke", body, nil)
+}
+
+// HoldCert suspends the valid certificate with the serial number.
+func (c *Client) HoldCert(ctx context.Context, serial *big.Int) error {
+	return c.do(ctx, "POST", "/admin/api/cert/"+serial.String()+"/hold", nil, nil)
+}
+
+// ReleaseCert releases the held certificate with the serial number.
+func (c *Client) ReleaseCert(ctx context.Context, serial *big.Int) error {
+	return c.do(ctx, "POST", "/admin/api/cert/"+serial.String()+"/release", nil, nil)
+}
+
+// CRL returns the DER encoded CRL of the CA.
+func (c *Client) CRL(ctx context.Context) ([]byte, error) {
+	return c.doRaw(ctx, "GET", c.caPath("/scep", ""), url.Values{"operation": {"GetCRL"}}, nil)
+}
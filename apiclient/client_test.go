@@ -0,0 +1,178 @@
+package apiclient_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/procube-open/scep/apiclient"
+	scepdepot "github.com/procube-open/scep/depot"
+	sqlitedepot "github.com/procube-open/scep/depot/sqlite"
+	scepserver "github.com/procube-open/scep/server"
+)
+
+func newServer(t *testing.T) (*httptest.Server, scepdepot.Store) {
+	t.Helper()
+	depot, err := sqlitedepot.NewDepot(filepath.Join(t.TempDir(), "scep.db"), "../scep/testdata/testca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { depot.DB().Close() })
+	// the CA of testdata cannot sign CRLs
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := scepdepot.NewCACert(scepdepot.WithCommonName("test CA")).SelfSign(rand.Reader, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := scepdepot.StoreForCA(depot, "", []*x509.Certificate{crt}, key)
+	svc, err := scepserver.NewService(crt, key, scepserver.NopCSRSigner(), scepserver.WithCRLStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := scepserver.MakeServerEndpoints(svc, "")
+	handler := scepserver.MakeHTTPHandler(store, e, svc, scepserver.NopCSRSigner(), nil, nil, kitlog.NewNopLogger())
+	// the admin API of the test server is behind basic authentication
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, store
+}
+
+func TestClient(t *testing.T) {
+	server, depot := newServer(t)
+	ctx := context.Background()
+	c, err := apiclient.New(server.URL+"/", apiclient.WithBasicAuth("admin", "s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddClient(ctx, "alice", map[string]interface{}{"owner": "it"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateClient(ctx, "alice", map[string]interface{}{"owner": "hr"}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := c.GetClient(ctx, "alice")
+	if err != nil || client == nil || client.Status != "INACTIVE" || client.Attributes["owner"] != "hr" {
+		t.Errorf("GetClient() = %+v, %v", client, err)
+	}
+	if client, err := c.GetClient(ctx, "bob"); client != nil || err != nil {
+		t.Errorf("GetClient() of an unknown client = %+v, %v", client, err)
+	}
+	clients, err := c.ListClients(ctx)
+	if err != nil || len(clients) != 1 || clients[0].Uid != "alice" {
+		t.Errorf("ListClients() = %+v, %v", clients, err)
+	}
+
+	secret, err := c.CreateSecret(ctx, scepdepot.CreateSecretInfo{Target: "alice", Generate: true, Available_Period: "1h"})
+	if err != nil || secret.Type != "ACTIVATE" || secret.Secret == "" {
+		t.Fatalf("CreateSecret() = %+v, %v", secret, err)
+	}
+	info, err := c.GetSecret(ctx, "alice")
+	if err != nil || info.Type != "ACTIVATE" || info.Delete_At.Before(time.Now()) {
+		t.Errorf("GetSecret() = %+v, %v", info, err)
+	}
+
+	cert := issueCert(t, depot, "alice")
+	certs, err := c.ListCerts(ctx, "alice")
+	if err != nil || len(certs) != 1 || certs[0].Serial.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("ListCerts() = %+v, %v", certs, err)
+	}
+	if err := c.RevokeCert(ctx, cert.SerialNumber, scepdepot.KeyCompromise, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetCert(ctx, cert.SerialNumber)
+	if err != nil || got.Status != "R" || got.RevocationReason == nil || *got.RevocationReason != scepdepot.KeyCompromise {
+		t.Errorf("GetCert() after revocation = %+v, %v", got, err)
+	}
+	der, err := c.CRL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("CRL entries = %+v", crl.RevokedCertificateEntries)
+	}
+
+	var apiErr *apiclient.Error
+	if err := c.RevokeClient(ctx, "bob"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "Client not found" {
+		t.Errorf("RevokeClient() of an unknown client = %v", err)
+	}
+	if _, err := c.GetCert(ctx, new(big.Int).Lsh(cert.SerialNumber, 8)); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetCert() of an unknown serial = %v", err)
+	}
+
+	unauthenticated, err := apiclient.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unauthenticated.Ping(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Ping() without credentials = %v", err)
+	}
+}
+
+// issueCert stores a certificate of the client uid signed by the CA of
+// depot, as the signer does.
+func issueCert(t *testing.T, depot scepdepot.Store, uid string) *x509.Certificate {
+	t.Helper()
+	crts, caKey, err := depot.CA([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := depot.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: uid},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, crts[0], &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.Put(uid, cert, ""); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -5,7 +5,9 @@ import (
 	"context"
 	"crypto/x509"
 	"errors"
+	"fmt"
 
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/scep"
 	scepserver "github.com/procube-open/scep/server"
 )
@@ -16,17 +18,99 @@ type Store interface {
 	HasChallenge(pw string) (bool, error)
 }
 
-// Middleware wraps next in a CSRSigner that verifies and invalidates the challenge
+// BoundStore is a Store whose challenges can be bound to the uid of a
+// client, so that they are only valid for a CSR of that client.
+type BoundStore interface {
+	Store
+
+	// SCEPChallengeFor returns a challenge bound to uid.
+	SCEPChallengeFor(uid string) (string, error)
+
+	// UseChallenge invalidates pw, reporting whether it was valid and the
+	// uid it is bound to. The uid of an unbound challenge is empty.
+	UseChallenge(pw string) (bool, string, error)
+}
+
+// Middleware wraps next in a CSRSigner that verifies and invalidates the challenge.
+// If store is a BoundStore, the CN of the CSR must be the uid a challenge is
+// bound to. An unbound challenge enrolls any CN without checking the client;
+// ClientMiddleware checks the clients of the server.
 func Middleware(store Store, next scepserver.CSRSignerContext) scepserver.CSRSignerContextFunc {
 	return func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
 		// TODO: compare challenge only for PKCSReq?
-		valid, err := store.HasChallenge(m.ChallengePassword)
+		var (
+			valid bool
+			uid   string
+			err   error
+		)
+		if bound, ok := store.(BoundStore); ok {
+			valid, uid, err = bound.UseChallenge(m.ChallengePassword)
+		} else {
+			valid, err = store.HasChallenge(m.ChallengePassword)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, errors.New("invalid challenge")
+		}
+		if uid != "" {
+			if m.CSR == nil || m.CSR.Subject.CommonName != uid {
+				return nil, &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf("challenge is bound to %q", uid)}
+			}
+			ctx = scepdepot.NewContext(ctx, &scepdepot.Enrollment{UID: uid})
+		}
+		return next.SignCSRContext(ctx, m)
+	}
+}
+
+// ClientStore finds the clients managed by the server.
+type ClientStore interface {
+	// GetClient returns the client uid, or nil if it is not managed by
+	// the server.
+	GetClient(uid string) (*scepdepot.Client, error)
+}
+
+// ClientMiddleware wraps next in a CSRSigner that verifies and invalidates
+// the challenges of store for the clients of clients. The client is the uid
+// a challenge is bound to, which the CSR must request as its CN, or else
+// the CN of the CSR. As with a secret, the client must be ISSUABLE or
+// UPDATABLE, and is enrolled with its attributes and profile.
+func ClientMiddleware(clients ClientStore, store BoundStore, next scepserver.CSRSignerContext) scepserver.CSRSignerContextFunc {
+	return func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if m.CSR == nil || m.CSR.Subject.CommonName == "" {
+			return nil, &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: "CSR has no CN"}
+		}
+		cn := m.CSR.Subject.CommonName
+		// the client is checked before the challenge is used, so that a
+		// challenge is not spent on a client which cannot enroll
+		client, err := clients.GetClient(cn)
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			return nil, errors.New("client not found")
+		}
+		if !(client.Status == "ISSUABLE" || client.Status == "UPDATABLE") {
+			return nil, errors.New("client is not issuable or updatable")
+		}
+		valid, uid, err := store.UseChallenge(m.ChallengePassword)
 		if err != nil {
 			return nil, err
 		}
 		if !valid {
 			return nil, errors.New("invalid challenge")
 		}
+		if uid != "" && uid != cn {
+			return nil, &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf("challenge is bound to %q", uid)}
+		}
+		profile, _ := client.Attributes["profile"].(string)
+		ctx = scepdepot.NewContext(ctx, &scepdepot.Enrollment{
+			UID:        cn,
+			Status:     client.Status,
+			Profile:    profile,
+			Attributes: client.Attributes,
+		})
 		return next.SignCSRContext(ctx, m)
 	}
 }
@@ -0,0 +1,126 @@
+package challenge
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+	scepserver "github.com/procube-open/scep/server"
+)
+
+// memBoundStore maps challenges to the uid they are bound to.
+type memBoundStore map[string]string
+
+func (s memBoundStore) SCEPChallenge() (string, error) { return s.SCEPChallengeFor("") }
+
+func (s memBoundStore) SCEPChallengeFor(uid string) (string, error) {
+	pw := "challenge-" + uid
+	s[pw] = uid
+	return pw, nil
+}
+
+func (s memBoundStore) HasChallenge(pw string) (bool, error) {
+	valid, _, err := s.UseChallenge(pw)
+	return valid, err
+}
+
+func (s memBoundStore) UseChallenge(pw string) (bool, string, error) {
+	uid, ok := s[pw]
+	delete(s, pw)
+	return ok, uid, nil
+}
+
+func TestBoundMiddleware(t *testing.T) {
+	store := memBoundStore{}
+	var enrollment *scepdepot.Enrollment
+	signer := Middleware(store, scepserver.CSRSignerContextFunc(func(ctx context.Context, _ *scep.CSRReqMessage) (*x509.Certificate, error) {
+		enrollment, _ = scepdepot.FromContext(ctx)
+		return nil, nil
+	}))
+	ctx := context.Background()
+
+	pw, _ := store.SCEPChallengeFor("pc01")
+	m := &scep.CSRReqMessage{CSR: testCSR(t, "pc02"), ChallengePassword: pw}
+	if _, err := signer.SignCSRContext(ctx, m); err == nil {
+		t.Error("challenge bound to pc01 was accepted for pc02")
+	}
+
+	pw, _ = store.SCEPChallengeFor("pc01")
+	m = &scep.CSRReqMessage{CSR: testCSR(t, "pc01"), ChallengePassword: pw}
+	if _, err := signer.SignCSRContext(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment == nil || enrollment.UID != "pc01" {
+		t.Errorf("unexpected enrollment %+v", enrollment)
+	}
+	if _, err := signer.SignCSRContext(ctx, m); err == nil {
+		t.Error("challenge should not be valid twice")
+	}
+
+	enrollment = nil
+	pw, _ = store.SCEPChallenge()
+	m = &scep.CSRReqMessage{CSR: testCSR(t, "pc02"), ChallengePassword: pw}
+	if _, err := signer.SignCSRContext(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment != nil {
+		t.Errorf("unbound challenge set enrollment %+v", enrollment)
+	}
+}
+
+// memClientStore maps uids to their clients.
+type memClientStore map[string]*scepdepot.Client
+
+func (s memClientStore) GetClient(uid string) (*scepdepot.Client, error) {
+	return s[uid], nil
+}
+
+func TestClientMiddleware(t *testing.T) {
+	store := memBoundStore{}
+	clients := memClientStore{
+		"pc01": {Uid: "pc01", Status: "ISSUABLE", Attributes: map[string]interface{}{"profile": "802.1x"}},
+		"pc02": {Uid: "pc02", Status: "ISSUED"},
+	}
+	var enrollment *scepdepot.Enrollment
+	signer := ClientMiddleware(clients, store, scepserver.CSRSignerContextFunc(func(ctx context.Context, _ *scep.CSRReqMessage) (*x509.Certificate, error) {
+		enrollment, _ = scepdepot.FromContext(ctx)
+		return nil, nil
+	}))
+	ctx := context.Background()
+
+	// an unbound challenge enrolls the client of the CN
+	pw, _ := store.SCEPChallenge()
+	m := &scep.CSRReqMessage{CSR: testCSR(t, "pc01"), ChallengePassword: pw}
+	if _, err := signer.SignCSRContext(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment == nil || enrollment.UID != "pc01" || enrollment.Status != "ISSUABLE" || enrollment.Profile != "802.1x" {
+		t.Errorf("unexpected enrollment %+v", enrollment)
+	}
+	if _, err := signer.SignCSRContext(ctx, m); err == nil {
+		t.Error("challenge should not be valid twice")
+	}
+
+	for _, test := range []struct {
+		name string
+		cn   string
+		uid  string
+	}{
+		{"unknown client", "pc03", ""},
+		{"client not issuable", "pc02", ""},
+		{"bound to another client", "pc01", "pc02"},
+		{"no CN", "", ""},
+	} {
+		pw, _ := store.SCEPChallengeFor(test.uid)
+		m := &scep.CSRReqMessage{CSR: testCSR(t, test.cn), ChallengePassword: pw}
+		if _, err := signer.SignCSRContext(ctx, m); err == nil {
+			t.Errorf("%s: challenge was accepted", test.name)
+		}
+	}
+	// the challenge of a client which cannot enroll is not used
+	if _, ok := store["challenge-"]; !ok {
+		t.Error("challenge was used for a client which cannot enroll")
+	}
+}
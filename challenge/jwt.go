@@ -0,0 +1,216 @@
+package challenge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+	scepserver "github.com/procube-open/scep/server"
+)
+
+// JWTStore records the IDs of the signed challenges that have been used
+// and finds the clients managed by the server.
+type JWTStore interface {
+	// UseJTI records jti, which can be forgotten after expiresAt.
+	// It returns false if jti was already recorded.
+	UseJTI(jti string, expiresAt time.Time) (bool, error)
+
+	// ReleaseJTI forgets jti, so that its challenge can be used again.
+	ReleaseJTI(jti string) error
+
+	ClientStore
+}
+
+// Claims are the claims of a signed challenge.
+// The subject is the uid of the client the challenge was issued for.
+type Claims struct {
+	jwt.RegisteredClaims
+
+	// SANs are the subject alternative names the CSR may request, as DNS
+	// names, email addresses, IP addresses or URIs.
+	SANs []string `json:"sans,omitempty"`
+
+	// Profile is the certificate profile to issue with.
+	Profile string `json:"profile,omitempty"`
+}
+
+// LoadJWTKey reads the key verifying signed challenges from path.
+// A PEM encoded public key or certificate verifies RS*, PS* or ES* signed
+// challenges; any other content is a shared secret verifying HS* signed
+// challenges.
+func LoadJWTKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < 32 {
+			return nil, errors.New("challenge JWT secret must be at least 32 bytes")
+		}
+		return secret, nil
+	}
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported challenge JWT key type %T", key)
+	}
+}
+
+func validMethods(key interface{}) ([]string, error) {
+	switch key.(type) {
+	case []byte:
+		return []string{"HS256", "HS384", "HS512"}, nil
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported challenge JWT key type %T", key)
+	}
+}
+
+// IsJWT reports whether challenge looks like a compact JWS.
+func IsJWT(challenge string) bool {
+	return strings.Count(challenge, ".") == 2 && strings.HasPrefix(challenge, "eyJ")
+}
+
+// JWTOption customizes JWTMiddleware.
+type JWTOption func(*jwtConfig)
+
+type jwtConfig struct {
+	fallback scepserver.CSRSignerContext
+}
+
+// WithFallback passes challenges that are not JWTs to fallback, such as
+// the secret challenge middleware, instead of rejecting them.
+func WithFallback(fallback scepserver.CSRSignerContext) JWTOption {
+	return func(c *jwtConfig) {
+		c.fallback = fallback
+	}
+}
+
+// JWTMiddleware wraps next in a CSRSigner that verifies challenges signed
+// with key, as returned by LoadJWTKey. The challenges enroll clients that
+// are not managed by the server; the clients of store, whose status and
+// secret follow their own lifecycle, are rejected. The ID of every
+// challenge is recorded in store once next has signed the CSR, so that it
+// is used once, and the CSR must request the uid as its CN, if any, and
+// only the SANs listed in the challenge.
+func JWTMiddleware(key interface{}, store JWTStore, next scepserver.CSRSignerContext, opts ...JWTOption) (scepserver.CSRSignerContextFunc, error) {
+	methods, err := validMethods(key)
+	if err != nil {
+		return nil, err
+	}
+	var conf jwtConfig
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+	)
+	keyFunc := func(*jwt.Token) (interface{}, error) { return key, nil }
+
+	return func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if !IsJWT(m.ChallengePassword) {
+			if conf.fallback != nil {
+				return conf.fallback.SignCSRContext(ctx, m)
+			}
+			return nil, errors.New("invalid challenge")
+		}
+		claims := new(Claims)
+		if _, err := parser.ParseWithClaims(m.ChallengePassword, claims, keyFunc); err != nil {
+			return nil, fmt.Errorf("invalid challenge: %w", err)
+		}
+		if claims.Subject == "" || claims.ID == "" {
+			return nil, errors.New("invalid challenge: no sub or jti claim")
+		}
+		if err := checkCSR(claims, m.CSR); err != nil {
+			return nil, err
+		}
+		client, err := store.GetClient(claims.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if client != nil {
+			return nil, &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf("%q is a registered client and enrolls with its secret", claims.Subject)}
+		}
+		// the ID is recorded before signing so that concurrent requests
+		// cannot use the challenge twice, and released if signing fails
+		ok, err := store.UseJTI(claims.ID, claims.ExpiresAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("challenge has already been used")
+		}
+		ctx = scepdepot.NewContext(ctx, &scepdepot.Enrollment{
+			UID:     claims.Subject,
+			Profile: claims.Profile,
+		})
+		crt, err := next.SignCSRContext(ctx, m)
+		if err != nil {
+			if rerr := store.ReleaseJTI(claims.ID); rerr != nil {
+				return nil, errors.Join(err, rerr)
+			}
+			return nil, err
+		}
+		return crt, nil
+	}, nil
+}
+
+// checkCSR checks that csr requests the subject of claims as CN and only
+// the SANs allowed by claims.
+func checkCSR(claims *Claims, csr *x509.CertificateRequest) error {
+	if cn := csr.Subject.CommonName; cn != "" && cn != claims.Subject {
+		return &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf("CN %q does not match the challenge", cn)}
+	}
+	allowed := make(map[string]bool, len(claims.SANs))
+	for _, san := range claims.SANs {
+		allowed[strings.ToLower(san)] = true
+	}
+	var sans []string
+	sans = append(sans, csr.DNSNames...)
+	sans = append(sans, csr.EmailAddresses...)
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if !allowed[strings.ToLower(san)] {
+			return &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf("SAN %q is not allowed by the challenge", san)}
+		}
+	}
+	return nil
+}
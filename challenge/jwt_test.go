@@ -0,0 +1,183 @@
+package challenge
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+	scepserver "github.com/procube-open/scep/server"
+)
+
+// memJWTStore records the used IDs and the registered clients in maps.
+type memJWTStore struct {
+	jtis    map[string]time.Time
+	clients map[string]*scepdepot.Client
+}
+
+func (s memJWTStore) UseJTI(jti string, expiresAt time.Time) (bool, error) {
+	if _, ok := s.jtis[jti]; ok {
+		return false, nil
+	}
+	s.jtis[jti] = expiresAt
+	return true, nil
+}
+
+func (s memJWTStore) ReleaseJTI(jti string) error {
+	delete(s.jtis, jti)
+	return nil
+}
+
+func (s memJWTStore) GetClient(uid string) (*scepdepot.Client, error) {
+	return s.clients[uid], nil
+}
+
+func testCSR(t *testing.T, cn string, dnsNames ...string) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newClaims(uid, jti string, expiresIn time.Duration, sans ...string) Claims {
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   uid,
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		},
+		SANs:    sans,
+		Profile: "802.1x",
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes.Repeat([]byte("k"), 32)
+
+	var (
+		enrollment *scepdepot.Enrollment
+		signErr    error
+	)
+	next := scepserver.CSRSignerContextFunc(func(ctx context.Context, _ *scep.CSRReqMessage) (*x509.Certificate, error) {
+		enrollment, _ = scepdepot.FromContext(ctx)
+		return nil, signErr
+	})
+	fallback := scepserver.CSRSignerContextFunc(func(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error) {
+		return nil, errors.New("fallback")
+	})
+
+	store := memJWTStore{
+		jtis:    map[string]time.Time{},
+		clients: map[string]*scepdepot.Client{"registered": {Uid: "registered", Status: "ISSUABLE"}},
+	}
+	ecSigner, err := JWTMiddleware(&ecKey.PublicKey, store, next, WithFallback(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacSigner, err := JWTMiddleware(secret, store, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// a valid challenge is accepted once
+	m := &scep.CSRReqMessage{
+		CSR:               testCSR(t, "pc01", "pc01.example.com"),
+		ChallengePassword: sign(t, jwt.SigningMethodES256, ecKey, newClaims("pc01", "1", time.Hour, "pc01.example.com")),
+	}
+	if _, err := ecSigner.SignCSRContext(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment == nil || enrollment.UID != "pc01" || enrollment.Profile != "802.1x" {
+		t.Errorf("unexpected enrollment %+v", enrollment)
+	}
+	if _, err := ecSigner.SignCSRContext(ctx, m); err == nil {
+		t.Error("challenge should not be valid twice")
+	}
+
+	// a challenge is used only if the certificate is issued
+	signErr = errors.New("signing failed")
+	m.ChallengePassword = sign(t, jwt.SigningMethodES256, ecKey, newClaims("pc01", "7", time.Hour, "pc01.example.com"))
+	if _, err := ecSigner.SignCSRContext(ctx, m); err != signErr {
+		t.Fatalf("have %v, want %v", err, signErr)
+	}
+	signErr = nil
+	if _, err := ecSigner.SignCSRContext(ctx, m); err != nil {
+		t.Errorf("challenge of a failed enrollment: %v", err)
+	}
+
+	// registered clients enroll with their secrets
+	enrollment = nil
+	m = &scep.CSRReqMessage{
+		CSR:               testCSR(t, "registered"),
+		ChallengePassword: sign(t, jwt.SigningMethodES256, ecKey, newClaims("registered", "8", time.Hour)),
+	}
+	if _, err := ecSigner.SignCSRContext(ctx, m); err == nil || enrollment != nil {
+		t.Errorf("challenge of a registered client: %v, enrollment %+v", err, enrollment)
+	}
+	if _, ok := store.jtis["8"]; ok {
+		t.Error("challenge of a registered client is used")
+	}
+
+	m = &scep.CSRReqMessage{CSR: testCSR(t, "pc01", "pc01.example.com")}
+	m.ChallengePassword = sign(t, jwt.SigningMethodHS256, secret, newClaims("pc01", "2", time.Hour, "pc01.example.com"))
+	if _, err := hmacSigner.SignCSRContext(ctx, m); err != nil {
+		t.Errorf("HMAC challenge: %v", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		challenge string
+		csr       *x509.CertificateRequest
+	}{
+		{"expired", sign(t, jwt.SigningMethodES256, ecKey, newClaims("pc01", "3", -time.Minute)), testCSR(t, "pc01")},
+		{"wrong key", sign(t, jwt.SigningMethodHS256, secret, newClaims("pc01", "4", time.Hour)), testCSR(t, "pc01")},
+		{"other CN", sign(t, jwt.SigningMethodES256, ecKey, newClaims("pc01", "5", time.Hour)), testCSR(t, "pc02")},
+		{"SAN not allowed", sign(t, jwt.SigningMethodES256, ecKey, newClaims("pc01", "6", time.Hour)), testCSR(t, "pc01", "pc01.example.com")},
+		{"not a JWT", "pc01\\secret", testCSR(t, "pc01")},
+	} {
+		m := &scep.CSRReqMessage{CSR: test.csr, ChallengePassword: test.challenge}
+		if _, err := ecSigner.SignCSRContext(ctx, m); err == nil {
+			t.Errorf("%s: challenge was accepted", test.name)
+		}
+	}
+	m = &scep.CSRReqMessage{CSR: testCSR(t, "pc01"), ChallengePassword: "pc01\\secret"}
+	if _, err := ecSigner.SignCSRContext(ctx, m); err == nil || err.Error() != "fallback" {
+		t.Errorf("not a JWT: have %v, want fallback", err)
+	}
+}
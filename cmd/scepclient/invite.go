@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/procube-open/scep/server/invite"
+)
+
+type redeemResponse struct {
+	Uid     string `json:"uid"`
+	Secret  string `json:"secret"`
+	SCEPURL string `json:"scep_url"`
+}
+
+// redeemInvitation consumes the invitation at inviteURL and returns the
+// uid and secret to enroll with, and the URL of the SCEP server.
+func redeemInvitation(inviteURL string) (*redeemResponse, error) {
+	token, err := invite.TokenFromURL(inviteURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(inviteURL)
+	if err != nil {
+		return nil, err
+	}
+	redeemURL := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/api/invite/redeem"}).String()
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(redeemURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("redeeming invitation failed with status %s: %s", resp.Status, msg)
+	}
+	var r redeemResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.SCEPURL == "" {
+		r.SCEPURL = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/scep"}).String()
+	}
+	return &r, nil
+}
@@ -291,6 +291,7 @@ func main() {
 		flUid     = flag.String("uid", "", "uid of user")
 		flSecret  = flag.String("secret", "", "password of user")
 		flWorkDir = flag.String("out", ".", "create certificates under this directory")
+		flInvite  = flag.String("invite", "", "enrollment invitation URL to redeem instead of -uid and -secret")
 	)
 	flag.Parse()
 
@@ -300,9 +301,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *flInvite != "" {
+		invitation, err := redeemInvitation(*flInvite)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*flUid = invitation.Uid
+		*flSecret = invitation.Secret
+		flServerURL = invitation.SCEPURL
+	}
+
 	var challenge string
 	if *flUid == "" || *flSecret == "" {
-		fmt.Fprintln(os.Stderr, "please set -uid and -secret option")
+		fmt.Fprintln(os.Stderr, "please set -uid and -secret or -invite option")
 		os.Exit(1)
 	}
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+var certCommands = map[string]command{
+	"list":    {"<cn>", "list the certificates issued to a CN", certList},
+	"show":    {"<serial>", "show a certificate", certShow},
+	"revoke":  {"<serial>", "revoke a valid or held certificate", certRevoke},
+	"hold":    {"<serial>", "suspend a valid certificate", certHold},
+	"release": {"<serial>", "release a held certificate", certRelease},
+}
+
+var crlCommands = map[string]command{
+	"fetch": {"", "fetch the CRL of the CA and show it or write it to a file", crlFetch},
+}
+
+// certStatuses are the names of the statuses of certificates.
+var certStatuses = map[string]string{
+	"V": "valid",
+	"H": "held",
+	"R": "revoked",
+}
+
+func certList(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("cert list", "<cn>"), args, 1)
+	if err != nil {
+		return err
+	}
+	certs, err := a.client.ListCerts(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(certs)
+	}
+	rows := make([][]string, len(certs))
+	for i, c := range certs {
+		rows[i] = []string{
+			c.Serial.String(),
+			certStatus(c.Status),
+			formatTime(c.ValidFrom),
+			formatTime(c.ValidTill),
+			formatTime(c.RevocationDate),
+			revocationReason(&c),
+		}
+	}
+	return a.printTable([]string{"SERIAL", "STATUS", "VALID FROM", "VALID TILL", "REVOKED AT", "REASON"}, rows)
+}
+
+func certShow(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("cert show", "<serial>")
+	flPEM := fs.Bool("pem", false, "print the certificate as PEM")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	serial, err := parseSerial(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := a.client.GetCert(ctx, serial)
+	if err != nil {
+		return err
+	}
+	if *flPEM {
+		_, err := fmt.Fprint(a.stdout, c.CertData)
+		return err
+	}
+	if a.json {
+		return a.printJSON(c)
+	}
+	fields := [][2]string{
+		{"Serial", fmt.Sprintf("%s (0x%x)", &c.Serial, &c.Serial)},
+		{"CN", c.CN},
+		{"Status", certStatus(c.Status)},
+		{"Valid from", formatTime(c.ValidFrom)},
+		{"Valid till", formatTime(c.ValidTill)},
+	}
+	switch c.Status {
+	case "H":
+		fields = append(fields, [2]string{"Held at", formatTime(c.RevocationDate)})
+	case "R":
+		fields = append(fields,
+			[2]string{"Revoked at", formatTime(c.RevocationDate)},
+			[2]string{"Reason", revocationReason(c)},
+		)
+	}
+	if c.InvalidityDate != nil {
+		fields = append(fields, [2]string{"Invalidity date", formatTime(*c.InvalidityDate)})
+	}
+	if block, _ := pem.Decode([]byte(c.CertData)); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			sum := sha256.Sum256(cert.Raw)
+			fields = append(fields,
+				[2]string{"Subject", cert.Subject.String()},
+				[2]string{"Issuer", cert.Issuer.String()},
+				[2]string{"SHA-256", fmt.Sprintf("%X", sum)},
+			)
+		}
+	}
+	return a.printFields(fields)
+}
+
+func certRevoke(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("cert revoke", "<serial>")
+	var (
+		flReason         = fs.String("reason", "unspecified", "RFC 5280 revocation reason, such as keyCompromise, superseded or cessationOfOperation")
+		flInvalidityDate = fs.String("invalidity-date", "", "when the key is known or suspected to be compromised, in RFC 3339")
+	)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	serial, err := parseSerial(args[0])
+	if err != nil {
+		return err
+	}
+	reason, err := scepdepot.ParseRevocationReason(*flReason)
+	if err != nil {
+		return err
+	}
+	var invalidityDate *time.Time
+	if *flInvalidityDate != "" {
+		t, err := time.Parse(time.RFC3339, *flInvalidityDate)
+		if err != nil {
+			return fmt.Errorf("invalid -invalidity-date: %w", err)
+		}
+		invalidityDate = &t
+	}
+	if err := a.client.RevokeCert(ctx, serial, reason, invalidityDate); err != nil {
+		return err
+	}
+	return a.done("certificate %s revoked", serial)
+}
+
+func certHold(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("cert hold", "<serial>"), args, 1)
+	if err != nil {
+		return err
+	}
+	serial, err := parseSerial(args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.client.HoldCert(ctx, serial); err != nil {
+		return err
+	}
+	return a.done("certificate %s held", serial)
+}
+
+func certRelease(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("cert release", "<serial>"), args, 1)
+	if err != nil {
+		return err
+	}
+	serial, err := parseSerial(args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.client.ReleaseCert(ctx, serial); err != nil {
+		return err
+	}
+	return a.done("certificate %s released", serial)
+}
+
+// parseSerial parses a decimal serial number, or a hexadecimal one
+// starting with 0x, as the admin API does.
+func parseSerial(s string) (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(s, 0)
+	if !ok || serial.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid serial number %q", s)
+	}
+	return serial, nil
+}
+
+func certStatus(status string) string {
+	if name, ok := certStatuses[status]; ok {
+		return name
+	}
+	return status
+}
+
+func revocationReason(c *scepdepot.Certificate) string {
+	if c.Status != "R" {
+		return "-"
+	}
+	if c.RevocationReason == nil {
+		return scepdepot.Unspecified.String()
+	}
+	return c.RevocationReason.String()
+}
+
+// crlInfo is the JSON output of crl fetch.
+type crlInfo struct {
+	Issuer     string     `json:"issuer"`
+	Number     *big.Int   `json:"number"`
+	ThisUpdate time.Time  `json:"this_update"`
+	NextUpdate time.Time  `json:"next_update"`
+	Revoked    []crlEntry `json:"revoked"`
+}
+
+type crlEntry struct {
+	Serial    *big.Int  `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    string    `json:"reason"`
+}
+
+func crlFetch(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("crl fetch", "")
+	var (
+		flOut    = fs.String("out", "", "file to write the CRL to, - for the standard output. the CRL is shown if empty")
+		flFormat = fs.String("format", "der", "format of the CRL written to -out: \"der\" or \"pem\"")
+	)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *flFormat != "der" && *flFormat != "pem" {
+		return fmt.Errorf("unknown format %q", *flFormat)
+	}
+	der, err := a.client.CRL(ctx)
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return fmt.Errorf("parse CRL: %w", err)
+	}
+
+	if *flOut != "" {
+		data := der
+		if *flFormat == "pem" {
+			data = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+		}
+		if *flOut == "-" {
+			_, err = a.stdout.Write(data)
+		} else {
+			err = os.WriteFile(*flOut, data, 0644)
+		}
+		return err
+	}
+
+	info := crlInfo{
+		Issuer:     crl.Issuer.String(),
+		Number:     crl.Number,
+		ThisUpdate: crl.ThisUpdate,
+		NextUpdate: crl.NextUpdate,
+		Revoked:    []crlEntry{},
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		info.Revoked = append(info.Revoked, crlEntry{
+			Serial:    entry.SerialNumber,
+			RevokedAt: entry.RevocationTime,
+			Reason:    scepdepot.RevocationReason(entry.ReasonCode).String(),
+		})
+	}
+	if a.json {
+		return a.printJSON(info)
+	}
+	if err := a.printFields([][2]string{
+		{"Issuer", info.Issuer},
+		{"Number", fmt.Sprint(info.Number)},
+		{"This update", formatTime(info.ThisUpdate)},
+		{"Next update", formatTime(info.NextUpdate)},
+	}); err != nil {
+		return err
+	}
+	if len(info.Revoked) == 0 {
+		return nil
+	}
+	fmt.Fprintln(a.stdout)
+	rows := make([][]string, len(info.Revoked))
+	for i, e := range info.Revoked {
+		rows[i] = []string{e.Serial.String(), formatTime(e.RevokedAt), e.Reason}
+	}
+	return a.printTable([]string{"SERIAL", "REVOKED AT", "REASON"}, rows)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var clientCommands = map[string]command{
+	"list":   {"", "list the clients", clientList},
+	"get":    {"<uid>", "show a client", clientGet},
+	"add":    {"<uid>", "add an INACTIVE client", clientAdd},
+	"update": {"<uid>", "replace the attributes of a client", clientUpdate},
+	"revoke": {"<uid>", "make a client INACTIVE, revoking its certificates", clientRevoke},
+	"delete": {"<uid>", "revoke the certificates of a client and archive it", clientDelete},
+}
+
+func clientList(ctx context.Context, a *app, args []string) error {
+	if _, err := parseArgs(flagSet("client list", ""), args, 0); err != nil {
+		return err
+	}
+	clients, err := a.client.ListClients(ctx)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(clients)
+	}
+	rows := make([][]string, len(clients))
+	for i, c := range clients {
+		rows[i] = []string{c.Uid, c.Status, orDash(c.CA), formatAttributes(c.Attributes)}
+	}
+	return a.printTable([]string{"UID", "STATUS", "CA", "ATTRIBUTES"}, rows)
+}
+
+func clientGet(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("client get", "<uid>"), args, 1)
+	if err != nil {
+		return err
+	}
+	c, err := a.client.GetClient(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("client %s not found", args[0])
+	}
+	if a.json {
+		return a.printJSON(c)
+	}
+	return a.printFields([][2]string{
+		{"UID", c.Uid},
+		{"Status", c.Status},
+		{"CA", orDash(c.CA)},
+		{"Attributes", formatAttributes(c.Attributes)},
+	})
+}
+
+func clientAdd(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("client add", "<uid>")
+	attrs := addAttributeFlags(fs)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	attributes, err := attrs.attributes()
+	if err != nil {
+		return err
+	}
+	if err := a.client.AddClient(ctx, args[0], attributes); err != nil {
+		return err
+	}
+	return a.done("client %s added", args[0])
+}
+
+func clientUpdate(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("client update", "<uid>")
+	attrs := addAttributeFlags(fs)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	attributes, err := attrs.attributes()
+	if err != nil {
+		return err
+	}
+	if err := a.client.UpdateClient(ctx, args[0], attributes); err != nil {
+		return err
+	}
+	return a.done("client %s updated", args[0])
+}
+
+func clientRevoke(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("client revoke", "<uid>"), args, 1)
+	if err != nil {
+		return err
+	}
+	if err := a.client.RevokeClient(ctx, args[0]); err != nil {
+		return err
+	}
+	return a.done("client %s revoked", args[0])
+}
+
+func clientDelete(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("client delete", "<uid>"), args, 1)
+	if err != nil {
+		return err
+	}
+	if err := a.client.DeleteClient(ctx, args[0]); err != nil {
+		return err
+	}
+	return a.done("client %s deleted", args[0])
+}
+
+// attributeFlags are the flags setting the attributes of a client.
+type attributeFlags struct {
+	json  *string
+	pairs *stringsFlag
+}
+
+func addAttributeFlags(fs *flag.FlagSet) attributeFlags {
+	pairs := &stringsFlag{}
+	fs.Var(pairs, "attr", "attribute as name=value, may be repeated")
+	return attributeFlags{
+		json:  fs.String("attributes", "", "attributes as a JSON object"),
+		pairs: pairs,
+	}
+}
+
+// attributes returns the object of -attributes with the values of -attr.
+func (f attributeFlags) attributes() (map[string]interface{}, error) {
+	attributes := map[string]interface{}{}
+	if *f.json != "" {
+		if err := json.Unmarshal([]byte(*f.json), &attributes); err != nil {
+			return nil, fmt.Errorf("invalid -attributes: %w", err)
+		}
+	}
+	for _, pair := range *f.pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -attr %q, use name=value", pair)
+		}
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+// formatAttributes formats attributes as name=value pairs in the order of
+// their names.
+func formatAttributes(attributes map[string]interface{}) string {
+	if len(attributes) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value, ok := attributes[name].(string)
+		if !ok {
+			b, _ := json.Marshal(attributes[name])
+			value = string(b)
+		}
+		pairs[i] = name + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/procube-open/scep/apiclient"
+)
+
+// config is the configuration file of scepctl, a JSON object of server
+// profiles.
+type config struct {
+	// DefaultProfile is the profile used without -profile.
+	DefaultProfile string             `json:"default_profile"`
+	Profiles       map[string]profile `json:"profiles"`
+}
+
+// profile is a SCEP server and the credentials of its admin API.
+type profile struct {
+	URL string `json:"url"`
+	// CA is the name of the CA of the server, empty for the default CA.
+	CA       string `json:"ca"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	// TLSCA is the path of the CA certificates verifying the server,
+	// which defaults to the certificates of the system.
+	TLSCA                 string `json:"tls_ca"`
+	TLSCert               string `json:"tls_cert"`
+	TLSKey                string `json:"tls_key"`
+	TLSInsecureSkipVerify bool   `json:"tls_insecure_skip_verify"`
+}
+
+// defaultServerURL is the server of scepctl without a profile, the default
+// address of scepserver.
+const defaultServerURL = "http://127.0.0.1:3000"
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "scepctl", "config.json")
+}
+
+// loadProfile returns the profile name of the configuration file path, or
+// its default profile if name is empty. A missing file is an empty
+// configuration, unless a profile is named.
+func loadProfile(path, name string) (profile, error) {
+	var cfg config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) || path == "" {
+		if name != "" {
+			return profile{}, fmt.Errorf("no profile %s: %s does not exist", name, path)
+		}
+		return profile{URL: defaultServerURL}, nil
+	} else if err != nil {
+		return profile{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return profile{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		return profile{URL: defaultServerURL}, nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("no profile %s in %s", name, path)
+	}
+	if p.URL == "" {
+		p.URL = defaultServerURL
+	}
+	return p, nil
+}
+
+// client returns the API client of the profile.
+func (p profile) client() (*apiclient.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.TLSInsecureSkipVerify}
+	if p.TLSCA != "" {
+		pem, err := os.ReadFile(p.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", p.TLSCA)
+		}
+	}
+	if p.TLSCert != "" || p.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(p.TLSCert, p.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	opts := []apiclient.Option{
+		apiclient.WithHTTPClient(&http.Client{Transport: transport}),
+		apiclient.WithCA(p.CA),
+	}
+	if p.Token != "" {
+		opts = append(opts, apiclient.WithBearerToken(p.Token))
+	} else if p.Username != "" {
+		opts = append(opts, apiclient.WithBasicAuth(p.Username, p.Password))
+	}
+	return apiclient.New(p.URL, opts...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := writeConfig(t, `{
+		"default_profile": "prod",
+		"profiles": {
+			"prod": {"url": "https://scep.example.com", "ca": "users", "token": "secret"},
+			"local": {"username": "admin", "password": "pass"}
+		}
+	}`)
+	missing := filepath.Join(t.TempDir(), "config.json")
+
+	for _, test := range []struct {
+		name       string
+		path       string
+		profile    string
+		want       profile
+		wantErrHas string
+	}{
+		{name: "default profile", path: path, want: profile{URL: "https://scep.example.com", CA: "users", Token: "secret"}},
+		{name: "named profile", path: path, profile: "local", want: profile{URL: defaultServerURL, Username: "admin", Password: "pass"}},
+		{name: "unknown profile", path: path, profile: "test", wantErrHas: "no profile test in"},
+		{name: "missing file", path: missing, want: profile{URL: defaultServerURL}},
+		{name: "no path", want: profile{URL: defaultServerURL}},
+		{name: "profile of a missing file", path: missing, profile: "prod", wantErrHas: "does not exist"},
+		{name: "no default profile", path: writeConfig(t, `{"profiles": {}}`), want: profile{URL: defaultServerURL}},
+		{name: "invalid JSON", path: writeConfig(t, `{"profiles":`), wantErrHas: "parse "},
+		{name: "unknown field", path: writeConfig(t, `{"profile": "prod"}`), wantErrHas: `unknown field "profile"`},
+		{name: "unreadable file", path: t.TempDir(), wantErrHas: "is a directory"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := loadProfile(test.path, test.profile)
+			if test.wantErrHas != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErrHas) {
+					t.Fatalf("have error %v, want one containing %q", err, test.wantErrHas)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != test.want {
+				t.Errorf("have profile %+v, want %+v", p, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// Command scepctl manages the clients, secrets and certificates of a SCEP
+// server through its REST API.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/procube-open/scep/apiclient"
+	"github.com/procube-open/scep/utils"
+)
+
+// version info
+var version = "unknown"
+
+// command is a subcommand of a resource, such as client add.
+type command struct {
+	args  string
+	usage string
+	run   func(ctx context.Context, app *app, args []string) error
+}
+
+// commands are the commands of each resource.
+var commands = map[string]map[string]command{
+	"client": clientCommands,
+	"secret": secretCommands,
+	"cert":   certCommands,
+	"crl":    crlCommands,
+}
+
+// errUsage is returned by commands called with wrong arguments, after they
+// printed their usage.
+var errUsage = errors.New("usage")
+
+// app is the state shared by the commands.
+type app struct {
+	client *apiclient.Client
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	var (
+		flVersion     = flag.Bool("version", false, "prints version information")
+		flConfig      = flag.String("config", utils.EnvString("SCEPCTL_CONFIG", defaultConfigPath()), "path of the configuration file of the server profiles")
+		flProfile     = flag.String("profile", utils.EnvString("SCEPCTL_PROFILE", ""), "server profile of the configuration file to use (default is default_profile of the file)")
+		flURL         = flag.String("url", utils.EnvString("SCEPCTL_URL", ""), "URL of the SCEP server, such as https://scep.example.com")
+		flCA          = flag.String("ca", utils.EnvString("SCEPCTL_CA", ""), "name of the CA of the server to manage (default is the default CA)")
+		flUsername    = flag.String("username", utils.EnvString("SCEPCTL_USERNAME", ""), "username of the basic authentication of the admin API")
+		flPassword    = flag.String("password", utils.EnvString("SCEPCTL_PASSWORD", ""), "password of the basic authentication of the admin API")
+		flToken       = flag.String("token", utils.EnvString("SCEPCTL_TOKEN", ""), "bearer token of the admin API")
+		flTLSCA       = flag.String("tls-ca", utils.EnvString("SCEPCTL_TLS_CA", ""), "path of the CA certificates verifying the server")
+		flTLSCert     = flag.String("tls-cert", utils.EnvString("SCEPCTL_TLS_CERT", ""), "path of the TLS client certificate")
+		flTLSKey      = flag.String("tls-key", utils.EnvString("SCEPCTL_TLS_KEY", ""), "path of the key of the TLS client certificate")
+		flTLSInsecure = flag.Bool("tls-insecure", false, "do not verify the certificate of the server")
+		flOutput      = flag.String("output", utils.EnvString("SCEPCTL_OUTPUT", "table"), "output format: \"table\" or \"json\"")
+	)
+	flag.Usage = usage
+	flag.Parse()
+
+	if *flVersion {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s %s\n", args[0], args[1])
+		usage()
+		os.Exit(2)
+	}
+	if *flOutput != "table" && *flOutput != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *flOutput)
+		os.Exit(2)
+	}
+
+	profile, err := loadProfile(*flConfig, *flProfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the flags and environment variables override the profile
+	override(&profile.URL, *flURL)
+	override(&profile.CA, *flCA)
+	override(&profile.Username, *flUsername)
+	override(&profile.Password, *flPassword)
+	override(&profile.Token, *flToken)
+	override(&profile.TLSCA, *flTLSCA)
+	override(&profile.TLSCert, *flTLSCert)
+	override(&profile.TLSKey, *flTLSKey)
+	profile.TLSInsecureSkipVerify = profile.TLSInsecureSkipVerify || *flTLSInsecure
+
+	client, err := profile.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	a := &app{
+		client: client,
+		json:   *flOutput == "json",
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	err = cmd.run(ctx, a, args[2:])
+	cancel()
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func override(value *string, flagValue string) {
+	if flagValue != "" {
+		*value = flagValue
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: scepctl [<flags>] <resource> <command> [<args>]")
+	fmt.Fprintln(out)
+	resources := make([]string, 0, len(commands))
+	for resource := range commands {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, resource := range resources {
+		names := make([]string, 0, len(commands[resource]))
+		for name := range commands[resource] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd := commands[resource][name]
+			fmt.Fprintf(w, " %s %s %s\t%s\n", resource, name, cmd.args, cmd.usage)
+		}
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "type scepctl <resource> <command> -help to see the flags of each command")
+}
+
+// flagSet returns the flags of the command name, such as "client add",
+// whose usage lists its arguments args.
+func flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: scepctl %s [<flags>] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of fs in args, which must leave n arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	// the flag package has printed the error and the usage
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// printJSON writes v as indented JSON.
+func (a *app) printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.stdout, "%s\n", b)
+	return err
+}
+
+// printTable writes the rows under header, aligned in columns.
+func (a *app) printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(a.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// printFields writes the name and value pairs of fields, one per line.
+func (a *app) printFields(fields [][2]string) error {
+	w := tabwriter.NewWriter(a.stdout, 0, 8, 2, ' ', 0)
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s:\t%s\n", f[0], f[1])
+	}
+	return w.Flush()
+}
+
+// done reports the success of a command without output.
+func (a *app) done(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(a.stderr, format+"\n", args...)
+	return err
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
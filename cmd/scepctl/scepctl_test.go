@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	value := "profile"
+	override(&value, "")
+	if value != "profile" {
+		t.Errorf("an empty flag overrode the profile: have %q", value)
+	}
+	override(&value, "flag")
+	if value != "flag" {
+		t.Errorf("have %q, want the flag", value)
+	}
+}
+
+func TestPrintJSON(t *testing.T) {
+	var out bytes.Buffer
+	a := &app{stdout: &out}
+	if err := a.printJSON(map[string]interface{}{"uid": "pc01", "attributes": []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"attributes\": [],\n  \"uid\": \"pc01\"\n}\n"
+	if have := out.String(); have != want {
+		t.Errorf("have\n%s\nwant\n%s", have, want)
+	}
+}
+
+func TestPrintJSONError(t *testing.T) {
+	var out bytes.Buffer
+	a := &app{stdout: &out}
+	if err := a.printJSON(make(chan int)); err == nil {
+		t.Error("no error for a value that is not JSON")
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q", out.String())
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	var out bytes.Buffer
+	a := &app{stdout: &out}
+	err := a.printTable([]string{"UID", "STATUS"}, [][]string{
+		{"pc01", "ISSUABLE"},
+		{"laptop-0002", orDash("")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "UID          STATUS\n" +
+		"pc01         ISSUABLE\n" +
+		"laptop-0002  -\n"
+	if have := out.String(); have != want {
+		t.Errorf("have\n%s\nwant\n%s", have, want)
+	}
+}
+
+func TestPrintFields(t *testing.T) {
+	var out bytes.Buffer
+	a := &app{stdout: &out}
+	err := a.printFields([][2]string{
+		{"Uid", "pc01"},
+		{"Status", "ISSUABLE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Uid:     pc01\n" +
+		"Status:  ISSUABLE\n"
+	if have := out.String(); have != want {
+		t.Errorf("have\n%s\nwant\n%s", have, want)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+var secretCommands = map[string]command{
+	"create": {"<uid>", "create a secret, activating an INACTIVE client or making an ISSUED client UPDATABLE", secretCreate},
+	"get":    {"<uid>", "show the secret of a client, without the secret itself", secretGet},
+}
+
+func secretCreate(ctx context.Context, a *app, args []string) error {
+	fs := flagSet("secret create", "<uid>")
+	var (
+		flSecret    = fs.String("secret", "", "the secret")
+		flGenerate  = fs.Bool("generate", false, "let the server generate the secret")
+		flAvailable = fs.String("available-period", "24h", "how long the secret can be used")
+		flPending   = fs.String("pending-period", "0h", "how long the old certificate stays valid after an update")
+		flProfile   = fs.String("profile", "", "certificate profile of the certificate issued with the secret")
+		flInvite    = fs.Bool("invite", false, "also issue an enrollment invitation")
+	)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if (*flSecret == "") == !*flGenerate {
+		return errors.New("give either -secret or -generate")
+	}
+	secret, err := a.client.CreateSecret(ctx, scepdepot.CreateSecretInfo{
+		Target:           args[0],
+		Secret:           *flSecret,
+		Generate:         *flGenerate,
+		Available_Period: *flAvailable,
+		Pending_Period:   *flPending,
+		Profile:          *flProfile,
+		Invite:           *flInvite,
+	})
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(secret)
+	}
+	fields := [][2]string{
+		{"Target", secret.Target},
+		{"Secret", secret.Secret},
+		{"Type", secret.Type},
+	}
+	if inv := secret.Invitation; inv != nil {
+		fields = append(fields,
+			[2]string{"Invitation URL", inv.URL},
+			[2]string{"Invitation expires", formatTime(inv.ExpiresAt)},
+		)
+	}
+	return a.printFields(fields)
+}
+
+func secretGet(ctx context.Context, a *app, args []string) error {
+	args, err := parseArgs(flagSet("secret get", "<uid>"), args, 1)
+	if err != nil {
+		return err
+	}
+	info, err := a.client.GetSecret(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(info)
+	}
+	return a.printFields([][2]string{
+		{"Type", info.Type},
+		{"Delete at", formatTime(info.Delete_At)},
+		{"Pending period", orDash(info.Pending_Period)},
+		{"Profile", orDash(info.Profile)},
+	})
+}
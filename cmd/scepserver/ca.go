@@ -0,0 +1,594 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/boltdb/bolt"
+	scepdepot "github.com/procube-open/scep/depot"
+	boltdepot "github.com/procube-open/scep/depot/bolt"
+	"github.com/procube-open/scep/depot/pkcs11"
+	"github.com/procube-open/scep/depot/sqldepot"
+	"github.com/procube-open/scep/scep"
+	"github.com/procube-open/scep/utils"
+)
+
+// caSubcommands are the ca subcommands managing an existing CA, which take
+// their own flags.
+var caSubcommands = map[string]func(args []string) int{
+	"info":    caInfoMain,
+	"export":  caExportMain,
+	"backup":  caBackupMain,
+	"restore": caRestoreMain,
+}
+
+// depotFlags are the flags selecting the CA folder and the database of a
+// ca subcommand.
+type depotFlags struct {
+	path, driver, dsn *string
+}
+
+func addDepotFlags(cmd *flag.FlagSet) depotFlags {
+	return depotFlags{
+		path:   cmd.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder"),
+		driver: cmd.String("depot-driver", utils.EnvString("SCEP_DEPOT_DRIVER", ""), "database the clients and certificates are stored in: \"mysql\", \"postgres\", \"sqlite\" or \"bolt\""),
+		dsn:    cmd.String("dsn", utils.EnvString("SCEP_DSN", ""), "Data Source Name of MySQL or PostgreSQL, or the path of the SQLite or Bolt database"),
+	}
+}
+
+// dbPath returns the path of the SQLite or Bolt database file, or "" for
+// database servers.
+func (f depotFlags) dbPath() string {
+	switch depotDriver(*f.driver, *f.dsn) {
+	case "sqlite":
+		if *f.dsn == "" {
+			return filepath.Join(*f.path, "scep.sqlite")
+		}
+	case "bolt":
+		if *f.dsn == "" {
+			return filepath.Join(*f.path, "scep.db")
+		}
+	default:
+		return ""
+	}
+	return *f.dsn
+}
+
+func caInfoMain(args []string) int {
+	cmd := flag.NewFlagSet("ca info", flag.ExitOnError)
+	df := addDepotFlags(cmd)
+	flSerialMode := cmd.String("serial-mode", utils.EnvString("SCEP_SERIAL_MODE", "sequential"), "how certificate serial numbers are allocated: \"sequential\" or \"random\"")
+	cmd.Parse(args)
+
+	certs, err := scepdepot.LoadCACerts(*df.path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i, cert := range certs {
+		if i > 0 {
+			fmt.Println()
+			fmt.Printf("Issuer certificate %d\n", i)
+		}
+		printCertInfo(cert)
+	}
+	fmt.Println()
+	fmt.Printf("Key file:         %s\n", keyFileInfo(*df.path))
+
+	// the database is only read, so that info does not migrate it
+	depot, err := openDepotReadOnly(*df.driver, *df.dsn, *df.path, *flSerialMode == "random")
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		fmt.Println("Last serial:      none, the database does not exist")
+		return 0
+	case errors.Is(err, bolt.ErrTimeout):
+		fmt.Println("Last serial:      unknown, the bolt database is in use by a running server")
+		return 0
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	next, err := depot.GetNextSerial()
+	switch {
+	case errors.Is(err, scepdepot.ErrRandomSerial):
+		fmt.Println("Last serial:      random serial numbers")
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	default:
+		last := new(big.Int).Sub(next, big.NewInt(1))
+		fmt.Printf("Last serial:      %s (0x%x)\n", last, last)
+	}
+	return 0
+}
+
+func printCertInfo(cert *x509.Certificate) {
+	now := time.Now()
+	expiry := fmt.Sprintf("in %d days", int(cert.NotAfter.Sub(now).Hours()/24))
+	if now.After(cert.NotAfter) {
+		expiry = "expired"
+	}
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	fmt.Printf("Subject:          %s\n", cert.Subject)
+	fmt.Printf("Issuer:           %s\n", cert.Issuer)
+	fmt.Printf("Serial:           %s\n", cert.SerialNumber)
+	fmt.Printf("Not before:       %s\n", cert.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Printf("Not after:        %s (%s)\n", cert.NotAfter.UTC().Format(time.RFC3339), expiry)
+	fmt.Printf("Key type:         %s\n", keyType(cert.PublicKey))
+	fmt.Printf("SHA-1:            %s\n", fingerprint(sha1Sum[:]))
+	fmt.Printf("SHA-256:          %s\n", fingerprint(sha256Sum[:]))
+}
+
+func keyType(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+// fingerprint formats sum as colon separated hexadecimal bytes, like
+// openssl x509 -fingerprint.
+func fingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// keyFileInfo describes how ca.key in dir is stored.
+func keyFileInfo(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "none, the key is in a PKCS#11 token"
+	} else if err != nil {
+		return err.Error()
+	}
+	block, _ := pem.Decode(data)
+	switch {
+	case block == nil:
+		return "unknown format"
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		return "encrypted PKCS#8"
+	case block.Type == "PRIVATE KEY":
+		return "PKCS#8, not encrypted"
+	case x509.IsEncryptedPEMBlock(block):
+		return "legacy encrypted PEM, re-encrypt it with ca -rekey-storage"
+	default:
+		return block.Type + ", not encrypted"
+	}
+}
+
+func caExportMain(args []string) int {
+	cmd := flag.NewFlagSet("ca export", flag.ExitOnError)
+	flDepotPath := cmd.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder")
+	flFormat := cmd.String("format", "pem", "format of the certificates: \"pem\", \"der\" or \"p7b\" for a degenerate PKCS#7")
+	flOut := cmd.String("out", "-", "file to write the certificates to, - for the standard output")
+	flChain := cmd.Bool("chain", true, "also export the issuers of a subordinate CA")
+	cmd.Parse(args)
+
+	certs, err := scepdepot.LoadCACerts(*flDepotPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*flChain {
+		certs = certs[:1]
+	}
+	data, err := exportCerts(certs, *flFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *flOut == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*flOut, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func exportCerts(certs []*x509.Certificate, format string) ([]byte, error) {
+	switch format {
+	case "pem":
+		var data []byte
+		for _, cert := range certs {
+			data = append(data, pemCert(cert.Raw)...)
+		}
+		return data, nil
+	case "der":
+		if len(certs) > 1 {
+			return nil, errors.New("DER holds a single certificate, export the chain as pem or p7b or use -chain=false")
+		}
+		return certs[0].Raw, nil
+	case "p7b":
+		return scep.DegenerateCertificates(certs)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// backupManifest describes a backup archive.
+type backupManifest struct {
+	Driver    string    `json:"driver"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The entries of a backup archive: the manifest, the files of the CA
+// folder under depot/ and the dump of the database.
+const (
+	backupManifestName = "manifest.json"
+	backupDepotDir     = "depot/"
+	backupSQLName      = "depot.sql"
+	backupBoltName     = "depot.bolt"
+)
+
+func caBackupMain(args []string) int {
+	cmd := flag.NewFlagSet("ca backup", flag.ExitOnError)
+	df := addDepotFlags(cmd)
+	flOut := cmd.String("out", "", "file to write the encrypted backup to")
+	flPassword := cmd.String("password", utils.EnvString("SCEPCA_BACKUP_PASSWORD", ""), "password the backup is encrypted with")
+	cmd.Parse(args)
+	if *flOut == "" || *flPassword == "" {
+		fmt.Fprintln(os.Stderr, "-out and -password are required")
+		return 2
+	}
+	if err := backup(df, *flOut, *flPassword); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// backup writes the CA folder and a dump of the database to out, in a tar
+// archive encrypted with password by age.
+func backup(df depotFlags, out, password string) error {
+	var (
+		depot scepdepot.Store
+		err   error
+	)
+	if depotDriver(*df.driver, *df.dsn) == "bolt" {
+		// opened for writing, which waits for the lock of a running server
+		depot, err = openDepot(*df.driver, *df.dsn, *df.path, false)
+	} else {
+		// a running server may use the database, whose schema is not
+		// migrated under it
+		depot, err = openCurrentDepot(*df.driver, *df.dsn, *df.path)
+	}
+	if errors.Is(err, bolt.ErrTimeout) {
+		// a bolt database is locked by the server using it
+		return errors.New("the bolt database is in use by a running server: stop the server to back it up")
+	} else if err != nil {
+		return err
+	}
+	var dump bytes.Buffer
+	var dumpName string
+	switch d := depot.(type) {
+	case *sqldepot.Depot:
+		defer d.DB().Close()
+		dumpName = backupSQLName
+		err = d.Dump(&dump)
+	case *boltdepot.Depot:
+		defer d.Close()
+		dumpName = backupBoltName
+		err = d.Backup(&dump)
+	default:
+		err = fmt.Errorf("cannot back up a %T", depot)
+	}
+	if err != nil {
+		return err
+	}
+
+	recipient, err := age.NewScryptRecipient(password)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeBackup(file, recipient, df, dumpName, dump.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+func writeBackup(w io.Writer, recipient age.Recipient, df depotFlags, dumpName string, dump []byte) error {
+	enc, err := age.Encrypt(w, recipient)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(enc)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.Marshal(backupManifest{
+		Driver:    depotDriver(*df.driver, *df.dsn),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, backupManifestName, manifest, 0644); err != nil {
+		return err
+	}
+	// the database file is in the dump, its copy in the folder may be
+	// inconsistent
+	var skip []string
+	if dbPath := df.dbPath(); dbPath != "" {
+		abs, err := filepath.Abs(dbPath)
+		if err != nil {
+			return err
+		}
+		skip = []string{abs, abs + "-wal", abs + "-shm", abs + "-journal"}
+	}
+	err = filepath.WalkDir(*df.path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		for _, s := range skip {
+			if abs == s {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(*df.path, name)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return writeTarFile(tw, backupDepotDir+filepath.ToSlash(rel), data, info.Mode().Perm())
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, dumpName, dump, 0600); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode fs.FileMode) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(mode),
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// backupFile is a file of a backup archive.
+type backupFile struct {
+	data []byte
+	mode fs.FileMode
+}
+
+func caRestoreMain(args []string) int {
+	cmd := flag.NewFlagSet("ca restore", flag.ExitOnError)
+	df := addDepotFlags(cmd)
+	flIn := cmd.String("in", "", "encrypted backup to restore")
+	flPassword := cmd.String("password", utils.EnvString("SCEPCA_BACKUP_PASSWORD", ""), "password the backup is encrypted with")
+	flKeyPassword := cmd.String("key-password", utils.EnvString("SCEP_CA_PASS", ""), "password of ca.key in the backup")
+	flModule := cmd.String("pkcs11-module", utils.EnvString("SCEP_PKCS11_MODULE", ""), "path of the PKCS#11 module of the token holding the CA key, for backups without ca.key")
+	flSlot := cmd.Int("pkcs11-slot", utils.EnvInt("SCEP_PKCS11_SLOT", 0), "slot number of the PKCS#11 token")
+	flPIN := cmd.String("pkcs11-pin", utils.EnvString("SCEP_PKCS11_PIN", ""), "user PIN of the PKCS#11 token")
+	flKeyLabel := cmd.String("pkcs11-key-label", utils.EnvString("SCEP_PKCS11_KEY_LABEL", "scep-ca"), "label of the CA key in the PKCS#11 token")
+	cmd.Parse(args)
+	if *flIn == "" || *flPassword == "" {
+		fmt.Fprintln(os.Stderr, "-in and -password are required")
+		return 2
+	}
+
+	files, err := readBackup(*flIn, *flPassword)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// nothing is written before the CA of the backup is checked
+	var token *pkcs11.Token
+	if _, ok := files[backupDepotDir+"ca.key"]; !ok && *flModule != "" {
+		token, err = pkcs11.Open(pkcs11.Config{
+			Module: *flModule,
+			Slot:   *flSlot,
+			PIN:    *flPIN,
+			Label:  *flKeyLabel,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer token.Close()
+	}
+	if err := checkBackupCA(files, []byte(*flKeyPassword), token); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := restore(df, files); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// readBackup decrypts the backup archive in and returns its files.
+func readBackup(in, password string) (map[string]backupFile, error) {
+	file, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identity, err := age.NewScryptIdentity(password)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := age.Decrypt(file, identity)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", in, err)
+	}
+	gz, err := gzip.NewReader(dec)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]backupFile)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !fs.ValidPath(name) {
+			return nil, fmt.Errorf("invalid entry %q in the backup", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = backupFile{data: data, mode: hdr.FileInfo().Mode().Perm()}
+	}
+	if _, ok := files[backupManifestName]; !ok {
+		return nil, errors.New("the file is not a CA backup")
+	}
+	return files, nil
+}
+
+// checkBackupCA checks that the CA certificate of the backup is the
+// certificate of its key, which is ca.key or the key of token.
+func checkBackupCA(files map[string]backupFile, keyPassword []byte, token *pkcs11.Token) error {
+	crt, ok := files[backupDepotDir+"ca.crt"]
+	if !ok {
+		return errors.New("the backup has no ca.crt")
+	}
+	certs, err := scepdepot.ParseCerts(crt.data)
+	if err != nil {
+		return err
+	}
+	var key crypto.Signer
+	if file, ok := files[backupDepotDir+"ca.key"]; ok {
+		key, err = scepdepot.ParseCAKey(file.data, keyPassword)
+	} else if token != nil {
+		key, err = token.Key()
+	} else {
+		err = errors.New("the backup has no ca.key, give the PKCS#11 token holding the CA key")
+	}
+	if err != nil {
+		return err
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(certs[0].PublicKey) {
+		return errors.New("ca.crt of the backup is not the certificate of the CA key")
+	}
+	return nil
+}
+
+// restore writes the database and the CA folder of the backup files,
+// refusing to replace existing files or rows.
+func restore(df depotFlags, files map[string]backupFile) error {
+	var manifest backupManifest
+	if err := json.Unmarshal(files[backupManifestName].data, &manifest); err != nil {
+		return err
+	}
+	driver := depotDriver(*df.driver, *df.dsn)
+	if manifest.Driver != driver {
+		return fmt.Errorf("the backup is of a %s depot, not of a %s depot", manifest.Driver, driver)
+	}
+	for name := range files {
+		if rel, ok := strings.CutPrefix(name, backupDepotDir); ok {
+			if _, err := os.Stat(filepath.Join(*df.path, filepath.FromSlash(rel))); err == nil {
+				return fmt.Errorf("%s already exists in %s", rel, *df.path)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(*df.path, 0755); err != nil {
+		return err
+	}
+	if driver == "bolt" {
+		dump, ok := files[backupBoltName]
+		if !ok {
+			return errors.New("the backup has no bolt database")
+		}
+		if err := writeNewFile(df.dbPath(), dump.data, 0600); err != nil {
+			return err
+		}
+	} else {
+		dump, ok := files[backupSQLName]
+		if !ok {
+			return errors.New("the backup has no SQL dump")
+		}
+		depot, err := openDepot(driver, *df.dsn, *df.path, false)
+		if err != nil {
+			return err
+		}
+		d := depot.(*sqldepot.Depot)
+		err = d.Restore(bytes.NewReader(dump.data))
+		d.DB().Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, file := range files {
+		if rel, ok := strings.CutPrefix(name, backupDepotDir); ok {
+			if err := writeNewFile(filepath.Join(*df.path, filepath.FromSlash(rel)), file.data, file.mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/procube-open/scep/challenge"
+	"github.com/procube-open/scep/csrverifier"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/depot/pkcs11"
+	"github.com/procube-open/scep/scep"
+	scepserver "github.com/procube-open/scep/server"
+)
+
+// caConfig configures a CA of the server. The default CA is configured by
+// the flags, the named CAs by the JSON file of -cas.
+type caConfig struct {
+	// Depot is the directory of ca.crt and ca.key of the CA.
+	Depot  string `json:"depot"`
+	CAPass string `json:"ca_pass"`
+	// PKCS11KeyLabel is the label of the CA key in the token of
+	// -pkcs11-module. The key is read from ca.key if it is empty.
+	PKCS11KeyLabel    string `json:"pkcs11_key_label"`
+	ValidityDays      int    `json:"validity_days"`
+	AllowRenewalDays  int    `json:"allow_renewal_days"`
+	Profiles          string `json:"profiles"`
+	DefaultProfile    string `json:"default_profile"`
+	SubjectPolicy     string `json:"subject_policy"`
+	SignServerAttrs   bool   `json:"sign_server_attrs"`
+	ChallengeMode     string `json:"challenge_mode"`
+	ChallengeTTL      string `json:"challenge_ttl"`
+	ChallengePassword string `json:"challenge_password"`
+	ChallengeJWTKey   string `json:"challenge_jwt_key"`
+}
+
+var caNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// loadCAConfigs reads the named CAs from the JSON file path, an object
+// mapping the names of the CAs to their configuration.
+func loadCAConfigs(path string) (map[string]caConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	configs := make(map[string]caConfig, len(raw))
+	for name, msg := range raw {
+		if !caNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid CA name %q: use lower case letters, digits, '-' and '_'", name)
+		}
+		for _, reserved := range scepserver.ReservedCANames {
+			if name == reserved {
+				return nil, fmt.Errorf("the CA name %q is reserved", name)
+			}
+		}
+		cfg := caConfig{
+			ValidityDays:  365,
+			ChallengeMode: "secret",
+			ChallengeTTL:  "1h",
+		}
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("CA %s: %w", name, err)
+		}
+		if cfg.Depot == "" {
+			return nil, fmt.Errorf("CA %s: depot is required", name)
+		}
+		configs[name] = cfg
+	}
+	return configs, nil
+}
+
+// newCA loads the CA name of cfg, whose clients and certificates are kept
+// in depot, and builds its SCEP endpoints. The verifiers check the CSRs of
+// every CA.
+func newCA(name string, cfg caConfig, depot scepdepot.Store, token *pkcs11.Token, verifiers []csrverifier.CSRVerifier, logger log.Logger) (scepserver.CA, error) {
+	// the CA is loaded once, the key stays in the token if there is one
+	var (
+		crts []*x509.Certificate
+		key  scepdepot.CAKey
+		err  error
+	)
+	if token != nil && cfg.PKCS11KeyLabel != "" {
+		if key, err = token.KeyLabeled(cfg.PKCS11KeyLabel); err != nil {
+			return scepserver.CA{}, err
+		}
+		crts, err = scepdepot.LoadCACerts(cfg.Depot)
+	} else {
+		crts, key, err = scepdepot.LoadCA(cfg.Depot, []byte(cfg.CAPass))
+	}
+	if err != nil {
+		return scepserver.CA{}, err
+	}
+	store := scepdepot.StoreForCA(depot, name, crts, key)
+
+	profiles, err := scepdepot.LoadProfiles(cfg.Profiles)
+	if err != nil {
+		return scepserver.CA{}, fmt.Errorf("load certificate profiles: %w", err)
+	}
+	if _, ok := profiles[cfg.DefaultProfile]; cfg.DefaultProfile != "" && !ok {
+		return scepserver.CA{}, fmt.Errorf("unknown default profile %q", cfg.DefaultProfile)
+	}
+	signerOpts := []scepdepot.Option{
+		scepdepot.WithAllowRenewalDays(cfg.AllowRenewalDays),
+		scepdepot.WithValidityDays(cfg.ValidityDays),
+		scepdepot.WithCAPass(cfg.CAPass),
+		scepdepot.WithProfiles(profiles),
+		scepdepot.WithDefaultProfile(cfg.DefaultProfile),
+	}
+	if cfg.SignServerAttrs {
+		signerOpts = append(signerOpts, scepdepot.WithSeverAttrs())
+	}
+	if cfg.SubjectPolicy != "" {
+		policy, err := scepdepot.LoadSubjectPolicy(cfg.SubjectPolicy)
+		if err != nil {
+			return scepserver.CA{}, fmt.Errorf("load subject policy: %w", err)
+		}
+		signerOpts = append(signerOpts, scepdepot.WithSubjectPolicy(policy))
+	}
+
+	var challengeStore scepdepot.ChallengeStore
+	switch cfg.ChallengeMode {
+	case "secret":
+	case "dynamic":
+		ttl, err := time.ParseDuration(cfg.ChallengeTTL)
+		if err != nil {
+			return scepserver.CA{}, fmt.Errorf("invalid challenge TTL: %w", err)
+		}
+		if ttl <= 0 {
+			return scepserver.CA{}, fmt.Errorf("invalid challenge TTL %s: must be positive", ttl)
+		}
+		factory, ok := depot.(scepdepot.ChallengeStoreFactory)
+		if !ok {
+			return scepserver.CA{}, fmt.Errorf("the depot does not keep one-time challenges")
+		}
+		challengeStore = scepdepot.ChallengeStoreForCA(factory.NewChallengeStore(ttl), name)
+	default:
+		return scepserver.CA{}, fmt.Errorf("unknown challenge mode %q", cfg.ChallengeMode)
+	}
+
+	var signer scepserver.CSRSignerContext = scepdepot.NewSigner(store, signerOpts...)
+	// the verifiers run after the challenge middleware has identified the client
+	for _, verifier := range verifiers {
+		signer = csrverifier.Middleware(verifier, signer)
+	}
+	var challengeSigner scepserver.CSRSignerContext = scepserver.SecretChallengeMiddleware(store, signer)
+	if challengeStore != nil {
+		// uid\secret challenges, as sent by the REST API, are still
+		// verified against the secrets
+		secretSigner := challengeSigner
+		dynamicSigner := challenge.ClientMiddleware(store, challengeStore, signer)
+		challengeSigner = scepserver.CSRSignerContextFunc(func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+			if strings.Contains(m.ChallengePassword, "\\") {
+				return secretSigner.SignCSRContext(ctx, m)
+			}
+			return dynamicSigner.SignCSRContext(ctx, m)
+		})
+	}
+	if cfg.ChallengeJWTKey != "" {
+		jwtKey, err := challenge.LoadJWTKey(cfg.ChallengeJWTKey)
+		if err != nil {
+			return scepserver.CA{}, fmt.Errorf("load challenge JWT key: %w", err)
+		}
+		// challenges that are not JWTs are verified according to the challenge mode
+		signer, err = challenge.JWTMiddleware(jwtKey, store, signer, challenge.WithFallback(challengeSigner))
+		if err != nil {
+			return scepserver.CA{}, err
+		}
+	} else {
+		signer = challengeSigner
+	}
+	if cfg.ChallengePassword != "" {
+		signer = scepserver.StaticChallengeMiddleware(cfg.ChallengePassword, signer)
+	}
+
+	scepPath := "/scep"
+	if name != "" {
+		scepPath += "/" + name
+		logger = log.With(logger, "ca", name)
+	}
+	svcOpts := []scepserver.ServiceOption{
+		scepserver.WithLogger(logger),
+		scepserver.WithCRLStore(store),
+		scepserver.WithSCEPPath(scepPath),
+	}
+	// GetCACert returns the chain of a subordinate CA
+	for _, crt := range crts[1:] {
+		svcOpts = append(svcOpts, scepserver.WithAddlCA(crt))
+	}
+	svc, err := scepserver.NewService(crts[0], key, signer, svcOpts...)
+	if err != nil {
+		return scepserver.CA{}, err
+	}
+	lginfo := level.Info(logger)
+	svc = scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service"), svc)
+
+	e := scepserver.MakeServerEndpoints(svc, cfg.Depot)
+	e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
+	e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
+	return scepserver.CA{
+		Name:       name,
+		Store:      store,
+		Endpoints:  e,
+		Signer:     signer,
+		Challenges: challengeStore,
+		Profiles:   profiles,
+	}, nil
+}
+
+// checkCASubjects checks that no two CAs have the same subject, as the
+// certificates of a CA are told apart by their issuer.
+func checkCASubjects(cas []scepserver.CA) error {
+	seen := map[string]string{}
+	for _, ca := range cas {
+		crts, _, err := ca.Store.CA(nil)
+		if err != nil {
+			return err
+		}
+		subject := string(crts[0].RawSubject)
+		if other, ok := seen[subject]; ok {
+			return fmt.Errorf("the CAs %s and %s have the same subject %s", displayCAName(other), displayCAName(ca.Name), crts[0].Subject)
+		}
+		seen[subject] = ca.Name
+	}
+	return nil
+}
+
+func displayCAName(name string) string {
+	if name == "" {
+		return "(default)"
+	}
+	return name
+}
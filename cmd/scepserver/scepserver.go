@@ -1,28 +1,41 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"database/sql"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/procube-open/scep/csrverifier"
 	executablecsrverifier "github.com/procube-open/scep/csrverifier/executable"
+	policycsrverifier "github.com/procube-open/scep/csrverifier/policy"
+	webhookcsrverifier "github.com/procube-open/scep/csrverifier/webhook"
 	scepdepot "github.com/procube-open/scep/depot"
+	boltdepot "github.com/procube-open/scep/depot/bolt"
 	"github.com/procube-open/scep/depot/mysql"
+	"github.com/procube-open/scep/depot/pkcs11"
+	"github.com/procube-open/scep/depot/postgres"
+	"github.com/procube-open/scep/depot/sqldepot"
+	"github.com/procube-open/scep/depot/sqlite"
 	"github.com/procube-open/scep/hook"
 	scepserver "github.com/procube-open/scep/server"
+	"github.com/procube-open/scep/server/invite"
 	"github.com/procube-open/scep/utils"
 
+	"github.com/boltdb/bolt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
@@ -34,37 +47,65 @@ var (
 
 func main() {
 	var caCMD = flag.NewFlagSet("ca", flag.ExitOnError)
+	var dbCMD = flag.NewFlagSet("db", flag.ExitOnError)
 	{
 		if len(os.Args) >= 2 {
 			if os.Args[1] == "ca" {
 				status := caMain(caCMD)
 				os.Exit(status)
 			}
+			if os.Args[1] == "db" {
+				status := dbMain(dbCMD)
+				os.Exit(status)
+			}
 		}
 	}
 
 	//main flags
 	var (
-		flVersion           = flag.Bool("version", false, "prints version information")
-		flHTTPAddr          = flag.String("http-addr", utils.EnvString("SCEP_HTTP_ADDR", ""), "http listen address. defaults to \":8080\"")
-		flPort              = flag.String("port", utils.EnvString("SCEP_HTTP_LISTEN_PORT", "3000"), "http port to listen on (if you want to specify an address, use -http-addr instead)")
-		flDepotPath         = flag.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder")
-		flCAPass            = flag.String("capass", utils.EnvString("SCEP_CA_PASS", ""), "passwd for the ca.key")
-		flClDuration        = flag.String("crtvalid", utils.EnvString("SCEP_CERT_VALID", "365"), "validity for new client certificates in days")
-		flClAllowRenewal    = flag.String("allowrenew", utils.EnvString("SCEP_CERT_RENEW", "0"), "do not allow renewal until n days before expiry, set to 0 to always allow")
-		flChallengePassword = flag.String("challenge", utils.EnvString("SCEP_CHALLENGE_PASSWORD", ""), "enforce a challenge password")
-		flCSRVerifierExec   = flag.String("csrverifierexec", utils.EnvString("SCEP_CSR_VERIFIER_EXEC", ""), "will be passed the CSRs for verification")
-		flDebug             = flag.Bool("debug", utils.EnvBool("SCEP_LOG_DEBUG"), "enable debug logging")
-		flLogJSON           = flag.Bool("log-json", utils.EnvBool("SCEP_LOG_JSON"), "output JSON logs")
-		flSignServerAttrs   = flag.Bool("sign-server-attrs", utils.EnvBool("SCEP_SIGN_SERVER_ATTRS"), "sign cert attrs for server usage")
-		flDSN               = flag.String("dsn", utils.EnvString("SCEP_DSN", ""), "Data Source Name of MySQL")
-		flTicker            = flag.String("ticker", utils.EnvString("SCEP_TICKER", "24h"), "ticker duration")
+		flVersion            = flag.Bool("version", false, "prints version information")
+		flHTTPAddr           = flag.String("http-addr", utils.EnvString("SCEP_HTTP_ADDR", ""), "http listen address. defaults to \":8080\"")
+		flPort               = flag.String("port", utils.EnvString("SCEP_HTTP_LISTEN_PORT", "3000"), "http port to listen on (if you want to specify an address, use -http-addr instead)")
+		flDepotPath          = flag.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder")
+		flCAPass             = flag.String("capass", utils.EnvString("SCEP_CA_PASS", ""), "passwd for the ca.key")
+		flPKCS11Module       = flag.String("pkcs11-module", utils.EnvString("SCEP_PKCS11_MODULE", ""), "path of the PKCS#11 module of the token holding the CA key. the CA key is read from ca.key if empty")
+		flPKCS11Slot         = flag.Int("pkcs11-slot", utils.EnvInt("SCEP_PKCS11_SLOT", 0), "slot number of the PKCS#11 token")
+		flPKCS11PIN          = flag.String("pkcs11-pin", utils.EnvString("SCEP_PKCS11_PIN", ""), "user PIN of the PKCS#11 token")
+		flPKCS11KeyLabel     = flag.String("pkcs11-key-label", utils.EnvString("SCEP_PKCS11_KEY_LABEL", "scep-ca"), "label of the CA key in the PKCS#11 token")
+		flClDuration         = flag.String("crtvalid", utils.EnvString("SCEP_CERT_VALID", "365"), "validity for new client certificates in days")
+		flClAllowRenewal     = flag.String("allowrenew", utils.EnvString("SCEP_CERT_RENEW", "0"), "do not allow renewal until n days before expiry, set to 0 to always allow")
+		flChallengePassword  = flag.String("challenge", utils.EnvString("SCEP_CHALLENGE_PASSWORD", ""), "enforce a challenge password")
+		flChallengeMode      = flag.String("challenge-mode", utils.EnvString("SCEP_CHALLENGE_MODE", "secret"), "how challenges are verified: \"secret\" for uid\\secret of stored secrets, \"dynamic\" for one-time challenges from /admin/api/challenge")
+		flChallengeTTL       = flag.String("challenge-ttl", utils.EnvString("SCEP_CHALLENGE_TTL", "1h"), "validity of one-time challenges in dynamic challenge mode")
+		flChallengeJWTKey    = flag.String("challenge-jwt-key", utils.EnvString("SCEP_CHALLENGE_JWT_KEY", ""), "path to a public key or shared secret verifying signed (JWT) challenges")
+		flCSRVerifierExec    = flag.String("csrverifierexec", utils.EnvString("SCEP_CSR_VERIFIER_EXEC", ""), "will be passed the CSRs for verification")
+		flCSRVerifierURL     = flag.String("csrverifier-url", utils.EnvString("SCEP_CSR_VERIFIER_URL", ""), "URL of a policy service the enrollments are POSTed to for verification")
+		flCSRVerifierToken   = flag.String("csrverifier-token", utils.EnvString("SCEP_CSR_VERIFIER_TOKEN", ""), "bearer token sent to the policy service")
+		flCSRVerifierTimeout = flag.String("csrverifier-timeout", utils.EnvString("SCEP_CSR_VERIFIER_TIMEOUT", "10s"), "timeout of calls to the policy service")
+		flCSRPolicy          = flag.String("csr-policy", utils.EnvString("SCEP_CSR_POLICY", ""), "path to a JSON file of rules CSRs must satisfy")
+		flDebug              = flag.Bool("debug", utils.EnvBool("SCEP_LOG_DEBUG"), "enable debug logging")
+		flLogJSON            = flag.Bool("log-json", utils.EnvBool("SCEP_LOG_JSON"), "output JSON logs")
+		flSignServerAttrs    = flag.Bool("sign-server-attrs", utils.EnvBool("SCEP_SIGN_SERVER_ATTRS"), "sign cert attrs for server usage")
+		flProfiles           = flag.String("profiles", utils.EnvString("SCEP_CERT_PROFILES", ""), "path to a JSON file of certificate profiles")
+		flDefaultProfile     = flag.String("default-profile", utils.EnvString("SCEP_DEFAULT_PROFILE", ""), "certificate profile used when neither the secret nor the client selects one")
+		flSubjectPolicy      = flag.String("subject-policy", utils.EnvString("SCEP_SUBJECT_POLICY", ""), "path to a JSON file building or validating certificate subjects and SANs from client attributes")
+		flExternalURL        = flag.String("external-url", utils.EnvString("SCEP_EXTERNAL_URL", ""), "external URL of the server as seen by the clients, such as https://scep.example.com. enables enrollment invitations")
+		flInviteKey          = flag.String("invite-key", utils.EnvString("SCEP_INVITE_KEY", ""), "path to the key signing enrollment invitations. defaults to invite.key in the depot, created if missing")
+		flInviteURL          = flag.String("invite-url", utils.EnvString("SCEP_INVITE_URL", ""), "URL of the publish frontend invitations point to. defaults to /publish on the external URL")
+		flDepotDriver        = flag.String("depot-driver", utils.EnvString("SCEP_DEPOT_DRIVER", ""), "database the clients and certificates are stored in: \"mysql\", \"postgres\", \"sqlite\" or \"bolt\". defaults to postgres for postgres:// DSNs and to mysql otherwise")
+		flDSN                = flag.String("dsn", utils.EnvString("SCEP_DSN", ""), "Data Source Name of MySQL or PostgreSQL, or the path of the SQLite or Bolt database. these default to scep.sqlite and scep.db in the depot")
+		flSerialMode         = flag.String("serial-mode", utils.EnvString("SCEP_SERIAL_MODE", "sequential"), "how certificate serial numbers are allocated: \"sequential\" or \"random\" for 159-bit random numbers")
+		flTicker             = flag.String("ticker", utils.EnvString("SCEP_TICKER", "24h"), "ticker duration")
+		flArchiveRetention   = flag.String("archive-retention", utils.EnvString("SCEP_ARCHIVE_RETENTION", "2160h"), "how long archived clients are kept before they are purged")
+		flCAs                = flag.String("cas", utils.EnvString("SCEP_CAS", ""), "path to a JSON file of additional CAs served at /scep/{name} and /api/{name}")
 	)
 	flag.Usage = func() {
 		flag.PrintDefaults()
 
 		fmt.Println("usage: scep [<command>] [<args>]")
 		fmt.Println(" ca <args> create/manage a CA")
+		fmt.Println(" ca <info|export|backup|restore> <args> show, export, back up or restore a CA")
+		fmt.Println(" db <migrate|status|rollback> <args> manage the schema of the SQL depot")
 		fmt.Println("type <command> --help to see usage for each subcommand")
 	}
 	flag.Parse()
@@ -108,11 +149,34 @@ func main() {
 	lginfo := level.Info(logger)
 
 	var err error
-	depot, err := mysql.NewTableDepot(*flDSN, *flDepotPath)
+	var randomSerials bool
+	switch *flSerialMode {
+	case "sequential":
+	case "random":
+		randomSerials = true
+	default:
+		lginfo.Log("err", fmt.Sprintf("unknown serial mode %q", *flSerialMode))
+		os.Exit(1)
+	}
+	depot, err := openDepot(*flDepotDriver, *flDSN, *flDepotPath, randomSerials)
 	if err != nil {
 		lginfo.Log("err", err)
 		os.Exit(1)
 	}
+	var token *pkcs11.Token
+	if *flPKCS11Module != "" {
+		token, err = pkcs11.Open(pkcs11.Config{
+			Module: *flPKCS11Module,
+			Slot:   *flPKCS11Slot,
+			PIN:    *flPKCS11PIN,
+			Label:  *flPKCS11KeyLabel,
+		})
+		if err != nil {
+			lginfo.Log("err", err)
+			os.Exit(1)
+		}
+		defer token.Close()
+	}
 	allowRenewal, err := strconv.Atoi(*flClAllowRenewal)
 	if err != nil {
 		lginfo.Log("err", err, "msg", "No valid number for allowed renewal time")
@@ -132,67 +196,159 @@ func main() {
 		}
 		csrVerifier = executableCSRVerifier
 	}
+	var webhookVerifier csrverifier.CSRVerifier
+	if *flCSRVerifierURL != "" {
+		timeout, err := time.ParseDuration(*flCSRVerifierTimeout)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "No valid CSR verifier timeout")
+			os.Exit(1)
+		}
+		webhookVerifier, err = webhookcsrverifier.New(*flCSRVerifierURL,
+			webhookcsrverifier.WithHTTPClient(&http.Client{Timeout: timeout}),
+			webhookcsrverifier.WithBearerToken(*flCSRVerifierToken),
+			webhookcsrverifier.WithLogger(lginfo),
+		)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not instantiate CSR verifier")
+			os.Exit(1)
+		}
+	}
+	var policyVerifier csrverifier.CSRVerifier
+	if *flCSRPolicy != "" {
+		config, err := policycsrverifier.LoadConfig(*flCSRPolicy)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not load CSR policy")
+			os.Exit(1)
+		}
+		policyVerifier, err = policycsrverifier.New(config, depot)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not instantiate CSR policy verifier")
+			os.Exit(1)
+		}
+	}
+
+	// each verifier wraps the previous ones, so the policy runs first
+	var verifiers []csrverifier.CSRVerifier
+	for _, v := range []csrverifier.CSRVerifier{webhookVerifier, csrVerifier, policyVerifier} {
+		if v != nil {
+			verifiers = append(verifiers, v)
+		}
+	}
+
+	configs := map[string]caConfig{"": {
+		Depot:             *flDepotPath,
+		CAPass:            *flCAPass,
+		PKCS11KeyLabel:    *flPKCS11KeyLabel,
+		ValidityDays:      clientValidity,
+		AllowRenewalDays:  allowRenewal,
+		Profiles:          *flProfiles,
+		DefaultProfile:    *flDefaultProfile,
+		SubjectPolicy:     *flSubjectPolicy,
+		SignServerAttrs:   *flSignServerAttrs,
+		ChallengeMode:     *flChallengeMode,
+		ChallengeTTL:      *flChallengeTTL,
+		ChallengePassword: *flChallengePassword,
+		ChallengeJWTKey:   *flChallengeJWTKey,
+	}}
+	if *flCAs != "" {
+		named, err := loadCAConfigs(*flCAs)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not load CAs")
+			os.Exit(1)
+		}
+		for name, cfg := range named {
+			configs[name] = cfg
+		}
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var cas []scepserver.CA
+	for _, name := range names {
+		ca, err := newCA(name, configs[name], depot, token, verifiers, logger)
+		if err != nil {
+			lginfo.Log("err", err, "ca", name)
+			os.Exit(1)
+		}
+		cas = append(cas, ca)
+	}
+	if err := checkCASubjects(cas); err != nil {
+		lginfo.Log("err", err)
+		os.Exit(1)
+	}
 
 	duration, err := time.ParseDuration(*flTicker)
 	if err != nil {
 		lginfo.Log("err", err, "msg", "No valid ticker duration")
 		os.Exit(1)
 	}
+	archiveRetention, err := time.ParseDuration(*flArchiveRetention)
+	if err != nil {
+		lginfo.Log("err", err, "msg", "No valid archive retention duration")
+		os.Exit(1)
+	}
 	ticker := time.NewTicker(duration)
 	go func() {
 		for range ticker.C {
 			lginfo.Log("msg", "Checking certificates")
-			depot.CheckCertRevocation()
-			depot.CheckCertExpiration()
+			if err := depot.CheckCertRevocation(); err != nil {
+				lginfo.Log("msg", "failed to check the revocations of the certificates", "err", err)
+			}
+			if err := depot.CheckCertExpiration(); err != nil {
+				lginfo.Log("msg", "failed to check the expiration of the certificates", "err", err)
+			}
 
 			lginfo.Log("msg", "Checking secrets")
-			depot.CheckSecretExpiration()
+			if err := depot.CheckSecretExpiration(); err != nil {
+				lginfo.Log("msg", "failed to check the expiration of the secrets", "err", err)
+			}
+
+			lginfo.Log("msg", "Purging archived clients")
+			if err := depot.PurgeArchivedClients(archiveRetention); err != nil {
+				lginfo.Log("msg", "failed to purge the archived clients", "err", err)
+			}
+
+			lginfo.Log("msg", "Purging used challenge IDs")
+			if err := depot.PurgeUsedJTIs(); err != nil {
+				lginfo.Log("msg", "failed to purge the used challenge IDs", "err", err)
+			}
+			for _, ca := range cas {
+				if ca.Challenges != nil {
+					if err := ca.Challenges.PurgeExpiredChallenges(); err != nil {
+						lginfo.Log("msg", "failed to purge the expired challenges", "ca", ca.Name, "err", err)
+					}
+				}
+			}
 		}
 	}()
 
-	var svc scepserver.Service // scep service
-	{
-		crts, key, err := depot.CA([]byte(*flCAPass))
-		if err != nil {
-			lginfo.Log("err", err)
-			os.Exit(1)
+	// invitations are only enabled with an external URL, as the URLs they
+	// return must not be built from the headers of the request
+	var issuer *invite.Issuer
+	if *flExternalURL == "" && (*flInviteKey != "" || *flInviteURL != "") {
+		lginfo.Log("err", "-invite-key and -invite-url require -external-url", "msg", "Could not instantiate invitation issuer")
+		os.Exit(1)
+	}
+	if *flExternalURL != "" {
+		keyPath := *flInviteKey
+		if keyPath == "" {
+			keyPath = filepath.Join(*flDepotPath, "invite.key")
 		}
-		if len(crts) < 1 {
-			lginfo.Log("err", "missing CA certificate")
+		key, err := invite.LoadOrCreateKey(keyPath)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not load invitation key")
 			os.Exit(1)
 		}
-		signerOpts := []scepdepot.Option{
-			scepdepot.WithAllowRenewalDays(allowRenewal),
-			scepdepot.WithValidityDays(clientValidity),
-			scepdepot.WithCAPass(*flCAPass),
-		}
-		if *flSignServerAttrs {
-			signerOpts = append(signerOpts, scepdepot.WithSeverAttrs())
-		}
-
-		var signer scepserver.CSRSignerContext = scepserver.SignCSRAdapter(scepdepot.NewSigner(depot, signerOpts...))
-		signer = scepserver.MySQLChallengeMiddleWare(depot, signer)
-		if *flChallengePassword != "" {
-			signer = scepserver.StaticChallengeMiddleware(*flChallengePassword, signer)
-		}
-		if csrVerifier != nil {
-			signer = csrverifier.Middleware(csrVerifier, signer)
-		}
-		svc, err = scepserver.NewService(crts[0], key, signer, scepserver.WithLogger(logger))
+		issuer, err = invite.NewIssuer(key, *flExternalURL, *flInviteURL)
 		if err != nil {
-			lginfo.Log("err", err)
+			lginfo.Log("err", err, "msg", "Could not instantiate invitation issuer")
 			os.Exit(1)
 		}
-		svc = scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service"), svc)
 	}
 
-	var h http.Handler // http handler
-	{
-		e := scepserver.MakeServerEndpoints(svc, *flDepotPath)
-		e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
-		e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
-		h = scepserver.MakeHTTPHandler(depot, e, svc, log.With(lginfo, "component", "http"))
-	}
+	h := scepserver.MakeMultiCAHandler(depot, cas, issuer, log.With(lginfo, "component", "http"))
 
 	// start http server
 	errs := make(chan error, 2)
@@ -209,7 +365,256 @@ func main() {
 	lginfo.Log("terminated", <-errs)
 }
 
+// openDepot opens the store of the driver. dsn is the Data Source Name of
+// MySQL or PostgreSQL, or the path of the SQLite or Bolt database.
+// Without a driver, it is selected by the scheme of dsn.
+func openDepot(driver, dsn, depotPath string, randomSerials bool) (scepdepot.Store, error) {
+	var opts []sqldepot.Option
+	boltOpts := []boltdepot.Option{boltdepot.WithCADir(depotPath)}
+	if randomSerials {
+		opts = append(opts, sqldepot.WithRandomSerials())
+		boltOpts = append(boltOpts, boltdepot.WithRandomSerials())
+	}
+	switch depotDriver(driver, dsn) {
+	case "mysql":
+		return mysql.NewTableDepot(dsn, depotPath, opts...)
+	case "postgres":
+		return postgres.NewDepot(dsn, depotPath, opts...)
+	case "sqlite":
+		if dsn == "" {
+			dsn = filepath.Join(depotPath, "scep.sqlite")
+		}
+		return sqlite.NewDepot(dsn, depotPath, opts...)
+	case "bolt":
+		if dsn == "" {
+			dsn = filepath.Join(depotPath, "scep.db")
+		}
+		db, err := bolt.Open(dsn, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, err
+		}
+		return boltdepot.NewBoltDepot(db, boltOpts...)
+	default:
+		return nil, fmt.Errorf("unknown depot driver %q", driver)
+	}
+}
+
+// openDepotReadOnly opens the depot like openDepot for the commands that
+// only read it. The schema of an SQL database is not migrated, and a Bolt
+// database is opened read-only, which fails with bolt.ErrTimeout while a
+// server holds it open.
+func openDepotReadOnly(driver, dsn, depotPath string, randomSerials bool) (scepdepot.Store, error) {
+	var opts []sqldepot.Option
+	boltOpts := []boltdepot.Option{boltdepot.WithCADir(depotPath)}
+	if randomSerials {
+		opts = append(opts, sqldepot.WithRandomSerials())
+		boltOpts = append(boltOpts, boltdepot.WithRandomSerials())
+	}
+	switch depotDriver(driver, dsn) {
+	case "mysql":
+		return mysql.OpenDepot(dsn, depotPath, opts...)
+	case "postgres":
+		return postgres.OpenDepot(dsn, depotPath, opts...)
+	case "sqlite":
+		if dsn == "" {
+			dsn = filepath.Join(depotPath, "scep.sqlite")
+		}
+		// opening a database file that does not exist would create it
+		if _, err := os.Stat(dsn); err != nil {
+			return nil, err
+		}
+		return sqlite.OpenDepot(dsn, depotPath, opts...)
+	case "bolt":
+		if dsn == "" {
+			dsn = filepath.Join(depotPath, "scep.db")
+		}
+		if _, err := os.Stat(dsn); err != nil {
+			return nil, err
+		}
+		db, err := bolt.Open(dsn, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		return boltdepot.NewBoltDepot(db, boltOpts...)
+	default:
+		return nil, fmt.Errorf("unknown depot driver %q", driver)
+	}
+}
+
+// depotDriver returns driver, or the driver selected by the scheme of dsn
+// if it is empty.
+func depotDriver(driver, dsn string) string {
+	if driver != "" {
+		return driver
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres"
+	}
+	return "mysql"
+}
+
+// openMigrator opens the SQL database of the driver and returns the
+// Migrator of its schema.
+func openMigrator(driver, dsn, depotPath string) (*sqldepot.Migrator, *sql.DB, error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	switch driver = depotDriver(driver, dsn); driver {
+	case "mysql":
+		db, err = mysql.Open(dsn)
+	case "postgres":
+		db, err = postgres.Open(dsn)
+	case "sqlite":
+		if dsn == "" {
+			dsn = filepath.Join(depotPath, "scep.sqlite")
+		}
+		db, err = sqlite.Open(dsn)
+	case "bolt":
+		return nil, nil, errors.New("the bolt depot has no schema migrations")
+	default:
+		return nil, nil, fmt.Errorf("unknown depot driver %q", driver)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := newMigrator(driver, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return m, db, nil
+}
+
+// newMigrator returns the Migrator of the schema of db, a database of the
+// SQL driver.
+func newMigrator(driver string, db *sql.DB) (*sqldepot.Migrator, error) {
+	switch driver {
+	case "mysql":
+		return mysql.NewMigrator(db)
+	case "postgres":
+		return postgres.NewMigrator(db)
+	case "sqlite":
+		return sqlite.NewMigrator(db)
+	default:
+		return nil, fmt.Errorf("the %s depot has no schema migrations", driver)
+	}
+}
+
+// openCurrentDepot opens the SQL depot of the driver without migrating it,
+// like openDepotReadOnly, and fails if its schema is not of the latest
+// version.
+func openCurrentDepot(driver, dsn, depotPath string) (*sqldepot.Depot, error) {
+	driver = depotDriver(driver, dsn)
+	if driver == "bolt" {
+		return nil, errors.New("the bolt depot has no schema migrations")
+	}
+	depot, err := openDepotReadOnly(driver, dsn, depotPath, false)
+	if err != nil {
+		return nil, err
+	}
+	d := depot.(*sqldepot.Depot)
+	m, err := newMigrator(driver, d.DB())
+	if err == nil {
+		err = m.CheckCurrent()
+	}
+	if err != nil {
+		d.DB().Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func dbMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath   = cmd.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder")
+		flDepotDriver = cmd.String("depot-driver", utils.EnvString("SCEP_DEPOT_DRIVER", ""), "database whose schema is managed: \"mysql\", \"postgres\" or \"sqlite\"")
+		flDSN         = cmd.String("dsn", utils.EnvString("SCEP_DSN", ""), "Data Source Name of MySQL or PostgreSQL, or the path of the SQLite database")
+		flSteps       = cmd.Int("steps", 1, "number of migrations to roll back")
+		flForce       = cmd.Bool("force", false, "allow rollback to roll back the first migration, which drops all the tables")
+	)
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "usage: scepserver db <migrate|status|rollback> [<args>]")
+		cmd.PrintDefaults()
+	}
+	if len(os.Args) < 3 {
+		cmd.Usage()
+		return 2
+	}
+	action := os.Args[2]
+	cmd.Parse(os.Args[3:])
+
+	m, db, err := openMigrator(*flDepotDriver, *flDSN, *flDepotPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	switch action {
+	case "migrate":
+		err = m.Migrate()
+	case "rollback":
+		err = rollback(m, *flSteps, *flForce)
+	case "status":
+		var versioned bool
+		if versioned, err = m.Versioned(); err != nil {
+			break
+		}
+		if !versioned {
+			fmt.Println("unversioned: db migrate versions the schema")
+		}
+		var status []sqldepot.MigrationStatus
+		if status, err = m.Status(); err != nil {
+			break
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+		err = m.Check()
+	default:
+		cmd.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// rollback prints the migrations that the rollback of steps migrations
+// rolls back and rolls them back. The first migration, which drops the
+// tables and their rows, is only rolled back if force is set.
+func rollback(m *sqldepot.Migrator, steps int, force bool) error {
+	if steps < 1 {
+		return fmt.Errorf("invalid -steps %d", steps)
+	}
+	plan, err := m.RollbackPlan(steps)
+	if err != nil {
+		return err
+	}
+	for _, migration := range plan {
+		if migration.Version == 1 && !force {
+			return fmt.Errorf("rolling back migration %04d_%s drops all the tables and their data, use -force to do it", migration.Version, migration.Name)
+		}
+	}
+	for _, migration := range plan {
+		fmt.Printf("rolling back %04d_%s\n", migration.Version, migration.Name)
+	}
+	return m.Rollback(steps)
+}
+
 func caMain(cmd *flag.FlagSet) int {
+	if len(os.Args) >= 3 {
+		if sub, ok := caSubcommands[os.Args[2]]; ok {
+			return sub(os.Args[3:])
+		}
+	}
 	var (
 		flDepotPath  = cmd.String("depot", utils.EnvString("SCEP_FILE_DEPOT", "ca-certs"), "path to ca folder")
 		flInit       = cmd.Bool("init", false, "create a new CA")
@@ -219,12 +624,85 @@ func caMain(cmd *flag.FlagSet) int {
 		flOrg        = cmd.String("organization", utils.EnvString("SCEPCA_ORG", "Procube"), "organization for CA cert")
 		flOrgUnit    = cmd.String("organizational_unit", utils.EnvString("SCEPCA_ORG_UNIT", ""), "organizational unit (OU) for CA cert")
 		flPassword   = cmd.String("key-password", "", "password to store rsa key")
+		flKDF        = cmd.String("key-kdf", utils.EnvString("SCEPCA_KEY_KDF", scepdepot.KDFScrypt), "key derivation function encrypting ca.key: \"scrypt\" or \"pbkdf2\"")
+		flRekey      = cmd.Bool("rekey-storage", false, "re-encrypt ca.key, decrypted with -key-password, with -new-key-password")
+		flNewPass    = cmd.String("new-key-password", "", "password -rekey-storage encrypts ca.key with. ca.key is stored unencrypted if empty")
+		flImportKey  = cmd.String("import-key", "", "path of a PEM, DER or PKCS#12 RSA key to store as ca.key instead of generating one")
+		flImportPass = cmd.String("import-key-password", "", "password of the key to import")
 		flCountry    = cmd.String("country", utils.EnvString("SCEPCA_COUNTRY", "JP"), "country for CA cert")
+		flCSR        = cmd.Bool("csr", false, "create the key of a subordinate CA and a certificate request ca.csr for the parent CA")
+		flImportCert = cmd.String("import-cert", "", "path of the subordinate CA certificate issued for ca.csr, optionally followed by its chain, to store as ca.crt")
+		flChain      = cmd.String("chain", "", "path of the certificates of the parent CAs of -import-cert, ending with the root CA")
+		flModule     = cmd.String("pkcs11-module", utils.EnvString("SCEP_PKCS11_MODULE", ""), "path of the PKCS#11 module of the token to generate the CA key in. the key is written to ca.key if empty")
+		flSlot       = cmd.Int("pkcs11-slot", utils.EnvInt("SCEP_PKCS11_SLOT", 0), "slot number of the PKCS#11 token")
+		flPIN        = cmd.String("pkcs11-pin", utils.EnvString("SCEP_PKCS11_PIN", ""), "user PIN of the PKCS#11 token")
+		flKeyLabel   = cmd.String("pkcs11-key-label", utils.EnvString("SCEP_PKCS11_KEY_LABEL", "scep-ca"), "label of the CA key in the PKCS#11 token")
 	)
 	cmd.Parse(os.Args[2:])
-	if *flInit {
+	if *flRekey {
+		if err := rekeyStorage(*flDepotPath, []byte(*flPassword), []byte(*flNewPass), *flKDF); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	var token *pkcs11.Token
+	if *flModule != "" && (*flInit || *flCSR || *flImportCert != "") {
+		var err error
+		token, err = pkcs11.Open(pkcs11.Config{
+			Module: *flModule,
+			Slot:   *flSlot,
+			PIN:    *flPIN,
+			Label:  *flKeyLabel,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer token.Close()
+	}
+	// the key of a new CA is generated in the token, imported or generated
+	// into ca.key
+	newKey := func() (crypto.Signer, error) {
+		if token != nil {
+			return token.GenerateKey(*flKeySize)
+		}
+		if *flImportKey != "" {
+			return importKey(*flImportKey, []byte(*flImportPass), []byte(*flPassword), *flKDF, *flDepotPath)
+		}
+		return createKey(*flKeySize, []byte(*flPassword), *flKDF, *flDepotPath)
+	}
+
+	switch {
+	case *flImportCert != "":
+		var key crypto.Signer
+		var err error
+		if token != nil {
+			key, err = token.Key()
+		} else {
+			key, err = loadKey(*flDepotPath, []byte(*flPassword))
+		}
+		if err == nil {
+			err = importCertificate(key, *flImportCert, *flChain, *flDepotPath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case *flCSR:
+		key, err := newKey()
+		if err == nil {
+			err = createCertificateRequest(key, *flCommonName, *flOrg, *flOrgUnit, *flCountry, *flDepotPath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Have the CA certificate request", filepath.Join(*flDepotPath, "ca.csr"), "signed by the parent CA and import it with -import-cert")
+	case *flInit:
 		fmt.Println("Initializing new CA")
-		key, err := createKey(*flKeySize, []byte(*flPassword), *flDepotPath)
+		key, err := newKey()
 		if err != nil {
 			fmt.Println(err)
 			return 0
@@ -233,80 +711,189 @@ func caMain(cmd *flag.FlagSet) int {
 			fmt.Println(err)
 			return 0
 		}
+	case *flImportKey != "":
+		if _, err := importKey(*flImportKey, []byte(*flImportPass), []byte(*flPassword), *flKDF, *flDepotPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
 	}
 
 	return 0
 }
 
 // create a key, save it to depot and return it for further usage.
-func createKey(bits int, password []byte, depot string) (*rsa.PrivateKey, error) {
-	// create depot folder if missing
-	if err := os.MkdirAll(depot, 0755); err != nil {
+func createKey(bits int, password []byte, kdf string, depot string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
 		return nil, err
 	}
-	name := filepath.Join(depot, "ca.key")
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
-	if err != nil {
+	if err := writeKey(key, password, kdf, depot); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return key, nil
+}
 
-	// create RSA key and save as PEM file
-	key, err := rsa.GenerateKey(rand.Reader, bits)
+// import the key at path, save it to depot and return it for further usage.
+func importKey(path string, importPassword, password []byte, kdf string, depot string) (scepdepot.CAKey, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	privPEMBlock, err := x509.EncryptPEMBlock(
-		rand.Reader,
-		rsaPrivateKeyPEMBlockType,
-		x509.MarshalPKCS1PrivateKey(key),
-		password,
-		x509.PEMCipher3DES,
-	)
+	key, err := scepdepot.ParseCAKey(data, importPassword)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("import %s: %w", path, err)
 	}
-	if err := pem.Encode(file, privPEMBlock); err != nil {
-		os.Remove(name)
+	if err := writeKey(key, password, kdf, depot); err != nil {
 		return nil, err
 	}
-
 	return key, nil
 }
 
-func createCertificateAuthority(key *rsa.PrivateKey, years int, commonName string, organization string, organizationalUnit string, country string, depot string) error {
-	cert := scepdepot.NewCACert(
-		scepdepot.WithYears(years),
+// writeKey saves key to ca.key in depot as PKCS#8, encrypted with password
+// if it is not empty. An existing ca.key is never overwritten.
+func writeKey(key crypto.Signer, password []byte, kdf string, depot string) error {
+	keyPEM, err := scepdepot.EncodeKey(key, password, kdf)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(filepath.Join(depot, "ca.key"), keyPEM, 0400)
+}
+
+// rekeyStorage re-encrypts ca.key in depot with newPassword. The new
+// ca.key replaces the old one only once it has been written completely.
+func rekeyStorage(depot string, password, newPassword []byte, kdf string) error {
+	name := filepath.Join(depot, "ca.key")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	key, err := scepdepot.ParseKey(data, password)
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", name, err)
+	}
+	keyPEM, err := scepdepot.EncodeKey(key, newPassword, kdf)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".new"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(keyPEM); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// loadKey reads ca.key in depot.
+func loadKey(depot string, password []byte) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Join(depot, "ca.key"))
+	if err != nil {
+		return nil, err
+	}
+	return scepdepot.ParseCAKey(data, password)
+}
+
+// createCertificateRequest saves a certificate request of a subordinate CA
+// with key to ca.csr in depot.
+func createCertificateRequest(key crypto.Signer, commonName string, organization string, organizationalUnit string, country string, depot string) error {
+	csr := scepdepot.NewCACert(
 		scepdepot.WithCommonName(commonName),
 		scepdepot.WithOrganization(organization),
 		scepdepot.WithOrganizationalUnit(organizationalUnit),
 		scepdepot.WithCountry(country),
 	)
-	crtBytes, err := cert.SelfSign(rand.Reader, &key.PublicKey, key)
+	csrBytes, err := csr.CSR(rand.Reader, key)
 	if err != nil {
 		return err
 	}
+	return writeNewFile(filepath.Join(depot, "ca.csr"), pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csrBytes,
+	}), 0444)
+}
 
-	name := filepath.Join(depot, "ca.crt")
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+// importCertificate checks the subordinate CA certificate in path against
+// key and the chain of its issuers, which follows it in path or is in
+// chainPath, and saves the certificate and the chain to ca.crt in depot.
+func importCertificate(key crypto.Signer, path, chainPath string, depot string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	certs, err := scepdepot.ParseCerts(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if chainPath != "" {
+		data, err := os.ReadFile(chainPath)
+		if err != nil {
+			return err
+		}
+		chain, err := scepdepot.ParseCerts(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", chainPath, err)
+		}
+		certs = append(certs, chain...)
+	}
+	chain, err := scepdepot.CAChain(key.Public(), certs[0], certs[1:])
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var chainPEM []byte
+	for _, c := range chain {
+		chainPEM = append(chainPEM, pemCert(c.Raw)...)
+	}
+	return writeNewFile(filepath.Join(depot, "ca.crt"), chainPEM, 0400)
+}
 
-	if _, err := file.Write(pemCert(crtBytes)); err != nil {
+// writeNewFile writes data to the file name, which must not exist.
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	// create depot folder if missing
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
 		file.Close()
 		os.Remove(name)
 		return err
 	}
+	return file.Close()
+}
+
+func createCertificateAuthority(key crypto.Signer, years int, commonName string, organization string, organizationalUnit string, country string, depot string) error {
+	cert := scepdepot.NewCACert(
+		scepdepot.WithYears(years),
+		scepdepot.WithCommonName(commonName),
+		scepdepot.WithOrganization(organization),
+		scepdepot.WithOrganizationalUnit(organizationalUnit),
+		scepdepot.WithCountry(country),
+	)
+	crtBytes, err := cert.SelfSign(rand.Reader, key.Public(), key)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return writeNewFile(filepath.Join(depot, "ca.crt"), pemCert(crtBytes), 0400)
 }
 
-const (
-	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
-	certificatePEMBlockType   = "CERTIFICATE"
-)
+const certificatePEMBlockType = "CERTIFICATE"
 
 func pemCert(derBytes []byte) []byte {
 	pemBlock := &pem.Block{
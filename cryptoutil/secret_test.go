@@ -0,0 +1,54 @@
+package cryptoutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashSecret(t *testing.T) {
+	hash, err := HashSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHashedSecret(hash) || strings.Contains(hash, "s3cret") {
+		t.Fatalf("unexpected hash %q", hash)
+	}
+	other, err := HashSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == other {
+		t.Error("hashes of the same secret are not salted")
+	}
+
+	for _, test := range []struct {
+		hash   string
+		secret string
+		want   bool
+	}{
+		{hash, "s3cret", true},
+		{other, "s3cret", true},
+		{hash, "s3cret ", false},
+		{hash, "", false},
+		{"s3cret", "s3cret", false},
+		{"$argon2id$v=19$m=19456,t=2,p=1$AAAA$", "s3cret", false},
+	} {
+		if have := CompareSecret(test.hash, test.secret); have != test.want {
+			t.Errorf("CompareSecret(%q, %q) = %v, want %v", test.hash, test.secret, have, test.want)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 43 || a == b || strings.ContainsAny(a, `\+/=`) {
+		t.Errorf("unexpected secrets %q, %q", a, b)
+	}
+}
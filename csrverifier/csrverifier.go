@@ -6,19 +6,62 @@ import (
 	"crypto/x509"
 	"errors"
 
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/scep"
 	scepserver "github.com/procube-open/scep/server"
 )
 
-// CSRVerifier verifies the raw decrypted CSR.
+// Request is the enrollment request passed to a CSRVerifier.
+type Request struct {
+	// CSR is the raw decrypted DER encoded CSR.
+	CSR []byte
+
+	// MessageType is PKCSReq for an initial enrollment, or RenewalReq
+	// or UpdateReq for a renewal.
+	MessageType scep.MessageType
+
+	// Enrollment identifies the client authorized by the challenge
+	// middleware. It is nil when no middleware identified the client.
+	// A verifier may change its Profile and Attributes to modify the
+	// certificate to be issued.
+	Enrollment *scepdepot.Enrollment
+}
+
+// MessageTypeName returns the name of the message type of r,
+// e.g. "PKCSReq", or an empty string if it is unknown.
+func (r *Request) MessageTypeName() string {
+	switch r.MessageType {
+	case scep.PKCSReq:
+		return "PKCSReq"
+	case scep.RenewalReq:
+		return "RenewalReq"
+	case scep.UpdateReq:
+		return "UpdateReq"
+	default:
+		return ""
+	}
+}
+
+// CSRVerifier verifies an enrollment request.
+// A verifier denies the request by returning false, or an error describing
+// the reason.
 type CSRVerifier interface {
-	Verify(data []byte) (bool, error)
+	Verify(ctx context.Context, req *Request) (bool, error)
 }
 
-// Middleware wraps next in a CSRSigner that runs verifier
+// Middleware wraps next in a CSRSigner that runs verifier.
+// It must be wrapped by the challenge middleware, so that the Enrollment
+// of the request is known to the verifier.
 func Middleware(verifier CSRVerifier, next scepserver.CSRSignerContext) scepserver.CSRSignerContextFunc {
 	return func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
-		ok, err := verifier.Verify(m.RawDecrypted)
+		req := &Request{
+			CSR:         m.RawDecrypted,
+			MessageType: m.MessageType,
+		}
+		if e, ok := scepdepot.FromContext(ctx); ok {
+			req.Enrollment = e
+		}
+		ok, err := verifier.Verify(ctx, req)
 		if err != nil {
 			return nil, err
 		}
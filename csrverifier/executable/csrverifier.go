@@ -2,11 +2,14 @@
 package executablecsrverifier
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"os"
 	"os/exec"
 
 	"github.com/go-kit/kit/log"
+	"github.com/procube-open/scep/csrverifier"
 )
 
 const (
@@ -36,7 +39,9 @@ func New(path string, logger log.Logger) (*ExecutableCSRVerifier, error) {
 }
 
 // ExecutableCSRVerifier implements a csrverifier.CSRVerifier.
-// It executes a command, and passes it the raw decrypted CSR.
+// It executes a command, and passes it the raw decrypted CSR on stdin and
+// the message type and client in the MESSAGE_TYPE, UID, STATUS, PROFILE and
+// ATTRIBUTES (JSON) environment variables.
 // If the command exit code is 0, the CSR is considered valid.
 // In any other cases, the CSR is considered invalid.
 type ExecutableCSRVerifier struct {
@@ -44,8 +49,21 @@ type ExecutableCSRVerifier struct {
 	logger     log.Logger
 }
 
-func (v *ExecutableCSRVerifier) Verify(data []byte) (bool, error) {
-	cmd := exec.Command(v.executable)
+func (v *ExecutableCSRVerifier) Verify(ctx context.Context, req *csrverifier.Request) (bool, error) {
+	cmd := exec.CommandContext(ctx, v.executable)
+	cmd.Env = append(os.Environ(), "MESSAGE_TYPE="+req.MessageTypeName())
+	if e := req.Enrollment; e != nil {
+		attributes, err := json.Marshal(e.Attributes)
+		if err != nil {
+			return false, err
+		}
+		cmd.Env = append(cmd.Env,
+			"UID="+e.UID,
+			"STATUS="+e.Status,
+			"PROFILE="+e.Profile,
+			"ATTRIBUTES="+string(attributes),
+		)
+	}
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -54,7 +72,7 @@ func (v *ExecutableCSRVerifier) Verify(data []byte) (bool, error) {
 
 	go func() {
 		defer stdin.Close()
-		stdin.Write(data)
+		stdin.Write(req.CSR)
 	}()
 
 	err = cmd.Run()
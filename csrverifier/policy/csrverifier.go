@@ -0,0 +1,238 @@
+// Package policycsrverifier defines the PolicyCSRVerifier csrverifier.CSRVerifier.
+package policycsrverifier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/procube-open/scep/csrverifier"
+	"github.com/procube-open/scep/scep"
+)
+
+// Config declares the rules a CSR must satisfy.
+// Zero values disable the corresponding rule.
+type Config struct {
+	// MinRSABits is the minimum modulus size of RSA keys.
+	MinRSABits int `json:"min_rsa_bits"`
+
+	// AllowedCurves lists the ECDSA curves by name, e.g. "P-256".
+	// ECDSA keys are rejected on any other curve.
+	AllowedCurves []string `json:"allowed_curves"`
+
+	// BannedSignatureAlgorithms lists CSR signature algorithms by their
+	// crypto/x509 name, e.g. "SHA1-RSA" or "ECDSA-SHA1".
+	BannedSignatureAlgorithms []string `json:"banned_signature_algorithms"`
+
+	// MaxSANs is the maximum number of SANs of all types together.
+	MaxSANs int `json:"max_sans"`
+
+	// RequiredSubjectFields and ForbiddenSubjectFields list subject
+	// attributes by their short name: CN, O, OU, C, ST, L, STREET,
+	// POSTALCODE and SERIALNUMBER.
+	RequiredSubjectFields  []string `json:"required_subject_fields"`
+	ForbiddenSubjectFields []string `json:"forbidden_subject_fields"`
+
+	// ForbidKeyReuse rejects public keys already certified for another client.
+	ForbidKeyReuse bool `json:"forbid_key_reuse"`
+}
+
+// DefaultConfig returns the rules used for the fields missing from a
+// configuration file.
+func DefaultConfig() *Config {
+	return &Config{
+		MinRSABits:                2048,
+		AllowedCurves:             []string{"P-256", "P-384", "P-521"},
+		BannedSignatureAlgorithms: []string{"MD5-RSA", "SHA1-RSA", "DSA-SHA1", "ECDSA-SHA1"},
+	}
+}
+
+// LoadConfig reads a Config from the JSON file at path over DefaultConfig.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parsing CSR policy: %w", err)
+	}
+	return config, nil
+}
+
+// KeyStore finds the clients a public key has been certified for.
+// It is satisfied by every depot.Store.
+type KeyStore interface {
+	GetCNsByPublicKey(rawSubjectPublicKeyInfo []byte) ([]string, error)
+}
+
+var subjectFields = map[string]func(pkix.Name) bool{
+	"CN":           func(n pkix.Name) bool { return n.CommonName != "" },
+	"O":            func(n pkix.Name) bool { return len(n.Organization) > 0 },
+	"OU":           func(n pkix.Name) bool { return len(n.OrganizationalUnit) > 0 },
+	"C":            func(n pkix.Name) bool { return len(n.Country) > 0 },
+	"ST":           func(n pkix.Name) bool { return len(n.Province) > 0 },
+	"L":            func(n pkix.Name) bool { return len(n.Locality) > 0 },
+	"STREET":       func(n pkix.Name) bool { return len(n.StreetAddress) > 0 },
+	"POSTALCODE":   func(n pkix.Name) bool { return len(n.PostalCode) > 0 },
+	"SERIALNUMBER": func(n pkix.Name) bool { return n.SerialNumber != "" },
+}
+
+var signatureAlgorithms = func() map[string]x509.SignatureAlgorithm {
+	algs := make(map[string]x509.SignatureAlgorithm)
+	for alg := x509.MD5WithRSA; alg <= x509.PureEd25519; alg++ {
+		algs[alg.String()] = alg
+	}
+	return algs
+}()
+
+// New creates a policycsrverifier.PolicyCSRVerifier.
+// store is only used, and then required, when config.ForbidKeyReuse is set.
+func New(config *Config, store KeyStore) (*PolicyCSRVerifier, error) {
+	for _, name := range append(config.RequiredSubjectFields, config.ForbiddenSubjectFields...) {
+		if _, ok := subjectFields[name]; !ok {
+			return nil, fmt.Errorf("unknown subject field %q", name)
+		}
+	}
+	banned := make(map[x509.SignatureAlgorithm]bool)
+	for _, name := range config.BannedSignatureAlgorithms {
+		alg, ok := signatureAlgorithms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown signature algorithm %q", name)
+		}
+		banned[alg] = true
+	}
+	if config.ForbidKeyReuse && store == nil {
+		return nil, fmt.Errorf("forbid_key_reuse requires a key store")
+	}
+	return &PolicyCSRVerifier{config: config, banned: banned, store: store}, nil
+}
+
+// PolicyCSRVerifier implements a csrverifier.CSRVerifier.
+// It checks the CSR against a declarative Config and reports every broken
+// rule as a Violation.
+type PolicyCSRVerifier struct {
+	config *Config
+	banned map[x509.SignatureAlgorithm]bool
+	store  KeyStore
+}
+
+// Violation is a rule broken by a CSR.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Violations is the error returned for a CSR breaking one or more rules.
+type Violations []Violation
+
+func (v Violations) Error() string {
+	msgs := make([]string, len(v))
+	for i, violation := range v {
+		msgs[i] = violation.Message
+	}
+	return "CSR violates policy: " + strings.Join(msgs, "; ")
+}
+
+// FailInfo returns badAlg when only key and algorithm rules are broken,
+// and badRequest otherwise.
+func (v Violations) FailInfo() scep.FailInfo {
+	for _, violation := range v {
+		switch violation.Rule {
+		case "min_rsa_bits", "allowed_curves", "banned_signature_algorithms":
+		default:
+			return scep.BadRequest
+		}
+	}
+	return scep.BadAlg
+}
+
+// Verify parses the CSR of req and checks it against the policy.
+// A CSR breaking rules is reported with a Violations error.
+func (v *PolicyCSRVerifier) Verify(_ context.Context, req *csrverifier.Request) (bool, error) {
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return false, err
+	}
+	// the client is identified by the uid of the challenge when known,
+	// as the CN of the CSR may be left empty
+	owner := csr.Subject.CommonName
+	if req.Enrollment != nil {
+		owner = req.Enrollment.UID
+	}
+	violations, err := v.check(csr, owner)
+	if err != nil {
+		return false, err
+	}
+	if len(violations) > 0 {
+		return false, violations
+	}
+	return true, nil
+}
+
+func (v *PolicyCSRVerifier) check(csr *x509.CertificateRequest, owner string) (Violations, error) {
+	var violations Violations
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := pub.N.BitLen(); bits < v.config.MinRSABits {
+			violate("min_rsa_bits", "RSA key of %d bits is shorter than %d bits", bits, v.config.MinRSABits)
+		}
+	case *ecdsa.PublicKey:
+		if curve := pub.Curve.Params().Name; len(v.config.AllowedCurves) > 0 && !contains(v.config.AllowedCurves, curve) {
+			violate("allowed_curves", "ECDSA curve %s is not allowed", curve)
+		}
+	}
+
+	if v.banned[csr.SignatureAlgorithm] {
+		violate("banned_signature_algorithms", "signature algorithm %s is not allowed", csr.SignatureAlgorithm)
+	}
+
+	sans := len(csr.DNSNames) + len(csr.EmailAddresses) + len(csr.IPAddresses) + len(csr.URIs)
+	if v.config.MaxSANs > 0 && sans > v.config.MaxSANs {
+		violate("max_sans", "%d SANs exceed the maximum of %d", sans, v.config.MaxSANs)
+	}
+
+	for _, name := range v.config.RequiredSubjectFields {
+		if !subjectFields[name](csr.Subject) {
+			violate("required_subject_fields", "subject field %s is required", name)
+		}
+	}
+	for _, name := range v.config.ForbiddenSubjectFields {
+		if subjectFields[name](csr.Subject) {
+			violate("forbidden_subject_fields", "subject field %s is not allowed", name)
+		}
+	}
+
+	if v.config.ForbidKeyReuse {
+		cns, err := v.store.GetCNsByPublicKey(csr.RawSubjectPublicKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		for _, cn := range cns {
+			if cn != owner {
+				violate("forbid_key_reuse", "public key is already certified for another client")
+				break
+			}
+		}
+	}
+	return violations, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package policycsrverifier
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+
+	"github.com/procube-open/scep/csrverifier"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+)
+
+type keyStore map[string][]string
+
+func (s keyStore) GetCNsByPublicKey(raw []byte) ([]string, error) {
+	return s[string(raw)], nil
+}
+
+func newCSR(t *testing.T, key crypto.Signer, tmpl *x509.CertificateRequest) []byte {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func verify(v *PolicyCSRVerifier, der []byte) (bool, error) {
+	return v.Verify(context.Background(), &csrverifier.Request{CSR: der})
+}
+
+func rules(t *testing.T, err error) []string {
+	t.Helper()
+	var violations Violations
+	if !errors.As(err, &violations) {
+		t.Fatalf("have error %v, want Violations", err)
+	}
+	var rules []string
+	for _, v := range violations {
+		rules = append(rules, v.Rule)
+	}
+	return rules
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.MaxSANs = 1
+	config.RequiredSubjectFields = []string{"CN"}
+	config.ForbiddenSubjectFields = []string{"OU"}
+	v, err := New(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := verify(v, newCSR(t, goodKey, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "alice"},
+		DNSNames: []string{"alice.example.com"},
+	}))
+	if !ok || err != nil {
+		t.Fatalf("have %v, %v for a valid CSR", ok, err)
+	}
+
+	_, err = verify(v, newCSR(t, rsaKey, &x509.CertificateRequest{
+		Subject:            pkix.Name{CommonName: "alice"},
+		SignatureAlgorithm: x509.SHA1WithRSA,
+	}))
+	if have := rules(t, err); len(have) != 2 || have[0] != "min_rsa_bits" || have[1] != "banned_signature_algorithms" {
+		t.Errorf("have violations %v", have)
+	}
+	if info := err.(Violations).FailInfo(); info != scep.BadAlg {
+		t.Errorf("have failInfo %v, want %v", info, scep.BadAlg)
+	}
+
+	_, err = verify(v, newCSR(t, ecKey, &x509.CertificateRequest{
+		Subject:  pkix.Name{OrganizationalUnit: []string{"sales"}},
+		DNSNames: []string{"a.example.com", "b.example.com"},
+	}))
+	have := rules(t, err)
+	want := []string{"allowed_curves", "max_sans", "required_subject_fields", "forbidden_subject_fields"}
+	if len(have) != len(want) {
+		t.Fatalf("have violations %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("have violations %v, want %v", have, want)
+		}
+	}
+	if info := err.(Violations).FailInfo(); info != scep.BadRequest {
+		t.Errorf("have failInfo %v, want %v", info, scep.BadRequest)
+	}
+}
+
+func TestVerifyKeyReuse(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := newCSR(t, key, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "alice"}})
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.ForbidKeyReuse = true
+	if _, err := New(config, nil); err == nil {
+		t.Fatal("expected an error without a key store")
+	}
+
+	store := keyStore{string(csr.RawSubjectPublicKeyInfo): {"alice"}}
+	v, err := New(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verify(v, der); !ok || err != nil {
+		t.Errorf("renewal with the same key: have %v, %v", ok, err)
+	}
+
+	store[string(csr.RawSubjectPublicKeyInfo)] = []string{"bob"}
+	_, err = verify(v, der)
+	if have := rules(t, err); len(have) != 1 || have[0] != "forbid_key_reuse" {
+		t.Errorf("have violations %v", have)
+	}
+
+	// the uid of the challenge identifies the client rather than the CN
+	req := &csrverifier.Request{CSR: der, Enrollment: &scepdepot.Enrollment{UID: "bob"}}
+	if ok, err := v.Verify(context.Background(), req); !ok || err != nil {
+		t.Errorf("renewal by the uid of the key: have %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,226 @@
+// Package webhookcsrverifier defines the WebhookCSRVerifier csrverifier.CSRVerifier.
+package webhookcsrverifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/procube-open/scep/csrverifier"
+	"github.com/procube-open/scep/scep"
+)
+
+// Decisions of the policy service.
+const (
+	Allow  = "allow"
+	Deny   = "deny"
+	Modify = "modify"
+)
+
+// Request is the JSON body POSTed to the policy service.
+type Request struct {
+	// CSR is the PEM encoded CSR.
+	CSR            string                 `json:"csr"`
+	MessageType    string                 `json:"message_type"`
+	UID            string                 `json:"uid"`
+	Status         string                 `json:"status"`
+	Profile        string                 `json:"profile"`
+	Attributes     map[string]interface{} `json:"attributes"`
+	Subject        string                 `json:"subject"`
+	DNSNames       []string               `json:"dns_names"`
+	EmailAddresses []string               `json:"email_addresses"`
+	IPAddresses    []string               `json:"ip_addresses"`
+	URIs           []string               `json:"uris"`
+}
+
+// Response is the JSON answer of the policy service.
+type Response struct {
+	// Decision is Allow, Deny or Modify.
+	Decision string `json:"decision"`
+
+	// Reason explains a denial.
+	Reason string `json:"reason"`
+
+	// Profile and Attributes modify the enrollment when Decision is Modify.
+	// A non-empty Profile replaces the profile of the enrollment, and
+	// Attributes are merged over the attributes of the client.
+	Profile    string                 `json:"profile"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// DeniedError is returned when the policy service denies an enrollment.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "enrollment denied by policy service"
+	}
+	return "enrollment denied by policy service: " + e.Reason
+}
+
+// FailInfo returns badRequest.
+func (e *DeniedError) FailInfo() scep.FailInfo {
+	return scep.BadRequest
+}
+
+// Option customizes WebhookCSRVerifier.
+type Option func(*WebhookCSRVerifier)
+
+// WithHTTPClient sets the client used to call the policy service.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *WebhookCSRVerifier) {
+		v.client = client
+	}
+}
+
+// WithBearerToken sets a token sent in the Authorization header.
+func WithBearerToken(token string) Option {
+	return func(v *WebhookCSRVerifier) {
+		v.token = token
+	}
+}
+
+// WithLogger sets the logger of the verifier.
+func WithLogger(logger log.Logger) Option {
+	return func(v *WebhookCSRVerifier) {
+		v.logger = logger
+	}
+}
+
+// New creates a webhookcsrverifier.WebhookCSRVerifier calling the policy
+// service at rawURL.
+func New(rawURL string, opts ...Option) (*WebhookCSRVerifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("CSR verifier URL must be http or https: %s", rawURL)
+	}
+	v := &WebhookCSRVerifier{
+		url:    u.String(),
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// WebhookCSRVerifier implements a csrverifier.CSRVerifier.
+// It POSTs the enrollment request as JSON to an external policy service
+// and obeys its allow, deny or modify decision. Any failure to get a
+// decision denies the enrollment.
+type WebhookCSRVerifier struct {
+	url    string
+	token  string
+	client *http.Client
+	logger log.Logger
+}
+
+func (v *WebhookCSRVerifier) Verify(ctx context.Context, req *csrverifier.Request) (bool, error) {
+	body, err := newRequest(req)
+	if err != nil {
+		return false, err
+	}
+	resp, err := v.call(ctx, body)
+	if err != nil {
+		v.logger.Log("msg", "CSR verifier webhook failed", "err", err)
+		return false, err
+	}
+
+	switch resp.Decision {
+	case Allow:
+		return true, nil
+	case Deny:
+		return false, &DeniedError{Reason: resp.Reason}
+	case Modify:
+		e := req.Enrollment
+		if e == nil {
+			return false, fmt.Errorf("policy service modified an enrollment without a client")
+		}
+		if resp.Profile != "" {
+			e.Profile = resp.Profile
+		}
+		if len(resp.Attributes) > 0 {
+			attributes := make(map[string]interface{}, len(e.Attributes)+len(resp.Attributes))
+			for k, val := range e.Attributes {
+				attributes[k] = val
+			}
+			for k, val := range resp.Attributes {
+				attributes[k] = val
+			}
+			e.Attributes = attributes
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown decision %q from policy service", resp.Decision)
+	}
+}
+
+func newRequest(req *csrverifier.Request) (*Request, error) {
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, err
+	}
+	body := &Request{
+		CSR:            string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: req.CSR})),
+		MessageType:    req.MessageTypeName(),
+		Subject:        csr.Subject.String(),
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+	}
+	for _, ip := range csr.IPAddresses {
+		body.IPAddresses = append(body.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		body.URIs = append(body.URIs, uri.String())
+	}
+	if e := req.Enrollment; e != nil {
+		body.UID = e.UID
+		body.Status = e.Status
+		body.Profile = e.Profile
+		body.Attributes = e.Attributes
+	}
+	return body, nil
+}
+
+func (v *WebhookCSRVerifier) call(ctx context.Context, body *Request) (*Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if v.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+v.token)
+	}
+	httpResp, err := v.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, httpResp.Body)
+		return nil, fmt.Errorf("policy service returned %s", httpResp.Status)
+	}
+	resp := new(Response)
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("decoding policy service response: %w", err)
+	}
+	return resp, nil
+}
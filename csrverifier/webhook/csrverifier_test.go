@@ -0,0 +1,110 @@
+package webhookcsrverifier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/procube-open/scep/csrverifier"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+)
+
+// inventory is a policy service that knows the devices in its map.
+func inventory(t *testing.T, devices map[string]Response) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.MessageType != "PKCSReq" || req.Status != "ISSUABLE" || req.CSR == "" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		resp, ok := devices[req.UID]
+		if !ok {
+			resp = Response{Decision: Deny, Reason: "unknown device " + req.UID}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func testRequest(t *testing.T, uid string) *csrverifier.Request {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: uid},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &csrverifier.Request{
+		CSR:         der,
+		MessageType: scep.PKCSReq,
+		Enrollment: &scepdepot.Enrollment{
+			UID:        uid,
+			Status:     "ISSUABLE",
+			Attributes: map[string]interface{}{"owner": "alice"},
+		},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv := inventory(t, map[string]Response{
+		"pc01": {Decision: Allow},
+		"pc02": {
+			Decision:   Modify,
+			Profile:    "802.1x",
+			Attributes: map[string]interface{}{"hostname": "pc02"},
+		},
+	})
+	defer srv.Close()
+
+	v, err := New(srv.URL, WithBearerToken("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if ok, err := v.Verify(ctx, testRequest(t, "pc01")); !ok || err != nil {
+		t.Errorf("allow: have %v, %v", ok, err)
+	}
+
+	req := testRequest(t, "pc02")
+	if ok, err := v.Verify(ctx, req); !ok || err != nil {
+		t.Errorf("modify: have %v, %v", ok, err)
+	}
+	if e := req.Enrollment; e.Profile != "802.1x" || e.Attributes["hostname"] != "pc02" || e.Attributes["owner"] != "alice" {
+		t.Errorf("modify: have enrollment %+v", e)
+	}
+
+	ok, err := v.Verify(ctx, testRequest(t, "pc03"))
+	var denied *DeniedError
+	if ok || !errors.As(err, &denied) || denied.Reason != "unknown device pc03" {
+		t.Errorf("deny: have %v, %v", ok, err)
+	}
+
+	v, err = New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := v.Verify(ctx, testRequest(t, "pc01")); ok || err == nil {
+		t.Errorf("unauthorized: have %v, %v", ok, err)
+	}
+}
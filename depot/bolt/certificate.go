@@ -0,0 +1,395 @@
+package bolt
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+
+	"github.com/boltdb/bolt"
+)
+
+// certRecord is an issued certificate, keyed by its hex serial.
+type certRecord struct {
+	Id               int                     `json:"id"`
+	CN               string                  `json:"cn"`
+	Serial           string                  `json:"serial"`
+	Raw              []byte                  `json:"raw"`
+	Status           string                  `json:"status"`
+	ValidFrom        time.Time               `json:"valid_from"`
+	ValidTill        time.Time               `json:"valid_till"`
+	RevocationDate   *time.Time              `json:"revocation_date,omitempty"`
+	RevocationReason *depot.RevocationReason `json:"revocation_reason,omitempty"`
+	InvalidityDate   *time.Time              `json:"invalidity_date,omitempty"`
+	KeyID            string                  `json:"key_id"`
+}
+
+func (r *certRecord) certificate() depot.Certificate {
+	c := depot.Certificate{
+		Id:        r.Id,
+		CN:        r.CN,
+		Status:    r.Status,
+		ValidFrom: r.ValidFrom,
+		ValidTill: r.ValidTill,
+
+		RevocationReason: r.RevocationReason,
+		InvalidityDate:   r.InvalidityDate,
+	}
+	c.Serial.SetString(r.Serial, 16)
+	c.CertData = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.Raw}))
+	if r.RevocationDate != nil {
+		c.RevocationDate = *r.RevocationDate
+	}
+	return c
+}
+
+func putRecord(tx *bolt.Tx, r *certRecord) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(recordBucket)).Put([]byte(r.Serial), v)
+}
+
+func getRecord(tx *bolt.Tx, serial *big.Int) (*certRecord, error) {
+	v := tx.Bucket([]byte(recordBucket)).Get([]byte(fmt.Sprintf("%x", serial)))
+	if v == nil {
+		return nil, nil
+	}
+	r := new(certRecord)
+	return r, json.Unmarshal(v, r)
+}
+
+// records returns the certificate records for which match returns true,
+// in the order they were issued.
+func records(tx *bolt.Tx, match func(*certRecord) bool) ([]*certRecord, error) {
+	var rs []*certRecord
+	err := tx.Bucket([]byte(recordBucket)).ForEach(func(k, v []byte) error {
+		r := new(certRecord)
+		if err := json.Unmarshal(v, r); err != nil {
+			return err
+		}
+		if match(r) {
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Id < rs[j].Id })
+	return rs, err
+}
+
+func certsByCN(tx *bolt.Tx, cn string) ([]*certRecord, error) {
+	return records(tx, func(r *certRecord) bool { return r.CN == cn })
+}
+
+func (db *Depot) GetRCs() ([]x509.RevocationListEntry, error) {
+	return db.GetRCsByIssuer(nil)
+}
+
+// GetRCsByIssuer returns the CRL entries of the revoked and held
+// certificates issued by the CA whose DER encoded subject is rawIssuer, or
+// by any CA if rawIssuer is nil.
+func (db *Depot) GetRCsByIssuer(rawIssuer []byte) ([]x509.RevocationListEntry, error) {
+	var rcs []x509.RevocationListEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		rs, err := records(tx, func(r *certRecord) bool {
+			return (r.Status == "R" || r.Status == "H") && r.ValidTill.After(now)
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			c := r.certificate()
+			if rawIssuer != nil && !c.IssuedBy(rawIssuer) {
+				continue
+			}
+			rc, err := depot.RevocationListEntry(&c)
+			if err != nil {
+				return err
+			}
+			rcs = append(rcs, rc)
+		}
+		return nil
+	})
+	return rcs, err
+}
+
+func (db *Depot) GetCertsByCN(cn string) ([]depot.Certificate, error) {
+	var certs []depot.Certificate
+	err := db.View(func(tx *bolt.Tx) error {
+		rs, err := certsByCN(tx, cn)
+		for _, r := range rs {
+			certs = append(certs, r.certificate())
+		}
+		return err
+	})
+	return certs, err
+}
+
+func (db *Depot) GetCertBySerial(serial *big.Int) (*depot.Certificate, error) {
+	var cert *depot.Certificate
+	err := db.View(func(tx *bolt.Tx) error {
+		r, err := getRecord(tx, serial)
+		if err != nil || r == nil {
+			return err
+		}
+		c := r.certificate()
+		cert = &c
+		return nil
+	})
+	return cert, err
+}
+
+// GetCNsByPublicKey returns the distinct CNs of the certificates issued for
+// the DER encoded SubjectPublicKeyInfo.
+func (db *Depot) GetCNsByPublicKey(rawSubjectPublicKeyInfo []byte) ([]string, error) {
+	keyID := depot.PublicKeyID(rawSubjectPublicKeyInfo)
+	var cns []string
+	err := db.View(func(tx *bolt.Tx) error {
+		rs, err := records(tx, func(r *certRecord) bool { return r.KeyID == keyID })
+		seen := make(map[string]bool)
+		for _, r := range rs {
+			if !seen[r.CN] {
+				seen[r.CN] = true
+				cns = append(cns, r.CN)
+			}
+		}
+		return err
+	})
+	return cns, err
+}
+
+func (db *Depot) GetNextSerial() (*big.Int, error) {
+	if db.randomSerials {
+		return nil, depot.ErrRandomSerial
+	}
+	s := big.NewInt(2)
+	err := db.View(func(tx *bolt.Tx) error {
+		if k := tx.Bucket([]byte(certBucket)).Get([]byte("serial")); k != nil {
+			s.SetBytes(k)
+		}
+		return nil
+	})
+	return s, err
+}
+
+func (db *Depot) RevokeCertificate(uid string, revocationDate time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return revokeCertificates(tx, uid, revocationDate)
+	})
+}
+
+// RevokeClient revokes the certificates of uid, deletes its secret and makes
+// it INACTIVE.
+func (db *Depot) RevokeClient(uid string, revocationDate time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := revokeCertificates(tx, uid, revocationDate); err != nil {
+			return err
+		}
+		if err := deleteSecret(tx, uid); err != nil {
+			return err
+		}
+		c, err := getClient(tx, uid)
+		if err != nil || c == nil {
+			return err
+		}
+		c.Status = "INACTIVE"
+		return putClient(tx, c)
+	})
+}
+
+func revokeCertificates(tx *bolt.Tx, uid string, revocationDate time.Time) error {
+	certs, err := certsByCN(tx, uid)
+	if err != nil {
+		return err
+	}
+	for _, c := range certs {
+		if c.Status != "V" && c.Status != "H" {
+			continue
+		}
+		c.Status = "R"
+		c.RevocationDate = &revocationDate
+		c.RevocationReason = nil
+		if err := putRecord(tx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeCertificateBySerial revokes a single valid or held certificate and updates the
+// status of its client: a client left without a valid certificate becomes
+// INACTIVE, and a PENDING client whose other certificate remains becomes ISSUED.
+func (db *Depot) RevokeCertificateBySerial(serial *big.Int, reason depot.RevocationReason, revocationDate time.Time, invalidityDate *time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		cert, err := getRecord(tx, serial)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			return errors.New("certificate not found")
+		}
+		if cert.Status != "V" && cert.Status != "H" {
+			return errors.New("certificate is not valid")
+		}
+		cert.Status = "R"
+		cert.RevocationDate = &revocationDate
+		cert.RevocationReason = &reason
+		cert.InvalidityDate = invalidityDate
+		if err := putRecord(tx, cert); err != nil {
+			return err
+		}
+
+		client, err := getClient(tx, cert.CN)
+		if err != nil || client == nil {
+			return err
+		}
+		certs, err := certsByCN(tx, cert.CN)
+		if err != nil {
+			return err
+		}
+		var valid []*certRecord
+		for _, c := range certs {
+			if c.Status == "V" || c.Status == "H" {
+				valid = append(valid, c)
+			}
+		}
+		if len(valid) == 0 && (client.Status == "ISSUED" || client.Status == "PENDING") {
+			client.Status = "INACTIVE"
+			return putClient(tx, client)
+		}
+		if len(valid) > 0 && client.Status == "PENDING" {
+			// the remaining certificate must not be revoked by CheckCertRevocation
+			for _, c := range valid {
+				if c.Status != "V" {
+					continue
+				}
+				c.RevocationDate = nil
+				if err := putRecord(tx, c); err != nil {
+					return err
+				}
+			}
+			client.Status = "ISSUED"
+			return putClient(tx, client)
+		}
+		return nil
+	})
+}
+
+// HoldCertificate suspends a valid certificate. A held certificate is listed
+// in the CRL with the reason certificateHold until it is released or revoked.
+func (db *Depot) HoldCertificate(serial *big.Int, holdDate time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		cert, err := getRecord(tx, serial)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			return errors.New("certificate not found")
+		}
+		if cert.Status != "V" {
+			return errors.New("certificate is not valid")
+		}
+		if cert.RevocationDate != nil {
+			return errors.New("certificate is already scheduled for revocation")
+		}
+		reason := depot.CertificateHold
+		cert.Status = "H"
+		cert.RevocationDate = &holdDate
+		cert.RevocationReason = &reason
+		return putRecord(tx, cert)
+	})
+}
+
+// ReleaseCertificate makes a held certificate valid again.
+func (db *Depot) ReleaseCertificate(serial *big.Int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		cert, err := getRecord(tx, serial)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			return errors.New("certificate not found")
+		}
+		if cert.Status != "H" {
+			return errors.New("certificate is not on hold")
+		}
+		cert.Status = "V"
+		cert.RevocationDate = nil
+		cert.RevocationReason = nil
+		return putRecord(tx, cert)
+	})
+}
+
+// CheckCertRevocation revokes the old certificates of PENDING clients whose
+// pending period has passed, and makes the clients ISSUED.
+func (db *Depot) CheckCertRevocation() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		rs, err := records(tx, func(r *certRecord) bool {
+			return r.Status == "V" && r.RevocationDate != nil && r.RevocationDate.Before(now)
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			client, err := getClient(tx, r.CN)
+			if err != nil {
+				return err
+			}
+			if client == nil || client.Status != "PENDING" {
+				continue
+			}
+			reason := depot.Superseded
+			r.Status = "R"
+			r.RevocationReason = &reason
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+			client.Status = "ISSUED"
+			if err := putClient(tx, client); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CheckCertExpiration revokes the expired certificates of ISSUED clients
+// and makes the clients INACTIVE.
+func (db *Depot) CheckCertExpiration() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		rs, err := records(tx, func(r *certRecord) bool {
+			return (r.Status == "V" || r.Status == "H") && r.ValidTill.Before(now)
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			client, err := getClient(tx, r.CN)
+			if err != nil {
+				return err
+			}
+			if client == nil || client.Status != "ISSUED" {
+				continue
+			}
+			r.Status = "R"
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+			client.Status = "INACTIVE"
+			if err := putClient(tx, client); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+package bolt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+
+	"github.com/boltdb/bolt"
+)
+
+// UseJTI records the ID of a signed challenge, reporting false if it was
+// already used.
+func (db *Depot) UseJTI(jti string, expiresAt time.Time) (bool, error) {
+	used := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(jtiBucket))
+		if bucket.Get([]byte(jti)) != nil {
+			used = true
+			return nil
+		}
+		v, err := expiresAt.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(jti), v)
+	})
+	return !used && err == nil, err
+}
+
+// ReleaseJTI forgets the ID of a signed challenge.
+func (db *Depot) ReleaseJTI(jti string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jtiBucket)).Delete([]byte(jti))
+	})
+}
+
+// PurgeUsedJTIs forgets the IDs of signed challenges that have expired.
+func (db *Depot) PurgeUsedJTIs() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return purgeExpired(tx.Bucket([]byte(jtiBucket)), func(v []byte) (time.Time, error) {
+			var t time.Time
+			err := t.UnmarshalBinary(v)
+			return t, err
+		})
+	})
+}
+
+// purgeExpired deletes the entries of bucket whose expiry, as returned by
+// expiry, has passed.
+func purgeExpired(bucket *bolt.Bucket, expiry func([]byte) (time.Time, error)) error {
+	now := time.Now()
+	var keys [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		t, err := expiry(v)
+		if err != nil {
+			return err
+		}
+		if t.Before(now) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// challenge is a one-time challenge, keyed by the challenge itself.
+type challenge struct {
+	UID       string    `json:"uid,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ChallengeStore is a store of random one-time SCEP challenges that expire
+// after a TTL and are optionally bound to the uid of a client.
+// It implements depot.ChallengeStore and challenge.BoundStore.
+type ChallengeStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+// NewChallengeStore returns a ChallengeStore of challenges valid for ttl.
+func (db *Depot) NewChallengeStore(ttl time.Duration) depot.ChallengeStore {
+	return &ChallengeStore{db: db.DB, ttl: ttl}
+}
+
+// TTL returns how long the challenges of s are valid.
+func (s *ChallengeStore) TTL() time.Duration {
+	return s.ttl
+}
+
+// SCEPChallenge returns a new challenge usable by any client.
+func (s *ChallengeStore) SCEPChallenge() (string, error) {
+	return s.SCEPChallengeFor("")
+}
+
+// SCEPChallengeFor returns a new challenge usable only by the client uid.
+// An empty uid returns a challenge usable by any client.
+func (s *ChallengeStore) SCEPChallengeFor(uid string) (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	pw := base64.RawURLEncoding.EncodeToString(key)
+	v, err := json.Marshal(challenge{UID: uid, ExpiresAt: time.Now().Add(s.ttl)})
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(challengeBucket)).Put([]byte(pw), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return pw, nil
+}
+
+// HasChallenge consumes pw, reporting whether it was a valid challenge.
+func (s *ChallengeStore) HasChallenge(pw string) (bool, error) {
+	valid, _, err := s.UseChallenge(pw)
+	return valid, err
+}
+
+// UseChallenge consumes pw, reporting whether it was a valid challenge and
+// the uid it is bound to, if any.
+func (s *ChallengeStore) UseChallenge(pw string) (bool, string, error) {
+	var c challenge
+	valid := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(challengeBucket))
+		v := bucket.Get([]byte(pw))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		valid = c.ExpiresAt.After(time.Now())
+		return bucket.Delete([]byte(pw))
+	})
+	if err != nil {
+		return false, "", err
+	}
+	return valid, c.UID, nil
+}
+
+// PurgeExpiredChallenges deletes the challenges that have expired unused.
+func (s *ChallengeStore) PurgeExpiredChallenges() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return purgeExpired(tx.Bucket([]byte(challengeBucket)), func(v []byte) (time.Time, error) {
+			var c challenge
+			err := json.Unmarshal(v, &c)
+			return c.ExpiresAt, err
+		})
+	})
+}
@@ -0,0 +1,151 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+
+	"github.com/boltdb/bolt"
+)
+
+// clientRecord is a client, keyed by its uid.
+type clientRecord struct {
+	depot.Client
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+func getClient(tx *bolt.Tx, uid string) (*clientRecord, error) {
+	v := tx.Bucket([]byte(clientBucket)).Get([]byte(uid))
+	if v == nil {
+		return nil, nil
+	}
+	c := new(clientRecord)
+	return c, json.Unmarshal(v, c)
+}
+
+func putClient(tx *bolt.Tx, c *clientRecord) error {
+	v, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(clientBucket)).Put([]byte(c.Uid), v)
+}
+
+// updateClient applies update to the client uid, if it exists.
+func (db *Depot) updateClient(uid string, update func(*clientRecord)) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		c, err := getClient(tx, uid)
+		if err != nil || c == nil {
+			return err
+		}
+		update(c)
+		return putClient(tx, c)
+	})
+}
+
+func (db *Depot) AddClient(client depot.Client, initialStatus string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		c, err := getClient(tx, client.Uid)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			return errors.New("client " + client.Uid + " already exists")
+		}
+		client.Status = initialStatus
+		return putClient(tx, &clientRecord{Client: client})
+	})
+}
+
+func (db *Depot) UpdateAttributesClient(info depot.UpdateInfo) error {
+	return db.updateClient(info.Uid, func(c *clientRecord) {
+		c.Attributes = info.Attributes
+	})
+}
+
+func (db *Depot) UpdateStatusClient(uid string, status string) error {
+	return db.updateClient(uid, func(c *clientRecord) {
+		c.Status = status
+	})
+}
+
+func (db *Depot) GetClient(uid string) (*depot.Client, error) {
+	var client *depot.Client
+	err := db.View(func(tx *bolt.Tx) error {
+		c, err := getClient(tx, uid)
+		if c != nil {
+			client = &c.Client
+		}
+		return err
+	})
+	return client, err
+}
+
+func (db *Depot) GetClientList() ([]depot.Client, error) {
+	var clients []depot.Client
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(clientBucket)).ForEach(func(k, v []byte) error {
+			var c clientRecord
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Status != "ARCHIVED" {
+				clients = append(clients, c.Client)
+			}
+			return nil
+		})
+	})
+	return clients, err
+}
+
+// ArchiveClient revokes the certificates of uid, deletes its secret and
+// archives it.
+func (db *Depot) ArchiveClient(uid string, archivedAt time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		// revoked certificates stay listed in the CRL until they expire
+		if err := revokeCertificates(tx, uid, archivedAt); err != nil {
+			return err
+		}
+		if err := deleteSecret(tx, uid); err != nil {
+			return err
+		}
+		c, err := getClient(tx, uid)
+		if err != nil || c == nil {
+			return err
+		}
+		c.Status = "ARCHIVED"
+		c.ArchivedAt = &archivedAt
+		return putClient(tx, c)
+	})
+}
+
+func (db *Depot) PurgeArchivedClients(retention time.Duration) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		before := time.Now().Add(-retention)
+		var uids []string
+		err := tx.Bucket([]byte(clientBucket)).ForEach(func(k, v []byte) error {
+			var c clientRecord
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Status == "ARCHIVED" && c.ArchivedAt != nil && c.ArchivedAt.Before(before) {
+				uids = append(uids, c.Uid)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			if err := deleteSecret(tx, uid); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(clientBucket)).Delete([]byte(uid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,14 +1,16 @@
 package bolt
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"sync"
+	"time"
 
 	"github.com/procube-open/scep/depot"
 
@@ -19,26 +21,83 @@ import (
 // https://github.com/boltdb/bolt
 type Depot struct {
 	*bolt.DB
-	serialMu sync.RWMutex
+	serialMu      sync.RWMutex
+	caDir         string
+	randomSerials bool
 }
 
 const (
-	certBucket = "scep_certificates"
+	certBucket       = "scep_certificates"
+	clientBucket     = "scep_clients"
+	secretBucket     = "scep_secrets"
+	recordBucket     = "scep_certificate_records"
+	invitationBucket = "scep_invitations"
+	jtiBucket        = "scep_challenge_jtis"
+	challengeBucket  = "scep_bound_challenges"
 )
 
+var buckets = []string{
+	certBucket,
+	clientBucket,
+	secretBucket,
+	recordBucket,
+	invitationBucket,
+	jtiBucket,
+	challengeBucket,
+}
+
+// Option configures a Depot.
+type Option func(*Depot)
+
+// WithCADir makes the Depot read its CA from the ca.crt and ca.key files in
+// dir, as created by scepserver ca -init, instead of from the database.
+func WithCADir(dir string) Option {
+	return func(d *Depot) {
+		d.caDir = dir
+	}
+}
+
+// WithRandomSerials makes the Depot allocate random serial numbers of
+// depot.RandomSerialBits bits instead of sequential ones.
+func WithRandomSerials() Option {
+	return func(d *Depot) {
+		d.randomSerials = true
+	}
+}
+
 // NewBoltDepot creates a depot.Depot backed by BoltDB.
-func NewBoltDepot(db *bolt.DB) (*Depot, error) {
+func NewBoltDepot(db *bolt.DB, opts ...Option) (*Depot, error) {
+	d := &Depot{DB: db}
+	for _, opt := range opts {
+		opt(d)
+	}
+	// a database opened read-only is read as it is
+	if db.IsReadOnly() {
+		return d, nil
+	}
 	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(certBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &Depot{DB: db}, nil
+	return d, nil
+}
+
+var _ depot.Store = (*Depot)(nil)
+
+// Backup writes a consistent copy of the database to w, which can be
+// opened as the database to restore it.
+func (db *Depot) Backup(w io.Writer) error {
+	return db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
 }
 
 // For some read operations Bolt returns a direct memory reference to
@@ -55,7 +114,10 @@ func bucketGetCopy(b *bolt.Bucket, key []byte) (out []byte) {
 	return
 }
 
-func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+func (db *Depot) CA(pass []byte) ([]*x509.Certificate, depot.CAKey, error) {
+	if db.caDir != "" {
+		return depot.LoadCA(db.caDir, pass)
+	}
 	chain := []*x509.Certificate{}
 	var key *rsa.PrivateKey
 	err := db.View(func(tx *bolt.Tx) error {
@@ -91,6 +153,8 @@ func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
 	return chain, key, nil
 }
 
+// Put stores crt, issued to the client cn, and updates the status of the
+// client like the MySQL depot does.
 func (db *Depot) Put(cn string, crt *x509.Certificate, challnge string) error {
 	if crt == nil || crt.Raw == nil {
 		return fmt.Errorf("%q does not specify a valid certificate for storage", cn)
@@ -101,12 +165,21 @@ func (db *Depot) Put(cn string, crt *x509.Certificate, challnge string) error {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
 		name := cn + "." + crt.SerialNumber.String()
-		return bucket.Put([]byte(name), crt.Raw)
+		if err := bucket.Put([]byte(name), crt.Raw); err != nil {
+			return err
+		}
+		if crt.Subject.CommonName == "" {
+			cn = fmt.Sprintf("%x", sha256.Sum256(crt.Raw))
+		}
+		return writeRecord(tx, cn, crt)
 	})
 	return err
 }
 
 func (db *Depot) Serial() (*big.Int, error) {
+	if db.randomSerials {
+		return db.randomSerial()
+	}
 	db.serialMu.Lock()
 	defer db.serialMu.Unlock()
 	s, err := db.readSerial()
@@ -116,6 +189,38 @@ func (db *Depot) Serial() (*big.Int, error) {
 	return s, db.incrementSerial(s)
 }
 
+// ClaimSerial allocates serial if it is the next sequential serial number,
+// or if it is unused when serial numbers are random.
+func (db *Depot) ClaimSerial(serial *big.Int) (bool, error) {
+	if db.randomSerials {
+		cert, err := db.GetCertBySerial(serial)
+		return cert == nil && err == nil, err
+	}
+	db.serialMu.Lock()
+	defer db.serialMu.Unlock()
+	s, err := db.readSerial()
+	if err != nil || s.Cmp(serial) != 0 {
+		return false, err
+	}
+	return true, db.incrementSerial(s)
+}
+
+func (db *Depot) randomSerial() (*big.Int, error) {
+	for {
+		s, err := depot.RandomSerial()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := db.GetCertBySerial(s)
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil {
+			return s, nil
+		}
+	}
+}
+
 func (db *Depot) readSerial() (*big.Int, error) {
 	s := big.NewInt(2)
 	if !db.hasKey([]byte("serial")) {
@@ -171,26 +276,125 @@ func (db *Depot) incrementSerial(s *big.Int) error {
 	return db.writeSerial(serial)
 }
 
+// HasCN fails if the latest valid or held certificate of cn issued by the
+// CA of cert was issued later than allowTime days from now. If
+// revokeOldCertificate is set, that certificate is revoked as superseded.
 func (db *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
-	// TODO: implement allowTime
-	// TODO: implement revocation
 	if cert == nil {
 		return false, errors.New("nil certificate provided")
 	}
-	var hasCN bool
-	err := db.View(func(tx *bolt.Tx) error {
-		curs := tx.Bucket([]byte(certBucket)).Cursor()
-		prefix := []byte(cert.Subject.CommonName)
-		for k, v := curs.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = curs.Next() {
-			if bytes.Compare(v, cert.Raw) == 0 {
-				hasCN = true
-				return nil
+	err := db.Update(func(tx *bolt.Tx) error {
+		return hasCN(tx, cn, cert.RawIssuer, allowTime, revokeOldCertificate)
+	})
+	return err == nil, err
+}
+
+func hasCN(tx *bolt.Tx, cn string, rawIssuer []byte, allowTime int, revokeOldCertificate bool) error {
+	certs, err := certsByCN(tx, cn)
+	if err != nil {
+		return err
+	}
+	var latest *certRecord
+	for _, c := range certs {
+		if (c.Status == "V" || c.Status == "H") && depot.IssuedBy(c.Raw, rawIssuer) {
+			latest = c
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	if allowTime > 0 && latest.ValidFrom.After(time.Now().AddDate(0, 0, allowTime)) {
+		return errors.New("CN " + cn + " already exists")
+	}
+	if !revokeOldCertificate {
+		return nil
+	}
+	now := time.Now()
+	reason := depot.Superseded
+	latest.Status = "R"
+	latest.RevocationDate = &now
+	latest.RevocationReason = &reason
+	return putRecord(tx, latest)
+}
+
+// writeRecord records cert as issued to cn and updates the status of the
+// client cn, if it is managed here.
+func writeRecord(tx *bolt.Tx, cn string, cert *x509.Certificate) error {
+	if r, err := getRecord(tx, cert.SerialNumber); err != nil {
+		return err
+	} else if r != nil {
+		return depot.ErrSerialInUse
+	}
+	client, err := getClient(tx, cn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case client == nil:
+		// a client not managed here, enrolled with a signed challenge
+		if err := hasCN(tx, cn, cert.RawIssuer, 0, true); err != nil {
+			return err
+		}
+	case client.Status == "ISSUABLE":
+		if err := hasCN(tx, cn, cert.RawIssuer, 0, true); err != nil {
+			return err
+		}
+		client.Status = "ISSUED"
+		if err := putClient(tx, client); err != nil {
+			return err
+		}
+	case client.Status == "UPDATABLE":
+		if err := hasCN(tx, cn, cert.RawIssuer, 0, false); err != nil {
+			return err
+		}
+		client.Status = "PENDING"
+		if err := putClient(tx, client); err != nil {
+			return err
+		}
+		secret, err := getSecret(tx, cn)
+		if err != nil {
+			return err
+		}
+		duration, err := time.ParseDuration(secret.PendingPeriod)
+		if err != nil {
+			return err
+		}
+		revocationDate := time.Now().Add(duration)
+		certs, err := certsByCN(tx, cn)
+		if err != nil {
+			return err
+		}
+		for _, c := range certs {
+			if c.Status != "V" {
+				continue
+			}
+			c.RevocationDate = &revocationDate
+			if err := putRecord(tx, c); err != nil {
+				return err
 			}
 		}
+	default:
+		return errors.New("client is not issuable or updatable")
+	}
 
-		return nil
+	id, err := tx.Bucket([]byte(recordBucket)).NextSequence()
+	if err != nil {
+		return err
+	}
+	err = putRecord(tx, &certRecord{
+		Id:        int(id),
+		CN:        cn,
+		Serial:    fmt.Sprintf("%x", cert.SerialNumber),
+		Raw:       cert.Raw,
+		Status:    "V",
+		ValidFrom: cert.NotBefore,
+		ValidTill: cert.NotAfter,
+		KeyID:     depot.PublicKeyID(cert.RawSubjectPublicKeyInfo),
 	})
-	return hasCN, err
+	if err != nil {
+		return err
+	}
+	return deleteSecret(tx, cn)
 }
 
 func (db *Depot) CreateOrLoadKey(bits int) (*rsa.PrivateKey, error) {
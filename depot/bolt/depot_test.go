@@ -6,6 +6,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/procube-open/scep/depot/depottest"
 
 	"github.com/boltdb/bolt"
 )
@@ -146,3 +149,45 @@ func TestDepot_CreateOrLoadCA(t *testing.T) {
 		}
 	}
 }
+
+func TestDepot_Store(t *testing.T) {
+	db := createDB(0666, nil)
+	depottest.TestStore(t, db)
+	depottest.TestInvitations(t, db)
+	depottest.TestExpiration(t, db)
+	depottest.TestChallengeStore(t, db)
+	depottest.TestMultiCA(t, db)
+	depottest.TestConcurrentEnrollment(t, db)
+	depottest.TestSerials(t, db)
+
+	db = createDB(0666, nil)
+	db.randomSerials = true
+	depottest.TestRandomSerials(t, db)
+}
+
+func TestDepot_ReadOnly(t *testing.T) {
+	db := createDB(0666, nil)
+	path := db.Path()
+	defer os.Remove(path)
+	if err := db.incrementSerial(big.NewInt(41)); err != nil {
+		t.Fatal(err)
+	}
+	// the database is locked while it is open for writing
+	if _, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true, Timeout: 100 * time.Millisecond}); err != bolt.ErrTimeout {
+		t.Errorf("read-only Open() of a database in use = %v, want %v", err, bolt.ErrTimeout)
+	}
+	db.Close()
+
+	ro, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	d, err := NewBoltDepot(ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, err := d.GetNextSerial(); err != nil || next.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("GetNextSerial() = %v, %v, want 42", next, err)
+	}
+}
@@ -0,0 +1,94 @@
+package bolt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/procube-open/scep/cryptoutil"
+	"github.com/procube-open/scep/depot"
+
+	"github.com/boltdb/bolt"
+)
+
+// invitation is an enrollment invitation, keyed by its jti.
+type invitation struct {
+	Target     string     `json:"target"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+}
+
+// CreateInvitation records the invitation jti to target, which can be
+// redeemed once until expiresAt.
+func (db *Depot) CreateInvitation(jti, target string, expiresAt time.Time) error {
+	v, err := json.Marshal(invitation{Target: target, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(invitationBucket)).Put([]byte(jti), v)
+	})
+}
+
+// RedeemInvitation consumes the invitation jti to target and replaces the
+// secret of target with secret. It returns depot.ErrInvitationUsed if the
+// invitation cannot be redeemed.
+func (db *Depot) RedeemInvitation(jti, target, secret string) error {
+	hash, err := cryptoutil.HashSecret(secret)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := redeemInvitation(tx, jti, target); err != nil {
+			return err
+		}
+		return replaceSecret(tx, target, hash)
+	})
+}
+
+// redeemInvitation consumes the invitation jti to target.
+func redeemInvitation(tx *bolt.Tx, jti, target string) error {
+	bucket := tx.Bucket([]byte(invitationBucket))
+	v := bucket.Get([]byte(jti))
+	if v == nil {
+		return depot.ErrInvitationUsed
+	}
+	var inv invitation
+	if err := json.Unmarshal(v, &inv); err != nil {
+		return err
+	}
+	now := time.Now()
+	if inv.Target != target || inv.RedeemedAt != nil || !inv.ExpiresAt.After(now) {
+		return depot.ErrInvitationUsed
+	}
+	inv.RedeemedAt = &now
+	v, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(jti), v)
+}
+
+// deleteInvitations deletes the invitations to target.
+func deleteInvitations(tx *bolt.Tx, target string) error {
+	bucket := tx.Bucket([]byte(invitationBucket))
+	var jtis [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		var inv invitation
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+		if inv.Target == target {
+			jtis = append(jtis, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, jti := range jtis {
+		if err := bucket.Delete(jti); err != nil {
+			return err
+		}
+	}
+	return nil
+}
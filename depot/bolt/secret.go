@@ -0,0 +1,175 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/procube-open/scep/cryptoutil"
+	"github.com/procube-open/scep/depot"
+
+	"github.com/boltdb/bolt"
+)
+
+// secretRecord is the secret of a client, keyed by the uid of the client.
+type secretRecord struct {
+	Hash          string    `json:"hash"`
+	Type          string    `json:"type"`
+	CreatedAt     time.Time `json:"created_at"`
+	DeleteAt      time.Time `json:"delete_at"`
+	PendingPeriod string    `json:"pending_period"`
+	Profile       string    `json:"profile,omitempty"`
+}
+
+func getSecret(tx *bolt.Tx, target string) (*secretRecord, error) {
+	v := tx.Bucket([]byte(secretBucket)).Get([]byte(target))
+	if v == nil {
+		return nil, depot.ErrSecretNotFound
+	}
+	s := new(secretRecord)
+	return s, json.Unmarshal(v, s)
+}
+
+func putSecret(tx *bolt.Tx, target string, s *secretRecord) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(secretBucket)).Put([]byte(target), v)
+}
+
+// deleteSecret deletes the secret of target and the invitations to it.
+func deleteSecret(tx *bolt.Tx, target string) error {
+	if err := deleteInvitations(tx, target); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(secretBucket)).Delete([]byte(target))
+}
+
+// CreateSecret stores a hash of info.Secret for info.Target.
+func (db *Depot) CreateSecret(info depot.CreateSecretInfo) error {
+	now := time.Now()
+	hash, err := cryptoutil.HashSecret(info.Secret)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(info.Available_Period)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(secretBucket)).Get([]byte(info.Target)) != nil {
+			return errors.New("secret of " + info.Target + " already exists")
+		}
+		return putSecret(tx, info.Target, &secretRecord{
+			Hash:          hash,
+			Type:          info.Type,
+			CreatedAt:     now,
+			DeleteAt:      now.Add(duration),
+			PendingPeriod: info.Pending_Period,
+			Profile:       info.Profile,
+		})
+	})
+}
+
+func (db *Depot) GetSecret(target string) (depot.SecretInfo, error) {
+	var info depot.SecretInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		s, err := getSecret(tx, target)
+		if err != nil {
+			return err
+		}
+		info = depot.SecretInfo{
+			Hash:           s.Hash,
+			Type:           s.Type,
+			Delete_At:      s.DeleteAt,
+			Pending_Period: s.PendingPeriod,
+			Profile:        s.Profile,
+		}
+		return nil
+	})
+	return info, err
+}
+
+// CompareSecret reports whether secret is the secret of target.
+func (db *Depot) CompareSecret(target, secret string) (bool, error) {
+	info, err := db.GetSecret(target)
+	if err != nil {
+		return false, err
+	}
+	return cryptoutil.CompareSecret(info.Hash, secret), nil
+}
+
+// ReplaceSecret stores a hash of secret as the secret of target, keeping
+// its expiry.
+func (db *Depot) ReplaceSecret(target, secret string) error {
+	hash, err := cryptoutil.HashSecret(secret)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return replaceSecret(tx, target, hash)
+	})
+}
+
+// replaceSecret replaces the hash of the secret of target.
+func replaceSecret(tx *bolt.Tx, target, hash string) error {
+	s, err := getSecret(tx, target)
+	if err != nil {
+		return err
+	}
+	s.Hash = hash
+	return putSecret(tx, target, s)
+}
+
+// DeleteSecret deletes the secret of target and the invitations to it.
+func (db *Depot) DeleteSecret(target string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteSecret(tx, target)
+	})
+}
+
+// CheckSecretExpiration deletes the expired secrets and returns their
+// clients to the status they had before the secret was created.
+func (db *Depot) CheckSecretExpiration() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		var targets []string
+		err := tx.Bucket([]byte(secretBucket)).ForEach(func(k, v []byte) error {
+			var s secretRecord
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if s.DeleteAt.Before(now) {
+				targets = append(targets, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			client, err := getClient(tx, target)
+			if err != nil {
+				return err
+			}
+			if client != nil {
+				switch client.Status {
+				case "ISSUABLE":
+					client.Status = "INACTIVE"
+				case "UPDATABLE":
+					client.Status = "ISSUED"
+				default:
+					return errors.New("client is not issuable or updatable")
+				}
+				if err := putClient(tx, client); err != nil {
+					return err
+				}
+			}
+			if err := deleteSecret(tx, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
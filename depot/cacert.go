@@ -4,8 +4,10 @@ import (
 	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"io"
 	"math/big"
+	"math/bits"
 	"time"
 
 	"github.com/procube-open/scep/cryptoutil"
@@ -123,3 +125,46 @@ func (c *CACert) SelfSign(rand io.Reader, pub crypto.PublicKey, priv interface{}
 
 	return x509.CreateCertificate(rand, &tmpl, &tmpl, pub, priv)
 }
+
+// CSR creates a certificate request for a subordinate CA based off our
+// settings, signed by priv. It asks the parent CA for the CA basic
+// constraint and our key usage.
+func (c *CACert) CSR(rand io.Reader, priv crypto.Signer) ([]byte, error) {
+	basicConstraints, err := asn1.Marshal(struct {
+		IsCA bool
+	}{IsCA: true})
+	if err != nil {
+		return nil, err
+	}
+	keyUsage, err := marshalKeyUsage(c.keyUsage)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := x509.CertificateRequest{
+		Subject: *c.newPkixName(),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionBasicConstraints, Critical: true, Value: basicConstraints},
+			{Id: oidExtensionKeyUsage, Critical: true, Value: keyUsage},
+		},
+	}
+	return x509.CreateCertificateRequest(rand, &tmpl, priv)
+}
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+)
+
+// marshalKeyUsage encodes usage as the BIT STRING of the key usage
+// extension, in which the first usage is the most significant bit.
+func marshalKeyUsage(usage x509.KeyUsage) ([]byte, error) {
+	b := []byte{bits.Reverse8(byte(usage)), bits.Reverse8(byte(usage >> 8))}
+	if b[1] == 0 {
+		b = b[:1]
+	}
+	bitLength := len(b) * 8
+	if last := b[len(b)-1]; last != 0 {
+		bitLength -= bits.TrailingZeros8(last)
+	}
+	return asn1.Marshal(asn1.BitString{Bytes: b, BitLength: bitLength})
+}
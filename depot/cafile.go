@@ -0,0 +1,311 @@
+package depot
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadCA reads the CA certificate ca.crt and its key ca.key, encrypted
+// with pass if it is encrypted, from dir.
+func LoadCA(dir string, pass []byte) ([]*x509.Certificate, CAKey, error) {
+	certs, err := LoadCACerts(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ParseCAKey(keyPEM, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, key, nil
+}
+
+// LoadCACerts reads the CA certificate ca.crt from dir, for a CA whose key
+// is not in ca.key. ca.crt of a subordinate CA holds the CA certificate
+// followed by the chain of its issuers.
+func LoadCACerts(dir string) ([]*x509.Certificate, error) {
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCerts(caPEM)
+}
+
+// ParseCerts parses the certificates of the CERTIFICATE PEM blocks in data,
+// in their order.
+func ParseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate PEM block found")
+	}
+	return certs, nil
+}
+
+// ErrOtherCA is returned by the view of a CA of a store when a client
+// belongs to another CA.
+var ErrOtherCA = errors.New("the client belongs to another CA")
+
+// StoreForCA returns the view of s of the CA name, which is empty for the
+// default CA. Its CA is certs and key, loaded once instead of each time it
+// is used.
+//
+// The view adds clients to the CA and only finds the clients of the CA,
+// their secrets and the certificates the CA issued, and its CRL only lists
+// those. It fails with ErrOtherCA to change the clients of other CAs, their
+// secrets, or to issue certificates to them, and only supersedes the
+// certificates the CA issued. The other methods, such as the revocations,
+// the batch jobs and the serial numbers, act on the whole of s.
+func StoreForCA(s Store, name string, certs []*x509.Certificate, key CAKey) Store {
+	return &caStore{Store: s, name: name, certs: certs, key: key}
+}
+
+type caStore struct {
+	Store
+	name  string
+	certs []*x509.Certificate
+	key   CAKey
+}
+
+func (s *caStore) CA([]byte) ([]*x509.Certificate, CAKey, error) {
+	return s.certs, s.key, nil
+}
+
+// AddClient adds client as a client of the CA.
+func (s *caStore) AddClient(client Client, initialStatus string) error {
+	client.CA = s.name
+	return s.Store.AddClient(client, initialStatus)
+}
+
+func (s *caStore) GetClient(uid string) (*Client, error) {
+	c, err := s.Store.GetClient(uid)
+	if err != nil || c == nil || c.CA != s.name {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *caStore) GetClientList() ([]Client, error) {
+	clients, err := s.Store.GetClientList()
+	if err != nil {
+		return nil, err
+	}
+	var list []Client
+	for _, c := range clients {
+		if c.CA == s.name {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// checkCA returns ErrOtherCA if uid is a client of another CA.
+func (s *caStore) checkCA(uid string) error {
+	c, err := s.Store.GetClient(uid)
+	if err != nil {
+		return err
+	}
+	if c != nil && c.CA != s.name {
+		return ErrOtherCA
+	}
+	return nil
+}
+
+func (s *caStore) UpdateAttributesClient(info UpdateInfo) error {
+	if err := s.checkCA(info.Uid); err != nil {
+		return err
+	}
+	return s.Store.UpdateAttributesClient(info)
+}
+
+func (s *caStore) UpdateStatusClient(uid string, status string) error {
+	if err := s.checkCA(uid); err != nil {
+		return err
+	}
+	return s.Store.UpdateStatusClient(uid, status)
+}
+
+func (s *caStore) CreateSecret(info CreateSecretInfo) error {
+	if err := s.checkCA(info.Target); err != nil {
+		return err
+	}
+	return s.Store.CreateSecret(info)
+}
+
+func (s *caStore) GetSecret(target string) (SecretInfo, error) {
+	if err := s.checkCA(target); err == ErrOtherCA {
+		return SecretInfo{}, ErrSecretNotFound
+	} else if err != nil {
+		return SecretInfo{}, err
+	}
+	return s.Store.GetSecret(target)
+}
+
+func (s *caStore) CompareSecret(target, secret string) (bool, error) {
+	c, err := s.GetClient(target)
+	if err != nil || c == nil {
+		return false, err
+	}
+	return s.Store.CompareSecret(target, secret)
+}
+
+func (s *caStore) ReplaceSecret(target, secret string) error {
+	if err := s.checkCA(target); err == ErrOtherCA {
+		return ErrSecretNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.Store.ReplaceSecret(target, secret)
+}
+
+func (s *caStore) RedeemInvitation(jti, target, secret string) error {
+	if err := s.checkCA(target); err == ErrOtherCA {
+		return ErrInvitationUsed
+	} else if err != nil {
+		return err
+	}
+	return s.Store.RedeemInvitation(jti, target, secret)
+}
+
+func (s *caStore) DeleteSecret(target string) error {
+	if err := s.checkCA(target); err != nil {
+		return err
+	}
+	return s.Store.DeleteSecret(target)
+}
+
+// HasCN fails with ErrOtherCA if cn is a client of another CA. Only the
+// certificates issued by the CA are checked and revoked.
+func (s *caStore) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	if err := s.checkCA(cn); err != nil {
+		return false, err
+	}
+	return s.Store.HasCN(cn, allowTime, cert, revokeOldCertificate)
+}
+
+// Put fails with ErrOtherCA if cn is a client of another CA.
+func (s *caStore) Put(cn string, crt *x509.Certificate, challenge string) error {
+	if err := s.checkCA(cn); err != nil {
+		return err
+	}
+	return s.Store.Put(cn, crt, challenge)
+}
+
+func (s *caStore) GetCertsByCN(cn string) ([]Certificate, error) {
+	certs, err := s.Store.GetCertsByCN(cn)
+	if err != nil {
+		return nil, err
+	}
+	var issued []Certificate
+	for _, c := range certs {
+		if c.IssuedBy(s.certs[0].RawSubject) {
+			issued = append(issued, c)
+		}
+	}
+	return issued, nil
+}
+
+// GetCertBySerial returns nil and no error if the certificate was issued
+// by another CA.
+func (s *caStore) GetCertBySerial(serial *big.Int) (*Certificate, error) {
+	c, err := s.Store.GetCertBySerial(serial)
+	if err != nil || c == nil || !c.IssuedBy(s.certs[0].RawSubject) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *caStore) GetRCs() ([]x509.RevocationListEntry, error) {
+	return s.Store.GetRCsByIssuer(s.certs[0].RawSubject)
+}
+
+// ChallengeStoreForCA returns the challenges of challenges of the CA name,
+// which is empty for the default CA. The challenges of a named CA start
+// with its name, so that they cannot be used with another CA.
+func ChallengeStoreForCA(challenges ChallengeStore, name string) ChallengeStore {
+	if name == "" {
+		return challenges
+	}
+	return &caChallengeStore{ChallengeStore: challenges, prefix: name + "."}
+}
+
+type caChallengeStore struct {
+	ChallengeStore
+	prefix string
+}
+
+func (s *caChallengeStore) SCEPChallenge() (string, error) {
+	return s.SCEPChallengeFor("")
+}
+
+func (s *caChallengeStore) SCEPChallengeFor(uid string) (string, error) {
+	pw, err := s.ChallengeStore.SCEPChallengeFor(uid)
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + pw, nil
+}
+
+func (s *caChallengeStore) HasChallenge(pw string) (bool, error) {
+	valid, _, err := s.UseChallenge(pw)
+	return valid, err
+}
+
+func (s *caChallengeStore) UseChallenge(pw string) (bool, string, error) {
+	if !strings.HasPrefix(pw, s.prefix) {
+		return false, "", nil
+	}
+	return s.ChallengeStore.UseChallenge(strings.TrimPrefix(pw, s.prefix))
+}
+
+// CAChain checks that cert is a CA certificate of key, valid now, and
+// issued through the certificates of chain, and returns cert followed by
+// its issuers in order. The last certificate of chain is trusted as the
+// anchor, which should be the root CA.
+func CAChain(key crypto.PublicKey, cert *x509.Certificate, chain []*x509.Certificate) ([]*x509.Certificate, error) {
+	pub, ok := key.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("the certificate is not of the CA key")
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return nil, errors.New("the certificate is not a CA certificate")
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, errors.New("the certificate may not sign certificates")
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("missing the certificates of the issuers")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	opts.Roots.AddCert(chain[len(chain)-1])
+	for _, c := range chain[:len(chain)-1] {
+		opts.Intermediates.AddCert(c)
+	}
+	chains, err := cert.Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
@@ -0,0 +1,137 @@
+package depot_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+// issueCA signs a CA certificate for the request csr with the parent
+// certificate and key, copying the extensions requested by csr.
+func issueCA(t *testing.T, csrDER []byte, parent *x509.Certificate, parentKey *rsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         csr.Subject,
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: csr.Extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, csr.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSubordinateCA(t *testing.T) {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unlike the roots of ca -init, the root may issue subordinate CAs
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := scepdepot.NewCACert(scepdepot.WithCommonName("sub")).CSR(rand.Reader, testRSAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := issueCA(t, csr, root, rootKey)
+	if !sub.IsCA || sub.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Fatalf("CSR did not request a CA certificate: IsCA %v, KeyUsage %v", sub.IsCA, sub.KeyUsage)
+	}
+
+	chain, err := scepdepot.CAChain(testRSAKey.Public(), sub, []*x509.Certificate{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || !chain[0].Equal(sub) || !chain[1].Equal(root) {
+		t.Fatalf("chain is %v", chain)
+	}
+
+	if _, err := scepdepot.CAChain(rootKey.Public(), sub, []*x509.Certificate{root}); err == nil {
+		t.Error("accepted a certificate of another key")
+	}
+	if _, err := scepdepot.CAChain(testRSAKey.Public(), sub, nil); err == nil {
+		t.Error("accepted a certificate without its issuers")
+	}
+	other, err := scepdepot.NewCACert(scepdepot.WithCommonName("other")).SelfSign(rand.Reader, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRoot, err := x509.ParseCertificate(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scepdepot.CAChain(testRSAKey.Public(), sub, []*x509.Certificate{otherRoot}); err == nil {
+		t.Error("accepted a certificate issued by another CA")
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, root, testRSAKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scepdepot.CAChain(testRSAKey.Public(), leaf, []*x509.Certificate{root}); err == nil {
+		t.Error("accepted a certificate that is not a CA certificate")
+	}
+
+	dir := t.TempDir()
+	var chainPEM []byte
+	for _, c := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), chainPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := scepdepot.LoadCACerts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(sub) || !certs[1].Equal(root) {
+		t.Errorf("loaded %d CA certificates, want the subordinate CA and the root", len(certs))
+	}
+}
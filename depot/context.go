@@ -0,0 +1,51 @@
+package depot
+
+import "context"
+
+// Enrollment describes the client a CSR is being signed for. It is put into
+// the request context by the middleware that authorized the request, such as
+// a challenge middleware, and read by the Signer.
+type Enrollment struct {
+	// UID of the client the challenge was issued for.
+	UID string
+
+	// Status of the client before the certificate is issued,
+	// e.g. ISSUABLE or UPDATABLE.
+	Status string
+
+	// Profile is the name of the certificate profile to issue with.
+	// An empty Profile selects the default profile of the Signer.
+	Profile string
+
+	// Attributes of the client, used to render the subject policy.
+	Attributes map[string]interface{}
+}
+
+type enrollmentKey struct{}
+
+// NewContext returns a copy of ctx carrying e.
+func NewContext(ctx context.Context, e *Enrollment) context.Context {
+	return context.WithValue(ctx, enrollmentKey{}, e)
+}
+
+// FromContext returns the Enrollment stored in ctx, if any.
+func FromContext(ctx context.Context) (*Enrollment, bool) {
+	e, ok := ctx.Value(enrollmentKey{}).(*Enrollment)
+	return e, ok
+}
+
+type verifiedSecretKey struct{}
+
+// WithVerifiedSecret returns a copy of ctx recording that the caller has
+// already compared the secret of the uid\secret challenge of uid, so that
+// the challenge middleware does not hash it a second time.
+func WithVerifiedSecret(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, verifiedSecretKey{}, uid)
+}
+
+// VerifiedSecret reports whether ctx records that the secret of uid has
+// been compared.
+func VerifiedSecret(ctx context.Context, uid string) bool {
+	verified, ok := ctx.Value(verifiedSecretKey{}).(string)
+	return ok && verified == uid
+}
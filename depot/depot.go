@@ -1,14 +1,22 @@
 package depot
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"math/big"
 )
 
+// CAKey is the private key of a CA. It signs certificates and CRLs and
+// decrypts the SCEP requests encrypted to the CA. It is an *rsa.PrivateKey
+// read from ca.key, or a key kept in a PKCS#11 token.
+type CAKey interface {
+	crypto.Signer
+	crypto.Decrypter
+}
+
 // Depot is a repository for managing certificates
 type Depot interface {
-	CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error)
+	CA(pass []byte) ([]*x509.Certificate, CAKey, error)
 	Put(name string, crt *x509.Certificate, challenge string) error
 	Serial() (*big.Int, error)
 	HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error)
@@ -0,0 +1,893 @@
+// Package depottest tests implementations of depot.Store.
+//
+// The tests use random client uids and serial numbers, so that they can run
+// against a database that is not empty.
+package depottest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// TestStore tests the client, secret and certificate lifecycle of s.
+func TestStore(t *testing.T, s depot.Store) {
+	uid := randomUID(t)
+	if err := s.AddClient(depot.Client{Uid: uid, Attributes: map[string]interface{}{"owner": "alice"}}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddClient(depot.Client{Uid: uid}, "ISSUABLE"); err == nil {
+		t.Error("added a client twice")
+	}
+	c, err := s.GetClient(uid)
+	if err != nil || c == nil || c.Attributes["owner"] != "alice" {
+		t.Fatalf("GetClient() = %+v, %v", c, err)
+	}
+	if c, err := s.GetClient(randomUID(t)); c != nil || err != nil {
+		t.Errorf("GetClient() of an unknown client = %+v, %v", c, err)
+	}
+	createSecret(t, s, uid)
+	if ok, err := s.CompareSecret(uid, "s3cret"); !ok || err != nil {
+		t.Errorf("CompareSecret() = %v, %v", ok, err)
+	}
+	if ok, err := s.CompareSecret(uid, "other"); ok || err != nil {
+		t.Errorf("CompareSecret() of a wrong secret = %v, %v", ok, err)
+	}
+
+	first := testCert(t, uid)
+	if err := s.Put(uid, first, ""); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "ISSUED"; have != want {
+		t.Errorf("after issuance: have %s, want %s", have, want)
+	}
+	if _, err := s.GetSecret(uid); err != depot.ErrSecretNotFound {
+		t.Errorf("secret is not deleted after issuance: %v", err)
+	}
+	cns, err := s.GetCNsByPublicKey(first.RawSubjectPublicKeyInfo)
+	if err != nil || !reflect.DeepEqual(cns, []string{uid}) {
+		t.Errorf("GetCNsByPublicKey() = %v, %v", cns, err)
+	}
+
+	// renewal keeps the old certificate for the pending period
+	if err := s.UpdateStatusClient(uid, "UPDATABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	second := testCert(t, uid)
+	if err := s.Put(uid, second, ""); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "PENDING"; have != want {
+		t.Errorf("after renewal: have %s, want %s", have, want)
+	}
+	old, err := s.GetCertBySerial(first.SerialNumber)
+	if err != nil || old == nil {
+		t.Fatalf("GetCertBySerial() = %v, %v", old, err)
+	}
+	if old.Status != "V" || old.RevocationDate.IsZero() {
+		t.Errorf("old certificate: have %s revoked at %v", old.Status, old.RevocationDate)
+	}
+
+	// revoking the new certificate keeps the old one
+	invalidity := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := s.RevokeCertificateBySerial(second.SerialNumber, depot.KeyCompromise, time.Now(), &invalidity); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "ISSUED"; have != want {
+		t.Errorf("after revocation: have %s, want %s", have, want)
+	}
+	if old, _ = s.GetCertBySerial(first.SerialNumber); !old.RevocationDate.IsZero() {
+		t.Errorf("old certificate is still scheduled for revocation at %v", old.RevocationDate)
+	}
+	revoked, err := s.GetCertBySerial(second.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.RevocationReason == nil || *revoked.RevocationReason != depot.KeyCompromise ||
+		revoked.InvalidityDate == nil || !revoked.InvalidityDate.Equal(invalidity) {
+		t.Errorf("revoked certificate: have reason %v, invalidity date %v", revoked.RevocationReason, revoked.InvalidityDate)
+	}
+
+	if err := s.HoldCertificate(first.SerialNumber, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !inCRL(t, s, first.SerialNumber) || !inCRL(t, s, second.SerialNumber) {
+		t.Error("held and revoked certificates are not in the CRL")
+	}
+	if err := s.ReleaseCertificate(first.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if inCRL(t, s, first.SerialNumber) {
+		t.Error("released certificate is in the CRL")
+	}
+	certs, err := s.GetCertsByCN(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].Status != "V" || certs[1].Status != "R" {
+		t.Errorf("unexpected certificates %+v", certs)
+	}
+
+	// issuing to an issuable client supersedes its certificate
+	if err := s.UpdateStatusClient(uid, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	third := testCert(t, uid)
+	if err := s.Put(uid, third, ""); err != nil {
+		t.Fatal(err)
+	}
+	if old, _ = s.GetCertBySerial(first.SerialNumber); old.Status != "R" || old.RevocationReason == nil || *old.RevocationReason != depot.Superseded {
+		t.Errorf("old certificate: have %s, reason %v", old.Status, old.RevocationReason)
+	}
+
+	// a held certificate is superseded too
+	if err := s.HoldCertificate(third.SerialNumber, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateStatusClient(uid, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	if err := s.Put(uid, testCert(t, uid), ""); err != nil {
+		t.Fatal(err)
+	}
+	if old, _ = s.GetCertBySerial(third.SerialNumber); old.Status != "R" || old.RevocationReason == nil || *old.RevocationReason != depot.Superseded {
+		t.Errorf("held certificate: have %s, reason %v", old.Status, old.RevocationReason)
+	}
+
+	if err := s.ArchiveClient(uid, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := s.GetClientList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if c.Uid == uid {
+			t.Error("archived client is listed")
+		}
+	}
+	if err := s.PurgeArchivedClients(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.GetClient(uid); c != nil || err != nil {
+		t.Errorf("GetClient() of a purged client = %+v, %v", c, err)
+	}
+}
+
+// TestInvitations tests the invitations and signed challenge IDs of s.
+func TestInvitations(t *testing.T, s depot.Store) {
+	uid := randomUID(t)
+	if err := s.AddClient(depot.Client{Uid: uid}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	jti := randomUID(t)
+	if err := s.CreateInvitation(jti, uid, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RedeemInvitation(jti, "other", "n3w"); err != depot.ErrInvitationUsed {
+		t.Errorf("RedeemInvitation() for another client = %v", err)
+	}
+	if err := s.RedeemInvitation(jti, uid, "n3w"); err != nil {
+		t.Errorf("RedeemInvitation() = %v", err)
+	}
+	if ok, err := s.CompareSecret(uid, "n3w"); !ok || err != nil {
+		t.Errorf("CompareSecret() of the redeemed secret = %v, %v", ok, err)
+	}
+	if err := s.RedeemInvitation(jti, uid, "0ther"); err != depot.ErrInvitationUsed {
+		t.Errorf("second RedeemInvitation() = %v", err)
+	}
+	if ok, err := s.CompareSecret(uid, "n3w"); !ok || err != nil {
+		t.Errorf("a used invitation replaced the secret: %v, %v", ok, err)
+	}
+
+	// an invitation is not used if the secret was deleted
+	other := randomUID(t)
+	if err := s.AddClient(depot.Client{Uid: other}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	jti = randomUID(t)
+	if err := s.CreateInvitation(jti, other, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RedeemInvitation(jti, other, "n3w"); err != depot.ErrSecretNotFound {
+		t.Errorf("RedeemInvitation() without a secret = %v", err)
+	}
+	createSecret(t, s, other)
+	if err := s.RedeemInvitation(jti, other, "n3w"); err != nil {
+		t.Errorf("RedeemInvitation() after the secret was created = %v", err)
+	}
+
+	if err := s.ReplaceSecret(uid, "r3placed"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.CompareSecret(uid, "r3placed"); !ok || err != nil {
+		t.Errorf("CompareSecret() of the replaced secret = %v, %v", ok, err)
+	}
+	if err := s.ReplaceSecret(randomUID(t), "n3w"); err != depot.ErrSecretNotFound {
+		t.Errorf("ReplaceSecret() of an unknown client = %v", err)
+	}
+
+	jti = randomUID(t)
+	if ok, err := s.UseJTI(jti, time.Now().Add(time.Hour)); !ok || err != nil {
+		t.Errorf("UseJTI() = %v, %v", ok, err)
+	}
+	if ok, err := s.UseJTI(jti, time.Now().Add(time.Hour)); ok || err != nil {
+		t.Errorf("second UseJTI() = %v, %v", ok, err)
+	}
+	if err := s.ReleaseJTI(jti); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.UseJTI(jti, time.Now().Add(time.Hour)); !ok || err != nil {
+		t.Errorf("UseJTI() of a released ID = %v, %v", ok, err)
+	}
+	if err := s.PurgeUsedJTIs(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestExpiration tests the batch jobs of s expiring secrets and certificates.
+func TestExpiration(t *testing.T, s depot.Store) {
+	uid := randomUID(t)
+	if err := s.AddClient(depot.Client{Uid: uid}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.CreateSecret(depot.CreateSecretInfo{Secret: "s3cret", Type: "test", Target: uid, Available_Period: "-1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckSecretExpiration(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "INACTIVE"; have != want {
+		t.Errorf("after the secret expired: have %s, want %s", have, want)
+	}
+	if _, err := s.GetSecret(uid); err != depot.ErrSecretNotFound {
+		t.Errorf("expired secret is not deleted: %v", err)
+	}
+
+	// the old certificate is revoked when the pending period has passed
+	if err := s.UpdateStatusClient(uid, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	old := testCert(t, uid)
+	if err := s.Put(uid, old, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateStatusClient(uid, "UPDATABLE"); err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreateSecret(depot.CreateSecretInfo{Secret: "s3cret", Type: "test", Target: uid, Available_Period: "1h", Pending_Period: "-1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := testCertValidTill(t, uid, time.Now().Add(-time.Minute))
+	if err := s.Put(uid, expired, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckCertRevocation(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "ISSUED"; have != want {
+		t.Errorf("after the pending period: have %s, want %s", have, want)
+	}
+	if c, _ := s.GetCertBySerial(old.SerialNumber); c.Status != "R" {
+		t.Errorf("old certificate after the pending period: have %s", c.Status)
+	}
+
+	// an ISSUED client whose certificate has expired becomes INACTIVE
+	if err := s.CheckCertExpiration(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := clientStatus(t, s, uid), "INACTIVE"; have != want {
+		t.Errorf("after the certificate expired: have %s, want %s", have, want)
+	}
+	if c, _ := s.GetCertBySerial(expired.SerialNumber); c.Status != "R" {
+		t.Errorf("expired certificate: have %s", c.Status)
+	}
+}
+
+// TestChallengeStore tests the one-time challenges of s.
+func TestChallengeStore(t *testing.T, s depot.ChallengeStoreFactory) {
+	store := s.NewChallengeStore(time.Hour)
+	if ttl := store.TTL(); ttl != time.Hour {
+		t.Errorf("TTL() = %v, want %v", ttl, time.Hour)
+	}
+	pw, err := store.SCEPChallengeFor("pc01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, uid, err := store.UseChallenge(pw); !ok || uid != "pc01" || err != nil {
+		t.Errorf("UseChallenge() = %v, %q, %v", ok, uid, err)
+	}
+	if ok, _, err := store.UseChallenge(pw); ok || err != nil {
+		t.Errorf("second UseChallenge() = %v, %v", ok, err)
+	}
+
+	unbound, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unbound == pw {
+		t.Error("SCEPChallenge() returned a used challenge")
+	}
+	if ok, uid, err := store.UseChallenge(unbound); !ok || uid != "" || err != nil {
+		t.Errorf("UseChallenge() of an unbound challenge = %v, %q, %v", ok, uid, err)
+	}
+	if pw, err = store.SCEPChallenge(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.HasChallenge(pw); !ok || err != nil {
+		t.Errorf("HasChallenge() = %v, %v", ok, err)
+	}
+	if ok, err := store.HasChallenge(pw); ok || err != nil {
+		t.Errorf("second HasChallenge() = %v, %v", ok, err)
+	}
+	if ok, _, err := store.UseChallenge(randomUID(t)); ok || err != nil {
+		t.Errorf("UseChallenge() of an unknown challenge = %v, %v", ok, err)
+	}
+
+	expired := s.NewChallengeStore(-time.Minute)
+	if pw, err = expired.SCEPChallenge(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := expired.HasChallenge(pw); ok || err != nil {
+		t.Errorf("HasChallenge() of an expired challenge = %v, %v", ok, err)
+	}
+	if err := store.PurgeExpiredChallenges(); err != nil {
+		t.Error(err)
+	}
+}
+
+// ChallengeStore is a store which also keeps one-time challenges.
+type ChallengeStore interface {
+	depot.Store
+	depot.ChallengeStoreFactory
+}
+
+// TestMultiCA tests the views of s of two CAs, see depot.StoreForCA and
+// depot.ChallengeStoreForCA.
+func TestMultiCA(t *testing.T, s ChallengeStore) {
+	defaultCA, defaultKey := testCA(t, "default CA")
+	otherCA, otherKey := testCA(t, "other CA")
+	name := "ca" + randomUID(t)
+	def := depot.StoreForCA(s, "", []*x509.Certificate{defaultCA}, nil)
+	other := depot.StoreForCA(s, name, []*x509.Certificate{otherCA}, nil)
+
+	uid, otherUID := randomUID(t), randomUID(t)
+	if err := def.AddClient(depot.Client{Uid: uid}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddClient(depot.Client{Uid: otherUID, CA: "ignored"}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.GetClient(otherUID); err != nil || c == nil || c.CA != name {
+		t.Fatalf("GetClient() of a client of %s = %+v, %v", name, c, err)
+	}
+	if c, err := def.GetClient(otherUID); c != nil || err != nil {
+		t.Errorf("the default CA finds a client of %s: %+v, %v", name, c, err)
+	}
+	if c, err := other.GetClient(uid); c != nil || err != nil {
+		t.Errorf("%s finds a client of the default CA: %+v, %v", name, c, err)
+	}
+	list, err := other.GetClientList()
+	if err != nil || len(list) != 1 || list[0].Uid != otherUID {
+		t.Errorf("GetClientList() of %s = %+v, %v", name, list, err)
+	}
+
+	createSecret(t, s, otherUID)
+	if ok, err := def.CompareSecret(otherUID, "s3cret"); ok || err != nil {
+		t.Errorf("CompareSecret() of a client of another CA = %v, %v", ok, err)
+	}
+	if ok, err := other.CompareSecret(otherUID, "s3cret"); !ok || err != nil {
+		t.Errorf("CompareSecret() = %v, %v", ok, err)
+	}
+
+	cert := issuedCert(t, uid, defaultCA, defaultKey)
+	otherCert := issuedCert(t, otherUID, otherCA, otherKey)
+	if err := s.Put(uid, cert, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(otherUID, otherCert, ""); err != nil {
+		t.Fatal(err)
+	}
+	if certs, err := def.GetCertsByCN(otherUID); len(certs) != 0 || err != nil {
+		t.Errorf("the default CA finds the certificates of %s: %v, %v", name, certs, err)
+	}
+	if certs, err := other.GetCertsByCN(otherUID); len(certs) != 1 || err != nil {
+		t.Errorf("GetCertsByCN() = %v, %v", certs, err)
+	}
+	if c, err := other.GetCertBySerial(cert.SerialNumber); c != nil || err != nil {
+		t.Errorf("%s finds a certificate of the default CA: %+v, %v", name, c, err)
+	}
+	if _, err := other.HasCN(uid, 0, otherCert, true); err != depot.ErrOtherCA {
+		t.Errorf("HasCN() of a client of the default CA = %v, want %v", err, depot.ErrOtherCA)
+	}
+	if err := other.Put(uid, otherCert, ""); err != depot.ErrOtherCA {
+		t.Errorf("Put() of a client of the default CA = %v, want %v", err, depot.ErrOtherCA)
+	}
+	if err := other.UpdateStatusClient(uid, "INACTIVE"); err != depot.ErrOtherCA {
+		t.Errorf("UpdateStatusClient() of a client of the default CA = %v, want %v", err, depot.ErrOtherCA)
+	}
+
+	// Both CAs issue certificates to a CN which is not a client, and only
+	// supersede the certificates they issued.
+	sharedCN := randomUID(t)
+	for _, ca := range []struct {
+		s    depot.Store
+		cert *x509.Certificate
+	}{
+		{def, issuedCert(t, sharedCN, defaultCA, defaultKey)},
+		{other, issuedCert(t, sharedCN, otherCA, otherKey)},
+	} {
+		if _, err := ca.s.HasCN(sharedCN, 0, ca.cert, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := ca.s.Put(sharedCN, ca.cert, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if valid := validCerts(t, def, sharedCN); len(valid) != 1 {
+		t.Errorf("%d valid certificates of the default CA for a shared CN, want 1", len(valid))
+	}
+	if valid := validCerts(t, other, sharedCN); len(valid) != 1 {
+		t.Errorf("%d valid certificates of %s for a shared CN, want 1", len(valid), name)
+	}
+	for _, c := range []*x509.Certificate{cert, otherCert} {
+		if err := s.RevokeCertificateBySerial(c.SerialNumber, depot.KeyCompromise, time.Now(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !inCRL(t, def, cert.SerialNumber) || inCRL(t, def, otherCert.SerialNumber) {
+		t.Error("the CRL of the default CA does not list exactly its certificate")
+	}
+	if !inCRL(t, other, otherCert.SerialNumber) || inCRL(t, other, cert.SerialNumber) {
+		t.Errorf("the CRL of %s does not list exactly its certificate", name)
+	}
+	if !inCRL(t, s, cert.SerialNumber) || !inCRL(t, s, otherCert.SerialNumber) {
+		t.Error("the CRL of the store does not list the certificates of all CAs")
+	}
+
+	defChallenges := depot.ChallengeStoreForCA(s.NewChallengeStore(time.Hour), "")
+	otherChallenges := depot.ChallengeStoreForCA(s.NewChallengeStore(time.Hour), name)
+	pw, err := otherChallenges.SCEPChallengeFor(otherUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pw, name+".") {
+		t.Errorf("challenge %q of %s does not start with its name", pw, name)
+	}
+	if ok, _, err := defChallenges.UseChallenge(pw); ok || err != nil {
+		t.Errorf("the default CA accepts a challenge of %s: %v, %v", name, ok, err)
+	}
+	if ok, uid, err := otherChallenges.UseChallenge(pw); !ok || uid != otherUID || err != nil {
+		t.Errorf("UseChallenge() = %v, %q, %v", ok, uid, err)
+	}
+	defPW, err := defChallenges.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := otherChallenges.HasChallenge(defPW); ok || err != nil {
+		t.Errorf("%s accepts a challenge of the default CA: %v, %v", name, ok, err)
+	}
+}
+
+// TestConcurrentEnrollment tests that only one of parallel enrollments
+// and renewals of a client is recorded by s.
+func TestConcurrentEnrollment(t *testing.T, s depot.Store) {
+	uid := randomUID(t)
+	if err := s.AddClient(depot.Client{Uid: uid}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	if n := putParallel(t, s, uid); n != 1 {
+		t.Errorf("%d parallel enrollments succeeded, want 1", n)
+	}
+	if have, want := clientStatus(t, s, uid), "ISSUED"; have != want {
+		t.Errorf("after enrollment: have %s, want %s", have, want)
+	}
+	if _, err := s.GetSecret(uid); err != depot.ErrSecretNotFound {
+		t.Errorf("secret is not deleted after enrollment: %v", err)
+	}
+	if valid := validCerts(t, s, uid); len(valid) != 1 {
+		t.Errorf("%d valid certificates after enrollment, want 1", len(valid))
+	}
+
+	if err := s.UpdateStatusClient(uid, "UPDATABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, s, uid)
+	if n := putParallel(t, s, uid); n != 1 {
+		t.Errorf("%d parallel renewals succeeded, want 1", n)
+	}
+	if have, want := clientStatus(t, s, uid), "PENDING"; have != want {
+		t.Errorf("after renewal: have %s, want %s", have, want)
+	}
+	if valid := validCerts(t, s, uid); len(valid) != 2 {
+		t.Errorf("%d valid certificates after renewal, want 2", len(valid))
+	}
+}
+
+// putParallel puts certificates of uid in parallel and returns how many
+// were stored.
+func putParallel(t *testing.T, s depot.Store, uid string) int {
+	t.Helper()
+	const n = 10
+	certs := make([]*x509.Certificate, n)
+	for i := range certs {
+		certs[i] = testCert(t, uid)
+	}
+	var stored int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, cert := range certs {
+		wg.Add(1)
+		go func(cert *x509.Certificate) {
+			defer wg.Done()
+			<-start
+			if err := s.Put(uid, cert, ""); err == nil {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(cert)
+	}
+	close(start)
+	wg.Wait()
+	return int(stored)
+}
+
+func validCerts(t *testing.T, s depot.Store, uid string) []depot.Certificate {
+	t.Helper()
+	certs, err := s.GetCertsByCN(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var valid []depot.Certificate
+	for _, c := range certs {
+		if c.Status == "V" {
+			valid = append(valid, c)
+		}
+	}
+	return valid
+}
+
+// TestSerials tests that s allocates sequential serial numbers atomically.
+func TestSerials(t *testing.T, s depot.Store) {
+	const n = 20
+	serials := make(chan *big.Int, n)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serial, err := s.Serial()
+			if err != nil {
+				errs <- err
+				return
+			}
+			serials <- serial
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for serial := range serials {
+		if seen[serial.String()] {
+			t.Errorf("serial %v allocated twice", serial)
+		}
+		seen[serial.String()] = true
+	}
+
+	next, err := s.GetNextSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.ClaimSerial(new(big.Int).Add(next, big.NewInt(1))); ok || err != nil {
+		t.Errorf("ClaimSerial(next + 1) = %v, %v", ok, err)
+	}
+	if ok, err := s.ClaimSerial(next); !ok || err != nil {
+		t.Errorf("ClaimSerial(next) = %v, %v", ok, err)
+	}
+	if ok, err := s.ClaimSerial(next); ok || err != nil {
+		t.Errorf("second ClaimSerial(next) = %v, %v", ok, err)
+	}
+	serial, err := s.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := new(big.Int).Add(next, big.NewInt(1)); serial.Cmp(want) != 0 {
+		t.Errorf("Serial() after ClaimSerial = %v, want %v", serial, want)
+	}
+}
+
+// TestRandomSerials tests s allocating random serial numbers.
+func TestRandomSerials(t *testing.T, s depot.Store) {
+	if _, err := s.GetNextSerial(); err != depot.ErrRandomSerial {
+		t.Errorf("GetNextSerial() returned %v, want ErrRandomSerial", err)
+	}
+	a, err := s.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Cmp(b) == 0 || a.Sign() <= 0 || a.BitLen() > depot.RandomSerialBits {
+		t.Errorf("unexpected serials %v, %v", a, b)
+	}
+
+	cn := randomUID(t)
+	cert := testCert(t, cn)
+	if ok, err := s.ClaimSerial(cert.SerialNumber); !ok || err != nil {
+		t.Errorf("ClaimSerial() of an unused serial = %v, %v", ok, err)
+	}
+	if err := s.Put(cn, cert, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.ClaimSerial(cert.SerialNumber); ok || err != nil {
+		t.Errorf("ClaimSerial() of a used serial = %v, %v", ok, err)
+	}
+	if err := s.Put(cn, testCertSerial(t, randomUID(t), cert.SerialNumber), ""); err != depot.ErrSerialInUse {
+		t.Errorf("Put() of a used serial returned %v, want ErrSerialInUse", err)
+	}
+}
+
+func randomUID(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return "test-" + hex.EncodeToString(b)
+}
+
+func createSecret(t *testing.T, s depot.Store, uid string) {
+	t.Helper()
+	err := s.CreateSecret(depot.CreateSecretInfo{
+		Secret:           "s3cret",
+		Type:             "test",
+		Target:           uid,
+		Available_Period: "1h",
+		Pending_Period:   "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	return testCertValidTill(t, cn, time.Now().Add(time.Hour))
+}
+
+func testCertValidTill(t *testing.T, cn string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestCert(t, cn, serial, notAfter)
+}
+
+func testCertSerial(t *testing.T, cn string, serial *big.Int) *x509.Certificate {
+	t.Helper()
+	return newTestCert(t, cn, serial, time.Now().Add(time.Hour))
+}
+
+func newTestCert(t *testing.T, cn string, serial *big.Int, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testCA returns a CA certificate of cn and its key.
+func testCA(t *testing.T, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// issuedCert returns a certificate of cn issued by ca.
+func issuedCert(t *testing.T, cn string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	cert := testCert(t, cn)
+	tmpl := &x509.Certificate{
+		SerialNumber: cert.SerialNumber,
+		Subject:      cert.Subject,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, cert.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func clientStatus(t *testing.T, s depot.Store, uid string) string {
+	t.Helper()
+	c, err := s.GetClient(uid)
+	if err != nil || c == nil {
+		t.Fatalf("GetClient(%q) = %v, %v", uid, c, err)
+	}
+	return c.Status
+}
+
+func inCRL(t *testing.T, s depot.Store, serial *big.Int) bool {
+	t.Helper()
+	rcs, err := s.GetRCs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range rcs {
+		if rc.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Dumper is a Store that dumps its database and restores the dumps, such as
+// a *sqldepot.Depot.
+type Dumper interface {
+	depot.Store
+	Dump(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// TestDumpRestore tests that a dump of src is restored into dst, which must
+// be empty, with the times of its rows unchanged.
+func TestDumpRestore(t *testing.T, src, dst Dumper) {
+	issued, pending := randomUID(t), randomUID(t)
+	// the attributes end a statement and a string if they are not escaped
+	attrs := map[string]interface{}{"note": "it's a \\ test');\n--"}
+	if err := src.AddClient(depot.Client{Uid: issued, Attributes: attrs}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddClient(depot.Client{Uid: pending}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	createSecret(t, src, issued)
+	createSecret(t, src, pending)
+	serial, err := src.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(issued, testCertSerial(t, issued, serial), ""); err != nil {
+		t.Fatal(err)
+	}
+	invalidity := time.Now().Add(-time.Hour)
+	if err := src.RevokeCertificateBySerial(serial, depot.KeyCompromise, time.Now(), &invalidity); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err := src.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dump of another version of the schema is refused
+	otherVersion := regexp.MustCompile(`(?m)^-- schema version \d+$`).ReplaceAllString(dump.String(), "-- schema version 0")
+	if otherVersion == dump.String() {
+		t.Fatalf("the dump has no schema version:\n%s", dump.String())
+	}
+	if err := dst.Restore(strings.NewReader(otherVersion)); err == nil {
+		t.Error("restored a dump of another schema version")
+	}
+	if err := dst.Restore(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("Restore() = %v\n%s", err, dump.String())
+	}
+	wantClient, err := src.GetClient(issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := dst.GetClient(issued)
+	if err != nil || c == nil || c.Status != wantClient.Status || c.Attributes["note"] != attrs["note"] {
+		t.Errorf("restored client = %+v, %v, want %+v", c, err, wantClient)
+	}
+	if ok, err := dst.CompareSecret(pending, "s3cret"); !ok || err != nil {
+		t.Errorf("CompareSecret() of the restored secret = %v, %v", ok, err)
+	}
+	want, err := src.GetSecret(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := dst.GetSecret(pending); err != nil || !have.Delete_At.Equal(want.Delete_At) {
+		t.Errorf("restored secret = %+v, %v, want %+v", have, err, want)
+	}
+	wantCerts, err := src.GetCertsByCN(issued)
+	if err != nil || len(wantCerts) != 1 {
+		t.Fatalf("certificates = %+v, %v", wantCerts, err)
+	}
+	certs, err := dst.GetCertsByCN(issued)
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("restored certificates = %+v, %v", certs, err)
+	}
+	have, w := certs[0], wantCerts[0]
+	if have.Serial.Cmp(serial) != 0 || have.Status != "R" || !reflect.DeepEqual(have.RevocationReason, w.RevocationReason) {
+		t.Errorf("restored certificate = %+v, want %+v", have, w)
+	}
+	for _, tt := range []struct {
+		name       string
+		have, want time.Time
+	}{
+		{"valid_from", have.ValidFrom, w.ValidFrom},
+		{"valid_till", have.ValidTill, w.ValidTill},
+		{"revocation_date", have.RevocationDate, w.RevocationDate},
+		{"invalidity_date", *have.InvalidityDate, *w.InvalidityDate},
+	} {
+		if !tt.have.Equal(tt.want) {
+			t.Errorf("restored %s = %v, want %v", tt.name, tt.have, tt.want)
+		}
+	}
+	if next, err := dst.GetNextSerial(); err != nil || next.Cmp(new(big.Int).Add(serial, big.NewInt(1))) != 0 {
+		t.Errorf("GetNextSerial() after restore = %v, %v, want %v", next, err, new(big.Int).Add(serial, big.NewInt(1)))
+	}
+
+	if err := dst.Restore(bytes.NewReader(dump.Bytes())); err == nil {
+		t.Error("restored into a database that is not empty")
+	}
+}
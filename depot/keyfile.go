@@ -0,0 +1,143 @@
+package depot
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The key derivation functions EncodeKey derives the key encrypting the
+// private key with.
+const (
+	KDFScrypt = "scrypt"
+	KDFPBKDF2 = "pbkdf2"
+)
+
+// ErrNotCAKey is returned for keys that cannot be a CA key. SCEP clients
+// encrypt their requests to the CA, so the CA key must be able to decrypt,
+// which only RSA keys can.
+var ErrNotCAKey = errors.New("the CA key must be an RSA key")
+
+// kdfOpts are the parameters of the key derivation functions. The scrypt
+// cost is the one of OpenSSL, which refuses keys needing more than 32 MiB.
+var kdfOpts = map[string]pkcs8.KDFOpts{
+	KDFScrypt: pkcs8.ScryptOpts{
+		SaltSize:                 16,
+		CostParameter:            1 << 14,
+		BlockSize:                8,
+		ParallelizationParameter: 1,
+	},
+	KDFPBKDF2: pkcs8.PBKDF2Opts{
+		SaltSize:       16,
+		IterationCount: 600000,
+		HMACHash:       crypto.SHA256,
+	},
+}
+
+// EncodeKey encodes key as a PKCS#8 PEM block. If pass is not empty, the
+// key is encrypted with PBES2 and AES-256-CBC under a key derived from pass
+// by kdf, which is KDFScrypt or KDFPBKDF2.
+func EncodeKey(key crypto.Signer, pass []byte, kdf string) ([]byte, error) {
+	if len(pass) == 0 {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	opts, ok := kdfOpts[kdf]
+	if !ok {
+		return nil, fmt.Errorf("unknown key derivation function %q", kdf)
+	}
+	der, err := pkcs8.MarshalPrivateKey(key, pass, &pkcs8.Opts{
+		Cipher:  pkcs8.AES256CBC,
+		KDFOpts: opts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseKey parses a private key, decrypting it with pass if it is
+// encrypted. data is PEM of a PKCS#8 key, encrypted or not, or of a PKCS#1
+// RSA or SEC1 EC key, which may be encrypted the legacy OpenSSL way. Other
+// PEM blocks, such as certificates, are skipped. data may also be a DER
+// key or a PKCS#12 bundle.
+func ParseKey(data, pass []byte) (crypto.Signer, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		if key, err := parseDERKey(data); err == nil {
+			return key, nil
+		}
+		key, _, _, err := pkcs12.DecodeChain(data, string(pass))
+		if err != nil {
+			return nil, errors.New("no PEM, DER or PKCS#12 private key found")
+		}
+		return toSigner(key)
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "ENCRYPTED PRIVATE KEY":
+			if len(pass) == 0 {
+				return nil, errors.New("the private key is encrypted, but no password was given")
+			}
+			key, _, err := pkcs8.ParsePrivateKey(block.Bytes, pass)
+			if err != nil {
+				return nil, err
+			}
+			return toSigner(key)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			der := block.Bytes
+			if x509.IsEncryptedPEMBlock(block) {
+				b, err := x509.DecryptPEMBlock(block, pass)
+				if err != nil {
+					return nil, err
+				}
+				der = b
+			}
+			return parseDERKey(der)
+		}
+	}
+	return nil, errors.New("no private key PEM block found")
+}
+
+// ParseCAKey parses a private key like ParseKey and checks that it can be
+// a CA key.
+func ParseCAKey(data, pass []byte) (CAKey, error) {
+	key, err := ParseKey(data, pass)
+	if err != nil {
+		return nil, err
+	}
+	caKey, ok := key.(CAKey)
+	if !ok {
+		return nil, ErrNotCAKey
+	}
+	return caKey, nil
+}
+
+func parseDERKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return toSigner(key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unknown private key format")
+}
+
+func toSigner(key interface{}) (crypto.Signer, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,151 @@
+package depot_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var testRSAKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func sameKey(t *testing.T, got crypto.Signer, want crypto.Signer) {
+	t.Helper()
+	type equaler interface{ Equal(crypto.PublicKey) bool }
+	if !want.Public().(equaler).Equal(got.Public()) {
+		t.Error("parsed key differs from the encoded key")
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	for _, kdf := range []string{scepdepot.KDFScrypt, scepdepot.KDFPBKDF2} {
+		t.Run(kdf, func(t *testing.T) {
+			data, err := scepdepot.EncodeKey(testRSAKey, []byte("secret"), kdf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block, _ := pem.Decode(data); block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("encoded key is not an encrypted PKCS#8 PEM block:\n%s", data)
+			}
+			key, err := scepdepot.ParseCAKey(data, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameKey(t, key, testRSAKey)
+			if _, err := scepdepot.ParseKey(data, []byte("wrong")); err == nil {
+				t.Error("parsed the key with a wrong password")
+			}
+			if _, err := scepdepot.ParseKey(data, nil); err == nil {
+				t.Error("parsed the key without a password")
+			}
+		})
+	}
+
+	data, err := scepdepot.EncodeKey(testRSAKey, nil, scepdepot.KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(data); block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("key without a password is not a PKCS#8 PEM block:\n%s", data)
+	}
+	key, err := scepdepot.ParseKey(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameKey(t, key, testRSAKey)
+
+	if _, err := scepdepot.EncodeKey(testRSAKey, []byte("secret"), "md5"); err == nil {
+		t.Error("encoded a key with an unknown key derivation function")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(testRSAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ca.key as written by earlier versions
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(testRSAKey), []byte("secret"), x509.PEMCipher3DES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "key"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, testRSAKey.Public(), testRSAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Modern2023.Encode(testRSAKey, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		pass string
+		want crypto.Signer
+	}{
+		{"pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRSAKey)}), "", testRSAKey},
+		{"pkcs1 legacy encrypted", pem.EncodeToMemory(legacy), "secret", testRSAKey},
+		{"pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}), "", testRSAKey},
+		{"pkcs8 der", pkcs8DER, "", testRSAKey},
+		{"sec1", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), "", ecKey},
+		{"certificate and key", append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER})...), "", testRSAKey},
+		{"pkcs12", p12, "secret", testRSAKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := scepdepot.ParseKey(tc.data, []byte(tc.pass))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameKey(t, key, tc.want)
+		})
+	}
+
+	if _, err := scepdepot.ParseKey(p12, []byte("wrong")); err == nil {
+		t.Error("parsed a PKCS#12 bundle with a wrong password")
+	}
+	if _, err := scepdepot.ParseKey(certPEM, nil); err == nil || !strings.Contains(err.Error(), "no private key") {
+		t.Errorf("parsing a certificate: got %v", err)
+	}
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})
+	if _, err := scepdepot.ParseCAKey(ecPEM, nil); !errors.Is(err, scepdepot.ErrNotCAKey) {
+		t.Errorf("parsing an EC CA key: got %v, want %v", err, scepdepot.ErrNotCAKey)
+	}
+}
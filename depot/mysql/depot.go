@@ -1,321 +1,230 @@
+// Package mysql implements the depot on MySQL.
 package mysql
 
 import (
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"database/sql"
-	"encoding/pem"
+	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math/big"
-	"os"
-	"path/filepath"
-	"strconv"
-	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/depot/sqldepot"
 )
 
-type MySQLDepot struct {
-	db      *sql.DB
-	dirPath string
-}
+// MySQLDepot is kept for compatibility.
+type MySQLDepot = sqldepot.Depot
+
+// ChallengeStore is kept for compatibility.
+type ChallengeStore = sqldepot.ChallengeStore
+
+// Client, UpdateInfo, CreateSecretInfo, GetSecretInfo and Certificate are
+// kept for compatibility.
+type (
+	Client           = depot.Client
+	UpdateInfo       = depot.UpdateInfo
+	CreateSecretInfo = depot.CreateSecretInfo
+	GetSecretInfo    = depot.SecretInfo
+	Certificate      = depot.Certificate
+)
 
-func NewTableDepot(dsn, dirPath string) (*MySQLDepot, error) {
+// ErrInvitationUsed is kept for compatibility.
+var ErrInvitationUsed = depot.ErrInvitationUsed
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Open opens the MySQL database of dsn.
+func Open(dsn string) (*sql.DB, error) {
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	// Create table if not exists
-	createClientsTableQuery := `
-	CREATE TABLE IF NOT EXISTS clients (
-		uid VARCHAR(255) NOT NULL PRIMARY KEY,
-		status VARCHAR(255) NOT NULL,
-		attributes TEXT DEFAULT NULL
-	);`
-	createCertsTableQuery := `
-	CREATE TABLE IF NOT EXISTS certificates (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		cn VARCHAR(255) NOT NULL,
-		serial VARCHAR(255) NOT NULL,
-		cert_data BLOB NOT NULL,
-		status CHAR(1) NOT NULL,
-		valid_from TIMESTAMP NOT NULL,
-		valid_till TIMESTAMP NOT NULL,
-		revocation_date TIMESTAMP DEFAULT NULL
-	);`
-	createSerialTableQuery := `
-	CREATE TABLE IF NOT EXISTS serial_table (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		serial VARCHAR(255) NOT NULL
-	);`
-	createSecretsTableQuery := `
-	CREATE TABLE IF NOT EXISTS secrets (
-		challenge VARCHAR(255) NOT NULL PRIMARY KEY,
-		secret VARCHAR(255) NOT NULL,
-		target VARCHAR(255) NOT NULL,
-		type VARCHAR(255) NOT NULL,
-		created_at TIMESTAMP NOT NULL,
-		delete_at TIMESTAMP NOT NULL,
-		pending_period VARCHAR(255) DEFAULT NULL,
-		FOREIGN KEY (target) REFERENCES clients(uid)
-	);`
-
-	_, err = db.Exec(createClientsTableQuery)
+// NewMigrator returns the Migrator of the schema of db. A database created
+// before the schema was versioned is upgraded to the first migration.
+func NewMigrator(db *sql.DB) (*sqldepot.Migrator, error) {
+	sub, err := fs.Sub(migrations, "migrations")
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec(createCertsTableQuery)
+	ms, err := sqldepot.LoadMigrations(sub)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec(createSerialTableQuery)
+	return sqldepot.NewMigrator(db, dialect{}, ms, sqldepot.WithBaseline(upgradeLegacySchema))
+}
+
+// NewTableDepot opens the MySQL database of dsn and migrates its schema.
+// The CA is read from dirPath.
+func NewTableDepot(dsn, dirPath string, opts ...sqldepot.Option) (*MySQLDepot, error) {
+	db, err := Open(dsn)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec(createSecretsTableQuery)
+	m, err := NewMigrator(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-
-	return &MySQLDepot{db: db, dirPath: dirPath}, nil
+	if err := m.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqldepot.New(db, dialect{}, dirPath, opts...)
 }
 
-func (d *MySQLDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
-	caPEM, err := d.GetFile("ca.crt")
+// OpenDepot opens the MySQL database of dsn like NewTableDepot, but
+// without migrating its schema, for the commands that only read it.
+func OpenDepot(dsn, dirPath string, opts ...sqldepot.Option) (*sqldepot.Depot, error) {
+	db, err := Open(dsn)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	cert, err := loadCert(caPEM.Data)
-	if err != nil {
-		return nil, nil, err
+	return sqldepot.New(db, dialect{}, dirPath, opts...)
+}
+
+// upgradeLegacySchema adds the columns introduced before the schema was
+// versioned to the tables of an existing database.
+func upgradeLegacySchema(db *sql.DB) error {
+	for _, c := range []struct {
+		table, column, definition string
+	}{
+		{"clients", "archived_at", "TIMESTAMP NULL DEFAULT NULL"},
+		{"certificates", "revocation_reason", "INT DEFAULT NULL"},
+		{"certificates", "invalidity_date", "TIMESTAMP NULL DEFAULT NULL"},
+		{"certificates", "key_id", "CHAR(64) DEFAULT NULL"},
+		{"secrets", "profile", "VARCHAR(255) DEFAULT NULL"},
+	} {
+		if err := addColumnIfNotExists(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
 	}
-	keyPEM, err := d.GetFile("ca.key")
+	return nil
+}
+
+func addColumnIfNotExists(db *sql.DB, table, column, definition string) error {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table).Scan(&tables)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	if tables == 0 {
+		// created by the first migration
+		return nil
 	}
-	key, err := loadKey(keyPEM.Data, pass)
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&count)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	if count > 0 {
+		return nil
 	}
-	return []*x509.Certificate{cert}, key, nil
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
 }
 
-func (d *MySQLDepot) Put(cn string, crt *x509.Certificate, challenge string) error {
-	serial := crt.SerialNumber
-	if crt.Subject.CommonName == "" {
-		cn = fmt.Sprintf("%x", sha256.Sum256(crt.Raw))
-	}
+// errDuplicateEntry is the MySQL error number of a duplicate key.
+const errDuplicateEntry = 1062
 
-	if err := d.writeDB(cn, serial, challenge, crt); err != nil {
-		return err
-	}
+// dialect adapts the queries of sqldepot to MySQL.
+type dialect struct{}
 
-	return nil
+func (dialect) Rebind(query string) string {
+	return query
+}
+
+func (dialect) IsDuplicate(err error) bool {
+	var mysqlErr *mysqldriver.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errDuplicateEntry
+}
+
+func (dialect) Serial(db *sql.DB) (*big.Int, error) {
+	return allocateSerial(db, nil)
 }
 
-func (d *MySQLDepot) Serial() (*big.Int, error) {
+func (dialect) NextSerial(q sqldepot.RowQuerier) (*big.Int, error) {
 	var serialStr string
-	err := d.db.QueryRow("SELECT serial FROM serial_table LIMIT 1").Scan(&serialStr)
+	err := q.QueryRow("SELECT serial FROM serial_table LIMIT 1").Scan(&serialStr)
 	if err == sql.ErrNoRows {
 		s := big.NewInt(2)
-		if err := d.writeSerial(s); err != nil {
-			return nil, err
-		}
 		return s, nil
 	} else if err != nil {
 		return nil, err
 	}
 	serial := new(big.Int)
 	serial.SetString(serialStr, 16)
-	if err := d.incrementSerial(serial); err != nil {
-		return serial, err
-	}
+	serial.Add(serial, big.NewInt(1))
 	return serial, nil
 }
 
-func (d *MySQLDepot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
-	rows, err := d.db.Query("SELECT id, status, valid_from FROM certificates WHERE cn = ?", cn)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-
-	var candidates = make(map[string]string)
-	for rows.Next() {
-		var id int
-		var status string
-		var validFrom time.Time
-		if err := rows.Scan(&id, &status, &validFrom); err != nil {
-			return false, err
-		}
-
-		serial := fmt.Sprintf("%x", cert.SerialNumber)
-		if status == "R" {
-			candidates[serial] = fmt.Sprintf("%d", id)
-			delete(candidates, serial)
-		} else if status == "V" {
-			if validFrom.After(time.Now().AddDate(0, 0, allowTime)) && allowTime > 0 {
-				candidates[serial] = "no"
-			} else {
-				candidates[serial] = fmt.Sprintf("%d", id)
-			}
-		}
-	}
-	for _, value := range candidates {
-		if value == "no" {
-			return false, errors.New("CN " + cn + " already exists")
-		}
-		if revokeOldCertificate {
-			id, err := strconv.Atoi(value)
-			if err != nil {
-				return false, err
-			}
-			_, err = d.db.Exec("UPDATE certificates SET status = 'R', revocation_date = ? WHERE id = ?", time.Now(), id)
-			if err != nil {
-				return false, err
-			}
-		}
-	}
-	return true, nil
-}
-
-func (d *MySQLDepot) writeDB(cn string, serial *big.Int, challenge string, cert *x509.Certificate) error {
-	client, err := d.GetClient(cn)
-	if err != nil {
-		return err
-	}
-	if client.Status == "ISSUABLE" {
-		if _, err := d.HasCN(cn, 0, cert, true); err != nil {
-			return err
-		}
-		if err := d.UpdateStatusClient(cn, "ISSUED"); err != nil {
-			return err
-		}
-	} else if client.Status == "UPDATABLE" {
-		if _, err := d.HasCN(cn, 0, cert, false); err != nil {
-			return err
-		}
-		if err := d.UpdateStatusClient(cn, "PENDING"); err != nil {
-			return err
-		}
-		secret, err := d.GetSecret(cn)
-		if err != nil {
-			return err
-		}
-		duration, err := time.ParseDuration(secret.Pending_Period)
-		if err != nil {
-			return err
-		}
-		revocation_date := time.Now().Add(duration)
-		_, err = d.db.Exec("UPDATE certificates SET revocation_date = ? WHERE cn = ? AND status = 'V'", revocation_date, cn)
-		if err != nil {
-			return err
-		}
-	} else {
-		return errors.New("client is not issuable or updatable")
-	}
-
-	notBefore := cert.NotBefore
-	notAfter := cert.NotAfter
-
-	serialStr := fmt.Sprintf("%x", serial) // Convert serial to string
-	_, err = d.db.Exec("INSERT INTO certificates (cn, serial, cert_data, status, valid_from, valid_till) VALUES (?, ?, ?, ?, ?, ?)",
-		cn, serialStr, cert.Raw, "V", notBefore, notAfter)
-	if err != nil {
-		return err
-	}
-	if err := d.DeleteSecret(cn); err != nil {
-		return err
-	}
-	return nil
+func (dialect) ClaimSerial(db *sql.DB, serial *big.Int) (bool, error) {
+	s, err := allocateSerial(db, serial)
+	return s != nil, err
 }
 
-func (d *MySQLDepot) writeSerial(serial *big.Int) error {
-	serialStr := fmt.Sprintf("%x", serial.Bytes())
-	var rowExists int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM serial_table").Scan(&rowExists)
-	if err != nil {
-		return err
+// DumpStyle writes times like the driver, in the location of the loc
+// parameter of the DSN, which is also the one it reads them in. As the
+// TIMESTAMP columns read them in the time zone of the session, a dump is
+// restored with the loc and time_zone parameters it was dumped with.
+func (dialect) DumpStyle() sqldepot.DumpStyle {
+	return sqldepot.DumpStyle{
+		TimeLayout:       "2006-01-02 15:04:05.999999",
+		DriverLocation:   true,
+		BackslashEscapes: true,
+		BlobPrefix:       "X'",
 	}
-	if rowExists > 0 {
-		_, err = d.db.Exec("UPDATE serial_table SET serial = ? ORDER BY id LIMIT 1", serialStr)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err = d.db.Exec("INSERT INTO serial_table (serial) VALUES (?)", serialStr)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
 }
 
-func (d *MySQLDepot) incrementSerial(s *big.Int) error {
-	serial := s.Add(s, big.NewInt(1))
-	if err := d.writeSerial(serial); err != nil {
-		return err
+func (dialect) SetSerialSQL(serial *big.Int) []string {
+	return []string{
+		"DELETE FROM serial_table",
+		fmt.Sprintf("INSERT INTO serial_table (serial) VALUES ('%x')", serial.Bytes()),
 	}
-	return nil
 }
 
-// Load an encrypted private key from disk
-func loadKey(data []byte, password []byte) (*rsa.PrivateKey, error) {
-	pemBlock, _ := pem.Decode(data)
-	if pemBlock == nil {
-		return nil, errors.New("PEM decode failed")
-	}
-
-	if x509.IsEncryptedPEMBlock(pemBlock) {
-		b, err := x509.DecryptPEMBlock(pemBlock, password)
-		if err != nil {
-			return nil, err
-		}
-		return x509.ParsePKCS1PrivateKey(b)
+// allocateSerial allocates the serial number following the one stored in
+// serial_table, holding its row locked until the new one is stored. If want
+// is not nil, nothing is allocated and nil is returned unless want is the
+// next serial number.
+func allocateSerial(db *sql.DB, want *big.Int) (*big.Int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
 	}
-	return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
-}
+	defer tx.Rollback()
 
-func loadCert(data []byte) (*x509.Certificate, error) {
-	pemBlock, _ := pem.Decode(data)
-	if pemBlock == nil {
-		return nil, errors.New("PEM decode failed")
+	serial := big.NewInt(2)
+	var serialStr string
+	err = tx.QueryRow("SELECT serial FROM serial_table ORDER BY id LIMIT 1 FOR UPDATE").Scan(&serialStr)
+	exists := err == nil
+	if exists {
+		serial.SetString(serialStr, 16)
+		serial.Add(serial, big.NewInt(1))
+	} else if err != sql.ErrNoRows {
+		return nil, err
 	}
-	return x509.ParseCertificate(pemBlock.Bytes)
-}
-
-type file struct {
-	Info os.FileInfo
-	Data []byte
-}
-
-func (d *MySQLDepot) check(path string) error {
-	name := d.path(path)
-	_, err := os.Stat(name)
-	if err != nil {
-		return err
+	if want != nil && want.Cmp(serial) != 0 {
+		return nil, nil
 	}
-	return nil
-}
-
-func (d *MySQLDepot) path(name string) string {
-	return filepath.Join(d.dirPath, name)
-}
 
-func (d *MySQLDepot) GetFile(path string) (*file, error) {
-	if err := d.check(path); err != nil {
-		return nil, err
+	serialStr = fmt.Sprintf("%x", serial.Bytes())
+	if exists {
+		_, err = tx.Exec("UPDATE serial_table SET serial = ? ORDER BY id LIMIT 1", serialStr)
+	} else {
+		_, err = tx.Exec("INSERT INTO serial_table (serial) VALUES (?)", serialStr)
 	}
-	fi, err := os.Stat(d.path(path))
 	if err != nil {
 		return nil, err
 	}
-	b, err := os.ReadFile(d.path(path))
-	return &file{fi, b}, err
+	return serial, tx.Commit()
 }
@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/procube-open/scep/depot/depottest"
+	"github.com/procube-open/scep/depot/sqldepot"
+)
+
+// newTestDepot opens the MySQL database of SCEP_TEST_MYSQL_DSN, skipping the
+// test if it is not set. The CI workflow sets it to the database of a MySQL
+// service. The lifecycle shared with the other SQL depots is also tested
+// without a server by the sqlite package.
+func newTestDepot(t *testing.T, opts ...sqldepot.Option) *MySQLDepot {
+	dsn := os.Getenv("SCEP_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SCEP_TEST_MYSQL_DSN is not set")
+	}
+	d, err := NewTableDepot(dsn, t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.DB().Close() })
+	return d
+}
+
+func TestDepot(t *testing.T) {
+	d := newTestDepot(t)
+	depottest.TestStore(t, d)
+	depottest.TestInvitations(t, d)
+	depottest.TestExpiration(t, d)
+	depottest.TestChallengeStore(t, d)
+	depottest.TestMultiCA(t, d)
+	depottest.TestConcurrentEnrollment(t, d)
+	depottest.TestSerials(t, d)
+}
+
+func TestRandomSerials(t *testing.T) {
+	depottest.TestRandomSerials(t, newTestDepot(t, sqldepot.WithRandomSerials()))
+}
+
+// newEmptyDepot creates a database on the server of SCEP_TEST_MYSQL_DSN,
+// which is dropped at the end of the test. The times of its connections
+// are in Asia/Tokyo and its sessions in UTC, so that the times written by
+// the driver are not in the time zone of the session.
+func newEmptyDepot(t *testing.T) *MySQLDepot {
+	dsn := os.Getenv("SCEP_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SCEP_TEST_MYSQL_DSN is not set")
+	}
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Loc, err = time.LoadLocation("Asia/Tokyo"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	cfg.ParseTime = true
+
+	db, err := Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DBName = "scep_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := db.Exec("CREATE DATABASE " + cfg.DBName); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP DATABASE " + cfg.DBName)
+		db.Close()
+	})
+	d, err := NewTableDepot(cfg.FormatDSN(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.DB().Close() })
+	return d
+}
+
+func TestDumpRestore(t *testing.T) {
+	depottest.TestDumpRestore(t, newEmptyDepot(t), newEmptyDepot(t))
+}
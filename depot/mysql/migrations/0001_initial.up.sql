@@ -0,0 +1,56 @@
+CREATE TABLE IF NOT EXISTS clients (
+	uid VARCHAR(255) NOT NULL PRIMARY KEY,
+	status VARCHAR(255) NOT NULL,
+	attributes TEXT DEFAULT NULL,
+	archived_at TIMESTAMP NULL DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS certificates (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	cn VARCHAR(255) NOT NULL,
+	serial VARCHAR(255) NOT NULL,
+	cert_data BLOB NOT NULL,
+	status CHAR(1) NOT NULL,
+	valid_from TIMESTAMP NOT NULL,
+	valid_till TIMESTAMP NOT NULL,
+	revocation_date TIMESTAMP DEFAULT NULL,
+	revocation_reason INT DEFAULT NULL,
+	invalidity_date TIMESTAMP NULL DEFAULT NULL,
+	key_id CHAR(64) DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS serial_table (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	serial VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+	challenge VARCHAR(255) NOT NULL PRIMARY KEY,
+	secret VARCHAR(255) NOT NULL,
+	target VARCHAR(255) NOT NULL,
+	type VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	delete_at TIMESTAMP NOT NULL,
+	pending_period VARCHAR(255) DEFAULT NULL,
+	profile VARCHAR(255) DEFAULT NULL,
+	FOREIGN KEY (target) REFERENCES clients(uid)
+);
+
+CREATE TABLE IF NOT EXISTS invitations (
+	jti VARCHAR(64) NOT NULL PRIMARY KEY,
+	target VARCHAR(255) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	redeemed_at TIMESTAMP NULL DEFAULT NULL,
+	FOREIGN KEY (target) REFERENCES clients(uid)
+);
+
+CREATE TABLE IF NOT EXISTS challenge_jtis (
+	jti VARCHAR(255) NOT NULL PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS challenges (
+	challenge VARCHAR(64) NOT NULL PRIMARY KEY,
+	uid VARCHAR(255) DEFAULT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX certificates_cn ON certificates;
+DROP INDEX certificates_key_id ON certificates;
@@ -0,0 +1,2 @@
+CREATE INDEX certificates_cn ON certificates (cn);
+CREATE INDEX certificates_key_id ON certificates (key_id);
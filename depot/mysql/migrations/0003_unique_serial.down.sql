@@ -0,0 +1 @@
+DROP INDEX certificates_serial ON certificates;
@@ -0,0 +1,3 @@
+-- serial_table has a row for allocateSerial to lock
+INSERT INTO serial_table (serial) SELECT '01' FROM DUAL WHERE NOT EXISTS (SELECT * FROM serial_table);
+CREATE UNIQUE INDEX certificates_serial ON certificates (serial);
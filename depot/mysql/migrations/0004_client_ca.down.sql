@@ -0,0 +1,2 @@
+DROP INDEX clients_ca ON clients;
+ALTER TABLE clients DROP COLUMN ca;
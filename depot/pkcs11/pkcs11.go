@@ -0,0 +1,102 @@
+//go:build cgo
+
+// Package pkcs11 keeps the CA key in a PKCS#11 token, such as an HSM, so
+// that it never leaves the token.
+package pkcs11
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// Config selects the token and the CA key in it.
+type Config struct {
+	// Module is the path of the PKCS#11 library of the token.
+	Module string
+	// Slot is the number of the slot the token is in.
+	Slot int
+	// PIN logs in to the token as the user.
+	PIN string
+	// Label is the CKA_LABEL of the CA key.
+	Label string
+}
+
+// Token is a session with a PKCS#11 token.
+type Token struct {
+	ctx   *crypto11.Context
+	label []byte
+}
+
+// Open loads the module of cfg and logs in to the token in its slot.
+func Open(cfg Config) (*Token, error) {
+	if cfg.Module == "" {
+		return nil, errors.New("pkcs11: missing module path")
+	}
+	if cfg.Label == "" {
+		return nil, errors.New("pkcs11: missing key label")
+	}
+	slot := cfg.Slot
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       cfg.Module,
+		SlotNumber: &slot,
+		Pin:        cfg.PIN,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	return &Token{ctx: ctx, label: []byte(cfg.Label)}, nil
+}
+
+// Key returns the CA key of the token.
+func (t *Token) Key() (depot.CAKey, error) {
+	return t.KeyLabeled(string(t.label))
+}
+
+// KeyLabeled returns the key labeled label of the token, for tokens holding
+// the keys of several CAs.
+func (t *Token) KeyLabeled(label string) (depot.CAKey, error) {
+	signer, err := t.ctx.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("pkcs11: no key labeled %q in the token", label)
+	}
+	key, ok := signer.(depot.CAKey)
+	if !ok {
+		return nil, fmt.Errorf("pkcs11: key labeled %q cannot decrypt, the CA key must be RSA", label)
+	}
+	return key, nil
+}
+
+// GenerateKey creates an RSA CA key of bits in the token. It fails if the
+// token already has a key with the label.
+func (t *Token) GenerateKey(bits int) (depot.CAKey, error) {
+	existing, err := t.ctx.FindKeyPair(nil, t.label)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("pkcs11: the token already has a key labeled %q", t.label)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key, err := t.ctx.GenerateRSAKeyPairWithLabel(id, t.label, bits)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	return key, nil
+}
+
+// Close logs out of the token. The keys of the token cannot be used after
+// it is closed.
+func (t *Token) Close() error {
+	return t.ctx.Close()
+}
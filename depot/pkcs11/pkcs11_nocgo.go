@@ -0,0 +1,53 @@
+//go:build !cgo
+
+// Package pkcs11 keeps the CA key in a PKCS#11 token, such as an HSM, so
+// that it never leaves the token.
+package pkcs11
+
+import (
+	"errors"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// Config selects the token and the CA key in it.
+type Config struct {
+	// Module is the path of the PKCS#11 library of the token.
+	Module string
+	// Slot is the number of the slot the token is in.
+	Slot int
+	// PIN logs in to the token as the user.
+	PIN string
+	// Label is the CKA_LABEL of the CA key.
+	Label string
+}
+
+// Token is a session with a PKCS#11 token.
+type Token struct{}
+
+var errNoCgo = errors.New("pkcs11: scepserver was built without cgo, which PKCS#11 modules need")
+
+// Open fails, as PKCS#11 modules cannot be loaded without cgo.
+func Open(cfg Config) (*Token, error) {
+	return nil, errNoCgo
+}
+
+// Key returns the CA key of the token.
+func (t *Token) Key() (depot.CAKey, error) {
+	return nil, errNoCgo
+}
+
+// KeyLabeled returns the key labeled label of the token.
+func (t *Token) KeyLabeled(label string) (depot.CAKey, error) {
+	return nil, errNoCgo
+}
+
+// GenerateKey creates an RSA CA key of bits in the token.
+func (t *Token) GenerateKey(bits int) (depot.CAKey, error) {
+	return nil, errNoCgo
+}
+
+// Close logs out of the token.
+func (t *Token) Close() error {
+	return nil
+}
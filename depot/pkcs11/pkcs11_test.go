@@ -0,0 +1,162 @@
+//go:build cgo
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// softHSMModules are where distributions install the SoftHSM module.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSM initializes a SoftHSM token in a temporary directory and returns
+// its configuration. The test is skipped if SoftHSM is not installed; set
+// SCEP_TEST_PKCS11_MODULE if its module is elsewhere.
+func softHSM(t *testing.T) Config {
+	t.Helper()
+	module := os.Getenv("SCEP_TEST_PKCS11_MODULE")
+	if module == "" {
+		for _, m := range softHSMModules {
+			if _, err := os.Stat(m); err == nil {
+				module = m
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM is not installed")
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util is not installed")
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	out, err := exec.Command(util, "--init-token", "--free", "--label", "scep", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util: %v: %s", err, out)
+	}
+	m := regexp.MustCompile(`reassigned to slot (\d+)`).FindSubmatch(out)
+	if m == nil {
+		t.Fatalf("softhsm2-util: no slot in %q", out)
+	}
+	slot, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{Module: module, Slot: slot, PIN: "1234", Label: "scep-ca"}
+}
+
+func TestGenerateKey(t *testing.T) {
+	cfg := softHSM(t)
+	token, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+
+	if _, err := token.Key(); err == nil {
+		t.Fatal("found a key in an empty token")
+	}
+	generated, err := token.GenerateKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.GenerateKey(2048); err == nil {
+		t.Error("generated a second key with the same label")
+	}
+
+	key, err := token.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := key.Public().(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("public key is %T, want *rsa.PublicKey", key.Public())
+	}
+	if !pub.Equal(generated.Public()) {
+		t.Error("found key differs from the generated key")
+	}
+
+	digest := sha256.Sum256([]byte("scep"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("verify signature: %v", err)
+	}
+
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte("content encryption key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := key.Decrypt(rand.Reader, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "content encryption key" {
+		t.Errorf("decrypted %q", plaintext)
+	}
+}
+
+func TestKeyPersists(t *testing.T) {
+	cfg := softHSM(t)
+	token, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := token.GenerateKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := generated.Public().(*rsa.PublicKey)
+	token.Close()
+
+	token, err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+	key, err := token.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(key.Public()) {
+		t.Error("key differs after reopening the token")
+	}
+}
+
+func TestOpenWrongPIN(t *testing.T) {
+	cfg := softHSM(t)
+	cfg.PIN = "0000"
+	if token, err := Open(cfg); err == nil {
+		token.Close()
+		t.Fatal("opened the token with a wrong PIN")
+	}
+}
@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/procube-open/scep/depot/depottest"
+	"github.com/procube-open/scep/depot/sqldepot"
+)
+
+// newTestDepot opens the PostgreSQL database of SCEP_TEST_POSTGRES_DSN,
+// skipping the test if it is not set. The CI workflow sets it to the
+// database of a PostgreSQL service.
+func newTestDepot(t *testing.T, opts ...sqldepot.Option) *sqldepot.Depot {
+	dsn := os.Getenv("SCEP_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SCEP_TEST_POSTGRES_DSN is not set")
+	}
+	d, err := NewDepot(dsn, t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.DB().Close() })
+	return d
+}
+
+func TestDepot(t *testing.T) {
+	d := newTestDepot(t)
+	depottest.TestStore(t, d)
+	depottest.TestInvitations(t, d)
+	depottest.TestExpiration(t, d)
+	depottest.TestChallengeStore(t, d)
+	depottest.TestMultiCA(t, d)
+	depottest.TestConcurrentEnrollment(t, d)
+	depottest.TestSerials(t, d)
+}
+
+func TestRandomSerials(t *testing.T) {
+	depottest.TestRandomSerials(t, newTestDepot(t, sqldepot.WithRandomSerials()))
+}
+
+func TestSerial(t *testing.T) {
+	d := newTestDepot(t)
+	next, err := d.GetNextSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := d.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Cmp(next) != 0 {
+		t.Errorf("Serial() = %v, GetNextSerial() returned %v", serial, next)
+	}
+	again, err := d.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Cmp(serial) <= 0 {
+		t.Errorf("second Serial() = %v, want more than %v", again, serial)
+	}
+}
+
+// newEmptyDepot creates a database on the server of SCEP_TEST_POSTGRES_DSN,
+// which is dropped at the end of the test. Its sessions are in Asia/Tokyo,
+// so that the times it reads are not in UTC.
+func newEmptyDepot(t *testing.T) *sqldepot.Depot {
+	dsn := os.Getenv("SCEP_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SCEP_TEST_POSTGRES_DSN is not set")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "scep_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := db.Exec("CREATE DATABASE " + name); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP DATABASE " + name)
+		db.Close()
+	})
+	u.Path = "/" + name
+	q := u.Query()
+	q.Set("timezone", "Asia/Tokyo")
+	u.RawQuery = q.Encode()
+	d, err := NewDepot(u.String(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.DB().Close() })
+	return d
+}
+
+func TestDumpRestore(t *testing.T) {
+	depottest.TestDumpRestore(t, newEmptyDepot(t), newEmptyDepot(t))
+}
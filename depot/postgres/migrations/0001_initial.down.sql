@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS challenges;
+DROP TABLE IF EXISTS challenge_jtis;
+DROP TABLE IF EXISTS invitations;
+DROP TABLE IF EXISTS secrets;
+DROP SEQUENCE IF EXISTS certificate_serial;
+DROP TABLE IF EXISTS certificates;
+DROP TABLE IF EXISTS clients;
@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS clients (
+	uid VARCHAR(255) NOT NULL PRIMARY KEY,
+	status VARCHAR(255) NOT NULL,
+	attributes TEXT DEFAULT NULL,
+	archived_at TIMESTAMPTZ NULL DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS certificates (
+	id SERIAL PRIMARY KEY,
+	cn VARCHAR(255) NOT NULL,
+	serial VARCHAR(255) NOT NULL,
+	cert_data BYTEA NOT NULL,
+	status CHAR(1) NOT NULL,
+	valid_from TIMESTAMPTZ NOT NULL,
+	valid_till TIMESTAMPTZ NOT NULL,
+	revocation_date TIMESTAMPTZ DEFAULT NULL,
+	revocation_reason INT DEFAULT NULL,
+	invalidity_date TIMESTAMPTZ NULL DEFAULT NULL,
+	key_id CHAR(64) DEFAULT NULL
+);
+
+CREATE SEQUENCE IF NOT EXISTS certificate_serial START WITH 2;
+
+CREATE TABLE IF NOT EXISTS secrets (
+	challenge VARCHAR(255) NOT NULL PRIMARY KEY,
+	secret VARCHAR(255) NOT NULL,
+	target VARCHAR(255) NOT NULL REFERENCES clients(uid),
+	type VARCHAR(255) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	delete_at TIMESTAMPTZ NOT NULL,
+	pending_period VARCHAR(255) DEFAULT NULL,
+	profile VARCHAR(255) DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invitations (
+	jti VARCHAR(64) NOT NULL PRIMARY KEY,
+	target VARCHAR(255) NOT NULL REFERENCES clients(uid),
+	expires_at TIMESTAMPTZ NOT NULL,
+	redeemed_at TIMESTAMPTZ NULL DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS challenge_jtis (
+	jti VARCHAR(255) NOT NULL PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS challenges (
+	challenge VARCHAR(64) NOT NULL PRIMARY KEY,
+	uid VARCHAR(255) DEFAULT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX certificates_serial ON certificates (serial);
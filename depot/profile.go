@@ -0,0 +1,215 @@
+package depot
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profile defines the contents of the certificates issued to a class of
+// clients, such as the key usages, validity and which SANs are copied from
+// the CSR.
+type Profile struct {
+	// KeyUsage lists key usages by their RFC 5280 name, e.g. "digitalSignature".
+	KeyUsage []string `json:"key_usage"`
+
+	// ExtKeyUsage lists extended key usages by name, e.g. "clientAuth",
+	// or by dotted OID.
+	ExtKeyUsage []string `json:"ext_key_usage"`
+
+	// ValidityDays overrides the validity of the Signer when non-zero.
+	ValidityDays int `json:"validity_days"`
+
+	// SANs lists the SAN types copied from the CSR: "dns", "ip", "email"
+	// and "uri". SANs of other types are dropped.
+	SANs []string `json:"sans"`
+
+	// PolicyOIDs are added to the certificate policies extension.
+	PolicyOIDs []string `json:"policy_oids"`
+
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+	unknownEKU  []asn1.ObjectIdentifier
+	policies    []x509.OID
+	sans        map[string]bool
+}
+
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"nonRepudiation":    x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+var sanTypes = []string{"dns", "ip", "email", "uri"}
+
+// BuiltinProfiles returns the profiles that are available without
+// configuration.
+func BuiltinProfiles() map[string]*Profile {
+	profiles := map[string]*Profile{
+		"client-auth": {
+			KeyUsage:    []string{"digitalSignature"},
+			ExtKeyUsage: []string{"clientAuth"},
+			SANs:        sanTypes,
+		},
+		"server-auth": {
+			KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage: []string{"serverAuth"},
+			SANs:        []string{"dns", "ip"},
+		},
+		"smime": {
+			KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage: []string{"emailProtection"},
+			SANs:        []string{"email"},
+		},
+		"802.1x": {
+			KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage: []string{"clientAuth"},
+			SANs:        []string{"dns", "email", "uri"},
+		},
+		"code-signing": {
+			KeyUsage:    []string{"digitalSignature"},
+			ExtKeyUsage: []string{"codeSigning"},
+		},
+	}
+	for name, p := range profiles {
+		if err := p.compile(); err != nil {
+			panic("depot: invalid builtin profile " + name + ": " + err.Error())
+		}
+	}
+	return profiles
+}
+
+// LoadProfiles reads a JSON object of profiles keyed by name from path.
+// The profiles are merged over the builtin ones, so a file can both
+// override builtin profiles and add new ones.
+func LoadProfiles(path string) (map[string]*Profile, error) {
+	profiles := BuiltinProfiles()
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded map[string]*Profile
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("parsing profiles: %w", err)
+	}
+	for name, p := range loaded {
+		if p == nil {
+			return nil, fmt.Errorf("profile %q is empty", name)
+		}
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// compile resolves the names in p into their x509 values.
+func (p *Profile) compile() error {
+	p.keyUsage = 0
+	for _, name := range p.KeyUsage {
+		ku, ok := keyUsageNames[name]
+		if !ok {
+			return fmt.Errorf("unknown key usage %q", name)
+		}
+		p.keyUsage |= ku
+	}
+	p.extKeyUsage, p.unknownEKU = nil, nil
+	for _, name := range p.ExtKeyUsage {
+		if eku, ok := extKeyUsageNames[name]; ok {
+			p.extKeyUsage = append(p.extKeyUsage, eku)
+			continue
+		}
+		oid, err := parseOID(name)
+		if err != nil {
+			return fmt.Errorf("unknown extended key usage %q", name)
+		}
+		p.unknownEKU = append(p.unknownEKU, oid)
+	}
+	p.policies = nil
+	for _, s := range p.PolicyOIDs {
+		oid, err := x509.ParseOID(s)
+		if err != nil {
+			return fmt.Errorf("invalid policy OID %q", s)
+		}
+		p.policies = append(p.policies, oid)
+	}
+	p.sans = make(map[string]bool)
+	for _, t := range p.SANs {
+		if !contains(sanTypes, t) {
+			return fmt.Errorf("unknown SAN type %q", t)
+		}
+		p.sans[t] = true
+	}
+	if p.ValidityDays < 0 {
+		return fmt.Errorf("negative validity_days")
+	}
+	return nil
+}
+
+// apply sets the usages, policies and SANs of the profile on tmpl.
+func (p *Profile) apply(tmpl *x509.Certificate, csr *x509.CertificateRequest) {
+	tmpl.KeyUsage = p.keyUsage
+	tmpl.ExtKeyUsage = p.extKeyUsage
+	tmpl.UnknownExtKeyUsage = p.unknownEKU
+	tmpl.Policies = p.policies
+	tmpl.DNSNames, tmpl.IPAddresses, tmpl.EmailAddresses, tmpl.URIs = nil, nil, nil, nil
+	if p.sans["dns"] {
+		tmpl.DNSNames = csr.DNSNames
+	}
+	if p.sans["ip"] {
+		tmpl.IPAddresses = csr.IPAddresses
+	}
+	if p.sans["email"] {
+		tmpl.EmailAddresses = csr.EmailAddresses
+	}
+	if p.sans["uri"] {
+		tmpl.URIs = csr.URIs
+	}
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
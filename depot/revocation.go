@@ -0,0 +1,132 @@
+package depot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// RevocationReason is a CRLReason as defined in RFC 5280 Section 5.3.1.
+type RevocationReason int
+
+const (
+	Unspecified          RevocationReason = 0
+	KeyCompromise        RevocationReason = 1
+	CACompromise         RevocationReason = 2
+	AffiliationChanged   RevocationReason = 3
+	Superseded           RevocationReason = 4
+	CessationOfOperation RevocationReason = 5
+	CertificateHold      RevocationReason = 6
+	RemoveFromCRL        RevocationReason = 8
+	PrivilegeWithdrawn   RevocationReason = 9
+	AACompromise         RevocationReason = 10
+)
+
+var revocationReasonNames = map[RevocationReason]string{
+	Unspecified:          "unspecified",
+	KeyCompromise:        "keyCompromise",
+	CACompromise:         "cACompromise",
+	AffiliationChanged:   "affiliationChanged",
+	Superseded:           "superseded",
+	CessationOfOperation: "cessationOfOperation",
+	CertificateHold:      "certificateHold",
+	RemoveFromCRL:        "removeFromCRL",
+	PrivilegeWithdrawn:   "privilegeWithdrawn",
+	AACompromise:         "aACompromise",
+}
+
+func (r RevocationReason) String() string {
+	if name, ok := revocationReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RevocationReason(%d)", int(r))
+}
+
+// ParseRevocationReason parses either the RFC 5280 name of a reason
+// (e.g. "keyCompromise") or its integer value.
+func ParseRevocationReason(s string) (RevocationReason, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		r := RevocationReason(n)
+		if _, ok := revocationReasonNames[r]; !ok {
+			return 0, fmt.Errorf("unknown revocation reason %d", n)
+		}
+		return r, nil
+	}
+	for r, name := range revocationReasonNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %q", s)
+}
+
+// UnmarshalJSON accepts both the name and the integer value of a reason.
+func (r *RevocationReason) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("revocation reason must be a string or an integer")
+		}
+		s = strconv.Itoa(n)
+	}
+	reason, err := ParseRevocationReason(s)
+	if err != nil {
+		return err
+	}
+	*r = reason
+	return nil
+}
+
+// MarshalJSON encodes the reason by its RFC 5280 name.
+func (r RevocationReason) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+var oidExtensionInvalidityDate = asn1.ObjectIdentifier{2, 5, 29, 24}
+
+// IssuedBy reports whether c was issued by the CA whose DER encoded subject
+// is rawIssuer.
+func (c *Certificate) IssuedBy(rawIssuer []byte) bool {
+	block, _ := pem.Decode([]byte(c.CertData))
+	if block == nil {
+		return false
+	}
+	return IssuedBy(block.Bytes, rawIssuer)
+}
+
+// IssuedBy reports whether the DER encoded certificate der was issued by
+// the CA whose DER encoded subject is rawIssuer.
+func IssuedBy(der, rawIssuer []byte) bool {
+	crt, err := x509.ParseCertificate(der)
+	return err == nil && bytes.Equal(crt.RawIssuer, rawIssuer)
+}
+
+// RevocationListEntry returns the CRL entry of a revoked or held certificate,
+// with an invalidity date extension if the certificate has one.
+func RevocationListEntry(c *Certificate) (x509.RevocationListEntry, error) {
+	rc := x509.RevocationListEntry{
+		SerialNumber:   new(big.Int).Set(&c.Serial),
+		RevocationTime: c.RevocationDate,
+	}
+	if c.RevocationReason != nil {
+		rc.ReasonCode = int(*c.RevocationReason)
+	}
+	if c.InvalidityDate != nil {
+		v, err := asn1.MarshalWithParams(c.InvalidityDate.UTC(), "generalized")
+		if err != nil {
+			return rc, err
+		}
+		rc.ExtraExtensions = append(rc.ExtraExtensions, pkix.Extension{
+			Id:    oidExtensionInvalidityDate,
+			Value: v,
+		})
+	}
+	return rc, nil
+}
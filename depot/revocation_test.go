@@ -0,0 +1,52 @@
+package depot
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RevocationReason
+		wantErr bool
+	}{
+		{in: "keyCompromise", want: KeyCompromise},
+		{in: "cessationOfOperation", want: CessationOfOperation},
+		{in: "4", want: Superseded},
+		{in: "7", wantErr: true},
+		{in: "KeyCompromise", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRevocationReason(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRevocationReason(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRevocationReason(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRevocationReasonJSON(t *testing.T) {
+	var req struct {
+		Reason RevocationReason `json:"reason_code"`
+	}
+	for _, body := range []string{`{"reason_code":"superseded"}`, `{"reason_code":4}`} {
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Reason != Superseded {
+			t.Errorf("%s: have %v, want %v", body, req.Reason, Superseded)
+		}
+	}
+	b, err := json.Marshal(KeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(b), `"keyCompromise"`; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
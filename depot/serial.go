@@ -0,0 +1,35 @@
+package depot
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// RandomSerialBits is the size of random serial numbers. 159 bits keep the
+// DER encoding positive and within the 20 octets allowed by RFC 5280, and
+// exceed the 64 bits of entropy required by the CA/Browser Forum.
+const RandomSerialBits = 159
+
+// ErrRandomSerial is returned by GetNextSerial of a store allocating random
+// serial numbers.
+var ErrRandomSerial = errors.New("serial numbers are random and cannot be predicted")
+
+// ErrSerialInUse is returned when a certificate with the same serial number
+// is already stored.
+var ErrSerialInUse = errors.New("serial number is already in use")
+
+// RandomSerial returns a random positive serial number of at most
+// RandomSerialBits bits.
+func RandomSerial() (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), RandomSerialBits)
+	for {
+		serial, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
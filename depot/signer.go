@@ -1,8 +1,10 @@
 package depot
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/x509"
+	"fmt"
 	"time"
 
 	"github.com/procube-open/scep/cryptoutil"
@@ -18,6 +20,9 @@ type Signer struct {
 	validityDays     int
 	serverAttrs      bool
 	signatureAlgo    x509.SignatureAlgorithm
+	profiles         map[string]*Profile
+	defaultProfile   string
+	subjectPolicy    *SubjectPolicy
 }
 
 // Option customizes Signer
@@ -30,6 +35,7 @@ func NewSigner(depot Depot, opts ...Option) *Signer {
 		allowRenewalDays: 14,
 		validityDays:     365,
 		signatureAlgo:    0,
+		profiles:         BuiltinProfiles(),
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -73,8 +79,53 @@ func WithSeverAttrs() Option {
 	}
 }
 
+// WithProfiles sets the certificate profiles that can be selected by name.
+func WithProfiles(profiles map[string]*Profile) Option {
+	return func(s *Signer) {
+		s.profiles = profiles
+	}
+}
+
+// WithDefaultProfile sets the profile used when the enrollment does not
+// select one. Without a default profile, certificates are issued for client
+// authentication, or server usage if WithSeverAttrs is set.
+func WithDefaultProfile(name string) Option {
+	return func(s *Signer) {
+		s.defaultProfile = name
+	}
+}
+
+// WithSubjectPolicy sets the policy used to build or validate the subject
+// and SANs of certificates from the attributes of the enrolling client.
+func WithSubjectPolicy(p *SubjectPolicy) Option {
+	return func(s *Signer) {
+		s.subjectPolicy = p
+	}
+}
+
 // SignCSR signs a certificate using Signer's Depot CA
 func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	return s.SignCSRContext(context.Background(), m)
+}
+
+// SignCSRContext signs a certificate using Signer's Depot CA and the
+// certificate profile selected by the Enrollment in ctx. When ctx carries an
+// Enrollment, the common name is forced to its uid and the subject policy
+// of the Signer is enforced.
+func (s *Signer) SignCSRContext(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	e, hasEnrollment := FromContext(ctx)
+	profileName := s.defaultProfile
+	if hasEnrollment && e.Profile != "" {
+		profileName = e.Profile
+	}
+	var profile *Profile
+	if profileName != "" {
+		var ok bool
+		if profile, ok = s.profiles[profileName]; !ok {
+			return nil, fmt.Errorf("unknown certificate profile %q", profileName)
+		}
+	}
+
 	id, err := cryptoutil.GenerateSubjectKeyID(m.CSR.PublicKey)
 	if err != nil {
 		return nil, err
@@ -108,11 +159,22 @@ func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
 		URIs:               m.CSR.URIs,
 	}
 
-	if s.serverAttrs {
+	if profile != nil {
+		profile.apply(tmpl, m.CSR)
+		if profile.ValidityDays > 0 {
+			tmpl.NotAfter = time.Now().AddDate(0, 0, profile.ValidityDays).UTC()
+		}
+	} else if s.serverAttrs {
 		tmpl.KeyUsage |= x509.KeyUsageDataEncipherment | x509.KeyUsageKeyEncipherment
 		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
 	}
 
+	if hasEnrollment && e.UID != "" {
+		if err := enforceSubject(s.subjectPolicy, tmpl, m.CSR, e); err != nil {
+			return nil, err
+		}
+	}
+
 	caCerts, caKey, err := s.depot.CA([]byte(s.caPass))
 	if err != nil {
 		return nil, err
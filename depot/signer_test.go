@@ -0,0 +1,140 @@
+package depot_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	scepdepot "github.com/procube-open/scep/depot"
+	boltdepot "github.com/procube-open/scep/depot/bolt"
+	"github.com/procube-open/scep/scep"
+)
+
+func newTestSigner(t *testing.T, opts ...scepdepot.Option) *scepdepot.Signer {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "depot.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	depot, err := boltdepot.NewBoltDepot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := depot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := depot.CreateOrLoadCA(key, 1, "PROCUBE", "JP"); err != nil {
+		t.Fatal(err)
+	}
+	return scepdepot.NewSigner(depot, opts...)
+}
+
+func newTestCSR(t *testing.T, cn string) *scep.CSRReqMessage {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: cn},
+		DNSNames:       []string{cn + ".example.com"},
+		EmailAddresses: []string{cn + "@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &scep.CSRReqMessage{RawDecrypted: der, CSR: csr}
+}
+
+func TestSignerProfiles(t *testing.T) {
+	signer := newTestSigner(t, scepdepot.WithDefaultProfile("client-auth"))
+
+	crt, err := signer.SignCSRContext(context.Background(), newTestCSR(t, "default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := crt.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}; !reflect.DeepEqual(have, want) {
+		t.Errorf("default profile: have EKU %v, want %v", have, want)
+	}
+	if len(crt.EmailAddresses) != 1 {
+		t.Errorf("default profile: email SAN was not copied")
+	}
+
+	ctx := scepdepot.NewContext(context.Background(), &scepdepot.Enrollment{UID: "server", Profile: "server-auth"})
+	crt, err = signer.SignCSRContext(ctx, newTestCSR(t, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := crt.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}; !reflect.DeepEqual(have, want) {
+		t.Errorf("server-auth: have EKU %v, want %v", have, want)
+	}
+	if crt.KeyUsage&x509.KeyUsageKeyEncipherment == 0 {
+		t.Errorf("server-auth: keyEncipherment is missing")
+	}
+	if len(crt.DNSNames) != 1 || len(crt.IPAddresses) != 1 || len(crt.EmailAddresses) != 0 {
+		t.Errorf("server-auth: unexpected SANs dns=%v ip=%v email=%v", crt.DNSNames, crt.IPAddresses, crt.EmailAddresses)
+	}
+
+	ctx = scepdepot.NewContext(context.Background(), &scepdepot.Enrollment{UID: "unknown", Profile: "no-such-profile"})
+	if _, err := signer.SignCSRContext(ctx, newTestCSR(t, "unknown")); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	data := `{
+		"wifi": {
+			"key_usage": ["digitalSignature"],
+			"ext_key_usage": ["clientAuth", "1.3.6.1.5.5.7.3.14"],
+			"validity_days": 30,
+			"sans": ["dns"],
+			"policy_oids": ["1.2.3.4"]
+		}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := scepdepot.LoadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := profiles["client-auth"]; !ok {
+		t.Error("builtin profiles were not kept")
+	}
+
+	signer := newTestSigner(t, scepdepot.WithProfiles(profiles), scepdepot.WithDefaultProfile("wifi"))
+	crt, err := signer.SignCSR(newTestCSR(t, "wifi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crt.UnknownExtKeyUsage) != 1 || len(crt.Policies) != 1 {
+		t.Errorf("have unknown EKU %v and policies %v", crt.UnknownExtKeyUsage, crt.Policies)
+	}
+	if days := int(crt.NotAfter.Sub(crt.NotBefore).Hours() / 24); days != 30 {
+		t.Errorf("have validity of %d days, want 30", days)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"bad": {"key_usage": ["certSign"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scepdepot.LoadProfiles(path); err == nil {
+		t.Error("expected an error for an unknown key usage")
+	}
+}
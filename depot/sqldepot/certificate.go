@@ -0,0 +1,375 @@
+package sqldepot
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+func (d *Depot) GetRCs() ([]x509.RevocationListEntry, error) {
+	return d.GetRCsByIssuer(nil)
+}
+
+// GetRCsByIssuer returns the CRL entries of the revoked and held
+// certificates issued by the CA whose DER encoded subject is rawIssuer, or
+// by any CA if rawIssuer is nil.
+func (d *Depot) GetRCsByIssuer(rawIssuer []byte) ([]x509.RevocationListEntry, error) {
+	var rcs []x509.RevocationListEntry
+	rows, err := d.query("SELECT "+certColumns+" FROM certificates WHERE status IN (?, ?) AND valid_till > ?", "R", "H", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanCert(rows)
+		if err != nil {
+			return nil, err
+		}
+		if rawIssuer != nil && !c.IssuedBy(rawIssuer) {
+			continue
+		}
+		rc, err := depot.RevocationListEntry(c)
+		if err != nil {
+			return nil, err
+		}
+		rcs = append(rcs, rc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rcs, nil
+}
+
+func (d *Depot) GetCertsByCN(cn string) ([]depot.Certificate, error) {
+	var certs []depot.Certificate
+	rows, err := d.query("SELECT "+certColumns+" FROM certificates WHERE cn = ?", cn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanCert(rows)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, *c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+const certColumns = "id, cn, serial, cert_data, status, valid_from, valid_till, revocation_date, revocation_reason, invalidity_date"
+
+func scanCert(rows *sql.Rows) (*depot.Certificate, error) {
+	var c depot.Certificate
+	var serialStr string
+	var certRaw []byte
+	var revocationDate sql.NullTime
+	var reason sql.NullInt64
+	var invalidityDate sql.NullTime
+	err := rows.Scan(
+		&c.Id,
+		&c.CN,
+		&serialStr,
+		&certRaw,
+		&c.Status,
+		&c.ValidFrom,
+		&c.ValidTill,
+		&revocationDate,
+		&reason,
+		&invalidityDate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pemBlock := &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certRaw,
+	}
+	pemBytes := pem.EncodeToMemory(pemBlock)
+	if pemBytes != nil {
+		c.CertData = string(pemBytes)
+	}
+	if revocationDate.Valid {
+		c.RevocationDate = revocationDate.Time
+	}
+	if reason.Valid {
+		r := depot.RevocationReason(reason.Int64)
+		c.RevocationReason = &r
+	}
+	if invalidityDate.Valid {
+		c.InvalidityDate = &invalidityDate.Time
+	}
+	c.Serial.SetString(serialStr, 16)
+	return &c, nil
+}
+
+func (d *Depot) GetCertBySerial(serial *big.Int) (*depot.Certificate, error) {
+	rows, err := d.query("SELECT "+certColumns+" FROM certificates WHERE serial = ?", fmt.Sprintf("%x", serial))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanCert(rows)
+}
+
+// GetCNsByPublicKey returns the distinct CNs of the certificates issued for
+// the DER encoded SubjectPublicKeyInfo.
+func (d *Depot) GetCNsByPublicKey(rawSubjectPublicKeyInfo []byte) ([]string, error) {
+	rows, err := d.query("SELECT DISTINCT cn FROM certificates WHERE key_id = ?", depot.PublicKeyID(rawSubjectPublicKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cns []string
+	for rows.Next() {
+		var cn string
+		if err := rows.Scan(&cn); err != nil {
+			return nil, err
+		}
+		cns = append(cns, cn)
+	}
+	return cns, rows.Err()
+}
+
+func (d *Depot) GetNextSerial() (*big.Int, error) {
+	if d.randomSerials {
+		return nil, depot.ErrRandomSerial
+	}
+	return d.dialect.NextSerial(d.db)
+}
+
+func (d *Depot) ClaimSerial(serial *big.Int) (bool, error) {
+	if !d.randomSerials {
+		return d.dialect.ClaimSerial(d.db, serial)
+	}
+	// the unique index on certificates.serial rejects a concurrent claim
+	cert, err := d.GetCertBySerial(serial)
+	return cert == nil && err == nil, err
+}
+
+func (d *Depot) RevokeCertificate(uid string, revocation_date time.Time) error {
+	_, err := d.exec("UPDATE certificates SET status = 'R', revocation_date = ?, revocation_reason = NULL WHERE cn = ? AND status IN ('V', 'H')", revocation_date, uid)
+	return err
+}
+
+// RevokeClient revokes the certificates of uid, deletes its secret and makes
+// it INACTIVE in a transaction.
+func (d *Depot) RevokeClient(uid string, revocationDate time.Time) error {
+	return d.inTx(func(tx *Depot) error {
+		if _, err := tx.lockClient(uid); err != nil {
+			return err
+		}
+		if err := tx.RevokeCertificate(uid, revocationDate); err != nil {
+			return err
+		}
+		if err := tx.DeleteSecret(uid); err != nil {
+			return err
+		}
+		return tx.UpdateStatusClient(uid, "INACTIVE")
+	})
+}
+
+// withCertificate calls fn in a transaction with the certificate of serial,
+// read after locking the row of its client.
+func (d *Depot) withCertificate(serial *big.Int, fn func(tx *Depot, cert *depot.Certificate) error) error {
+	cert, err := d.GetCertBySerial(serial)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return errors.New("certificate not found")
+	}
+	return d.inTx(func(tx *Depot) error {
+		if _, err := tx.lockClient(cert.CN); err != nil {
+			return err
+		}
+		// the certificate may have changed before the client was locked
+		cert, err := tx.GetCertBySerial(serial)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			return errors.New("certificate not found")
+		}
+		return fn(tx, cert)
+	})
+}
+
+// RevokeCertificateBySerial revokes a single valid or held certificate and updates the
+// status of its client: a client left without a valid certificate becomes
+// INACTIVE, and a PENDING client whose other certificate remains becomes ISSUED.
+func (d *Depot) RevokeCertificateBySerial(serial *big.Int, reason depot.RevocationReason, revocationDate time.Time, invalidityDate *time.Time) error {
+	return d.withCertificate(serial, func(tx *Depot, cert *depot.Certificate) error {
+		if cert.Status != "V" && cert.Status != "H" {
+			return errors.New("certificate is not valid")
+		}
+		var invalidity sql.NullTime
+		if invalidityDate != nil {
+			invalidity = sql.NullTime{Time: *invalidityDate, Valid: true}
+		}
+		_, err := tx.exec("UPDATE certificates SET status = 'R', revocation_date = ?, revocation_reason = ?, invalidity_date = ? WHERE id = ?",
+			revocationDate, int(reason), invalidity, cert.Id)
+		if err != nil {
+			return err
+		}
+
+		client, err := tx.GetClient(cert.CN)
+		if err != nil || client == nil {
+			return err
+		}
+		var valid int
+		err = tx.queryRow("SELECT COUNT(*) FROM certificates WHERE cn = ? AND status IN ('V', 'H')", cert.CN).Scan(&valid)
+		if err != nil {
+			return err
+		}
+		if valid == 0 && (client.Status == "ISSUED" || client.Status == "PENDING") {
+			return tx.UpdateStatusClient(cert.CN, "INACTIVE")
+		}
+		if valid > 0 && client.Status == "PENDING" {
+			// the remaining certificate must not be revoked by CheckCertRevocation
+			_, err = tx.exec("UPDATE certificates SET revocation_date = NULL WHERE cn = ? AND status = 'V'", cert.CN)
+			if err != nil {
+				return err
+			}
+			return tx.UpdateStatusClient(cert.CN, "ISSUED")
+		}
+		return nil
+	})
+}
+
+// HoldCertificate suspends a valid certificate. A held certificate is listed
+// in the CRL with the reason certificateHold until it is released or revoked.
+func (d *Depot) HoldCertificate(serial *big.Int, holdDate time.Time) error {
+	return d.withCertificate(serial, func(tx *Depot, cert *depot.Certificate) error {
+		if cert.Status != "V" {
+			return errors.New("certificate is not valid")
+		}
+		if !cert.RevocationDate.IsZero() {
+			return errors.New("certificate is already scheduled for revocation")
+		}
+		_, err := tx.exec("UPDATE certificates SET status = 'H', revocation_date = ?, revocation_reason = ? WHERE id = ?",
+			holdDate, int(depot.CertificateHold), cert.Id)
+		return err
+	})
+}
+
+// ReleaseCertificate makes a held certificate valid again.
+func (d *Depot) ReleaseCertificate(serial *big.Int) error {
+	return d.withCertificate(serial, func(tx *Depot, cert *depot.Certificate) error {
+		if cert.Status != "H" {
+			return errors.New("certificate is not on hold")
+		}
+		_, err := tx.exec("UPDATE certificates SET status = 'V', revocation_date = NULL, revocation_reason = NULL WHERE id = ?", cert.Id)
+		return err
+	})
+}
+
+// certsToCheck returns the cn and id of the certificates the query selects.
+func (d *Depot) certsToCheck(query string, args ...interface{}) ([]string, []int, error) {
+	rows, err := d.query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var cns []string
+	var ids []int
+	for rows.Next() {
+		var cn string
+		var id int
+		if err := rows.Scan(&cn, &id); err != nil {
+			return nil, nil, err
+		}
+		cns = append(cns, cn)
+		ids = append(ids, id)
+	}
+	return cns, ids, rows.Err()
+}
+
+// CheckCertRevocation revokes the old certificates of PENDING clients whose
+// pending period has passed, and makes the clients ISSUED.
+func (d *Depot) CheckCertRevocation() error {
+	cns, ids, err := d.certsToCheck("SELECT cn, id FROM certificates WHERE status = ? AND revocation_date IS NOT NULL AND revocation_date < ?", "V", time.Now())
+	if err != nil {
+		return err
+	}
+	for i, cn := range cns {
+		err := d.inTx(func(tx *Depot) error {
+			client, err := tx.lockClient(cn)
+			if err != nil || client == nil || client.Status != "PENDING" {
+				return err
+			}
+			if _, err := tx.exec("UPDATE certificates SET status = 'R', revocation_reason = ? WHERE id = ? AND status = 'V'", int(depot.Superseded), ids[i]); err != nil {
+				return err
+			}
+			return tx.UpdateStatusClient(cn, "ISSUED")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckCertExpiration revokes the expired certificates of ISSUED clients
+// and makes the clients INACTIVE.
+func (d *Depot) CheckCertExpiration() error {
+	cns, ids, err := d.certsToCheck("SELECT cn, id FROM certificates WHERE status IN (?, ?) AND valid_till < ?", "V", "H", time.Now())
+	if err != nil {
+		return err
+	}
+	for i, cn := range cns {
+		err := d.inTx(func(tx *Depot) error {
+			client, err := tx.lockClient(cn)
+			if err != nil || client == nil || client.Status != "ISSUED" {
+				return err
+			}
+			if _, err := tx.exec("UPDATE certificates SET status = 'R' WHERE id = ? AND status IN ('V', 'H')", ids[i]); err != nil {
+				return err
+			}
+			return tx.UpdateStatusClient(cn, "INACTIVE")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUniqueSerials returns a *DuplicateSerialsError if serial numbers are
+// used by more than one certificate, which the unique index of the serials
+// does not allow.
+func (d *Depot) checkUniqueSerials() error {
+	rows, err := d.query("SELECT serial FROM certificates GROUP BY serial HAVING COUNT(*) > 1 ORDER BY serial")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var serials []string
+	for rows.Next() {
+		var serial string
+		if err := rows.Scan(&serial); err != nil {
+			return err
+		}
+		serials = append(serials, serial)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(serials) > 0 {
+		return &DuplicateSerialsError{Serials: serials}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package sqldepot
+
+import (
+	"time"
+)
+
+// UseJTI records the ID of a signed challenge, reporting false if it was
+// already used.
+func (d *Depot) UseJTI(jti string, expiresAt time.Time) (bool, error) {
+	_, err := d.exec("INSERT INTO challenge_jtis (jti, expires_at) VALUES (?, ?)", jti, expiresAt)
+	if d.dialect.IsDuplicate(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseJTI forgets the ID of a signed challenge.
+func (d *Depot) ReleaseJTI(jti string) error {
+	_, err := d.exec("DELETE FROM challenge_jtis WHERE jti = ?", jti)
+	return err
+}
+
+// PurgeUsedJTIs forgets the IDs of signed challenges that have expired.
+func (d *Depot) PurgeUsedJTIs() error {
+	_, err := d.exec("DELETE FROM challenge_jtis WHERE expires_at < ?", time.Now())
+	return err
+}
@@ -0,0 +1,87 @@
+package sqldepot
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// ChallengeStore is a store of random one-time SCEP challenges that expire
+// after a TTL and are optionally bound to the uid of a client.
+// It implements depot.ChallengeStore and challenge.BoundStore.
+type ChallengeStore struct {
+	d   *Depot
+	ttl time.Duration
+}
+
+// NewChallengeStore returns a ChallengeStore of challenges valid for ttl.
+func (d *Depot) NewChallengeStore(ttl time.Duration) depot.ChallengeStore {
+	return &ChallengeStore{d: d, ttl: ttl}
+}
+
+// TTL returns how long the challenges of s are valid.
+func (s *ChallengeStore) TTL() time.Duration {
+	return s.ttl
+}
+
+// SCEPChallenge returns a new challenge usable by any client.
+func (s *ChallengeStore) SCEPChallenge() (string, error) {
+	return s.SCEPChallengeFor("")
+}
+
+// SCEPChallengeFor returns a new challenge usable only by the client uid.
+// An empty uid returns a challenge usable by any client.
+func (s *ChallengeStore) SCEPChallengeFor(uid string) (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(key)
+	var boundUID sql.NullString
+	if uid != "" {
+		boundUID = sql.NullString{String: uid, Valid: true}
+	}
+	_, err := s.d.exec("INSERT INTO challenges (challenge, uid, expires_at) VALUES (?, ?, ?)",
+		challenge, boundUID, time.Now().Add(s.ttl))
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// HasChallenge consumes pw, reporting whether it was a valid challenge.
+func (s *ChallengeStore) HasChallenge(pw string) (bool, error) {
+	valid, _, err := s.UseChallenge(pw)
+	return valid, err
+}
+
+// UseChallenge consumes pw, reporting whether it was a valid challenge and
+// the uid it is bound to, if any.
+func (s *ChallengeStore) UseChallenge(pw string) (bool, string, error) {
+	var uid sql.NullString
+	err := s.d.queryRow("SELECT uid FROM challenges WHERE challenge = ?", pw).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	// the challenge is used by whoever deletes it
+	res, err := s.d.exec("DELETE FROM challenges WHERE challenge = ? AND expires_at > ?", pw, time.Now())
+	if err != nil {
+		return false, "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, "", err
+	}
+	return n == 1, uid.String, nil
+}
+
+// PurgeExpiredChallenges deletes the challenges that have expired unused.
+func (s *ChallengeStore) PurgeExpiredChallenges() error {
+	_, err := s.d.exec("DELETE FROM challenges WHERE expires_at < ?", time.Now())
+	return err
+}
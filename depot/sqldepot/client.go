@@ -0,0 +1,151 @@
+package sqldepot
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+func (d *Depot) AddClient(client depot.Client, initialStatus string) error {
+	attributesStr, err := json.Marshal(client.Attributes)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec("INSERT INTO clients (uid, status, attributes, ca) VALUES (?, ?, ?, ?)", client.Uid, initialStatus, string(attributesStr), client.CA)
+	return err
+}
+
+func (d *Depot) UpdateAttributesClient(info depot.UpdateInfo) error {
+	attributesStr, err := json.Marshal(info.Attributes)
+	if err != nil {
+		return err
+	}
+	_, err = d.exec("UPDATE clients SET attributes = ? WHERE uid = ?", string(attributesStr), info.Uid)
+	return err
+}
+
+func (d *Depot) UpdateStatusClient(uid string, status string) error {
+	_, err := d.exec("UPDATE clients SET status = ? WHERE uid = ?", status, uid)
+	return err
+}
+
+func (d *Depot) GetClient(uid string) (*depot.Client, error) {
+	return d.getClient("SELECT uid, status, attributes, ca FROM clients WHERE uid = ?", uid)
+}
+
+// lockClient returns the client uid like GetClient, locking its row until
+// the transaction of d ends.
+func (d *Depot) lockClient(uid string) (*depot.Client, error) {
+	return d.getClient("SELECT uid, status, attributes, ca FROM clients WHERE uid = ? FOR UPDATE", uid)
+}
+
+func (d *Depot) getClient(query, uid string) (*depot.Client, error) {
+	rows, err := d.query(query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var c depot.Client
+	var clientAttributes string
+	for rows.Next() {
+		err := rows.Scan(&c.Uid, &c.Status, &clientAttributes, &c.CA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Uid == "" {
+		return nil, nil
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(clientAttributes), &c.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (d *Depot) GetClientList() ([]depot.Client, error) {
+	var clients []depot.Client
+	rows, err := d.query("SELECT uid, status, attributes, ca FROM clients WHERE status <> ?", "ARCHIVED")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c depot.Client
+		var clientAttributes string
+		err := rows.Scan(&c.Uid, &c.Status, &clientAttributes, &c.CA)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(clientAttributes), &c.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// ArchiveClient revokes the certificates of uid, deletes its secret and
+// archives it in a transaction.
+func (d *Depot) ArchiveClient(uid string, archivedAt time.Time) error {
+	return d.inTx(func(tx *Depot) error {
+		if _, err := tx.lockClient(uid); err != nil {
+			return err
+		}
+		// revoked certificates stay listed in the CRL until they expire
+		if err := tx.RevokeCertificate(uid, archivedAt); err != nil {
+			return err
+		}
+		if err := tx.DeleteSecret(uid); err != nil {
+			return err
+		}
+		_, err := tx.exec("UPDATE clients SET status = ?, archived_at = ? WHERE uid = ?", "ARCHIVED", archivedAt, uid)
+		return err
+	})
+}
+
+func (d *Depot) PurgeArchivedClients(retention time.Duration) error {
+	rows, err := d.query("SELECT uid FROM clients WHERE status = ? AND archived_at < ?", "ARCHIVED", time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return err
+		}
+		uids = append(uids, uid)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if err := d.purgeArchivedClient(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeArchivedClient deletes the client uid and its secret in a
+// transaction, unless it has been reactivated since it was selected.
+func (d *Depot) purgeArchivedClient(uid string) error {
+	return d.inTx(func(tx *Depot) error {
+		c, err := tx.lockClient(uid)
+		if err != nil || c == nil || c.Status != "ARCHIVED" {
+			return err
+		}
+		if err := tx.DeleteSecret(uid); err != nil {
+			return err
+		}
+		_, err = tx.exec("DELETE FROM clients WHERE uid = ?", uid)
+		return err
+	})
+}
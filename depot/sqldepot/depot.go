@@ -0,0 +1,321 @@
+// Package sqldepot implements depot.Store on an SQL database. The queries
+// are written with ? placeholders and adapted to the database by a Dialect,
+// so that the MySQL, PostgreSQL and SQLite depots share the client, secret and
+// certificate lifecycle.
+package sqldepot
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// Dialect adapts the queries of a Depot to a database.
+type Dialect interface {
+	// Rebind replaces the ? placeholders of query with those of the database.
+	Rebind(query string) string
+	// IsDuplicate reports whether err is the violation of a unique key.
+	IsDuplicate(err error) bool
+	// Serial atomically allocates a certificate serial number.
+	Serial(db *sql.DB) (*big.Int, error)
+	// NextSerial returns the serial number Serial would allocate next,
+	// without allocating it. q is the database or a transaction on it.
+	NextSerial(q RowQuerier) (*big.Int, error)
+	// ClaimSerial atomically allocates serial if it is the serial number
+	// Serial would allocate next, and reports whether it did.
+	ClaimSerial(db *sql.DB, serial *big.Int) (bool, error)
+	// DumpStyle returns how the database reads the literals of a dump.
+	DumpStyle() DumpStyle
+	// SetSerialSQL returns the statements making serial the last serial
+	// number Serial allocated.
+	SetSerialSQL(serial *big.Int) []string
+}
+
+// RowQuerier is a *sql.DB or a *sql.Tx, which the dialects read a row of.
+type RowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Depot is a depot.Store on an SQL database whose tables have been created.
+type Depot struct {
+	db            *sql.DB
+	q             querier
+	dialect       Dialect
+	dirPath       string
+	randomSerials bool
+}
+
+var _ depot.Store = (*Depot)(nil)
+
+// Option configures a Depot.
+type Option func(*Depot)
+
+// WithRandomSerials makes the Depot allocate random serial numbers of
+// depot.RandomSerialBits bits instead of sequential ones.
+func WithRandomSerials() Option {
+	return func(d *Depot) {
+		d.randomSerials = true
+	}
+}
+
+// New returns a Depot on db, reading the CA from dirPath. The database must
+// have been migrated by a Migrator.
+func New(db *sql.DB, dialect Dialect, dirPath string, opts ...Option) (*Depot, error) {
+	d := &Depot{db: db, q: db, dialect: dialect, dirPath: dirPath}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
+}
+
+// DB returns the database of d.
+func (d *Depot) DB() *sql.DB {
+	return d.db
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (d *Depot) exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.q.Exec(d.dialect.Rebind(query), utc(args)...)
+}
+
+func (d *Depot) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.q.Query(d.dialect.Rebind(query), utc(args)...)
+}
+
+func (d *Depot) queryRow(query string, args ...interface{}) *sql.Row {
+	return d.q.QueryRow(d.dialect.Rebind(query), utc(args)...)
+}
+
+// inTx calls fn with a copy of d whose queries run in a transaction, which
+// is committed if fn returns nil and rolled back otherwise. If d is already
+// in a transaction, fn is called with d.
+func (d *Depot) inTx(fn func(tx *Depot) error) error {
+	if _, ok := d.q.(*sql.Tx); ok {
+		return fn(d)
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	txDepot := *d
+	txDepot.q = tx
+	if err := fn(&txDepot); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// utc converts the times in args to UTC, so that they compare correctly in
+// databases that store times as text.
+func utc(args []interface{}) []interface{} {
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			args[i] = v.UTC()
+		case sql.NullTime:
+			v.Time = v.Time.UTC()
+			args[i] = v
+		}
+	}
+	return args
+}
+
+// RebindDollar replaces the ? placeholders of query with $1, $2 and so on.
+func RebindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// backfillKeyIDs sets the key_id of certificates stored before the column existed.
+func (d *Depot) backfillKeyIDs() error {
+	rows, err := d.query("SELECT id, cert_data FROM certificates WHERE key_id IS NULL")
+	if err != nil {
+		return err
+	}
+	keyIDs := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var certData []byte
+		if err := rows.Scan(&id, &certData); err != nil {
+			rows.Close()
+			return err
+		}
+		cert, err := x509.ParseCertificate(certData)
+		if err != nil {
+			continue
+		}
+		keyIDs[id] = depot.PublicKeyID(cert.RawSubjectPublicKeyInfo)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, keyID := range keyIDs {
+		if _, err := d.exec("UPDATE certificates SET key_id = ? WHERE id = ?", keyID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, depot.CAKey, error) {
+	return depot.LoadCA(d.dirPath, pass)
+}
+
+func (d *Depot) Put(cn string, crt *x509.Certificate, challenge string) error {
+	serial := crt.SerialNumber
+	if crt.Subject.CommonName == "" {
+		cn = fmt.Sprintf("%x", sha256.Sum256(crt.Raw))
+	}
+
+	if err := d.writeDB(cn, serial, challenge, crt); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Depot) Serial() (*big.Int, error) {
+	if !d.randomSerials {
+		return d.dialect.Serial(d.db)
+	}
+	for {
+		serial, err := depot.RandomSerial()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := d.GetCertBySerial(serial)
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil {
+			return serial, nil
+		}
+	}
+}
+
+// HasCN fails if the latest valid or held certificate of cn issued by the
+// CA of cert was issued later than allowTime days from now. If
+// revokeOldCertificate is set, that certificate is revoked as superseded.
+func (d *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	rows, err := d.query("SELECT id, valid_from, cert_data FROM certificates WHERE cn = ? AND status IN ('V', 'H') ORDER BY id DESC", cn)
+	if err != nil {
+		return false, err
+	}
+	var id int
+	var validFrom time.Time
+	found := false
+	for rows.Next() {
+		var certData []byte
+		if err := rows.Scan(&id, &validFrom, &certData); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if cert == nil || depot.IssuedBy(certData, cert.RawIssuer) {
+			found = true
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if !found {
+		return true, nil
+	}
+	if allowTime > 0 && validFrom.After(time.Now().AddDate(0, 0, allowTime)) {
+		return false, errors.New("CN " + cn + " already exists")
+	}
+	if !revokeOldCertificate {
+		return true, nil
+	}
+	_, err = d.exec("UPDATE certificates SET status = 'R', revocation_date = ?, revocation_reason = ? WHERE id = ?", time.Now(), int(depot.Superseded), id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeDB records cert, issued to cn, and updates the status of its client
+// in a transaction holding the row of the client locked, so that concurrent
+// enrollments of a client are serialized.
+func (d *Depot) writeDB(cn string, serial *big.Int, challenge string, cert *x509.Certificate) error {
+	return d.inTx(func(tx *Depot) error {
+		client, err := tx.lockClient(cn)
+		if err != nil {
+			return err
+		}
+		if client == nil {
+			// a client not managed here, enrolled with a signed challenge
+			if _, err := tx.HasCN(cn, 0, cert, true); err != nil {
+				return err
+			}
+		} else if client.Status == "ISSUABLE" {
+			if _, err := tx.HasCN(cn, 0, cert, true); err != nil {
+				return err
+			}
+			if err := tx.UpdateStatusClient(cn, "ISSUED"); err != nil {
+				return err
+			}
+		} else if client.Status == "UPDATABLE" {
+			if _, err := tx.HasCN(cn, 0, cert, false); err != nil {
+				return err
+			}
+			if err := tx.UpdateStatusClient(cn, "PENDING"); err != nil {
+				return err
+			}
+			secret, err := tx.GetSecret(cn)
+			if err != nil {
+				return err
+			}
+			duration, err := time.ParseDuration(secret.Pending_Period)
+			if err != nil {
+				return err
+			}
+			revocation_date := time.Now().Add(duration)
+			_, err = tx.exec("UPDATE certificates SET revocation_date = ? WHERE cn = ? AND status = 'V'", revocation_date, cn)
+			if err != nil {
+				return err
+			}
+		} else {
+			return errors.New("client is not issuable or updatable")
+		}
+
+		notBefore := cert.NotBefore
+		notAfter := cert.NotAfter
+
+		serialStr := fmt.Sprintf("%x", serial) // Convert serial to string
+		_, err = tx.exec("INSERT INTO certificates (cn, serial, cert_data, status, valid_from, valid_till, key_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			cn, serialStr, cert.Raw, "V", notBefore, notAfter, depot.PublicKeyID(cert.RawSubjectPublicKeyInfo))
+		if d.dialect.IsDuplicate(err) {
+			return depot.ErrSerialInUse
+		} else if err != nil {
+			return err
+		}
+		return tx.DeleteSecret(cn)
+	})
+}
@@ -0,0 +1,58 @@
+package sqldepot
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRebindDollar(t *testing.T) {
+	for _, test := range []struct{ query, want string }{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT uid FROM clients WHERE uid = ?", "SELECT uid FROM clients WHERE uid = $1"},
+		{"UPDATE clients SET status = ? WHERE uid = ?", "UPDATE clients SET status = $1 WHERE uid = $2"},
+	} {
+		if have := RebindDollar(test.query); have != test.want {
+			t.Errorf("RebindDollar(%q) = %q, want %q", test.query, have, test.want)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_indexes.up.sql":   {Data: []byte("CREATE INDEX a ON t (a);\n")},
+		"0002_indexes.down.sql": {Data: []byte("DROP INDEX a;\n")},
+		"0001_initial.up.sql":   {Data: []byte("-- tables\nCREATE TABLE t (\n\ta INT\n);\nCREATE TABLE u (b INT);\n")},
+	}
+	ms, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].Version != 1 || ms[0].Name != "initial" || ms[0].Down != "" ||
+		ms[1].Version != 2 || ms[1].Name != "indexes" || ms[1].Down == "" {
+		t.Fatalf("unexpected migrations %+v", ms)
+	}
+	stmts := splitStatements(ms[0].Up)
+	if len(stmts) != 2 || stmts[0] != "CREATE TABLE t (\n\ta INT\n);" || stmts[1] != "CREATE TABLE u (b INT);" {
+		t.Errorf("unexpected statements %q", stmts)
+	}
+
+	for _, name := range []string{"initial.up.sql", "0001_initial.sql", "0003_x.down.sql"} {
+		fsys := fstest.MapFS{name: {Data: []byte("SELECT 1;")}}
+		if _, err := LoadMigrations(fsys); err == nil {
+			t.Errorf("LoadMigrations(%s) succeeded", name)
+		}
+	}
+}
+
+func TestLiteralTime(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	v := time.Date(2026, 1, 2, 9, 4, 5, 0, tokyo)
+	layout := "2006-01-02 15:04:05"
+	if have, want := literal(v, false, DumpStyle{TimeLayout: layout}), "'2026-01-02 00:04:05'"; have != want {
+		t.Errorf("literal() in UTC = %s, want %s", have, want)
+	}
+	if have, want := literal(v, false, DumpStyle{TimeLayout: layout, DriverLocation: true}), "'2026-01-02 09:04:05'"; have != want {
+		t.Errorf("literal() in the location of the driver = %s, want %s", have, want)
+	}
+}
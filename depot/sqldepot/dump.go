@@ -0,0 +1,284 @@
+package sqldepot
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DumpStyle is how a database reads the values of the literals of a dump.
+type DumpStyle struct {
+	// TimeLayout is the layout of the times the driver of the database
+	// writes. Times are dumped in UTC, unless DriverLocation is set.
+	TimeLayout string
+	// DriverLocation dumps times in the location the driver scanned them
+	// in, for drivers that write times in that location rather than in
+	// the one of the time.
+	DriverLocation bool
+	// BackslashEscapes makes backslashes in strings escaped, for databases
+	// that read them as escapes.
+	BackslashEscapes bool
+	// BlobPrefix starts the hexadecimal literal of a blob, which ends
+	// with a quote.
+	BlobPrefix string
+}
+
+// dumpTables are the tables Dump writes, in the order they are restored
+// in, with the columns that are not dumped.
+var dumpTables = []struct {
+	name string
+	skip string
+}{
+	{"clients", ""},
+	{"secrets", ""},
+	// the ids are allocated again, so that their sequence stays valid
+	{"certificates", "id"},
+}
+
+// Dump writes the clients, their secrets and the certificates as SQL
+// statements that Restore inserts into an empty database of the same kind.
+// The rows are read in a single read-only transaction, so that they are
+// consistent while the server is running. The dump records the version of
+// the schema and ends with a statement setting the last allocated serial
+// number.
+func (d *Depot) Dump(w io.Writer) error {
+	style := d.dialect.DumpStyle()
+	tx, err := d.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "-- scep depot dump of", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(bw, "%s%d\n", dumpVersionPrefix, version)
+	for _, table := range dumpTables {
+		if err := dumpTable(bw, tx, table.name, table.skip, style); err != nil {
+			return fmt.Errorf("dump %s: %w", table.name, err)
+		}
+	}
+	// read after the certificates, it is at least their largest serial
+	next, err := d.dialect.NextSerial(tx)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range d.dialect.SetSerialSQL(new(big.Int).Sub(next, big.NewInt(1))) {
+		fmt.Fprintln(bw, stmt+";")
+	}
+	return bw.Flush()
+}
+
+func dumpTable(w io.Writer, tx *sql.Tx, table, skip string, style DumpStyle) error {
+	order := ""
+	if table == "certificates" {
+		order = " ORDER BY id"
+	}
+	rows, err := tx.Query("SELECT * FROM " + table + order)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for _, t := range types {
+		if t.Name() != skip {
+			columns = append(columns, t.Name())
+		}
+	}
+	insert := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES ("
+	values := make([]interface{}, len(types))
+	ptrs := make([]interface{}, len(types))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		literals := make([]string, 0, len(columns))
+		for i, t := range types {
+			if t.Name() == skip {
+				continue
+			}
+			typeName := strings.ToUpper(t.DatabaseTypeName())
+			blob := strings.Contains(typeName, "BLOB") || typeName == "BYTEA"
+			literals = append(literals, literal(values[i], blob, style))
+		}
+		if _, err := fmt.Fprintln(w, insert+strings.Join(literals, ", ")+");"); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// literal formats v, scanned from a column, as an SQL literal.
+func literal(v interface{}, blob bool, style DumpStyle) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		if !style.DriverLocation {
+			v = v.UTC()
+		}
+		return quote(v.Format(style.TimeLayout), style)
+	case []byte:
+		if blob {
+			return style.BlobPrefix + hex.EncodeToString(v) + "'"
+		}
+		return quote(string(v), style)
+	case string:
+		return quote(v, style)
+	default:
+		return quote(fmt.Sprint(v), style)
+	}
+}
+
+func quote(s string, style DumpStyle) string {
+	s = strings.ReplaceAll(s, "'", "''")
+	if style.BackslashEscapes {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + s + "'"
+}
+
+// Restore inserts a dump written by Dump of a database of the same kind in
+// a transaction. It fails without inserting anything if the database
+// already has clients, secrets or certificates, or if its schema is not of
+// the version of the dump.
+func (d *Depot) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dumpVersion, err := parseDumpVersion(string(data))
+	if err != nil {
+		return err
+	}
+	stmts, err := splitDump(string(data), d.dialect.DumpStyle())
+	if err != nil {
+		return err
+	}
+	return d.inTx(func(tx *Depot) error {
+		version, err := schemaVersion(tx.q)
+		if err != nil {
+			return err
+		}
+		if version != dumpVersion {
+			return fmt.Errorf("the dump is of schema version %d, the database has version %d", dumpVersion, version)
+		}
+		for _, table := range dumpTables {
+			var n int
+			if err := tx.queryRow("SELECT COUNT(*) FROM " + table.name).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				return fmt.Errorf("the database is not empty: %s has %d rows", table.name, n)
+			}
+		}
+		for _, stmt := range stmts {
+			// the statements have no placeholders to rebind
+			if _, err := tx.q.Exec(stmt); err != nil {
+				return fmt.Errorf("%w: %.80s", err, stmt)
+			}
+		}
+		return nil
+	})
+}
+
+// dumpVersionPrefix starts the comment of a dump recording the version of
+// its schema.
+const dumpVersionPrefix = "-- schema version "
+
+// schemaVersion returns the latest migration applied to the database of q.
+func schemaVersion(q RowQuerier) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("read the schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// parseDumpVersion returns the schema version recorded in the header of
+// dump.
+func parseDumpVersion(dump string) (int, error) {
+	for _, line := range strings.Split(dump, "\n") {
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, dumpVersionPrefix); ok {
+			return strconv.Atoi(strings.TrimSpace(v))
+		}
+	}
+	return 0, errors.New("the dump has no schema version")
+}
+
+// splitDump splits a dump into its statements, skipping comments.
+func splitDump(dump string, style DumpStyle) ([]string, error) {
+	var (
+		stmts   []string
+		b       strings.Builder
+		inQuote bool
+	)
+	for i := 0; i < len(dump); i++ {
+		c := dump[i]
+		switch {
+		case inQuote:
+			b.WriteByte(c)
+			if c == '\\' && style.BackslashEscapes && i+1 < len(dump) {
+				i++
+				b.WriteByte(dump[i])
+			} else if c == '\'' {
+				inQuote = false
+			}
+		case c == '\'':
+			inQuote = true
+			b.WriteByte(c)
+		case c == '-' && strings.HasPrefix(dump[i:], "--"):
+			end := strings.IndexByte(dump[i:], '\n')
+			if end < 0 {
+				i = len(dump)
+			} else {
+				i += end
+			}
+		case c == ';':
+			stmts = append(stmts, strings.TrimSpace(b.String()))
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return nil, errors.New("the dump ends inside a string")
+	}
+	if rest := strings.TrimSpace(b.String()); rest != "" {
+		return nil, errors.New("the dump ends without a semicolon")
+	}
+	return stmts, nil
+}
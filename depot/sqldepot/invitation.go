@@ -0,0 +1,35 @@
+package sqldepot
+
+import (
+	"time"
+
+	"github.com/procube-open/scep/depot"
+)
+
+// CreateInvitation records the invitation jti to target, which can be
+// redeemed once until expiresAt.
+func (d *Depot) CreateInvitation(jti, target string, expiresAt time.Time) error {
+	_, err := d.exec("INSERT INTO invitations (jti, target, expires_at) VALUES (?, ?, ?)", jti, target, expiresAt)
+	return err
+}
+
+// RedeemInvitation consumes the invitation jti to target and replaces the
+// secret of target with secret. It returns depot.ErrInvitationUsed if the
+// invitation cannot be redeemed.
+func (d *Depot) RedeemInvitation(jti, target, secret string) error {
+	return d.inTx(func(tx *Depot) error {
+		res, err := tx.exec("UPDATE invitations SET redeemed_at = ? WHERE jti = ? AND target = ? AND redeemed_at IS NULL AND expires_at > ?",
+			time.Now(), jti, target, time.Now())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return depot.ErrInvitationUsed
+		}
+		return tx.ReplaceSecret(target, secret)
+	})
+}
@@ -0,0 +1,442 @@
+package sqldepot
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is a versioned change of the schema of a database.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// data changes the rows of the database after Up, for the migrations
+	// of the data that SQL cannot express. Rolling it back keeps the rows.
+	data func(d *Depot) error
+	// check fails if the rows of the database cannot be migrated by Up.
+	check func(d *Depot) error
+}
+
+// checks are the checks of the migrations of each name, which they run
+// before their statements.
+var checks = map[string]func(d *Depot) error{
+	"unique_serial": (*Depot).checkUniqueSerials,
+}
+
+// DuplicateSerialsError is returned when the certificates table cannot get
+// its unique index because serial numbers are used by more than one
+// certificate.
+type DuplicateSerialsError struct {
+	// Serials are the duplicate serial numbers, as stored in the table.
+	Serials []string
+}
+
+func (e *DuplicateSerialsError) Error() string {
+	return fmt.Sprintf("serial numbers %s are used by more than one certificate: "+
+		"keep one row of each in the certificates table, revoking the serial number if its certificates are in use, and migrate again",
+		strings.Join(e.Serials, ", "))
+}
+
+// dataMigrations are the migrations of the rows stored by earlier versions,
+// which every SQL depot runs after the migrations of its schema with the
+// same version.
+var dataMigrations = []Migration{
+	{Version: 5, Name: "backfill_key_ids", data: (*Depot).backfillKeyIDs},
+	{Version: 6, Name: "hash_secrets", data: (*Depot).hashSecrets},
+}
+
+// MigrationStatus is a Migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// SchemaTooNewError is returned when the database has been migrated by a
+// newer version of the server than the one running.
+type SchemaTooNewError struct {
+	Version int
+	Known   int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than version %d known by this server", e.Version, e.Known)
+}
+
+// SchemaOutdatedError is returned when the database has not been migrated
+// to the latest version known by the running server.
+type SchemaOutdatedError struct {
+	Version int
+	Latest  int
+}
+
+func (e *SchemaOutdatedError) Error() string {
+	return fmt.Sprintf("database schema version %d is older than version %d of this server: run db migrate first", e.Version, e.Latest)
+}
+
+// LoadMigrations reads the migrations in fsys, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql, in version order.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s is neither .up.sql nor .down.sql", file)
+		}
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		prefix, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s has no version", file)
+		}
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up.sql", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and rolls back the migrations of a database, recording
+// the applied versions in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+	baseline   func(*sql.DB) error
+}
+
+// ErrUnversioned is returned when rolling back a database without a
+// schema_migrations table.
+var ErrUnversioned = errors.New("database schema is not versioned")
+
+// MigratorOption configures a Migrator.
+type MigratorOption func(*Migrator)
+
+// WithBaseline sets a function that Migrate calls before migrating a
+// database that has the tables of the depot but no applied migration, to
+// bring a database created before its schema was versioned up to what the
+// first migration expects.
+func WithBaseline(baseline func(*sql.DB) error) MigratorOption {
+	return func(m *Migrator) {
+		m.baseline = baseline
+	}
+}
+
+// NewMigrator returns a Migrator of migrations, which are in version order,
+// and of the migrations of the data shared by the SQL depots.
+func NewMigrator(db *sql.DB, dialect Dialect, migrations []Migration, opts ...MigratorOption) (*Migrator, error) {
+	all := append([]Migration(nil), migrations...)
+	for _, dm := range dataMigrations {
+		for _, migration := range migrations {
+			if migration.Version == dm.Version {
+				return nil, fmt.Errorf("migrations %s and %s have the same version", migration.Name, dm.Name)
+			}
+		}
+		all = append(all, dm)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	for i := range all {
+		all[i].check = checks[all[i].Name]
+	}
+	m := &Migrator{db: db, dialect: dialect, migrations: all}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
+}
+
+func (m *Migrator) latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// hasTable reports whether the database has table.
+func (m *Migrator) hasTable(table string) (bool, error) {
+	err := m.db.QueryRow("SELECT 1 FROM " + table + " WHERE 1 = 0").Scan(new(int))
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	// the query fails on a missing table, unless the database is unreachable
+	if err := m.db.Ping(); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// Versioned reports whether the database has a schema_migrations table.
+// Only Migrate creates it.
+func (m *Migrator) Versioned() (bool, error) {
+	return m.hasTable("schema_migrations")
+}
+
+func (m *Migrator) createTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+// applied returns when the versions applied to the database were applied.
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Version returns the latest version applied to the database, or 0 if it
+// is not versioned.
+func (m *Migrator) Version() (int, error) {
+	if versioned, err := m.Versioned(); err != nil || !versioned {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := m.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Check returns a *SchemaTooNewError if the database has a version newer
+// than the migrations.
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version > m.latest() {
+		return &SchemaTooNewError{Version: version, Known: m.latest()}
+	}
+	return nil
+}
+
+// CheckCurrent returns the error of Check, or a *SchemaOutdatedError if
+// migrations have not been applied to the database.
+func (m *Migrator) CheckCurrent() error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version < m.latest() {
+		return &SchemaOutdatedError{Version: version, Latest: m.latest()}
+	}
+	return nil
+}
+
+// Migrate applies the migrations that have not been applied, each in a
+// transaction where the database supports transactional DDL.
+// It fails if the database has a version newer than the migrations.
+func (m *Migrator) Migrate() error {
+	if err := m.createTable(); err != nil {
+		return err
+	}
+	if err := m.Check(); err != nil {
+		return err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 && m.baseline != nil {
+		// the tables of a database created before the schema was versioned
+		legacy, err := m.hasTable("clients")
+		if err != nil {
+			return err
+		}
+		if legacy {
+			if err := m.baseline(m.db); err != nil {
+				return err
+			}
+		}
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if migration.check != nil {
+			if err := migration.check(&Depot{db: m.db, q: m.db, dialect: m.dialect}); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+		err := m.run(migration.Up, migration.data,
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// RollbackPlan returns the migrations Rollback(steps) rolls back, in the
+// order it rolls them back.
+func (m *Migrator) RollbackPlan(steps int) ([]Migration, error) {
+	versioned, err := m.Versioned()
+	if err != nil {
+		return nil, err
+	}
+	if !versioned {
+		return nil, ErrUnversioned
+	}
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var plan []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(plan) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == "" && migration.data == nil {
+			return nil, fmt.Errorf("migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+		}
+		plan = append(plan, migration)
+	}
+	return plan, nil
+}
+
+// Rollback rolls back the latest steps migrations applied to the database.
+func (m *Migrator) Rollback(steps int) error {
+	plan, err := m.RollbackPlan(steps)
+	if err != nil {
+		return err
+	}
+	for _, migration := range plan {
+		err := m.run(migration.Down, nil, "DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+		if err != nil {
+			return fmt.Errorf("rollback of migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// Status returns the migrations and when they were applied. None is applied
+// to a database that is not versioned.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	versioned, err := m.Versioned()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	if versioned {
+		if applied, err = m.applied(); err != nil {
+			return nil, err
+		}
+	}
+	var status []MigrationStatus
+	for _, migration := range m.migrations {
+		s := MigrationStatus{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// run executes the statements of script, data and then query in a
+// transaction.
+func (m *Migrator) run(script string, data func(*Depot) error, query string, args ...interface{}) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		if err := data(&Depot{db: m.db, q: tx, dialect: m.dialect}); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(m.dialect.Rebind(query), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements splits script into the statements that end with a
+// semicolon at the end of a line, dropping -- comment lines.
+func splitStatements(script string) []string {
+	var stmts []string
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(b.String()))
+			b.Reset()
+		}
+	}
+	if s := strings.TrimSpace(b.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
@@ -0,0 +1,170 @@
+package sqldepot
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/procube-open/scep/cryptoutil"
+	"github.com/procube-open/scep/depot"
+)
+
+// CreateSecret stores a hash of info.Secret for info.Target.
+func (d *Depot) CreateSecret(info depot.CreateSecretInfo) error {
+	now := time.Now()
+	hash, err := cryptoutil.HashSecret(info.Secret)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(info.Available_Period)
+	if err != nil {
+		return err
+	}
+	deleteAt := now.Add(duration)
+	var profile sql.NullString
+	if info.Profile != "" {
+		profile = sql.NullString{String: info.Profile, Valid: true}
+	}
+	_, err = d.exec("INSERT INTO secrets (challenge, secret, target, type, created_at, delete_at, pending_period, profile) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		info.Target, hash, info.Target, info.Type, now, deleteAt, info.Pending_Period, profile)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteSecret deletes the secret of target and the invitations to it.
+func (d *Depot) DeleteSecret(target string) error {
+	if _, err := d.exec("DELETE FROM invitations WHERE target = ?", target); err != nil {
+		return err
+	}
+	_, err := d.exec("DELETE FROM secrets WHERE target = ?", target)
+	return err
+}
+
+// ReplaceSecret stores a hash of secret as the secret of target, keeping
+// its expiry.
+func (d *Depot) ReplaceSecret(target, secret string) error {
+	hash, err := cryptoutil.HashSecret(secret)
+	if err != nil {
+		return err
+	}
+	res, err := d.exec("UPDATE secrets SET secret = ? WHERE target = ?", hash, target)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return depot.ErrSecretNotFound
+	}
+	return nil
+}
+
+func (d *Depot) GetSecret(target string) (depot.SecretInfo, error) {
+	var secret depot.SecretInfo
+	rows, err := d.query("SELECT secret, type, delete_at, pending_period, profile FROM secrets WHERE target = ?", target)
+	if err != nil {
+		return secret, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return secret, depot.ErrSecretNotFound
+	}
+	var profile sql.NullString
+	err = rows.Scan(&secret.Hash, &secret.Type, &secret.Delete_At, &secret.Pending_Period, &profile)
+	secret.Profile = profile.String
+	return secret, err
+}
+
+// CompareSecret reports whether secret is the secret of target.
+func (d *Depot) CompareSecret(target, secret string) (bool, error) {
+	info, err := d.GetSecret(target)
+	if err != nil {
+		return false, err
+	}
+	return cryptoutil.CompareSecret(info.Hash, secret), nil
+}
+
+// hashSecrets replaces the plaintext secrets stored by earlier versions
+// with their hashes, and the uid\secret challenge key with the uid.
+func (d *Depot) hashSecrets() error {
+	rows, err := d.query("SELECT challenge, secret, target FROM secrets")
+	if err != nil {
+		return err
+	}
+	type plaintext struct{ challenge, secret, target string }
+	var secrets []plaintext
+	for rows.Next() {
+		var p plaintext
+		if err := rows.Scan(&p.challenge, &p.secret, &p.target); err != nil {
+			rows.Close()
+			return err
+		}
+		if !cryptoutil.IsHashedSecret(p.secret) {
+			secrets = append(secrets, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range secrets {
+		hash, err := cryptoutil.HashSecret(p.secret)
+		if err != nil {
+			return err
+		}
+		_, err = d.exec("UPDATE secrets SET challenge = ?, secret = ? WHERE challenge = ?", p.target, hash, p.challenge)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckSecretExpiration deletes the expired secrets and returns their
+// clients to the status they had before the secret was created.
+func (d *Depot) CheckSecretExpiration() error {
+	rows, err := d.query("SELECT target FROM secrets WHERE delete_at < ?", time.Now())
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for rows.Next() {
+		var target string
+		if err := rows.Scan(&target); err != nil {
+			rows.Close()
+			return err
+		}
+		targets = append(targets, target)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, target := range targets {
+		client, err := d.GetClient(target)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			switch client.Status {
+			case "ISSUABLE":
+				err = d.UpdateStatusClient(target, "INACTIVE")
+			case "UPDATABLE":
+				err = d.UpdateStatusClient(target, "ISSUED")
+			default:
+				err = errors.New("client is not issuable or updatable")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := d.DeleteSecret(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Package sqlite implements the depot on SQLite, for single node
+// deployments that do not run a database server.
+package sqlite
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/procube-open/scep/depot/sqldepot"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Open opens the SQLite database file at path in WAL mode, creating it if
+// it does not exist.
+func Open(path string) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "foreign_keys(1)")
+	// transactions take the write lock when they begin, as SQLite has no
+	// SELECT ... FOR UPDATE
+	q.Set("_txlock", "immediate")
+	// times are written in a format that sorts as text
+	q.Set("_time_format", "sqlite")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewMigrator returns the Migrator of the schema of db.
+func NewMigrator(db *sql.DB) (*sqldepot.Migrator, error) {
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	ms, err := sqldepot.LoadMigrations(sub)
+	if err != nil {
+		return nil, err
+	}
+	return sqldepot.NewMigrator(db, dialect{}, ms)
+}
+
+// NewDepot opens the SQLite database file at path and migrates its schema.
+// The CA is read from dirPath.
+func NewDepot(path, dirPath string, opts ...sqldepot.Option) (*sqldepot.Depot, error) {
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := m.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqldepot.New(db, dialect{}, dirPath, opts...)
+}
+
+// OpenDepot opens the SQLite database file at path like NewDepot, but
+// without migrating its schema, for the commands that only read it.
+func OpenDepot(path, dirPath string, opts ...sqldepot.Option) (*sqldepot.Depot, error) {
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return sqldepot.New(db, dialect{}, dirPath, opts...)
+}
+
+// dialect adapts the queries of sqldepot to SQLite. Serial numbers are
+// allocated by incrementing the single row of serial_table.
+type dialect struct{}
+
+func (dialect) Rebind(query string) string {
+	return strings.Replace(query, " FOR UPDATE", "", 1)
+}
+
+func (dialect) IsDuplicate(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || code == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+func (dialect) Serial(db *sql.DB) (*big.Int, error) {
+	var serial int64
+	err := db.QueryRow(`INSERT INTO serial_table (id, serial) VALUES (1, 2)
+		ON CONFLICT (id) DO UPDATE SET serial = serial + 1 RETURNING serial`).Scan(&serial)
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(serial), nil
+}
+
+func (dialect) ClaimSerial(db *sql.DB, serial *big.Int) (bool, error) {
+	if !serial.IsInt64() {
+		return false, nil
+	}
+	// the row is created by the unique_serial migration
+	res, err := db.Exec("UPDATE serial_table SET serial = serial + 1 WHERE id = 1 AND serial + 1 = ?", serial.Int64())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (dialect) NextSerial(q sqldepot.RowQuerier) (*big.Int, error) {
+	var serial int64
+	err := q.QueryRow("SELECT serial FROM serial_table WHERE id = 1").Scan(&serial)
+	if err == sql.ErrNoRows {
+		return big.NewInt(2), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return big.NewInt(serial + 1), nil
+}
+
+// DumpStyle writes times in the format of Open, so that they compare as
+// text with the times the driver writes.
+func (dialect) DumpStyle() sqldepot.DumpStyle {
+	return sqldepot.DumpStyle{
+		TimeLayout: "2006-01-02 15:04:05.999999999-07:00",
+		BlobPrefix: "X'",
+	}
+}
+
+func (dialect) SetSerialSQL(serial *big.Int) []string {
+	return []string{"UPDATE serial_table SET serial = " + serial.String() + " WHERE id = 1"}
+}
@@ -0,0 +1,291 @@
+package sqlite
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/depot/depottest"
+	"github.com/procube-open/scep/depot/sqldepot"
+)
+
+func newTestDepot(t *testing.T, opts ...sqldepot.Option) *sqldepot.Depot {
+	d, err := NewDepot(filepath.Join(t.TempDir(), "scep.db"), t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.DB().Close() })
+	return d
+}
+
+func TestDepot(t *testing.T) {
+	d := newTestDepot(t)
+	depottest.TestStore(t, d)
+	depottest.TestInvitations(t, d)
+	depottest.TestExpiration(t, d)
+	depottest.TestChallengeStore(t, d)
+	depottest.TestMultiCA(t, d)
+	depottest.TestConcurrentEnrollment(t, d)
+	depottest.TestSerials(t, d)
+}
+
+func TestRandomSerials(t *testing.T) {
+	depottest.TestRandomSerials(t, newTestDepot(t, sqldepot.WithRandomSerials()))
+}
+
+func TestSerial(t *testing.T) {
+	d := newTestDepot(t)
+	for _, want := range []int64{2, 3, 4} {
+		next, err := d.GetNextSerial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial, err := d.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Int64() != want || next.Int64() != want {
+			t.Errorf("Serial() = %v, GetNextSerial() = %v, want %d", serial, next, want)
+		}
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	depottest.TestDumpRestore(t, newTestDepot(t), newTestDepot(t))
+}
+
+func testCert(t *testing.T, cn string, serial *big.Int) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestJournalMode(t *testing.T) {
+	d := newTestDepot(t)
+	var mode string
+	if err := d.DB().QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal mode is %q, want wal", mode)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scep.db")
+	d, err := NewDepot(path, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DB().Close()
+	m, err := NewMigrator(d.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d_%s is not applied", s.Version, s.Name)
+		}
+	}
+	latest := status[len(status)-1].Version
+
+	if err := m.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := m.Version(); err != nil || version != latest-1 {
+		t.Errorf("Version() after rollback = %d, %v, want %d", version, err, latest-1)
+	}
+	var outdated *sqldepot.SchemaOutdatedError
+	if err := m.CheckCurrent(); !errors.As(err, &outdated) || outdated.Version != latest-1 || outdated.Latest != latest {
+		t.Errorf("CheckCurrent() after rollback = %v", err)
+	}
+	if err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := m.Version(); err != nil || version != latest {
+		t.Errorf("Version() after migrate = %d, %v, want %d", version, err, latest)
+	}
+	if err := m.CheckCurrent(); err != nil {
+		t.Errorf("CheckCurrent() after migrate = %v", err)
+	}
+
+	_, err = d.DB().Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', ?)", latest+1, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tooNew *sqldepot.SchemaTooNewError
+	if _, err := NewDepot(path, t.TempDir()); !errors.As(err, &tooNew) || tooNew.Version != latest+1 || tooNew.Known != latest {
+		t.Errorf("NewDepot() on a newer schema returned %v", err)
+	}
+}
+
+func TestUnversioned(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "scep.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// a table of a database created before the schema was versioned
+	if _, err := db.Exec("CREATE TABLE clients (uid VARCHAR(255) NOT NULL PRIMARY KEY, status VARCHAR(255) NOT NULL, attributes TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			t.Errorf("migration %d_%s of an unversioned database is applied", s.Version, s.Name)
+		}
+	}
+	if version, err := m.Version(); version != 0 || err != nil {
+		t.Errorf("Version() = %d, %v", version, err)
+	}
+	if err := m.Rollback(1); err != sqldepot.ErrUnversioned {
+		t.Errorf("Rollback() = %v, want ErrUnversioned", err)
+	}
+	if versioned, err := m.Versioned(); versioned || err != nil {
+		t.Fatalf("Versioned() after Status and Version = %v, %v", versioned, err)
+	}
+
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := sqldepot.LoadMigrations(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baselined := false
+	m, err = sqldepot.NewMigrator(db, dialect{}, ms, sqldepot.WithBaseline(func(*sql.DB) error {
+		baselined = true
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !baselined {
+		t.Error("the baseline of a database with the legacy tables did not run")
+	}
+}
+
+func TestDataMigrations(t *testing.T) {
+	d := newTestDepot(t)
+	m, err := NewMigrator(d.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+	// rows stored before the data migrations
+	if err := d.AddClient(depot.Client{Uid: "old"}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	cert := testCert(t, "old", big.NewInt(10))
+	_, err = d.DB().Exec("INSERT INTO certificates (cn, serial, cert_data, status, valid_from, valid_till) VALUES ('old', 'a', ?, 'V', ?, ?)",
+		cert.Raw, cert.NotBefore.UTC(), cert.NotAfter.UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.DB().Exec("INSERT INTO secrets (challenge, secret, target, type, created_at, delete_at, pending_period) VALUES ('old\\s3cret', 's3cret', 'old', 'test', ?, ?, '0s')",
+		time.Now().UTC(), time.Now().Add(time.Hour).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if cns, err := d.GetCNsByPublicKey(cert.RawSubjectPublicKeyInfo); err != nil || len(cns) != 1 || cns[0] != "old" {
+		t.Errorf("GetCNsByPublicKey() after the migrations = %v, %v", cns, err)
+	}
+	if ok, err := d.CompareSecret("old", "s3cret"); !ok || err != nil {
+		t.Errorf("CompareSecret() after the migrations = %v, %v", ok, err)
+	}
+	var challenge string
+	if err := d.DB().QueryRow("SELECT challenge FROM secrets WHERE target = 'old'").Scan(&challenge); err != nil || challenge != "old" {
+		t.Errorf("challenge after the migrations = %q, %v", challenge, err)
+	}
+}
+
+func TestDuplicateSerials(t *testing.T) {
+	d := newTestDepot(t)
+	m, err := NewMigrator(d.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// back to the schema without the unique index of the serials
+	for {
+		version, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version < 3 {
+			break
+		}
+		if err := m.Rollback(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cn := range []string{"a", "b"} {
+		cert := testCert(t, cn, big.NewInt(10))
+		_, err := d.DB().Exec("INSERT INTO certificates (cn, serial, cert_data, status, valid_from, valid_till) VALUES (?, 'a', ?, 'V', ?, ?)",
+			cn, cert.Raw, cert.NotBefore.UTC(), cert.NotAfter.UTC())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dup *sqldepot.DuplicateSerialsError
+	if err := m.Migrate(); !errors.As(err, &dup) || len(dup.Serials) != 1 || dup.Serials[0] != "a" {
+		t.Fatalf("Migrate() with duplicate serials = %v", err)
+	}
+	if version, err := m.Version(); version != 2 || err != nil {
+		t.Errorf("Version() after the failed migration = %d, %v, want 2", version, err)
+	}
+	if _, err := d.DB().Exec("DELETE FROM certificates WHERE cn = 'b'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
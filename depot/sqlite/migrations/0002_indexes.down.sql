@@ -0,0 +1,3 @@
+DROP INDEX certificates_cn;
+DROP INDEX certificates_key_id;
+DROP INDEX secrets_target;
@@ -0,0 +1,3 @@
+-- serial_table has a row for ClaimSerial to update
+INSERT INTO serial_table (id, serial) VALUES (1, 1) ON CONFLICT (id) DO NOTHING;
+CREATE UNIQUE INDEX certificates_serial ON certificates (serial);
@@ -0,0 +1,3 @@
+-- the CA a client belongs to, '' for the default CA
+ALTER TABLE clients ADD COLUMN ca VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX clients_ca ON clients (ca);
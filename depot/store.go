@@ -0,0 +1,198 @@
+package depot
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Client is a device or user certificates are issued to.
+// Its Status is one of INACTIVE, ISSUABLE, ISSUED, UPDATABLE, PENDING or
+// ARCHIVED.
+type Client struct {
+	Uid        string                 `json:"uid"`
+	Status     string                 `json:"status"`
+	Attributes map[string]interface{} `json:"attributes"`
+	// CA is the name of the CA the client enrolls with, empty for the
+	// default CA.
+	CA string `json:"ca"`
+}
+
+// UpdateInfo replaces the attributes of a client.
+type UpdateInfo struct {
+	Uid        string                 `json:"uid"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// CreateSecretInfo describes a secret to create.
+type CreateSecretInfo struct {
+	Secret           string `json:"secret"`
+	Type             string `json:"type"`
+	Target           string `json:"target"`
+	Available_Period string `json:"available_period"`
+	Pending_Period   string `json:"pending_period"`
+	Profile          string `json:"profile"`
+
+	// Generate makes the server generate the secret instead of using Secret.
+	Generate bool `json:"generate"`
+	// Invite requests an enrollment invitation for the secret.
+	Invite bool `json:"invite"`
+}
+
+// SecretInfo describes a stored secret.
+type SecretInfo struct {
+	// Hash is the argon2id hash of the secret. The secret itself is not stored.
+	Hash           string    `json:"-"`
+	Type           string    `json:"type"`
+	Delete_At      time.Time `json:"delete_at"`
+	Pending_Period string    `json:"pending_period"`
+	Profile        string    `json:"profile"`
+}
+
+// Certificate is an issued certificate and its status: V for valid,
+// H for held and R for revoked.
+type Certificate struct {
+	Id             int       `json:"id"`
+	CN             string    `json:"cn"`
+	Serial         big.Int   `json:"serial"`
+	CertData       string    `json:"cert_data"`
+	Status         string    `json:"status"`
+	ValidFrom      time.Time `json:"valid_from"`
+	ValidTill      time.Time `json:"valid_till"`
+	RevocationDate time.Time `json:"revocation_date"`
+
+	RevocationReason *RevocationReason `json:"revocation_reason,omitempty"`
+	InvalidityDate   *time.Time        `json:"invalidity_date,omitempty"`
+}
+
+// ErrInvitationUsed is returned when an invitation was already redeemed,
+// has expired or was deleted together with its secret.
+var ErrInvitationUsed = errors.New("invitation is already used or expired")
+
+// ErrSecretNotFound is returned when a client has no secret.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ClientStore stores clients.
+type ClientStore interface {
+	AddClient(client Client, initialStatus string) error
+	UpdateAttributesClient(info UpdateInfo) error
+	UpdateStatusClient(uid string, status string) error
+	// GetClient returns nil and no error if the client does not exist.
+	GetClient(uid string) (*Client, error)
+	GetClientList() ([]Client, error)
+	// ArchiveClient revokes the certificates of uid, deletes its secret and
+	// archives it.
+	ArchiveClient(uid string, archivedAt time.Time) error
+	PurgeArchivedClients(retention time.Duration) error
+}
+
+// SecretStore stores hashes of the secrets clients enroll with.
+type SecretStore interface {
+	// CreateSecret stores a hash of info.Secret for info.Target.
+	CreateSecret(info CreateSecretInfo) error
+	GetSecret(target string) (SecretInfo, error)
+	// CompareSecret reports whether secret is the secret of target.
+	CompareSecret(target, secret string) (bool, error)
+	// ReplaceSecret replaces the secret of target, keeping its expiry.
+	ReplaceSecret(target, secret string) error
+	// DeleteSecret deletes the secret of target and the invitations to it.
+	DeleteSecret(target string) error
+	CheckSecretExpiration() error
+}
+
+// InvitationStore records the enrollment invitations to secrets.
+type InvitationStore interface {
+	CreateInvitation(jti, target string, expiresAt time.Time) error
+	// RedeemInvitation consumes an invitation and replaces the secret of
+	// target with secret, keeping its expiry, in one transaction. It
+	// returns ErrInvitationUsed if the invitation cannot be redeemed, and
+	// ErrSecretNotFound if target has no secret.
+	RedeemInvitation(jti, target, secret string) error
+}
+
+// CertificateStore looks up issued certificates.
+type CertificateStore interface {
+	GetCertsByCN(cn string) ([]Certificate, error)
+	// GetCertBySerial returns nil and no error if there is no certificate.
+	GetCertBySerial(serial *big.Int) (*Certificate, error)
+	// GetCNsByPublicKey returns the distinct CNs of the certificates issued
+	// for the DER encoded SubjectPublicKeyInfo.
+	GetCNsByPublicKey(rawSubjectPublicKeyInfo []byte) ([]string, error)
+	// GetNextSerial returns the serial number the next certificate would
+	// get, without allocating it. It returns ErrRandomSerial if serial
+	// numbers are random.
+	GetNextSerial() (*big.Int, error)
+	// ClaimSerial allocates serial to a certificate signed outside of the
+	// store. It returns false if serial is not the next serial number, or
+	// is already in use if serial numbers are random.
+	ClaimSerial(serial *big.Int) (bool, error)
+	CheckCertExpiration() error
+}
+
+// RevocationStore revokes, holds and releases certificates.
+type RevocationStore interface {
+	// GetRCs returns the CRL entries of the revoked and held certificates.
+	GetRCs() ([]x509.RevocationListEntry, error)
+	// GetRCsByIssuer returns the CRL entries of the revoked and held
+	// certificates issued by the CA whose DER encoded subject is rawIssuer.
+	GetRCsByIssuer(rawIssuer []byte) ([]x509.RevocationListEntry, error)
+	// RevokeCertificate revokes the valid and held certificates of uid.
+	RevokeCertificate(uid string, revocationDate time.Time) error
+	// RevokeClient revokes the certificates of uid, deletes its secret and
+	// makes it INACTIVE.
+	RevokeClient(uid string, revocationDate time.Time) error
+	RevokeCertificateBySerial(serial *big.Int, reason RevocationReason, revocationDate time.Time, invalidityDate *time.Time) error
+	HoldCertificate(serial *big.Int, holdDate time.Time) error
+	ReleaseCertificate(serial *big.Int) error
+	CheckCertRevocation() error
+}
+
+// JTIStore records the IDs of the signed challenges that have been used.
+type JTIStore interface {
+	// UseJTI records jti, which can be forgotten after expiresAt.
+	// It returns false if jti was already recorded.
+	UseJTI(jti string, expiresAt time.Time) (bool, error)
+	// ReleaseJTI forgets jti, so that its challenge can be used again
+	// after the enrollment with it failed.
+	ReleaseJTI(jti string) error
+	PurgeUsedJTIs() error
+}
+
+// ChallengeStore is a store of random one-time SCEP challenges that expire
+// after a TTL and are optionally bound to the uid of a client.
+type ChallengeStore interface {
+	// TTL returns how long the challenges are valid.
+	TTL() time.Duration
+	SCEPChallenge() (string, error)
+	SCEPChallengeFor(uid string) (string, error)
+	HasChallenge(pw string) (bool, error)
+	UseChallenge(pw string) (bool, string, error)
+	PurgeExpiredChallenges() error
+}
+
+// Store is a Depot that stores everything the server manages.
+type Store interface {
+	Depot
+	ClientStore
+	SecretStore
+	InvitationStore
+	CertificateStore
+	RevocationStore
+	JTIStore
+}
+
+// ChallengeStoreFactory is implemented by the stores that keep one-time
+// challenges.
+type ChallengeStoreFactory interface {
+	// NewChallengeStore returns a ChallengeStore of challenges valid for ttl.
+	NewChallengeStore(ttl time.Duration) ChallengeStore
+}
+
+// PublicKeyID identifies a public key by the hex SHA-256 of its DER
+// SubjectPublicKeyInfo.
+func PublicKeyID(rawSubjectPublicKeyInfo []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(rawSubjectPublicKeyInfo))
+}
@@ -0,0 +1,322 @@
+package depot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/procube-open/scep/scep"
+)
+
+// EnrollmentError is returned by the Signer when a CSR is rejected.
+// The SCEP service answers such errors with a CertRep carrying Info.
+type EnrollmentError struct {
+	Info   scep.FailInfo
+	Reason string
+}
+
+func (e *EnrollmentError) Error() string {
+	return e.Reason
+}
+
+// FailInfo returns the SCEP failInfo of the rejection.
+func (e *EnrollmentError) FailInfo() scep.FailInfo {
+	return e.Info
+}
+
+func rejectf(format string, args ...interface{}) error {
+	return &EnrollmentError{Info: scep.BadRequest, Reason: fmt.Sprintf(format, args...)}
+}
+
+const (
+	// SubjectBuild issues certificates with the subject fields and SANs
+	// rendered from the policy, ignoring those requested in the CSR.
+	SubjectBuild = "build"
+
+	// SubjectValidate issues certificates with the SANs of the CSR, and
+	// rejects CSRs requesting values the policy does not render. The subject
+	// fields the policy has no template for are dropped.
+	SubjectValidate = "validate"
+)
+
+// SubjectPolicy builds or validates the subject and SANs of certificates
+// from the attributes of the enrolling client. Every field is a text/template
+// executed with .uid and .attributes, e.g. "{{.attributes.hostname}}.corp.example".
+type SubjectPolicy struct {
+	// Mode is SubjectBuild or SubjectValidate. It defaults to SubjectBuild.
+	Mode string `json:"mode"`
+
+	Subject struct {
+		Organization       string `json:"organization"`
+		OrganizationalUnit string `json:"organizational_unit"`
+		Country            string `json:"country"`
+		Province           string `json:"province"`
+		Locality           string `json:"locality"`
+	} `json:"subject"`
+
+	DNS   []string `json:"dns"`
+	Email []string `json:"email"`
+	IP    []string `json:"ip"`
+	URI   []string `json:"uri"`
+
+	// UPN is added as a Microsoft user principal name otherName SAN.
+	// CSRs cannot request a UPN, so it is issued in both modes.
+	UPN string `json:"upn"`
+
+	templates map[string][]*template.Template
+}
+
+var oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// LoadSubjectPolicy reads a SubjectPolicy from the JSON file at path.
+func LoadSubjectPolicy(path string) (*SubjectPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(SubjectPolicy)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parsing subject policy: %w", err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compile parses the templates of p.
+func (p *SubjectPolicy) compile() error {
+	switch p.Mode {
+	case "":
+		p.Mode = SubjectBuild
+	case SubjectBuild, SubjectValidate:
+	default:
+		return fmt.Errorf("unknown subject policy mode %q", p.Mode)
+	}
+	fields := map[string][]string{
+		"organization":        {p.Subject.Organization},
+		"organizational_unit": {p.Subject.OrganizationalUnit},
+		"country":             {p.Subject.Country},
+		"province":            {p.Subject.Province},
+		"locality":            {p.Subject.Locality},
+		"dns":                 p.DNS,
+		"email":               p.Email,
+		"ip":                  p.IP,
+		"uri":                 p.URI,
+		"upn":                 {p.UPN},
+	}
+	p.templates = make(map[string][]*template.Template)
+	for field, texts := range fields {
+		for _, text := range texts {
+			if text == "" {
+				continue
+			}
+			t, err := template.New(field).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return fmt.Errorf("subject policy %s: %w", field, err)
+			}
+			p.templates[field] = append(p.templates[field], t)
+		}
+	}
+	return nil
+}
+
+// render executes the templates of field for e.
+func (p *SubjectPolicy) render(field string, e *Enrollment) ([]string, error) {
+	data := map[string]interface{}{
+		"uid":        e.UID,
+		"attributes": e.Attributes,
+	}
+	var values []string
+	for _, t := range p.templates[field] {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, rejectf("cannot render %s for %s: %v", field, e.UID, err)
+		}
+		if v := strings.TrimSpace(buf.String()); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// enforceSubject sets the common name of tmpl to the uid of e and builds or
+// validates the other subject fields and the SANs with p, which may be nil.
+func enforceSubject(p *SubjectPolicy, tmpl *x509.Certificate, csr *x509.CertificateRequest, e *Enrollment) error {
+	if cn := csr.Subject.CommonName; cn != "" && cn != e.UID {
+		return rejectf("CSR common name %q does not match uid %q", cn, e.UID)
+	}
+	tmpl.Subject.CommonName = e.UID
+	if p == nil {
+		return nil
+	}
+
+	// the subject fields the policy has no template for are dropped in
+	// both modes, so that a CSR cannot request them unchecked
+	tmpl.Subject = pkix.Name{CommonName: e.UID}
+	subjectFields := []struct {
+		name string
+		dst  *[]string
+		req  []string
+	}{
+		{"organization", &tmpl.Subject.Organization, csr.Subject.Organization},
+		{"organizational_unit", &tmpl.Subject.OrganizationalUnit, csr.Subject.OrganizationalUnit},
+		{"country", &tmpl.Subject.Country, csr.Subject.Country},
+		{"province", &tmpl.Subject.Province, csr.Subject.Province},
+		{"locality", &tmpl.Subject.Locality, csr.Subject.Locality},
+	}
+	for _, f := range subjectFields {
+		if len(p.templates[f.name]) == 0 {
+			continue
+		}
+		values, err := p.render(f.name, e)
+		if err != nil {
+			return err
+		}
+		if p.Mode == SubjectValidate {
+			for _, v := range f.req {
+				if !contains(values, v) {
+					return rejectf("CSR %s %q is not allowed for %s", f.name, v, e.UID)
+				}
+			}
+		}
+		*f.dst = values
+	}
+
+	dns, err := p.render("dns", e)
+	if err != nil {
+		return err
+	}
+	emails, err := p.render("email", e)
+	if err != nil {
+		return err
+	}
+	ipStrs, err := p.render("ip", e)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	for _, s := range ipStrs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return rejectf("rendered ip %q for %s is not an IP address", s, e.UID)
+		}
+		ips = append(ips, ip)
+	}
+	uriStrs, err := p.render("uri", e)
+	if err != nil {
+		return err
+	}
+	var uris []*url.URL
+	for _, s := range uriStrs {
+		u, err := url.Parse(s)
+		if err != nil {
+			return rejectf("rendered uri %q for %s is not a URI", s, e.UID)
+		}
+		uris = append(uris, u)
+	}
+
+	if p.Mode == SubjectBuild {
+		tmpl.DNSNames, tmpl.EmailAddresses, tmpl.IPAddresses, tmpl.URIs = dns, emails, ips, uris
+	} else {
+		for _, v := range csr.DNSNames {
+			if !containsFold(dns, v) {
+				return rejectf("CSR dns SAN %q is not allowed for %s", v, e.UID)
+			}
+		}
+		for _, v := range csr.EmailAddresses {
+			if !containsFold(emails, v) {
+				return rejectf("CSR email SAN %q is not allowed for %s", v, e.UID)
+			}
+		}
+	IPs:
+		for _, v := range csr.IPAddresses {
+			for _, ip := range ips {
+				if ip.Equal(v) {
+					continue IPs
+				}
+			}
+			return rejectf("CSR ip SAN %q is not allowed for %s", v, e.UID)
+		}
+		for _, v := range csr.URIs {
+			if !contains(uriStrs, v.String()) {
+				return rejectf("CSR uri SAN %q is not allowed for %s", v, e.UID)
+			}
+		}
+	}
+
+	upn, err := p.render("upn", e)
+	if err != nil {
+		return err
+	}
+	if len(upn) > 0 {
+		ext, err := marshalSANs(tmpl, upn[0])
+		if err != nil {
+			return err
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+	}
+	return nil
+}
+
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  string `asn1:"explicit,tag:0,utf8"`
+}
+
+// marshalSANs encodes the SANs of tmpl together with a UPN otherName.
+// crypto/x509 cannot encode otherName, so the whole extension is built
+// here and takes precedence over the SAN fields of tmpl.
+func marshalSANs(tmpl *x509.Certificate, upn string) (pkix.Extension, error) {
+	var names []asn1.RawValue
+	for _, name := range tmpl.DNSNames {
+		names = append(names, asn1.RawValue{Tag: 2, Class: asn1.ClassContextSpecific, Bytes: []byte(name)})
+	}
+	for _, email := range tmpl.EmailAddresses {
+		names = append(names, asn1.RawValue{Tag: 1, Class: asn1.ClassContextSpecific, Bytes: []byte(email)})
+	}
+	for _, ip := range tmpl.IPAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		names = append(names, asn1.RawValue{Tag: 7, Class: asn1.ClassContextSpecific, Bytes: ip})
+	}
+	for _, uri := range tmpl.URIs {
+		names = append(names, asn1.RawValue{Tag: 6, Class: asn1.ClassContextSpecific, Bytes: []byte(uri.String())})
+	}
+
+	b, err := asn1.Marshal(otherName{TypeID: oidUPN, Value: upn})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &seq); err != nil {
+		return pkix.Extension{}, err
+	}
+	names = append(names, asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: seq.Bytes})
+
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Value: value}, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
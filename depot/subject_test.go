@@ -0,0 +1,174 @@
+package depot_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+)
+
+func loadTestPolicy(t *testing.T, data string) *scepdepot.SubjectPolicy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "subject.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := scepdepot.LoadSubjectPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func enrollmentContext(uid string, attrs map[string]interface{}) context.Context {
+	return scepdepot.NewContext(context.Background(), &scepdepot.Enrollment{UID: uid, Attributes: attrs})
+}
+
+func assertRejected(t *testing.T, err error) {
+	t.Helper()
+	var rejected *scepdepot.EnrollmentError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("have error %v, want an EnrollmentError", err)
+	}
+	if rejected.FailInfo() != scep.BadRequest {
+		t.Errorf("have failInfo %v, want %v", rejected.FailInfo(), scep.BadRequest)
+	}
+}
+
+func TestSubjectCommonName(t *testing.T) {
+	signer := newTestSigner(t)
+
+	_, err := signer.SignCSRContext(enrollmentContext("alice", nil), newTestCSR(t, "bob"))
+	assertRejected(t, err)
+
+	crt, err := signer.SignCSRContext(enrollmentContext("alice", nil), newTestCSR(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crt.Subject.CommonName != "alice" {
+		t.Errorf("have CN %q, want alice", crt.Subject.CommonName)
+	}
+}
+
+func TestSubjectPolicyBuild(t *testing.T) {
+	policy := loadTestPolicy(t, `{
+		"subject": {"organization": "Example", "organizational_unit": "{{.attributes.department}}"},
+		"dns": ["{{.attributes.hostname}}.corp.example"],
+		"upn": "{{.attributes.upn}}"
+	}`)
+	signer := newTestSigner(t, scepdepot.WithSubjectPolicy(policy))
+	attrs := map[string]interface{}{
+		"hostname":   "pc01",
+		"department": "sales",
+		"upn":        "alice@corp.example",
+	}
+
+	crt, err := signer.SignCSRContext(enrollmentContext("alice", attrs), newTestCSR(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "pc01.corp.example" {
+		t.Errorf("have DNS SANs %v", crt.DNSNames)
+	}
+	if len(crt.EmailAddresses) != 0 || len(crt.IPAddresses) != 0 {
+		t.Errorf("requested SANs were copied: %v %v", crt.EmailAddresses, crt.IPAddresses)
+	}
+	if len(crt.Subject.OrganizationalUnit) != 1 || crt.Subject.OrganizationalUnit[0] != "sales" {
+		t.Errorf("have OU %v", crt.Subject.OrganizationalUnit)
+	}
+	if upn := certUPN(t, crt); upn != "alice@corp.example" {
+		t.Errorf("have UPN %q", upn)
+	}
+
+	delete(attrs, "hostname")
+	_, err = signer.SignCSRContext(enrollmentContext("alice", attrs), newTestCSR(t, "alice"))
+	assertRejected(t, err)
+}
+
+func TestSubjectPolicyValidate(t *testing.T) {
+	policy := loadTestPolicy(t, `{
+		"mode": "validate",
+		"dns": ["{{.uid}}.example.com"],
+		"email": ["{{.attributes.mail}}"],
+		"ip": ["192.0.2.1"]
+	}`)
+	signer := newTestSigner(t, scepdepot.WithSubjectPolicy(policy))
+
+	ctx := enrollmentContext("alice", map[string]interface{}{"mail": "alice@example.com"})
+	crt, err := signer.SignCSRContext(ctx, newTestCSR(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crt.DNSNames) != 1 || len(crt.EmailAddresses) != 1 || len(crt.IPAddresses) != 1 {
+		t.Errorf("have SANs %v %v %v", crt.DNSNames, crt.EmailAddresses, crt.IPAddresses)
+	}
+
+	ctx = enrollmentContext("alice", map[string]interface{}{"mail": "carol@example.com"})
+	_, err = signer.SignCSRContext(ctx, newTestCSR(t, "alice"))
+	assertRejected(t, err)
+}
+
+func TestSubjectPolicyValidateDropsUntemplatedFields(t *testing.T) {
+	policy := loadTestPolicy(t, `{
+		"mode": "validate",
+		"subject": {"organization": "Example"}
+	}`)
+	signer := newTestSigner(t, scepdepot.WithSubjectPolicy(policy))
+
+	csr := newTestCSR(t, "alice")
+	csr.CSR.Subject = pkix.Name{
+		CommonName:    "alice",
+		Organization:  []string{"Example"},
+		Country:       []string{"JP"},
+		StreetAddress: []string{"1 Main St"},
+		PostalCode:    []string{"100-0001"},
+		SerialNumber:  "42",
+		ExtraNames:    []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 12}, Value: "admin"}},
+	}
+	csr.CSR.DNSNames, csr.CSR.EmailAddresses, csr.CSR.IPAddresses = nil, nil, nil
+	crt, err := signer.SignCSRContext(enrollmentContext("alice", nil), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pkix.Name{CommonName: "alice", Organization: []string{"Example"}}
+	if have := crt.Subject.String(); have != want.String() {
+		t.Errorf("have subject %q, want %q", have, want.String())
+	}
+}
+
+func certUPN(t *testing.T, crt *x509.Certificate) string {
+	t.Helper()
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if name.Tag != 0 || name.Class != asn1.ClassContextSpecific {
+				continue
+			}
+			var on struct {
+				TypeID asn1.ObjectIdentifier
+				Value  string `asn1:"explicit,tag:0,utf8"`
+			}
+			seq := append([]byte{0x30, byte(len(name.Bytes))}, name.Bytes...)
+			if _, err := asn1.Unmarshal(seq, &on); err != nil {
+				t.Fatal(err)
+			}
+			if on.TypeID.String() == "1.3.6.1.4.1.311.20.2.3" {
+				return on.Value
+			}
+		}
+	}
+	return ""
+}
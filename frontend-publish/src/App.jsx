@@ -24,6 +24,7 @@ function App() {
   const queryParameters = new URLSearchParams(window.location.search)
   const uid = queryParameters.get("uid")
   const secret = queryParameters.get("secret")
+  const invite = queryParameters.get("invite")
   const { t } = useTranslation();
   const [isRevealPassword, setIsRevealPassword] = React.useState(false);
   const [isDownloading, setIsDownloading] = React.useState(false);
@@ -84,12 +85,57 @@ function App() {
   const {
     handleSubmit,
     control,
+    setValue,
   } = useForm({
     mode: "onBlur",
     criteriaMode: "all",
     shouldFocusError: false,
+    defaultValues: {
+      uid: uid ?? "",
+      secret: secret ?? "",
+    },
   });
 
+  const toastOptions = {
+    position: "bottom-left",
+    autoClose: 5000,
+    hideProgressBar: true,
+    closeOnClick: true,
+    pauseOnHover: true,
+    draggable: true,
+    progress: undefined,
+    theme: "light",
+    transition: Bounce,
+  }
+
+  // an invitation is redeemed once for the uid and a fresh secret
+  const redeemed = React.useRef(false)
+  React.useEffect(() => {
+    if (!invite || redeemed.current) return
+    redeemed.current = true
+    const redeem = async () => {
+      const res = await fetch('/api/invite/redeem', {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ token: invite })
+      });
+      if (res.status === 200) {
+        const data = await res.json()
+        setValue("uid", data.uid)
+        setValue("secret", data.secret)
+        window.history.replaceState(null, "", window.location.pathname)
+        toast.success(t("caweb.inviteRedeemed"), toastOptions)
+      }
+      else {
+        const data = await res.json().catch(() => ({}))
+        toast.error(data.message ?? t("caweb.inviteFailed"), toastOptions)
+      }
+    }
+    redeem()
+  }, [invite]) // eslint-disable-line react-hooks/exhaustive-deps
+
   const onSubmit = async (data) => {
     setIsDownloading(true)
     const res = await fetch('/api/cert/pkcs12', {
@@ -171,7 +217,6 @@ function App() {
                 label={t("caweb.uid")}
                 required
                 value={value}
-                defaultValue={uid}
                 sx={{
                   width: "45%",
                 }}
@@ -198,7 +243,6 @@ function App() {
                 label={t("caweb.secret")}
                 required
                 value={value}
-                defaultValue={secret}
                 sx={{
                   width: "45%",
                   ml: 2
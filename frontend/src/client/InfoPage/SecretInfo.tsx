@@ -35,7 +35,7 @@ const SecretInfo = (props: SecretInfoProps) => {
   const [params, setParams] = React.useState<SecretInfoParams>({ secret: '', delete_at: null, pending_period: "" });
   const secretQuery = useQuery({
     queryKey: ["secret"],
-    queryFn: () => dataProvider.getSecret("secret", { uid: uid }).catch(() => { return { secret: "", delete_at: null, pending_period: "" } }),
+    queryFn: () => dataProvider.getSecret("secret", { uid: uid }).catch(() => { return { delete_at: null, pending_period: "" } }),
   })
   const statusQuery = useQuery({
     queryKey: ["client"],
@@ -50,12 +50,13 @@ const SecretInfo = (props: SecretInfoProps) => {
     if (!secretQuery.isLoading) {
       const data = secretQuery.data;
       const pending_period = data.pending_period ? Math.floor(parseInt(data.pending_period.slice(0, -1)) / 24).toString() : "";
+      // the secret itself is never returned, only whether one exists
       setParams({
-        secret: data.secret,
+        secret: "",
         delete_at: data.delete_at ? dayjs(data.delete_at) : null,
         pending_period: pending_period
       })
-      if (data.secret !== "") {
+      if (data.delete_at) {
         setHasSecret(true);
       } else {
         setHasSecret(false);
@@ -97,7 +98,7 @@ const SecretInfo = (props: SecretInfoProps) => {
             </Typography>
             <TextField
               label={translate("secret.fields.secret")}
-              value={params.secret}
+              value={hasSecret ? "********" : params.secret}
               variant="outlined"
               disabled={hasSecret || status === "PENDING"}
               onChange={(event) => setParams({ ...params, secret: event.target.value })}
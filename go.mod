@@ -3,20 +3,38 @@ module github.com/procube-open/scep
 go 1.25.4
 
 require (
+	filippo.io/age v1.2.1
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/boltdb/bolt v1.3.1
 	github.com/go-kit/kit v0.13.0
 	github.com/go-sql-driver/mysql v1.9.3
+	github.com/golang-jwt/jwt/v5 v5.3.1
 	github.com/gorilla/mux v1.8.1
 	github.com/groob/finalizer v0.0.0-20210806035223-91592c9e1e0b
+	github.com/lib/pq v1.10.9
 	github.com/pkg/errors v0.9.1
 	github.com/smallstep/pkcs7 v0.2.1
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	golang.org/x/crypto v0.46.0
+	modernc.org/sqlite v1.46.1
+	rsc.io/qr v0.2.0
 	software.sslmate.com/src/go-pkcs12 v0.6.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/go-kit/log v0.2.1 // indirect
 	github.com/go-logfmt/logfmt v0.6.1 // indirect
-	golang.org/x/crypto v0.46.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
+	golang.org/x/exp v0.0.0-20251023183803-a4bb9ffd2546 // indirect
 	golang.org/x/sys v0.39.0 // indirect
+	modernc.org/libc v1.67.6 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
 )
@@ -7,7 +7,8 @@ import (
 	"errors"
 	"strings"
 
-	"github.com/procube-open/scep/depot/mysql"
+	"github.com/procube-open/scep/cryptoutil"
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/scep"
 )
 
@@ -62,8 +63,17 @@ func StaticChallengeMiddleware(challenge string, next CSRSignerContext) CSRSigne
 	}
 }
 
-// IDMChallengeMiddleware
-func MySQLChallengeMiddleWare(depot *mysql.MySQLDepot, next CSRSignerContext) CSRSignerContextFunc {
+// ChallengeStore is the store SecretChallengeMiddleware checks the clients
+// and their secrets in.
+type ChallengeStore interface {
+	scepdepot.ClientStore
+	scepdepot.SecretStore
+}
+
+// SecretChallengeMiddleware wraps next and validates the uid\secret
+// challenge from the CSR against the secret of an issuable or updatable
+// client.
+func SecretChallengeMiddleware(depot ChallengeStore, next CSRSignerContext) CSRSignerContextFunc {
 	return func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
 		arr := strings.Split(m.ChallengePassword, "\\")
 		if len(arr) != 2 {
@@ -73,6 +83,9 @@ func MySQLChallengeMiddleWare(depot *mysql.MySQLDepot, next CSRSignerContext) CS
 		if err != nil {
 			return nil, err
 		}
+		if client == nil {
+			return nil, errors.New("client not found")
+		}
 		if !(client.Status == "ISSUABLE" || client.Status == "UPDATABLE") {
 			return nil, errors.New("client is not issuable or updatable")
 		}
@@ -80,9 +93,22 @@ func MySQLChallengeMiddleWare(depot *mysql.MySQLDepot, next CSRSignerContext) CS
 		if err != nil {
 			return nil, err
 		}
-		if secret.Secret != arr[1] {
+		// the REST API has compared the secret before generating the key
+		if !scepdepot.VerifiedSecret(ctx, arr[0]) && !cryptoutil.CompareSecret(secret.Hash, arr[1]) {
 			return nil, errors.New("invalid secret")
 		}
+		// a profile chosen by the secret takes precedence over the one
+		// assigned to the client through its attributes
+		profile := secret.Profile
+		if profile == "" {
+			profile, _ = client.Attributes["profile"].(string)
+		}
+		ctx = scepdepot.NewContext(ctx, &scepdepot.Enrollment{
+			UID:        arr[0],
+			Status:     client.Status,
+			Profile:    profile,
+			Attributes: client.Attributes,
+		})
 		return next.SignCSRContext(ctx, m)
 	}
 }
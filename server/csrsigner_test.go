@@ -2,9 +2,15 @@ package scepserver
 
 import (
 	"context"
+	"crypto/x509"
+	"path/filepath"
 	"testing"
 
+	scepdepot "github.com/procube-open/scep/depot"
+	boltdepot "github.com/procube-open/scep/depot/bolt"
 	"github.com/procube-open/scep/scep"
+
+	"github.com/boltdb/bolt"
 )
 
 func TestChallengeMiddleware(t *testing.T) {
@@ -27,3 +33,46 @@ func TestChallengeMiddleware(t *testing.T) {
 		t.Error("invalid challenge should generate an error")
 	}
 }
+
+func TestSecretChallengeMiddleware(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "scep.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	depot, err := boltdepot.NewBoltDepot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.AddClient(scepdepot.Client{Uid: "pc01"}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	err = depot.CreateSecret(scepdepot.CreateSecretInfo{Target: "pc01", Secret: "s3cret", Type: "ACTIVATE", Available_Period: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := SecretChallengeMiddleware(depot, CSRSignerContextFunc(func(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error) {
+		return &x509.Certificate{}, nil
+	}))
+
+	for _, tt := range []struct {
+		name      string
+		ctx       context.Context
+		challenge string
+		ok        bool
+	}{
+		{"secret", context.Background(), `pc01\s3cret`, true},
+		{"wrong secret", context.Background(), `pc01\wrong`, false},
+		{"unknown client", context.Background(), `pc02\s3cret`, false},
+		{"no uid", context.Background(), "s3cret", false},
+		{"verified secret", scepdepot.WithVerifiedSecret(context.Background(), "pc01"), `pc01\wrong`, true},
+		{"secret verified for another uid", scepdepot.WithVerifiedSecret(context.Background(), "pc02"), `pc01\wrong`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := signer.SignCSRContext(tt.ctx, &scep.CSRReqMessage{ChallengePassword: tt.challenge})
+			if (err == nil) != tt.ok {
+				t.Errorf("SignCSRContext() = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
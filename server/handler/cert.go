@@ -1,28 +1,29 @@
 package handler
 
 import (
+	"context"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
-	"fmt"
+	"io"
+	"math/big"
 	"net/http"
 	"net/url"
-	"os"
-	"os/exec"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
+	kitlog "github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
-	"github.com/procube-open/scep/depot/mysql"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
 	"github.com/procube-open/scep/utils"
 
 	"software.sslmate.com/src/go-pkcs12"
 )
 
-func CertsHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func CertsHandler(depot scepdepot.CertificateStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
 		certs, err := depot.GetCertsByCN(params["CN"])
@@ -36,13 +37,13 @@ func CertsHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 	}
 }
 
-func checkIfRevoked(cert *x509.Certificate, revokedCerts []pkix.RevokedCertificate) bool {
-	for _, revokedCert := range revokedCerts {
+func findRevocation(cert *x509.Certificate, revokedCerts []x509.RevocationListEntry) *x509.RevocationListEntry {
+	for i, revokedCert := range revokedCerts {
 		if cert.SerialNumber.Cmp(revokedCert.SerialNumber) == 0 {
-			return true
+			return &revokedCerts[i]
 		}
 	}
-	return false
+	return nil
 }
 
 func returnError(w http.ResponseWriter, message string, status int) {
@@ -55,7 +56,54 @@ func returnError(w http.ResponseWriter, message string, status int) {
 	w.Write(b)
 }
 
-func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+// caVerifyOptions returns the CA certificates of depot and options verifying
+// client certificates against them. The certificates must be issued by the
+// CA itself, so that those of another CA under the same root, such as a
+// sibling subordinate CA, are rejected.
+func caVerifyOptions(depot CALoader) ([]*x509.Certificate, x509.VerifyOptions, error) {
+	caPass := utils.EnvString("SCEP_CA_PASS", "")
+	caCerts, _, err := depot.CA([]byte(caPass))
+	if err != nil {
+		return nil, x509.VerifyOptions{}, err
+	}
+	if len(caCerts) == 0 {
+		return nil, x509.VerifyOptions{}, errors.New("missing CA certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:     x509.NewCertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	opts.Roots.AddCert(caCerts[0])
+	return caCerts, opts, nil
+}
+
+// CAs are the views of the store of the CAs a server serves by their
+// names, which are empty for the default CA. See depot.StoreForCA.
+type CAs map[string]VerifyStore
+
+// VerifyStore is the view of the store of a CA VerifyHandler verifies
+// certificates with.
+type VerifyStore interface {
+	CALoader
+	// GetRCs returns the CRL entries of the CA.
+	GetRCs() ([]x509.RevocationListEntry, error)
+	GetClient(uid string) (*scepdepot.Client, error)
+}
+
+// names returns the names of the CAs, the default CA first.
+func (cas CAs) names() []string {
+	names := make([]string, 0, len(cas))
+	for name := range cas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VerifyHandler verifies the client certificate passed by the TLS
+// terminating proxy against cas and reports the client it was issued to,
+// including the name of the CA that issued it.
+func VerifyHandler(cas CAs) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type ErrResp_1 struct {
 			Message string `json:"message"`
@@ -96,6 +144,13 @@ func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		}
 
 		certBlock, _ := pem.Decode([]byte(decodedCert))
+		if certBlock == nil {
+			res := ErrResp_1{Message: "Parse Certificate failed"}
+			w.WriteHeader(http.StatusInternalServerError)
+			b, _ := json.Marshal(res)
+			w.Write(b)
+			return
+		}
 		cert, err := x509.ParseCertificate(certBlock.Bytes)
 		if err != nil {
 			res := ErrResp_1{Message: "Parse Certificate failed"}
@@ -119,22 +174,31 @@ func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			return
 		}
 
-		depotPath := utils.EnvString("SCEP_FILE_DEPOT", "ca-certs")
-		ca_crt, _ := os.ReadFile(depotPath + "/ca.crt")
-		caCertBlock, _ := pem.Decode(ca_crt)
-		caCert, _ := x509.ParseCertificate(caCertBlock.Bytes)
-		certPool := x509.NewCertPool()
-		certPool.AddCert(caCert)
-		opts := x509.VerifyOptions{
-			Roots:     certPool,
-			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		// the certificate is verified against each CA until one issued it
+		var depot VerifyStore
+		var caPEM []byte
+		for _, name := range cas.names() {
+			caCerts, opts, err := caVerifyOptions(cas[name])
+			if err != nil {
+				res := ErrResp_1{Message: "Failed to load CA certificate"}
+				w.WriteHeader(http.StatusInternalServerError)
+				b, _ := json.Marshal(res)
+				w.Write(b)
+				return
+			}
+			if _, err := cert.Verify(opts); err == nil {
+				depot = cas[name]
+				break
+			}
+			for _, c := range caCerts {
+				caPEM = append(caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+			}
 		}
-
-		if _, err := cert.Verify(opts); err != nil {
+		if depot == nil {
 			res := ErrResp_3{
 				Message:     "Failed to verify certificate",
 				Certificate: string(decodedCert),
-				CaCert:      string(ca_crt),
+				CaCert:      string(caPEM),
 			}
 			w.WriteHeader(http.StatusUnauthorized)
 			b, _ := json.Marshal(res)
@@ -150,7 +214,15 @@ func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			w.Write(b)
 			return
 		}
-		if checkIfRevoked(cert, rcs) {
+		if rc := findRevocation(cert, rcs); rc != nil && rc.ReasonCode == int(scepdepot.CertificateHold) {
+			res := ErrResp_1{
+				Message: "Certificate is suspended",
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			b, _ := json.Marshal(res)
+			w.Write(b)
+			return
+		} else if rc != nil {
 			res := ErrResp_1{
 				Message: "Certificate is revoked",
 			}
@@ -181,6 +253,7 @@ func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 				Uid:        client.Uid,
 				Status:     client.Status,
 				Attributes: client.Attributes,
+				CA:         client.CA,
 			}
 			b, _ := json.Marshal(res)
 			w.Write(b)
@@ -188,13 +261,35 @@ func VerifyHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 	}
 }
 
-type createInfo *struct {
+// createInfo is the request of Pkcs12Handler.
+type createInfo struct {
 	Uid      string `json:"uid"`
 	Secret   string `json:"secret"`
 	Password string `json:"password"`
+	KeyType  string `json:"key_type"`
+	Encoding string `json:"encoding"`
+}
+
+// pkcs12Encoders are the PKCS#12 encodings a caller can choose from.
+var pkcs12Encoders = map[string]*pkcs12.Encoder{
+	"modern2023": pkcs12.Modern2023,
+	"legacy-rc2": pkcs12.LegacyRC2,
+	"legacy-des": pkcs12.LegacyDES,
+}
+
+// EnrollStore is the store the enrollment handlers check the secrets of the
+// clients in and load the CA certificates from.
+type EnrollStore interface {
+	CALoader
+	CompareSecret(target, secret string) (bool, error)
 }
 
-func Pkcs12Handler(depot *mysql.MySQLDepot) http.HandlerFunc {
+// CALoader loads the CA certificates and key.
+type CALoader interface {
+	CA(pass []byte) ([]*x509.Certificate, scepdepot.CAKey, error)
+}
+
+func Pkcs12Handler(depot EnrollStore, signer Signer, logger kitlog.Logger) http.HandlerFunc {
 	type ErrResp struct {
 		Message string `json:"message"`
 	}
@@ -209,20 +304,19 @@ func Pkcs12Handler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			w.Write(b)
 			return
 		}
-		secret, err := depot.GetSecret(info.Uid)
-		if err != nil || secret.Secret != info.Secret {
+		ok, err := depot.CompareSecret(info.Uid, info.Secret)
+		if err != nil || !ok {
 			res := ErrResp{Message: "Failed to create certificate"}
 			w.WriteHeader(http.StatusUnauthorized)
 			b, _ := json.Marshal(res)
 			w.Write(b)
 			return
 		}
-		p12, err := createPKCS12(depot, info)
+		// the challenge middleware does not compare the secret again
+		ctx := scepdepot.WithVerifiedSecret(r.Context(), info.Uid)
+		p12, err := createPKCS12(ctx, depot, signer, info)
 		if err != nil {
-			res := ErrResp{Message: err.Error()}
-			w.WriteHeader(http.StatusInternalServerError)
-			b, _ := json.Marshal(res)
-			w.Write(b)
+			writeEnrollError(w, logger, info.Uid, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
@@ -230,73 +324,252 @@ func Pkcs12Handler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		w.Write(p12)
 	}
 }
-func createPKCS12(depot *mysql.MySQLDepot, info createInfo) ([]byte, error) {
-	var err error
+
+// createPKCS12 issues a certificate for a key generated in memory and
+// returns both, together with the CA chain, as a PKCS#12 file.
+func createPKCS12(ctx context.Context, depot CALoader, signer Signer, info createInfo) ([]byte, error) {
 	if info.Password == "" {
-		return nil, errors.New("password is required")
+		return nil, badRequestf("password is required")
 	}
-	if info.Uid != "" && info.Secret != "" {
-		os.RemoveAll("/tmp/" + info.Uid)
-		if err := os.Mkdir("/tmp/"+info.Uid, 0770); err != nil {
-			return nil, err
-		}
-		// cert.pem,key.pem,csr.pemを作成
-		fmt.Println("--- POST CSR myself ---")
-		cmd := exec.Command("./scepclient-opt", "-uid", info.Uid, "-secret", info.Secret, "-out", "/tmp/"+info.Uid+"/")
-		var out strings.Builder
-		cmd.Stdout = &out
-		err = cmd.Run()
-		fmt.Println(out.String())
-	} else {
-		err = errors.New("without uid or secret params")
+	if info.Uid == "" || info.Secret == "" {
+		return nil, badRequestf("without uid or secret params")
 	}
-	fmt.Println("--- finish ---")
-	if err != nil {
-		return nil, errors.New("Failed to create certificate")
+	encodingName := info.Encoding
+	if encodingName == "" {
+		encodingName = "modern2023"
 	}
-	// pkcs12形式に変換
-	//X509.PrivateKey読み込み
-	key, err := os.ReadFile("/tmp/" + info.Uid + "/key.pem")
-	if err != nil {
-		return nil, err
+	encoder, ok := pkcs12Encoders[encodingName]
+	if !ok {
+		return nil, badRequestf("unsupported encoding %q", info.Encoding)
 	}
-	keyBlock, _ := pem.Decode([]byte(key))
-	k, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	key, err := generateKey(info.KeyType)
 	if err != nil {
 		return nil, err
 	}
-
-	//X509.Certificate読み込み
-	cert, err := os.ReadFile("/tmp/" + info.Uid + "/cert.pem")
+	csr, err := newCSR(key, info.Uid)
 	if err != nil {
 		return nil, err
 	}
-	certBlock, _ := pem.Decode([]byte(cert))
-	c, err := x509.ParseCertificate(certBlock.Bytes)
+	crt, err := signCSR(ctx, signer, csr, info.Uid, info.Secret)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "Failed to create certificate")
 	}
 
-	//X509.Certificate読み込み
 	caPass := utils.EnvString("SCEP_CA_PASS", "")
 	caCerts, _, err := depot.CA([]byte(caPass))
 	if err != nil {
 		return nil, err
 	}
+	return encoder.Encode(key, crt, caCerts, info.Password)
+}
 
-	//PKCS12エンコード
-	p12, err := pkcs12.LegacyDES.Encode(k, c, caCerts, info.Password)
-	if err != nil {
-		return nil, err
+func EnrollHandler(depot EnrollStore, signer Signer, logger kitlog.Logger) http.HandlerFunc {
+	type enrollRequest struct {
+		Uid    string `json:"uid"`
+		Secret string `json:"secret"`
+		CSR    string `json:"csr"`
+		Format string `json:"format"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			returnError(w, "Failed to decode request", http.StatusBadRequest)
+			return
+		}
+		if req.Uid == "" || req.Secret == "" || req.CSR == "" {
+			returnError(w, "uid, secret and csr are required", http.StatusBadRequest)
+			return
+		}
+		if req.Format != "" && req.Format != "pem" && req.Format != "pkcs7" {
+			returnError(w, "format must be pem or pkcs7", http.StatusBadRequest)
+			return
+		}
+		csrBlock, _ := pem.Decode([]byte(req.CSR))
+		if csrBlock == nil || (csrBlock.Type != "CERTIFICATE REQUEST" && csrBlock.Type != "NEW CERTIFICATE REQUEST") {
+			returnError(w, "Failed to decode CSR", http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+		if err != nil {
+			returnError(w, "Failed to parse CSR", http.StatusBadRequest)
+			return
+		}
+		if err := csr.CheckSignature(); err != nil {
+			returnError(w, "Invalid CSR signature", http.StatusBadRequest)
+			return
+		}
+		if csr.Subject.CommonName != req.Uid {
+			returnError(w, "CSR common name does not match uid", http.StatusBadRequest)
+			return
+		}
+		ok, err := depot.CompareSecret(req.Uid, req.Secret)
+		if err != nil || !ok {
+			returnError(w, "Failed to create certificate", http.StatusUnauthorized)
+			return
+		}
+		// the challenge middleware does not compare the secret again
+		ctx := scepdepot.WithVerifiedSecret(r.Context(), req.Uid)
+		crt, err := signCSR(ctx, signer, csr, req.Uid, req.Secret)
+		if err != nil {
+			writeEnrollError(w, logger, req.Uid, err)
+			return
+		}
+		caPass := utils.EnvString("SCEP_CA_PASS", "")
+		caCerts, _, err := depot.CA([]byte(caPass))
+		if err != nil {
+			logger.Log("msg", "failed to load the CA", "err", err)
+			returnError(w, "Failed to create certificate", http.StatusInternalServerError)
+			return
+		}
+		chain := append([]*x509.Certificate{crt}, caCerts...)
+		if req.Format == "pkcs7" {
+			p7, err := scep.DegenerateCertificates(chain)
+			if err != nil {
+				logger.Log("msg", "failed to encode the certificates", "err", err)
+				returnError(w, "Failed to create certificate", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/pkcs7-mime")
+			w.Write(p7)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, c := range chain {
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		}
 	}
+}
 
-	//ファイルを掃除
-	os.RemoveAll("/tmp/" + info.Uid)
+// CertHandler returns the certificate whose serial number is the serial
+// path parameter.
+func CertHandler(depot scepdepot.CertificateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		cert, ok := certBySerial(w, r, depot)
+		if !ok {
+			return
+		}
+		b, _ := json.Marshal(cert)
+		w.Write(b)
+	}
+}
 
-	return p12, nil
+// RevocationStore looks up certificates and revokes them.
+type RevocationStore interface {
+	scepdepot.CertificateStore
+	scepdepot.RevocationStore
 }
 
-func AddCertHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func RevokeCertHandler(depot RevocationStore) http.HandlerFunc {
+	type revokeRequest struct {
+		ReasonCode     scepdepot.RevocationReason `json:"reason_code"`
+		InvalidityDate *time.Time                 `json:"invalidity_date"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var req revokeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			returnError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.ReasonCode {
+		case scepdepot.CertificateHold:
+			returnError(w, "Use the hold endpoint to suspend a certificate", http.StatusBadRequest)
+			return
+		case scepdepot.RemoveFromCRL:
+			returnError(w, "Reason "+req.ReasonCode.String()+" is not supported", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if req.InvalidityDate != nil && req.InvalidityDate.After(now) {
+			returnError(w, "Invalidity date is in the future", http.StatusBadRequest)
+			return
+		}
+		cert, ok := certBySerial(w, r, depot)
+		if !ok {
+			return
+		}
+		if cert.Status != "V" && cert.Status != "H" {
+			returnError(w, "Certificate is not valid", http.StatusBadRequest)
+			return
+		}
+		if err := depot.RevokeCertificateBySerial(&cert.Serial, req.ReasonCode, now, req.InvalidityDate); err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func HoldCertHandler(depot RevocationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		cert, ok := certBySerial(w, r, depot)
+		if !ok {
+			return
+		}
+		if cert.Status != "V" {
+			returnError(w, "Certificate is not valid", http.StatusBadRequest)
+			return
+		}
+		if err := depot.HoldCertificate(&cert.Serial, time.Now()); err != nil {
+			returnError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ReleaseCertHandler(depot RevocationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		cert, ok := certBySerial(w, r, depot)
+		if !ok {
+			return
+		}
+		if cert.Status != "H" {
+			returnError(w, "Certificate is not on hold", http.StatusBadRequest)
+			return
+		}
+		if err := depot.ReleaseCertificate(&cert.Serial); err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// certBySerial looks up the certificate named by the serial path parameter
+// and writes an error response if it does not exist.
+func certBySerial(w http.ResponseWriter, r *http.Request, depot scepdepot.CertificateStore) (*scepdepot.Certificate, bool) {
+	params := mux.Vars(r)
+	serial, ok := new(big.Int).SetString(params["serial"], 0)
+	if !ok {
+		returnError(w, "Invalid serial number", http.StatusBadRequest)
+		return nil, false
+	}
+	cert, err := depot.GetCertBySerial(serial)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if cert == nil {
+		returnError(w, "Certificate not found", http.StatusNotFound)
+		return nil, false
+	}
+	return cert, true
+}
+
+// AddCertStore is the store AddCertHandler records the certificates of the
+// clients in.
+type AddCertStore interface {
+	scepdepot.Depot
+	scepdepot.ClientStore
+	scepdepot.SecretStore
+	scepdepot.CertificateStore
+}
+
+func AddCertHandler(depot AddCertStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		type certJson struct {
@@ -332,17 +605,6 @@ func AddCertHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			return
 		}
 
-		// シリアル番号の一致確認
-		nextSerial, err := depot.GetNextSerial()
-		if err != nil {
-			returnError(w, "Failed to get next serial number", http.StatusInternalServerError)
-			return
-		}
-		if nextSerial.Cmp(certX509.SerialNumber) != 0 {
-			returnError(w, "Serial number is not matched", http.StatusInternalServerError)
-			return
-		}
-
 		// クライアントの状態確認
 		client, err := depot.GetClient(certX509.Subject.CommonName)
 		if err != nil {
@@ -359,15 +621,10 @@ func AddCertHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		}
 
 		// 証明書の検証
-		depotPath := utils.EnvString("SCEP_FILE_DEPOT", "ca-certs")
-		ca_crt, _ := os.ReadFile(depotPath + "/ca.crt")
-		caCertBlock, _ := pem.Decode(ca_crt)
-		caCert, _ := x509.ParseCertificate(caCertBlock.Bytes)
-		certPool := x509.NewCertPool()
-		certPool.AddCert(caCert)
-		opts := x509.VerifyOptions{
-			Roots:     certPool,
-			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		_, opts, err := caVerifyOptions(depot)
+		if err != nil {
+			returnError(w, "Failed to load CA certificate", http.StatusInternalServerError)
+			return
 		}
 		if _, err := certX509.Verify(opts); err != nil {
 			returnError(w, "Failed to verify certificate", http.StatusUnauthorized)
@@ -375,16 +632,20 @@ func AddCertHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		}
 
 		// 証明書の追加
-		secret, err := depot.GetSecret(certX509.Subject.CommonName)
-		if err != nil {
+		// シークレットは平文で保存されていないため、存在のみ確認する
+		cn := certX509.Subject.CommonName
+		if _, err := depot.GetSecret(cn); err != nil {
 			returnError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		cn := certX509.Subject.CommonName
-		challenge := cn + "\\" + secret.Secret
-		_, err = depot.Serial()
+		// シリアル番号の払い出し
+		claimed, err := depot.ClaimSerial(certX509.SerialNumber)
 		if err != nil {
-			returnError(w, err.Error(), http.StatusInternalServerError)
+			returnError(w, "Failed to claim serial number", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			returnError(w, "Serial number is not matched", http.StatusInternalServerError)
 			return
 		}
 		_, err = depot.HasCN(cn, 0, certX509, true)
@@ -392,7 +653,7 @@ func AddCertHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			returnError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if err := depot.Put(cn, certX509, challenge); err != nil {
+		if err := depot.Put(cn, certX509, ""); err != nil {
 			returnError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
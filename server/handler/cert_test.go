@@ -0,0 +1,406 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/scep"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var testKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// testCert signs a certificate of cn with parent, or self-signs it if
+// parent is nil. All certificates share testKey.
+func testCert(t *testing.T, cn string, parent *x509.Certificate, isCA bool) *x509.Certificate {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		tmpl.BasicConstraintsValid = true
+		tmpl.IsCA = true
+		tmpl.ExtKeyUsage = nil
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, testKey.Public(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCAVerifyOptions(t *testing.T) {
+	root := testCert(t, "root", nil, true)
+	sub := testCert(t, "sub", root, true)
+	sibling := testCert(t, "sibling", root, true)
+	depot := scepdepot.StoreForCA(nil, "", []*x509.Certificate{sub, root}, nil)
+	_, opts, err := caVerifyOptions(depot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cert   *x509.Certificate
+		verify bool
+	}{
+		{"issued by the CA", testCert(t, "client", sub, false), true},
+		{"issued by a sibling CA", testCert(t, "client", sibling, false), false},
+		{"issued by the root", testCert(t, "client", root, false), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cert.Verify(opts); (err == nil) != tt.verify {
+				t.Errorf("Verify() = %v, want verified %v", err, tt.verify)
+			}
+		})
+	}
+}
+
+// newEnrollStore returns the store of newTestStore with the client pc01,
+// activated by activate.
+func newEnrollStore(t *testing.T) scepdepot.Store {
+	t.Helper()
+	store, _ := newTestStore(t)
+	if err := store.AddClient(scepdepot.Client{Uid: "pc01"}, "INACTIVE"); err != nil {
+		t.Fatal(err)
+	}
+	activate(t, store)
+	return store
+}
+
+// activate makes pc01 issuable with the secret "s3cret", which an
+// enrollment consumes.
+func activate(t *testing.T, store scepdepot.Store) {
+	t.Helper()
+	if err := store.DeleteSecret("pc01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateStatusClient("pc01", "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	err := store.CreateSecret(scepdepot.CreateSecretInfo{Target: "pc01", Secret: "s3cret", Type: "ACTIVATE", Available_Period: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingSigner fails to sign with an error which must not reach the caller.
+var failingSigner = signerFunc(func(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error) {
+	return nil, errors.New("database password is hunter2")
+})
+
+// rejectingSigner rejects the CSR like the subject policy and the verifiers.
+var rejectingSigner = signerFunc(func(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error) {
+	return nil, &scepdepot.EnrollmentError{Info: scep.BadRequest, Reason: "CN pc01 is not allowed"}
+})
+
+type signerFunc func(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error)
+
+func (f signerFunc) SignCSRContext(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	return f(ctx, m)
+}
+
+func TestCertStatusHandlers(t *testing.T) {
+	store := newEnrollStore(t)
+	csr, err := newCSR(testKey, "pc01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func() string {
+		t.Helper()
+		activate(t, store)
+		crt, err := scepdepot.NewSigner(store).SignCSR(&scep.CSRReqMessage{RawDecrypted: csr.Raw, CSR: csr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt.SerialNumber.String()
+	}
+	do := func(h http.HandlerFunc, serial, body string) (int, map[string]interface{}) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/admin/api/cert/"+serial, strings.NewReader(body))
+		return serve(t, h, mux.SetURLVars(r, map[string]string{"serial": serial}))
+	}
+	status := func(serial string) string {
+		t.Helper()
+		code, body := do(CertHandler(store), serial, "")
+		if code != http.StatusOK {
+			t.Fatalf("get %s: %d %v", serial, code, body)
+		}
+		return body["status"].(string)
+	}
+	revoke, hold, release := RevokeCertHandler(store), HoldCertHandler(store), ReleaseCertHandler(store)
+
+	serial := issue()
+	for _, tt := range []struct {
+		name   string
+		h      http.HandlerFunc
+		serial string
+		body   string
+		code   int
+		status string
+	}{
+		{"hold", hold, serial, "", http.StatusNoContent, "H"},
+		{"hold a held certificate", hold, serial, "", http.StatusBadRequest, "H"},
+		{"release", release, serial, "", http.StatusNoContent, "V"},
+		{"release a valid certificate", release, serial, "", http.StatusBadRequest, "V"},
+		{"revoke with certificateHold", revoke, serial, `{"reason_code": 6}`, http.StatusBadRequest, "V"},
+		{"revoke with removeFromCRL", revoke, serial, `{"reason_code": 8}`, http.StatusBadRequest, "V"},
+		{"revoke with a future invalidity date", revoke, serial, `{"invalidity_date": "2999-01-01T00:00:00Z"}`, http.StatusBadRequest, "V"},
+		{"revoke", revoke, serial, `{"reason_code": 1}`, http.StatusNoContent, "R"},
+		{"revoke a revoked certificate", revoke, serial, "", http.StatusBadRequest, "R"},
+		{"hold a revoked certificate", hold, serial, "", http.StatusBadRequest, "R"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := do(tt.h, tt.serial, tt.body); code != tt.code {
+				t.Errorf("have status %d, want %d: %v", code, tt.code, body)
+			}
+			if have := status(tt.serial); have != tt.status {
+				t.Errorf("have certificate status %s, want %s", have, tt.status)
+			}
+		})
+	}
+
+	// a held certificate can be revoked
+	serial = issue()
+	if code, body := do(hold, serial, ""); code != http.StatusNoContent {
+		t.Fatalf("hold: %d %v", code, body)
+	}
+	if code, body := do(revoke, serial, ""); code != http.StatusNoContent || status(serial) != "R" {
+		t.Errorf("revoke a held certificate: %d %v", code, body)
+	}
+
+	for _, h := range []http.HandlerFunc{revoke, hold, release} {
+		if code, body := do(h, "12345", ""); code != http.StatusNotFound {
+			t.Errorf("unknown serial: %d %v", code, body)
+		}
+		if code, body := do(h, "pc01", ""); code != http.StatusBadRequest {
+			t.Errorf("invalid serial: %d %v", code, body)
+		}
+	}
+}
+
+func TestPkcs12Handler(t *testing.T) {
+	store := newEnrollStore(t)
+	h := Pkcs12Handler(store, scepdepot.NewSigner(store), kitlog.NewNopLogger())
+	post := func(h http.Handler, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/cert/pkcs12", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(h, `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "key_type": "ecdsa-p256"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("have status %d: %s", w.Code, w.Body)
+	}
+	key, crt, chain, err := pkcs12.DecodeChain(w.Body.Bytes(), "p12pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok || crt.Subject.CommonName != "pc01" || len(chain) != 1 {
+		t.Errorf("have key %T, certificate of %q and a chain of %d", key, crt.Subject.CommonName, len(chain))
+	}
+
+	for _, tt := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"wrong secret", `{"uid": "pc01", "secret": "wrong", "password": "p12pass"}`, http.StatusUnauthorized},
+		{"unknown client", `{"uid": "pc02", "secret": "s3cret", "password": "p12pass"}`, http.StatusUnauthorized},
+		{"null body", `null`, http.StatusUnauthorized},
+		{"no password", `{"uid": "pc01", "secret": "s3cret"}`, http.StatusBadRequest},
+		{"unsupported key type", `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "key_type": "dsa"}`, http.StatusBadRequest},
+		{"unsupported encoding", `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "encoding": "none"}`, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			activate(t, store)
+			if w := post(h, tt.body); w.Code != tt.code {
+				t.Errorf("have status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+
+	activate(t, store)
+	w = post(Pkcs12Handler(store, failingSigner, kitlog.NewNopLogger()), `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "key_type": "ecdsa-p256"}`)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("failed signing: %d %s", w.Code, w.Body)
+	}
+	activate(t, store)
+	w = post(Pkcs12Handler(store, rejectingSigner, kitlog.NewNopLogger()), `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "key_type": "ecdsa-p256"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "CN pc01 is not allowed") {
+		t.Errorf("rejected CSR: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestEnrollHandlersVerifiedSecret(t *testing.T) {
+	store := newEnrollStore(t)
+	var verified bool
+	signer := signerFunc(func(ctx context.Context, m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		verified = scepdepot.VerifiedSecret(ctx, "pc01")
+		return scepdepot.NewSigner(store).SignCSRContext(ctx, m)
+	})
+	csr, err := newCSR(testKey, "pc01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enroll, err := json.Marshal(map[string]string{
+		"uid":    "pc01",
+		"secret": "s3cret",
+		"csr":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		h    http.Handler
+		body string
+	}{
+		{"pkcs12", Pkcs12Handler(store, signer, kitlog.NewNopLogger()), `{"uid": "pc01", "secret": "s3cret", "password": "p12pass", "key_type": "ecdsa-p256"}`},
+		{"enroll", EnrollHandler(store, signer, kitlog.NewNopLogger()), string(enroll)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			activate(t, store)
+			verified = false
+			w := httptest.NewRecorder()
+			tt.h.ServeHTTP(w, httptest.NewRequest("POST", "/api/cert/"+tt.name, strings.NewReader(tt.body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("have status %d: %s", w.Code, w.Body)
+			}
+			if !verified {
+				t.Error("the signer compares the secret again")
+			}
+		})
+	}
+}
+
+func TestEnrollHandler(t *testing.T) {
+	store := newEnrollStore(t)
+	h := EnrollHandler(store, scepdepot.NewSigner(store), kitlog.NewNopLogger())
+	csrPEM := func(cn string) string {
+		csr, err := newCSR(testKey, cn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	}
+	post := func(h http.Handler, req map[string]string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/cert/enroll", bytes.NewReader(body)))
+		return w
+	}
+
+	w := post(h, map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc01")})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-pem-file" {
+		t.Fatalf("have status %d: %s", w.Code, w.Body)
+	}
+	block, rest := pem.Decode(w.Body.Bytes())
+	if block == nil {
+		t.Fatal("no certificate in the response")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crt.Subject.CommonName != "pc01" {
+		t.Errorf("have CN %q, want pc01", crt.Subject.CommonName)
+	}
+	if block, _ := pem.Decode(rest); block == nil {
+		t.Error("no CA certificate in the response")
+	}
+
+	activate(t, store)
+	w = post(h, map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc01"), "format": "pkcs7"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pkcs7-mime" {
+		t.Errorf("pkcs7: have status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  map[string]string
+		code int
+	}{
+		{"wrong secret", map[string]string{"uid": "pc01", "secret": "wrong", "csr": csrPEM("pc01")}, http.StatusUnauthorized},
+		{"no csr", map[string]string{"uid": "pc01", "secret": "s3cret"}, http.StatusBadRequest},
+		{"unsupported format", map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc01"), "format": "der"}, http.StatusBadRequest},
+		{"not a PEM CSR", map[string]string{"uid": "pc01", "secret": "s3cret", "csr": "pc01"}, http.StatusBadRequest},
+		{"CSR of another uid", map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc02")}, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			activate(t, store)
+			if w := post(h, tt.req); w.Code != tt.code {
+				t.Errorf("have status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+
+	activate(t, store)
+	w = post(EnrollHandler(store, failingSigner, kitlog.NewNopLogger()), map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc01")})
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("failed signing: %d %s", w.Code, w.Body)
+	}
+	activate(t, store)
+	w = post(EnrollHandler(store, rejectingSigner, kitlog.NewNopLogger()), map[string]string{"uid": "pc01", "secret": "s3cret", "csr": csrPEM("pc01")})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "CN pc01 is not allowed") {
+		t.Errorf("rejected CSR: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestVerifyHandlerMalformedCertificate(t *testing.T) {
+	store, _ := newTestStore(t)
+	h := VerifyHandler(CAs{"": store})
+	for _, header := range []string{"not a certificate", url.PathEscape("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n")} {
+		r := httptest.NewRequest("GET", "/api/cert/verify", nil)
+		r.Header.Set("X-Mtls-Clientcert", header)
+		code, body := serve(t, h, r)
+		if code != http.StatusInternalServerError || body["message"] != "Parse Certificate failed" {
+			t.Errorf("%q: %d %v", header, code, body)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+// ChallengeHandler returns a fresh one-time challenge, bound to the client
+// given by the uid query parameter if any.
+func ChallengeHandler(depot scepdepot.ClientStore, store scepdepot.ChallengeStore) http.HandlerFunc {
+	type challengeResponse struct {
+		Challenge string    `json:"challenge"`
+		Uid       string    `json:"uid,omitempty"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if store == nil {
+			returnError(w, "Dynamic challenges are not enabled", http.StatusNotFound)
+			return
+		}
+		uid := r.URL.Query().Get("uid")
+		if uid != "" {
+			client, err := depot.GetClient(uid)
+			if err != nil {
+				returnError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if client == nil {
+				returnError(w, "Client not found", http.StatusNotFound)
+				return
+			}
+		}
+		expiresAt := time.Now().Add(store.TTL())
+		challenge, err := store.SCEPChallengeFor(uid)
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(challengeResponse{
+			Challenge: challenge,
+			Uid:       uid,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	}
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/depot/sqldepot"
+	sqlitedepot "github.com/procube-open/scep/depot/sqlite"
+)
+
+// newTestStore returns a store of a new SQLite database, whose CA is a new
+// self-signed certificate of testKey, and the database itself.
+func newTestStore(t *testing.T) (scepdepot.Store, *sqldepot.Depot) {
+	t.Helper()
+	depot, err := sqlitedepot.NewDepot(filepath.Join(t.TempDir(), "scep.db"), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { depot.DB().Close() })
+	ca := testCert(t, "test CA", nil, true)
+	return scepdepot.StoreForCA(depot, "", []*x509.Certificate{ca}, testKey), depot
+}
+
+// serve serves r with h and returns the status and the decoded JSON body.
+func serve(t *testing.T, h http.Handler, r *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var body map[string]interface{}
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s: %v: %s", r.Method, r.URL, err, w.Body)
+		}
+	}
+	return w.Code, body
+}
+
+func TestChallengeHandler(t *testing.T) {
+	store, depot := newTestStore(t)
+	if err := store.AddClient(scepdepot.Client{Uid: "pc01"}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	challenges := depot.NewChallengeStore(time.Hour)
+	h := ChallengeHandler(store, challenges)
+
+	// a bound challenge is used once, by its client
+	code, body := serve(t, h, httptest.NewRequest("GET", "/admin/api/challenge?uid=pc01", nil))
+	if code != http.StatusOK || body["uid"] != "pc01" {
+		t.Fatalf("bound challenge: %d %v", code, body)
+	}
+	pw, _ := body["challenge"].(string)
+	if ok, uid, err := challenges.UseChallenge(pw); !ok || uid != "pc01" || err != nil {
+		t.Errorf("UseChallenge() = %v, %q, %v", ok, uid, err)
+	}
+	if ok, _, err := challenges.UseChallenge(pw); ok || err != nil {
+		t.Errorf("second UseChallenge() = %v, %v", ok, err)
+	}
+
+	// an unbound challenge is bound to no client
+	code, body = serve(t, h, httptest.NewRequest("GET", "/admin/api/challenge", nil))
+	if _, ok := body["uid"]; code != http.StatusOK || ok {
+		t.Fatalf("unbound challenge: %d %v", code, body)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, body["expires_at"].(string))
+	if err != nil || expiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expires_at = %v, %v", body["expires_at"], err)
+	}
+	pw, _ = body["challenge"].(string)
+	if ok, uid, err := challenges.UseChallenge(pw); !ok || uid != "" || err != nil {
+		t.Errorf("UseChallenge() of an unbound challenge = %v, %q, %v", ok, uid, err)
+	}
+
+	// a challenge expires after the TTL of the store
+	code, body = serve(t, ChallengeHandler(store, depot.NewChallengeStore(-time.Minute)), httptest.NewRequest("GET", "/admin/api/challenge", nil))
+	if code != http.StatusOK {
+		t.Fatalf("expired challenge: %d %v", code, body)
+	}
+	pw, _ = body["challenge"].(string)
+	if ok, _, err := challenges.UseChallenge(pw); ok || err != nil {
+		t.Errorf("UseChallenge() of an expired challenge = %v, %v", ok, err)
+	}
+
+	if code, _ := serve(t, h, httptest.NewRequest("GET", "/admin/api/challenge?uid=pc02", nil)); code != http.StatusNotFound {
+		t.Errorf("challenge of an unknown client: %d", code)
+	}
+	if code, _ := serve(t, ChallengeHandler(store, nil), httptest.NewRequest("GET", "/admin/api/challenge", nil)); code != http.StatusNotFound {
+		t.Errorf("challenge without dynamic challenges: %d", code)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/procube-open/scep/depot/mysql"
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/hook"
 )
 
@@ -15,9 +15,10 @@ type ResClient struct {
 	Uid        string                 `json:"uid"`
 	Status     string                 `json:"status"`
 	Attributes map[string]interface{} `json:"attributes"`
+	CA         string                 `json:"ca"`
 }
 
-func GetClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func GetClientHandler(depot scepdepot.ClientStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
 		c, err := depot.GetClient(params["CN"])
@@ -34,13 +35,14 @@ func GetClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			Uid:        c.Uid,
 			Status:     c.Status,
 			Attributes: c.Attributes,
+			CA:         c.CA,
 		}
 		b, _ := json.Marshal(res)
 		w.Write(b)
 	}
 }
 
-func ListClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func ListClientHandler(depot scepdepot.ClientStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		clientList, err := depot.GetClientList()
 		if err != nil {
@@ -53,6 +55,7 @@ func ListClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 				Uid:        c.Uid,
 				Status:     c.Status,
 				Attributes: c.Attributes,
+				CA:         c.CA,
 			})
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -61,13 +64,13 @@ func ListClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 	}
 }
 
-func AddClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func AddClientHandler(depot scepdepot.ClientStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type ErrResp struct {
 			Message string `json:"message"`
 		}
 		decoder := json.NewDecoder(r.Body)
-		var c mysql.Client
+		var c scepdepot.Client
 		err := decoder.Decode(&c)
 		if err != nil {
 			res := ErrResp{Message: "Failed to decode request"}
@@ -107,13 +110,13 @@ func AddClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 	}
 }
 
-func UpdateClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func UpdateClientHandler(depot scepdepot.ClientStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type ErrResp struct {
 			Message string `json:"message"`
 		}
 		decoder := json.NewDecoder(r.Body)
-		var c mysql.UpdateInfo
+		var c scepdepot.UpdateInfo
 		err := decoder.Decode(&c)
 		if err != nil {
 			res := ErrResp{Message: "Failed to decode request"}
@@ -133,13 +136,20 @@ func UpdateClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 	}
 }
 
-func RevokeClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+// ClientRevocationStore is the store RevokeClientHandler revokes the
+// clients in.
+type ClientRevocationStore interface {
+	scepdepot.ClientStore
+	scepdepot.RevocationStore
+}
+
+func RevokeClientHandler(depot ClientRevocationStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type ErrResp struct {
 			Message string `json:"message"`
 		}
 		decoder := json.NewDecoder(r.Body)
-		var c mysql.UpdateInfo
+		var c scepdepot.UpdateInfo
 		err := decoder.Decode(&c)
 		if err != nil {
 			res := ErrResp{Message: "Failed to decode request"}
@@ -160,20 +170,15 @@ func RevokeClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			w.Write(b)
 			return
 		}
+		if client.Status == "ARCHIVED" {
+			res := ErrResp{Message: "Client is archived"}
+			w.WriteHeader(http.StatusBadRequest)
+			b, _ := json.Marshal(res)
+			w.Write(b)
+			return
+		}
 		if client.Status != "INACTIVE" {
-			if client.Status != "ISSUABLE" {
-				if err := depot.RevokeCertificate(c.Uid, time.Now()); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
-			if client.Status == "ISSUABLE" || client.Status == "UPDATABLE" {
-				if err := depot.DeleteSecret(c.Uid); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
-			if err := depot.UpdateStatusClient(c.Uid, "INACTIVE"); err != nil {
+			if err := depot.RevokeClient(c.Uid, time.Now()); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -186,3 +191,39 @@ func RevokeClientHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		}
 	}
 }
+
+func DeleteClientHandler(depot scepdepot.ClientStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type ErrResp struct {
+			Message string `json:"message"`
+		}
+		params := mux.Vars(r)
+		uid := params["uid"]
+		client, err := depot.GetClient(uid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if client == nil {
+			res := ErrResp{Message: "Client not found"}
+			w.WriteHeader(http.StatusNotFound)
+			b, _ := json.Marshal(res)
+			w.Write(b)
+			return
+		}
+		if client.Status == "ARCHIVED" {
+			res := ErrResp{Message: "Client is already archived"}
+			w.WriteHeader(http.StatusBadRequest)
+			b, _ := json.Marshal(res)
+			w.Write(b)
+			return
+		}
+		// Revoked certificates stay in the certificates table so that they
+		// are listed in the CRL until they expire.
+		if err := depot.ArchiveClient(uid, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
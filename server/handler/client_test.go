@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	scepdepot "github.com/procube-open/scep/depot"
+)
+
+func TestDeleteClientHandler(t *testing.T) {
+	store, _ := newTestStore(t)
+	if err := store.AddClient(scepdepot.Client{Uid: "pc01"}, "ISSUABLE"); err != nil {
+		t.Fatal(err)
+	}
+	h := DeleteClientHandler(store)
+	del := func(uid string) (int, map[string]interface{}) {
+		r := mux.SetURLVars(httptest.NewRequest("DELETE", "/admin/api/client/"+uid, nil), map[string]string{"uid": uid})
+		return serve(t, h, r)
+	}
+
+	if code, body := del("pc01"); code != http.StatusNoContent {
+		t.Fatalf("delete: %d %v", code, body)
+	}
+	client, err := store.GetClient("pc01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Status != "ARCHIVED" {
+		t.Errorf("have status %s, want ARCHIVED", client.Status)
+	}
+	if code, body := del("pc01"); code != http.StatusBadRequest {
+		t.Errorf("delete an archived client: %d %v", code, body)
+	}
+	if code, body := del("pc02"); code != http.StatusNotFound {
+		t.Errorf("delete an unknown client: %d %v", code, body)
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/procube-open/scep/scep"
+)
+
+// Signer signs the CSR of an enrollment request.
+// It is satisfied by scepserver.CSRSignerContext, so REST enrollment goes
+// through the same challenge, verifier and depot checks as SCEP.
+type Signer interface {
+	SignCSRContext(context.Context, *scep.CSRReqMessage) (*x509.Certificate, error)
+}
+
+// requestError is an error of the request itself, whose message is returned
+// to the caller like those of the rejections of the CSR by the signer. The
+// other errors of signing and of the depot are only logged.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func badRequestf(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// writeEnrollError answers err, an error of issuing a certificate for uid.
+// An error of the request and a rejection of the CSR, an error with a SCEP
+// failInfo, are returned with 400. The other errors are logged and answered
+// with 500.
+func writeEnrollError(w http.ResponseWriter, logger kitlog.Logger, uid string, err error) {
+	var reqErr *requestError
+	var rejected interface {
+		error
+		FailInfo() scep.FailInfo
+	}
+	switch {
+	case errors.As(err, &reqErr):
+		returnError(w, reqErr.Error(), http.StatusBadRequest)
+	case errors.As(err, &rejected):
+		returnError(w, rejected.Error(), http.StatusBadRequest)
+	default:
+		logger.Log("msg", "failed to create certificate", "uid", uid, "err", err)
+		returnError(w, "Failed to create certificate", http.StatusInternalServerError)
+	}
+}
+
+// generateKey creates a private key of the given type in memory.
+// An empty keyType selects rsa2048.
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, badRequestf("unsupported key type %q", keyType)
+	}
+}
+
+// newCSR creates a CSR for uid signed by key.
+func newCSR(key crypto.Signer, uid string) (*x509.CertificateRequest, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: uid},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+// signCSR passes csr to signer with the challenge password of uid and secret.
+func signCSR(ctx context.Context, signer Signer, csr *x509.CertificateRequest, uid, secret string) (*x509.Certificate, error) {
+	m := &scep.CSRReqMessage{
+		RawDecrypted:      csr.Raw,
+		CSR:               csr,
+		ChallengePassword: uid + "\\" + secret,
+		MessageType:       scep.PKCSReq,
+	}
+	crt, err := signer.SignCSRContext(ctx, m)
+	if err == nil && crt == nil {
+		err = errors.New("no signed certificate")
+	}
+	return crt, err
+}
@@ -1,17 +1,50 @@
 package handler
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/procube-open/scep/depot/mysql"
+	"github.com/procube-open/scep/cryptoutil"
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/server/invite"
 )
 
-func CreateSecretHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+// createSecretResponse is the only response the secret is returned in,
+// as only its hash is stored.
+type createSecretResponse struct {
+	Target     string              `json:"target"`
+	Secret     string              `json:"secret"`
+	Type       string              `json:"type"`
+	Invitation *invitationResponse `json:"invitation,omitempty"`
+}
+
+type invitationResponse struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// QRCode is the base64 encoded PNG of a QR code of URL.
+	QRCode string `json:"qr_png"`
+}
+
+// InvitationStore is the store of the clients, their secrets and the
+// invitations to them.
+type InvitationStore interface {
+	scepdepot.ClientStore
+	scepdepot.SecretStore
+	scepdepot.InvitationStore
+}
+
+// Profiles maps the names of the CAs to the certificate profiles they issue.
+type Profiles map[string]map[string]*scepdepot.Profile
+
+func CreateSecretHandler(depot InvitationStore, issuer *invite.Issuer, profiles Profiles) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -19,21 +52,46 @@ func CreateSecretHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			return
 		}
 		defer r.Body.Close()
-		var secret mysql.CreateSecretInfo
+		var secret scepdepot.CreateSecretInfo
 		err = json.Unmarshal(body, &secret)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if secret.Generate {
+			secret.Secret, err = cryptoutil.GenerateSecret()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		if strings.Contains(secret.Target, "\\") || strings.Contains(secret.Secret, "\\") {
 			http.Error(w, "Target contains backslash", http.StatusInternalServerError)
 			return
 		}
+		if secret.Secret == "" {
+			http.Error(w, "Secret is empty", http.StatusBadRequest)
+			return
+		}
+		if secret.Invite && issuer == nil {
+			http.Error(w, "Invitations are not enabled", http.StatusBadRequest)
+			return
+		}
 		client, err := depot.GetClient(secret.Target)
-		if err != nil {
+		if err != nil || client == nil {
 			http.Error(w, "Target not found", http.StatusInternalServerError)
 			return
 		}
+		// the profile is checked here rather than at enrollment, where the
+		// secret would already have been handed out
+		profile := secret.Profile
+		if profile == "" {
+			profile, _ = client.Attributes["profile"].(string)
+		}
+		if _, ok := profiles[client.CA][profile]; profile != "" && !ok {
+			http.Error(w, fmt.Sprintf("Unknown profile %q", profile), http.StatusBadRequest)
+			return
+		}
 		if client.Status == "INACTIVE" {
 			err = depot.UpdateStatusClient(secret.Target, "ISSUABLE")
 			if err != nil {
@@ -62,12 +120,30 @@ func CreateSecretHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 			return
 		}
 
+		resp := createSecretResponse{
+			Target: secret.Target,
+			Secret: secret.Secret,
+			Type:   secret.Type,
+		}
+		if secret.Invite {
+			resp.Invitation, err = createInvitation(depot, issuer, secret.Target)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		res, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-
+		w.Write(res)
 	}
 }
 
-func GetSecretHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
+func GetSecretHandler(depot scepdepot.SecretStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
 		secrets, err := depot.GetSecret(params["CN"])
@@ -84,3 +160,109 @@ func GetSecretHandler(depot *mysql.MySQLDepot) http.HandlerFunc {
 		w.Write(body)
 	}
 }
+
+// createInvitation issues an invitation to the secret of target, which
+// expires together with the secret.
+func createInvitation(depot InvitationStore, issuer *invite.Issuer, target string) (*invitationResponse, error) {
+	info, err := depot.GetSecret(target)
+	if err != nil {
+		return nil, err
+	}
+	token, jti, err := issuer.Issue(target, info.Delete_At)
+	if err != nil {
+		return nil, err
+	}
+	if err := depot.CreateInvitation(jti, target, info.Delete_At); err != nil {
+		return nil, err
+	}
+	u, err := issuer.URL(token)
+	if err != nil {
+		return nil, err
+	}
+	png, err := invite.QRCode(u)
+	if err != nil {
+		return nil, err
+	}
+	return &invitationResponse{
+		URL:       u,
+		Token:     token,
+		ExpiresAt: info.Delete_At,
+		QRCode:    base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// RedeemInvitationHandler consumes an invitation and returns a newly
+// generated secret of the invited client, replacing the one the invitation
+// was issued for, and the URL of the SCEP endpoint of its CA on the
+// external URL of the server.
+func RedeemInvitationHandler(depot InvitationStore, issuer *invite.Issuer) http.HandlerFunc {
+	type redeemRequest struct {
+		Token string `json:"token"`
+	}
+	type redeemResponse struct {
+		Uid       string    `json:"uid"`
+		Secret    string    `json:"secret"`
+		ExpiresAt time.Time `json:"expires_at"`
+		SCEPURL   string    `json:"scep_url"`
+		CA        string    `json:"ca"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if issuer == nil {
+			returnError(w, "Invitations are not enabled", http.StatusNotFound)
+			return
+		}
+		var req redeemRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			returnError(w, "Failed to decode request", http.StatusBadRequest)
+			return
+		}
+		claims, err := issuer.Parse(req.Token)
+		if err != nil {
+			returnError(w, "Invalid invitation", http.StatusUnauthorized)
+			return
+		}
+		secret, err := cryptoutil.GenerateSecret()
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = depot.RedeemInvitation(claims.ID, claims.Subject, secret)
+		if errors.Is(err, scepdepot.ErrInvitationUsed) || errors.Is(err, scepdepot.ErrSecretNotFound) {
+			returnError(w, "Invitation is already used or expired", http.StatusGone)
+			return
+		} else if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info, err := depot.GetSecret(claims.Subject)
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the client enrolls at the SCEP endpoint of its CA
+		client, err := depot.GetClient(claims.Subject)
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		scepPath := "/scep"
+		var ca string
+		if client != nil && client.CA != "" {
+			ca = client.CA
+			scepPath += "/" + ca
+		}
+		b, err := json.Marshal(redeemResponse{
+			Uid:       claims.Subject,
+			Secret:    secret,
+			ExpiresAt: info.Delete_At,
+			SCEPURL:   issuer.ServerURL(scepPath),
+			CA:        ca,
+		})
+		if err != nil {
+			returnError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	}
+}
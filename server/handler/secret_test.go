@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	scepdepot "github.com/procube-open/scep/depot"
+	"github.com/procube-open/scep/server/invite"
+)
+
+func TestCreateSecretHandlerProfile(t *testing.T) {
+	store, _ := newTestStore(t)
+	for uid, attrs := range map[string]map[string]interface{}{
+		"pc01": nil,
+		"pc02": {"profile": "no-such-profile"},
+	} {
+		if err := store.AddClient(scepdepot.Client{Uid: uid, Attributes: attrs}, "INACTIVE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := CreateSecretHandler(store, nil, Profiles{"": scepdepot.BuiltinProfiles()})
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		body   string
+		code   int
+	}{
+		{"unknown secret profile", "pc01", `{"target": "pc01", "generate": true, "available_period": "1h", "profile": "no-such-profile"}`, http.StatusBadRequest},
+		{"unknown client profile", "pc02", `{"target": "pc02", "generate": true, "available_period": "1h"}`, http.StatusBadRequest},
+		{"secret profile over the client one", "pc02", `{"target": "pc02", "generate": true, "available_period": "1h", "profile": "client-auth"}`, http.StatusCreated},
+		{"known profile", "pc01", `{"target": "pc01", "generate": true, "available_period": "1h", "profile": "client-auth"}`, http.StatusCreated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/api/secret/create", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Errorf("have status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			// a rejected secret leaves the client inactive
+			client, err := store.GetClient(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.code == http.StatusBadRequest && client.Status != "INACTIVE" {
+				t.Errorf("have client status %s, want INACTIVE", client.Status)
+			}
+		})
+	}
+}
+
+func TestInvitationHandlers(t *testing.T) {
+	store, _ := newTestStore(t)
+	if err := store.AddClient(scepdepot.Client{Uid: "pc01"}, "INACTIVE"); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := invite.NewIssuer(bytes.Repeat([]byte{1}, invite.KeySize), "https://ca.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles := Profiles{"": scepdepot.BuiltinProfiles()}
+	create := func(issuer *invite.Issuer, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		CreateSecretHandler(store, issuer, profiles).ServeHTTP(w, httptest.NewRequest("POST", "/admin/api/secret/create", strings.NewReader(body)))
+		return w
+	}
+	redeem := func(issuer *invite.Issuer, token string) (int, map[string]interface{}) {
+		body := `{"token": "` + token + `"}`
+		return serve(t, RedeemInvitationHandler(store, issuer), httptest.NewRequest("POST", "/api/invite/redeem", strings.NewReader(body)))
+	}
+
+	if w := create(nil, `{"target": "pc01", "generate": true, "available_period": "1h", "invite": true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invitation without an issuer: have status %d: %s", w.Code, w.Body)
+	}
+	w := create(issuer, `{"target": "pc01", "generate": true, "available_period": "1h", "invite": true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("have status %d: %s", w.Code, w.Body)
+	}
+	var created createSecretResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || created.Type != "ACTIVATE" || created.Invitation == nil {
+		t.Fatalf("unexpected response %+v", created)
+	}
+	if !strings.HasPrefix(created.Invitation.URL, "https://ca.example.com/publish?invite=") || created.Invitation.QRCode == "" {
+		t.Errorf("unexpected invitation %+v", created.Invitation)
+	}
+
+	if code, body := redeem(issuer, "not a token"); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: %d %v", code, body)
+	}
+	if code, body := redeem(nil, created.Invitation.Token); code != http.StatusNotFound {
+		t.Errorf("redeem without an issuer: %d %v", code, body)
+	}
+	code, body := redeem(issuer, created.Invitation.Token)
+	if code != http.StatusOK || body["uid"] != "pc01" || body["scep_url"] != "https://ca.example.com/scep" {
+		t.Fatalf("redeem: %d %v", code, body)
+	}
+	// the redeemed secret replaces the one the invitation was issued for
+	secret, _ := body["secret"].(string)
+	if ok, err := store.CompareSecret("pc01", secret); !ok || err != nil {
+		t.Errorf("CompareSecret() of the redeemed secret = %v, %v", ok, err)
+	}
+	if ok, _ := store.CompareSecret("pc01", created.Secret); ok {
+		t.Error("the secret the invitation was issued for is still valid")
+	}
+	if code, body := redeem(issuer, created.Invitation.Token); code != http.StatusGone {
+		t.Errorf("redeem twice: %d %v", code, body)
+	}
+}
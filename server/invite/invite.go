@@ -0,0 +1,166 @@
+// Package invite issues and verifies signed enrollment invitations.
+//
+// An invitation is an HS256 JWT naming the client it was issued for. It is
+// delivered to the device user as a URL of the publish frontend, optionally
+// rendered as a QR code, and is redeemed once for a fresh enrollment secret.
+package invite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"rsc.io/qr"
+)
+
+// KeySize is the size in bytes of generated signing keys.
+const KeySize = 32
+
+// Claims are the claims of an invitation token.
+// The subject is the uid of the invited client.
+type Claims struct {
+	jwt.RegisteredClaims
+}
+
+// Issuer signs and verifies invitation tokens.
+type Issuer struct {
+	key        []byte
+	serverURL  string
+	publishURL string
+}
+
+// NewIssuer creates an Issuer signing with key. serverURL is the external
+// URL of the server as seen by the clients, such as
+// https://scep.example.com, which the SCEP URLs given to the redeemers of
+// invitations are built from. publishURL is the URL of the publish frontend
+// that invitation URLs point to, the /publish page of serverURL if empty.
+func NewIssuer(key []byte, serverURL, publishURL string) (*Issuer, error) {
+	if len(key) < KeySize {
+		return nil, fmt.Errorf("invitation key must be at least %d bytes", KeySize)
+	}
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	if err := checkURL(serverURL); err != nil {
+		return nil, fmt.Errorf("server URL: %w", err)
+	}
+	if publishURL == "" {
+		publishURL = serverURL + "/publish"
+	} else if err := checkURL(publishURL); err != nil {
+		return nil, fmt.Errorf("publish URL: %w", err)
+	}
+	return &Issuer{key: key, serverURL: serverURL, publishURL: publishURL}, nil
+}
+
+// checkURL checks that rawURL is an absolute http or https URL.
+func checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http or https URL", rawURL)
+	}
+	return nil
+}
+
+// LoadOrCreateKey reads the signing key from path, creating a random key
+// there if the file does not exist.
+func LoadOrCreateKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0400); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Issue returns a token inviting uid, valid until expiresAt, and its
+// unique ID with which the token is consumed.
+func (i *Issuer) Issue(uid string, expiresAt time.Time) (token string, jti string, err error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	jti = hex.EncodeToString(id)
+	now := time.Now()
+	claims := Claims{jwt.RegisteredClaims{
+		ID:        jti,
+		Subject:   uid,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}}
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(i.key)
+	return token, jti, err
+}
+
+// Parse verifies the signature and expiry of token and returns its claims.
+func (i *Issuer) Parse(token string) (*Claims, error) {
+	claims := new(Claims)
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return i.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, errors.New("invitation has no subject or ID")
+	}
+	return claims, nil
+}
+
+// URL returns the invitation URL of token.
+func (i *Issuer) URL(token string) (string, error) {
+	u, err := url.Parse(i.publishURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("invite", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ServerURL returns the URL of path on the server.
+func (i *Issuer) ServerURL(path string) string {
+	return i.serverURL + path
+}
+
+// QRCode renders s as a QR code PNG.
+func QRCode(s string) ([]byte, error) {
+	code, err := qr.Encode(s, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+// TokenFromURL returns the token of an invitation URL.
+func TokenFromURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	token := u.Query().Get("invite")
+	if token == "" {
+		return "", errors.New("URL has no invite parameter")
+	}
+	return token, nil
+}
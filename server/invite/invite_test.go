@@ -0,0 +1,74 @@
+package invite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssuer(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	issuer, err := NewIssuer(key, "https://ca.example.com/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, jti, err := issuer.Issue("pc01", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := issuer.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "pc01" || claims.ID != jti {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	u, err := issuer.URL(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://ca.example.com/publish?invite="; !strings.HasPrefix(u, want) {
+		t.Errorf("URL() = %q, want prefix %q", u, want)
+	}
+	if have, want := issuer.ServerURL("/scep/iot"), "https://ca.example.com/scep/iot"; have != want {
+		t.Errorf("ServerURL() = %q, want %q", have, want)
+	}
+	if have, err := TokenFromURL(u); err != nil || have != token {
+		t.Errorf("TokenFromURL(%q) = %q, %v", u, have, err)
+	}
+	png, err := QRCode(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Error("QR code is not a PNG")
+	}
+
+	other, err := NewIssuer(bytes.Repeat([]byte{2}, KeySize), "https://ca.example.com", "https://www.example.com/enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := other.URL(token); err != nil || !strings.HasPrefix(u, "https://www.example.com/enroll?invite=") {
+		t.Errorf("URL() with a publish URL = %q, %v", u, err)
+	}
+	if _, err := other.Parse(token); err == nil {
+		t.Error("token signed with another key was accepted")
+	}
+	expired, _, err := issuer.Issue("pc01", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.Parse(expired); err == nil {
+		t.Error("expired token was accepted")
+	}
+	if _, err := NewIssuer([]byte("short"), "https://ca.example.com", ""); err == nil {
+		t.Error("short key was accepted")
+	}
+	for _, serverURL := range []string{"", "ca.example.com", "/scep", "ftp://ca.example.com"} {
+		if _, err := NewIssuer(key, serverURL, ""); err == nil {
+			t.Errorf("server URL %q was accepted", serverURL)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package scepserver
 import (
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -11,7 +10,7 @@ import (
 	"math/big"
 	"time"
 
-	"github.com/procube-open/scep/depot/mysql"
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/scep"
 	"github.com/procube-open/scep/utils"
 
@@ -47,7 +46,7 @@ type service struct {
 	// quite likely the same as the CA keypair but may be its own SCEP
 	// specific keypair in the case of e.g. RA (proxy) operation.
 	crt *x509.Certificate
-	key *rsa.PrivateKey
+	key scepdepot.CAKey
 
 	// Optional additional CA certificates for e.g. RA (proxy) use.
 	// Only used in this service when responding to GetCACert.
@@ -60,6 +59,19 @@ type service struct {
 
 	/// info logging is implemented in the service middleware layer.
 	debugLogger log.Logger
+
+	// The store the CRL is made from.
+	crlStore CRLStore
+
+	// The path of the SCEP endpoint the distribution point of the CRL
+	// refers to.
+	scepPath string
+}
+
+// CRLStore provides the CA and the revoked certificates a CRL is made of.
+type CRLStore interface {
+	CA(pass []byte) ([]*x509.Certificate, scepdepot.CAKey, error)
+	GetRCs() ([]x509.RevocationListEntry, error)
 }
 
 func (svc *service) GetCACaps(ctx context.Context) ([]byte, error) {
@@ -95,7 +107,12 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 	}
 	if err != nil {
 		svc.debugLogger.Log("msg", "failed to sign CSR", "err", err)
-		certRep, err := msg.Fail(svc.crt, svc.key, scep.BadRequest)
+		info := scep.FailInfo(scep.BadRequest)
+		var rejected interface{ FailInfo() scep.FailInfo }
+		if errors.As(err, &rejected) {
+			info = rejected.FailInfo()
+		}
+		certRep, err := msg.Fail(svc.crt, svc.key, info)
 		return certRep.Raw, err
 	}
 
@@ -123,12 +140,11 @@ type issuingDistributionPoint struct {
 var oidExtensionIssuingDistributionPoint = []int{2, 5, 29, 28}
 
 func (svc *service) GetCRL(ctx context.Context, depotPath string, _ string) ([]byte, error) {
-	dsn := utils.EnvString("SCEP_DSN", "")
 	port := utils.EnvString("SCEP_HTTP_LISTEN_PORT", "")
 	caPass := utils.EnvString("SCEP_CA_PASS", "")
-	depot, err := mysql.NewTableDepot(dsn, depotPath)
-	if err != nil {
-		return nil, err
+	depot := svc.crlStore
+	if depot == nil {
+		return nil, errors.New("CRL is not available")
 	}
 	rcs, err := depot.GetRCs()
 	if err != nil {
@@ -142,7 +158,7 @@ func (svc *service) GetCRL(ctx context.Context, depotPath string, _ string) ([]b
 
 	dp := distributionPointName{
 		FullName: []asn1.RawValue{
-			{Tag: 6, Class: 2, Bytes: []byte("http://localhost:" + port + "/scep?operation=GetCRL")},
+			{Tag: 6, Class: 2, Bytes: []byte("http://localhost:" + port + svc.scepPath + "?operation=GetCRL")},
 		},
 	}
 	idp := issuingDistributionPoint{
@@ -161,12 +177,12 @@ func (svc *service) GetCRL(ctx context.Context, depotPath string, _ string) ([]b
 	}
 
 	crlTpl := &x509.RevocationList{
-		SignatureAlgorithm:  x509.SHA256WithRSA,
-		RevokedCertificates: rcs,
-		Number:              big.NewInt(2),
-		ThisUpdate:          time.Now(),
-		NextUpdate:          time.Now().Add(24 * time.Hour),
-		ExtraExtensions:     []pkix.Extension{cdpExt},
+		SignatureAlgorithm:        x509.SHA256WithRSA,
+		RevokedCertificateEntries: rcs,
+		Number:                    big.NewInt(2),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(24 * time.Hour),
+		ExtraExtensions:           []pkix.Extension{cdpExt},
 	}
 
 	crl, err := x509.CreateRevocationList(rand.Reader, crlTpl, cert[0], key)
@@ -188,6 +204,24 @@ func WithLogger(logger log.Logger) ServiceOption {
 	}
 }
 
+// WithCRLStore sets the store GetCRL makes the CRL from.
+// Without it, GetCRL fails.
+func WithCRLStore(store CRLStore) ServiceOption {
+	return func(s *service) error {
+		s.crlStore = store
+		return nil
+	}
+}
+
+// WithSCEPPath sets the path of the SCEP endpoint of the CA, which the
+// distribution point of its CRL refers to. It defaults to /scep.
+func WithSCEPPath(path string) ServiceOption {
+	return func(s *service) error {
+		s.scepPath = path
+		return nil
+	}
+}
+
 // WithAddlCA appends an additional certificate to the slice of CA certs
 func WithAddlCA(ca *x509.Certificate) ServiceOption {
 	return func(s *service) error {
@@ -197,12 +231,13 @@ func WithAddlCA(ca *x509.Certificate) ServiceOption {
 }
 
 // NewService creates a new scep service
-func NewService(crt *x509.Certificate, key *rsa.PrivateKey, signer CSRSignerContext, opts ...ServiceOption) (Service, error) {
+func NewService(crt *x509.Certificate, key scepdepot.CAKey, signer CSRSignerContext, opts ...ServiceOption) (Service, error) {
 	s := &service{
 		crt:         crt,
 		key:         key,
 		signer:      signer,
 		debugLogger: log.NewNopLogger(),
+		scepPath:    "/scep",
 	}
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
@@ -38,7 +38,7 @@ func TestCaCert(t *testing.T) {
 	depot := scepdepot.Depot(boltDepot)
 
 	// load CA & key again
-	certs, key, err := depot.CA([]byte{})
+	certs, _, err := depot.CA([]byte{})
 	if err != nil {
 		t.Fatal(err)
 	}
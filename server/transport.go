@@ -14,30 +14,51 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/groob/finalizer/logutil"
 	"github.com/pkg/errors"
-	"github.com/procube-open/scep/depot/mysql"
+	scepdepot "github.com/procube-open/scep/depot"
 	"github.com/procube-open/scep/server/handler"
+	"github.com/procube-open/scep/server/invite"
 	"github.com/procube-open/scep/utils"
 )
 
-func MakeHTTPHandler(depot *mysql.MySQLDepot, e *Endpoints, svc Service, logger kitlog.Logger) http.Handler {
+// CA is a CA served by the handler of MakeMultiCAHandler.
+type CA struct {
+	// Name is the name the CA is served under, empty for the default CA.
+	Name string
+	// Store is the view of the store of the CA, see depot.StoreForCA.
+	Store      scepdepot.Store
+	Endpoints  *Endpoints
+	Signer     CSRSignerContext
+	Challenges scepdepot.ChallengeStore
+	// Profiles are the certificate profiles Signer issues, the builtin
+	// ones if nil.
+	Profiles map[string]*scepdepot.Profile
+}
+
+// ReservedCANames are the names a CA cannot have, as they are the first
+// path segments of the API of the default CA.
+var ReservedCANames = []string{"cert", "client", "invite", "download", "files"}
+
+func MakeHTTPHandler(depot scepdepot.Store, e *Endpoints, svc Service, signer CSRSignerContext, issuer *invite.Issuer, challenges scepdepot.ChallengeStore, logger kitlog.Logger) http.Handler {
+	return MakeMultiCAHandler(depot, []CA{{
+		Store:      depot,
+		Endpoints:  e,
+		Signer:     signer,
+		Challenges: challenges,
+	}}, issuer, logger)
+}
+
+// MakeMultiCAHandler returns the handler of the server serving cas. The
+// default CA is served at /scep and /api, a named CA at /scep/{name} and
+// /api/{name}. The clients of a named CA are added, and their certificates
+// are added, at /admin/api/{name}. The other admin API manages the clients
+// of all CAs in depot.
+func MakeMultiCAHandler(depot scepdepot.Store, cas []CA, issuer *invite.Issuer, logger kitlog.Logger) http.Handler {
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
 		kithttp.ServerFinalizer(logutil.NewHTTPLogger(logger).LoggingFinalizer),
 	}
 
 	r := mux.NewRouter()
-	r.Methods("GET").Path("/scep").Handler(kithttp.NewServer(
-		e.GetEndpoint,
-		decodeSCEPRequest,
-		encodeSCEPResponse,
-		opts...,
-	))
-	r.Methods("POST").Path("/scep").Handler(kithttp.NewServer(
-		e.PostEndpoint,
-		decodeSCEPRequest,
-		encodeSCEPResponse,
-		opts...,
-	))
 
 	frontendPath := "frontend/build"
 	frontendHandler := http.FileServer(http.Dir(frontendPath))
@@ -54,23 +75,67 @@ func MakeHTTPHandler(depot *mysql.MySQLDepot, e *Endpoints, svc Service, logger
 	r.Methods("GET", "HEAD").PathPrefix("/api/download/").Handler(http.StripPrefix("/api/download/", downloadHandler))
 	r.Methods("GET").Path("/api/files/{path:.*}").HandlerFunc(handler.ListFilesHandler(downloadPath))
 
-	r.Methods("GET").Path("/api/cert/verify").HandlerFunc(handler.VerifyHandler(depot))
+	// /api/cert/verify accepts the certificates of any CA
+	all := handler.CAs{}
+	profiles := handler.Profiles{}
+	for _, ca := range cas {
+		all[ca.Name] = ca.Store
+		profiles[ca.Name] = ca.Profiles
+		if ca.Profiles == nil {
+			profiles[ca.Name] = scepdepot.BuiltinProfiles()
+		}
+	}
+	r.Methods("GET").Path("/api/cert/verify").HandlerFunc(handler.VerifyHandler(all))
 	r.Methods("GET").Path("/api/cert/list/{CN}").HandlerFunc(handler.CertsHandler(depot))
-	r.Methods("POST").Path("/api/cert/pkcs12").HandlerFunc(handler.Pkcs12Handler(depot))
+	r.Methods("POST").Path("/api/invite/redeem").HandlerFunc(handler.RedeemInvitationHandler(depot, issuer))
 
 	r.Methods("GET").Path("/api/client").HandlerFunc(handler.ListClientHandler(depot))
 	r.Methods("GET").Path("/api/client/{CN}").HandlerFunc(handler.GetClientHandler(depot))
 
+	for _, ca := range cas {
+		scepPath, apiPath, adminPath := "/scep", "/api", "/admin/api"
+		if ca.Name != "" {
+			scepPath += "/" + ca.Name
+			apiPath += "/" + ca.Name
+			adminPath += "/" + ca.Name
+			r.Methods("GET").Path(apiPath + "/cert/verify").HandlerFunc(handler.VerifyHandler(handler.CAs{ca.Name: ca.Store}))
+			r.Methods("GET").Path(apiPath + "/cert/list/{CN}").HandlerFunc(handler.CertsHandler(ca.Store))
+			r.Methods("GET").Path(apiPath + "/client").HandlerFunc(handler.ListClientHandler(ca.Store))
+			r.Methods("GET").Path(apiPath + "/client/{CN}").HandlerFunc(handler.GetClientHandler(ca.Store))
+		}
+		r.Methods("GET").Path(scepPath).Handler(kithttp.NewServer(
+			ca.Endpoints.GetEndpoint,
+			decodeSCEPRequest,
+			encodeSCEPResponse,
+			opts...,
+		))
+		r.Methods("POST").Path(scepPath).Handler(kithttp.NewServer(
+			ca.Endpoints.PostEndpoint,
+			decodeSCEPRequest,
+			encodeSCEPResponse,
+			opts...,
+		))
+		r.Methods("POST").Path(apiPath + "/cert/pkcs12").HandlerFunc(handler.Pkcs12Handler(ca.Store, ca.Signer, logger))
+		r.Methods("POST").Path(apiPath + "/cert/enroll").HandlerFunc(handler.EnrollHandler(ca.Store, ca.Signer, logger))
+
+		r.Methods("POST").Path(adminPath + "/cert/add").HandlerFunc(handler.AddCertHandler(ca.Store))
+		r.Methods("POST").Path(adminPath + "/client/add").HandlerFunc(handler.AddClientHandler(ca.Store))
+		r.Methods("GET").Path(adminPath + "/challenge").HandlerFunc(handler.ChallengeHandler(ca.Store, ca.Challenges))
+	}
+
 	pingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("pong")) })
 	r.Methods("GET").Path("/admin/api/ping").HandlerFunc(pingHandler)
 
-	r.Methods("POST").Path("/admin/api/cert/add").HandlerFunc(handler.AddCertHandler(depot))
+	r.Methods("GET").Path("/admin/api/cert/{serial}").HandlerFunc(handler.CertHandler(depot))
+	r.Methods("POST").Path("/admin/api/cert/{serial}/revoke").HandlerFunc(handler.RevokeCertHandler(depot))
+	r.Methods("POST").Path("/admin/api/cert/{serial}/hold").HandlerFunc(handler.HoldCertHandler(depot))
+	r.Methods("POST").Path("/admin/api/cert/{serial}/release").HandlerFunc(handler.ReleaseCertHandler(depot))
 
-	r.Methods("POST").Path("/admin/api/client/add").HandlerFunc(handler.AddClientHandler(depot))
 	r.Methods("POST").Path("/admin/api/client/revoke").HandlerFunc(handler.RevokeClientHandler(depot))
 	r.Methods("PUT").Path("/admin/api/client/update").HandlerFunc(handler.UpdateClientHandler(depot))
+	r.Methods("DELETE").Path("/admin/api/client/{uid}").HandlerFunc(handler.DeleteClientHandler(depot))
 
-	r.Methods("POST").Path("/admin/api/secret/create").HandlerFunc(handler.CreateSecretHandler(depot))
+	r.Methods("POST").Path("/admin/api/secret/create").HandlerFunc(handler.CreateSecretHandler(depot, issuer, profiles))
 	r.Methods("GET").Path("/admin/api/secret/get/{CN}").HandlerFunc(handler.GetSecretHandler(depot))
 	return r
 }
@@ -3,15 +3,27 @@ package scepserver_test
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/go-sql-driver/mysql"
+	scepdepot "github.com/procube-open/scep/depot"
 	mysqldepot "github.com/procube-open/scep/depot/mysql"
+	sqlitedepot "github.com/procube-open/scep/depot/sqlite"
 	scepserver "github.com/procube-open/scep/server"
 
 	kitlog "github.com/go-kit/kit/log"
@@ -120,17 +132,131 @@ func TestPKIOperationGET(t *testing.T) {
 	}
 }
 
+func TestMultiCA(t *testing.T) {
+	depot, err := sqlitedepot.NewDepot(filepath.Join(t.TempDir(), "scep.db"), "../scep/testdata/testca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, key, err := depot.CA([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subDER, err := scepdepot.NewCACert(scepdepot.WithCommonName("sub CA")).SelfSign(rand.Reader, subKey.Public(), subKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subCrt, err := x509.ParseCertificate(subDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cas []scepserver.CA
+	for _, ca := range []struct {
+		name string
+		crt  *x509.Certificate
+		key  scepdepot.CAKey
+	}{
+		{"", crt[0], key},
+		{"sub", subCrt, subKey},
+	} {
+		store := scepdepot.StoreForCA(depot, ca.name, []*x509.Certificate{ca.crt}, ca.key)
+		svc, err := scepserver.NewService(ca.crt, ca.key, scepserver.NopCSRSigner())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cas = append(cas, scepserver.CA{
+			Name:      ca.name,
+			Store:     store,
+			Endpoints: scepserver.MakeServerEndpoints(svc, ""),
+			Signer:    scepserver.NopCSRSigner(),
+		})
+	}
+	server := httptest.NewServer(scepserver.MakeMultiCAHandler(depot, cas, nil, kitlog.NewNopLogger()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/scep/sub?operation=GetCACert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, subDER) {
+		t.Errorf("GetCACert of /scep/sub did not return the certificate of the CA: %d %q", resp.StatusCode, body)
+	}
+
+	if err := cas[1].Store.AddClient(scepdepot.Client{Uid: "pc01"}, "ISSUED"); err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "pc01"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, subCrt, leafKey.Public(), subKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	req, err := http.NewRequest("GET", server.URL+"/api/cert/verify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Mtls-Clientcert", url.PathEscape(string(leafPEM)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client struct {
+		Uid string `json:"uid"`
+		CA  string `json:"ca"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&client)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || client.Uid != "pc01" || client.CA != "sub" {
+		t.Errorf("verify: status %d, client %+v, %v", resp.StatusCode, client, err)
+	}
+
+	for path, want := range map[string]int{"/api/client": 1, "/api/sub/client": 1} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []interface{}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil || len(list) != want {
+			t.Errorf("%s listed %d clients, want %d: %v", path, len(list), want, err)
+		}
+	}
+	resp, err = http.Get(server.URL + "/api/sub/client/pc01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"ca":"sub"`) {
+		t.Errorf("/api/sub/client/pc01 returned %s", body)
+	}
+}
+
 func newServer(t *testing.T, opts ...scepserver.ServiceOption) (*httptest.Server, scepserver.Service, func()) {
+	var depot scepdepot.Store
 	var err error
-	c := mysql.Config{
-		DBName:    "certs",
-		User:      "root",
-		Passwd:    "root",
-		Addr:      "127.0.0.1:3306",
-		Net:       "tcp",
-		ParseTime: true,
+	// the tests run against MySQL if SCEP_TEST_MYSQL_DSN is set, and
+	// against SQLite otherwise
+	if dsn := os.Getenv("SCEP_TEST_MYSQL_DSN"); dsn != "" {
+		depot, err = mysqldepot.NewTableDepot(dsn, "../scep/testdata/testca")
+	} else {
+		depot, err = sqlitedepot.NewDepot(filepath.Join(t.TempDir(), "scep.db"), "../scep/testdata/testca")
 	}
-	depot, err := mysqldepot.NewTableDepot(c.FormatDSN(), "../scep/testdata/testca")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -144,7 +270,7 @@ func newServer(t *testing.T, opts ...scepserver.ServiceOption) (*httptest.Server
 	}
 	logger := kitlog.NewNopLogger()
 	e := scepserver.MakeServerEndpoints(svc, "")
-	handler := scepserver.MakeHTTPHandler(depot, e, svc, logger)
+	handler := scepserver.MakeHTTPHandler(depot, e, svc, scepserver.NopCSRSigner(), nil, nil, logger)
 	server := httptest.NewServer(handler)
 	teardown := func() {
 		server.Close()